@@ -26,6 +26,18 @@ type Configuration struct {
 		AccessLog struct {
 			// Disabled disables access logging.
 			Disabled bool `yaml:"disabled,omitempty"`
+
+			// Format selects the format of the access log. Options are
+			// "combined", the default, and "json".
+			Format string `yaml:"format,omitempty"`
+
+			// Fields lists the fields written by the json format, in
+			// order. All fields are written if empty.
+			Fields []string `yaml:"fields,omitempty"`
+
+			// Path is the file the access log is appended to. The access
+			// log is written to stdout if empty.
+			Path string `yaml:"path,omitempty"`
 		} `yaml:"accesslog,omitempty"`
 
 		// Level is the granularity at which registry operations are logged.
@@ -55,12 +67,33 @@ type Configuration struct {
 	// used to gate requests.
 	Auth Auth `yaml:"auth,omitempty"`
 
+	// Anonymous lists the repositories which may be accessed without
+	// credentials when an auth provider is configured.
+	Anonymous Anonymous `yaml:"anonymous,omitempty"`
+
 	// Middleware lists all middlewares to be used by the registry.
 	Middleware map[string][]Middleware `yaml:"middleware,omitempty"`
 
 	// Reporting is the configuration for error reporting
 	Reporting Reporting `yaml:"reporting,omitempty"`
 
+	// Tracing configures the export of spans recorded while handling
+	// requests.
+	Tracing Tracing `yaml:"tracing,omitempty"`
+
+	// Audit configures the audit log of authorization decisions and
+	// repository operations.
+	Audit Audit `yaml:"audit,omitempty"`
+
+	// Robots configures the robot accounts managed by the registry.
+	Robots Robots `yaml:"robots,omitempty"`
+
+	// RateLimit configures the rate limits applied to API requests.
+	RateLimit RateLimit `yaml:"ratelimit,omitempty"`
+
+	// Bandwidth configures the bandwidth available to blob transfers.
+	Bandwidth Bandwidth `yaml:"bandwidth,omitempty"`
+
 	// HTTP contains configuration parameters for the registry's http
 	// interface.
 	HTTP struct {
@@ -130,6 +163,22 @@ type Configuration struct {
 			Addr string `yaml:"addr,omitempty"`
 		} `yaml:"debug,omitempty"`
 
+		// Metrics configures the Prometheus metrics endpoint. Left disabled
+		// by default.
+		Metrics struct {
+			// Enabled exposes the metrics endpoint when true.
+			Enabled bool `yaml:"enabled,omitempty"`
+
+			// Path is the path the metrics are served on. Defaults to
+			// /metrics.
+			Path string `yaml:"path,omitempty"`
+
+			// Addr specifies a separate bind address for the metrics
+			// endpoint. If empty, the metrics are served by the main
+			// listener.
+			Addr string `yaml:"addr,omitempty"`
+		} `yaml:"metrics,omitempty"`
+
 		// HTTP2 configuration options
 		HTTP2 struct {
 			// Specifies wether the registry should disallow clients attempting
@@ -430,7 +479,7 @@ func (storage *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			}
 
 			if len(types) > 1 {
-				return fmt.Errorf("Must provide exactly one storage type. Provided: %v", types)
+				return fmt.Errorf("storage: must provide exactly one storage type. Provided: %v", types)
 			}
 		}
 		*storage = storageMap
@@ -491,7 +540,7 @@ func (auth *Auth) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 			// TODO(stevvooe): May want to change this slightly for
 			// authorization to allow multiple challenges.
-			return fmt.Errorf("must provide exactly one type. Provided: %v", types)
+			return fmt.Errorf("auth: must provide exactly one type. Provided: %v", types)
 
 		}
 		*auth = m
@@ -537,6 +586,161 @@ type Endpoint struct {
 	IgnoredMediaTypes []string      `yaml:"ignoredmediatypes"` // target media types to ignore
 }
 
+// Tracing configures where spans recorded while handling requests are
+// exported. Tracing is disabled unless at least one destination is set.
+type Tracing struct {
+	// ServiceName is reported to the collector as the name of the service.
+	// Defaults to "registry".
+	ServiceName string `yaml:"servicename,omitempty"`
+
+	// OTLP exports spans to a collector using OTLP over HTTP.
+	OTLP struct {
+		// Endpoint is the url spans are posted to, for example
+		// http://localhost:4318/v1/traces.
+		Endpoint string `yaml:"endpoint,omitempty"`
+
+		// Headers are added to each export request.
+		Headers http.Header `yaml:"headers,omitempty"`
+
+		// Timeout bounds each export request.
+		Timeout time.Duration `yaml:"timeout,omitempty"`
+	} `yaml:"otlp,omitempty"`
+
+	// File appends spans to a file as JSON lines.
+	File struct {
+		// Path is the file spans are written to.
+		Path string `yaml:"path,omitempty"`
+	} `yaml:"file,omitempty"`
+}
+
+// Audit configures where the audit log is written. Auditing is disabled
+// unless a file path is set or storage is enabled.
+type Audit struct {
+	// File writes the audit log to a local file.
+	File struct {
+		// Path is the file records are appended to.
+		Path string `yaml:"path,omitempty"`
+	} `yaml:"file,omitempty"`
+
+	// Storage writes the audit log using the registry's storage driver.
+	Storage struct {
+		// Enabled writes the audit log to the storage driver when true.
+		Enabled bool `yaml:"enabled,omitempty"`
+
+		// RootDirectory is the directory of the storage driver the log
+		// segments are written to. Defaults to /audit.
+		RootDirectory string `yaml:"rootdirectory,omitempty"`
+
+		// Instance names the chain of records written by this registry
+		// instance, so that instances sharing the storage keep separate
+		// chains. Defaults to the host name.
+		Instance string `yaml:"instance,omitempty"`
+
+		// FlushInterval is the interval at which buffered records are
+		// written to storage. Defaults to 5s.
+		FlushInterval time.Duration `yaml:"flushinterval,omitempty"`
+
+		// Sync writes records to storage before the operations they
+		// record complete, rather than buffering them.
+		Sync bool `yaml:"sync,omitempty"`
+	} `yaml:"storage,omitempty"`
+}
+
+// Enabled returns true if the audit log has a destination.
+func (audit Audit) Enabled() bool {
+	return audit.File.Path != "" || audit.Storage.Enabled
+}
+
+// Anonymous configures the access allowed to clients without credentials,
+// bypassing the access controller.
+type Anonymous struct {
+	// Rules lists the repositories and actions allowed anonymously.
+	Rules []AnonymousRule `yaml:"rules,omitempty"`
+}
+
+// AnonymousRule allows actions on the repositories matching a pattern, in
+// which * matches any sequence of characters, including slashes. The actions
+// are pull, push, delete and *, which allows all of them.
+type AnonymousRule struct {
+	Repository string   `yaml:"repository"`
+	Actions    []string `yaml:"actions"`
+}
+
+// Robots configures robot accounts, credentials with repository scopes
+// minted by the registry and persisted with its storage driver.
+type Robots struct {
+	// Enabled accepts robot accounts and serves the admin endpoints
+	// managing them.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// RootDirectory is the directory of the storage driver the accounts
+	// are stored in. Defaults to /robots.
+	RootDirectory string `yaml:"rootdirectory,omitempty"`
+
+	// Admins are the users allowed to manage robot accounts. If empty, only
+	// the acl and token access controllers, which grant all actions on the
+	// robots registry resource explicitly, allow users.
+	Admins []string `yaml:"admins,omitempty"`
+}
+
+// RateLimit configures token bucket rate limits per class of API route.
+// Requests are rejected once they exceed any of the limits of their class.
+type RateLimit struct {
+	// Redis shares the state of the limits across registry instances using
+	// the redis instance of the registry. State is kept in memory otherwise.
+	Redis bool `yaml:"redis,omitempty"`
+
+	// Manifest limits manifest and tag requests.
+	Manifest RateLimitClass `yaml:"manifest,omitempty"`
+
+	// Blob limits blob fetches and deletes.
+	Blob RateLimitClass `yaml:"blob,omitempty"`
+
+	// Upload limits blob upload requests.
+	Upload RateLimitClass `yaml:"upload,omitempty"`
+
+	// Catalog limits catalog requests.
+	Catalog RateLimitClass `yaml:"catalog,omitempty"`
+}
+
+// RateLimitClass configures the limits of a class of routes, per
+// authenticated user, per client IP and per repository.
+type RateLimitClass struct {
+	User       RateLimitBucket `yaml:"user,omitempty"`
+	IP         RateLimitBucket `yaml:"ip,omitempty"`
+	Repository RateLimitBucket `yaml:"repository,omitempty"`
+}
+
+// RateLimitBucket configures a token bucket. Rate is the number of requests
+// allowed per second, and Burst the number of requests allowed at once. A
+// zero rate disables the limit.
+type RateLimitBucket struct {
+	Rate  float64 `yaml:"rate,omitempty"`
+	Burst int     `yaml:"burst,omitempty"`
+}
+
+// Bandwidth configures the bandwidth limits of blob downloads and uploads.
+type Bandwidth struct {
+	// Download limits the blob content served to clients.
+	Download BandwidthLimits `yaml:"download,omitempty"`
+
+	// Upload limits the blob content received from clients.
+	Upload BandwidthLimits `yaml:"upload,omitempty"`
+}
+
+// BandwidthLimits are rates in bytes per second, shared evenly between
+// concurrent transfers. A zero rate is unlimited.
+type BandwidthLimits struct {
+	// Global is the total rate of all transfers.
+	Global int64 `yaml:"global,omitempty"`
+
+	// Client is the rate of the transfers of each client IP.
+	Client int64 `yaml:"client,omitempty"`
+
+	// User is the rate of the transfers of each authenticated user.
+	User int64 `yaml:"user,omitempty"`
+}
+
 // Reporting defines error reporting methods.
 type Reporting struct {
 	// Bugsnag configures error reporting for Bugsnag (bugsnag.com).
@@ -586,6 +790,149 @@ type Proxy struct {
 
 	// Password of the hub user
 	Password string `yaml:"password"`
+
+	// RefreshToken authenticates with the remote registry instead of
+	// Username and Password.
+	RefreshToken string `yaml:"refreshtoken,omitempty"`
+
+	// TLS configures the connections to the remote registry.
+	TLS ProxyTLS `yaml:"tls,omitempty"`
+
+	// CredentialsFile is the path of a docker config.json file holding the
+	// credentials of the remote registries, used for those configured
+	// without credentials.
+	CredentialsFile string `yaml:"credentialsfile,omitempty"`
+
+	// Upstreams lists the remote registries mirrored by the cache, each
+	// serving the repositories it matches. It cannot be combined with
+	// RemoteURL.
+	Upstreams []ProxyUpstream `yaml:"upstreams,omitempty"`
+
+	// Cache configures how long content is kept in the cache.
+	Cache ProxyCache `yaml:"cache,omitempty"`
+
+	// Warm configures the admin endpoint warming the cache.
+	Warm ProxyWarm `yaml:"warm,omitempty"`
+
+	// Coordination configures the de-duplication of blob fetches across
+	// the registry instances sharing the storage of the cache.
+	Coordination ProxyCoordination `yaml:"coordination,omitempty"`
+}
+
+// ProxyCoordination configures the coordination of the blob fetches of the
+// registry instances sharing a cache, so that a blob is fetched from the
+// remote by a single instance while the others wait for it.
+type ProxyCoordination struct {
+	// Redis coordinates the fetches using the redis instance of the
+	// registry. Fetches are only de-duplicated within an instance
+	// otherwise.
+	Redis bool `yaml:"redis,omitempty"`
+
+	// LeaseTTL is the time after which the fetch of an instance which
+	// stopped renewing its lease, as it crashed, is taken over. It defaults
+	// to 15 seconds.
+	LeaseTTL time.Duration `yaml:"leasettl,omitempty"`
+
+	// Wait is the time an instance waits for the lease of a blob fetched
+	// by another instance to be renewed before fetching it from the remote
+	// itself. It defaults to 1 minute.
+	Wait time.Duration `yaml:"wait,omitempty"`
+
+	// MaxWait is the longest a blob request waits for a blob fetched by
+	// another instance, even if its lease is renewed, before streaming the
+	// blob from the remote. It defaults to 30 seconds.
+	MaxWait time.Duration `yaml:"maxwait,omitempty"`
+}
+
+// ProxyWarm configures the admin endpoint pulling images into the cache,
+// served when an access controller is configured.
+type ProxyWarm struct {
+	// Admins are the users allowed to warm the cache. If empty, only the acl
+	// and token access controllers, which grant all actions on the cache
+	// registry resource explicitly, allow users.
+	Admins []string `yaml:"admins,omitempty"`
+}
+
+// ProxyCache configures the retention of the content of the pull through
+// cache.
+type ProxyCache struct {
+	// TTL is the time content is kept after it was last accessed. It
+	// defaults to 7 days.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+
+	// TTLs overrides TTL for the repositories matching their pattern. The
+	// first matching pattern applies.
+	TTLs []ProxyCacheTTL `yaml:"ttls,omitempty"`
+
+	// MaxSize is the maximum size of the content of the cache, in bytes.
+	// When it is exceeded, the least recently accessed content is removed.
+	// If zero, the size is unbounded.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+}
+
+// ProxyCacheTTL is the TTL of the repositories matching a pattern, in
+// which "*" matches any sequence of characters.
+type ProxyCacheTTL struct {
+	Repository string        `yaml:"repository"`
+	TTL        time.Duration `yaml:"ttl"`
+}
+
+// Enabled returns whether the registry is configured as a pull through
+// cache.
+func (proxy Proxy) Enabled() bool {
+	return proxy.RemoteURL != "" || len(proxy.Upstreams) > 0
+}
+
+// ProxyUpstream is a remote registry mirrored by the pull through cache. A
+// repository is served by the first upstream matching its name, either by
+// Prefix or by Regexp. An upstream with neither matches all repositories.
+type ProxyUpstream struct {
+	// Name identifies the upstream in logs.
+	Name string `yaml:"name"`
+
+	// Prefix matches the repositories whose names start with it, such as
+	// "hub/". If StripPrefix is set, the prefix is removed from the names
+	// requested from the upstream.
+	Prefix      string `yaml:"prefix,omitempty"`
+	StripPrefix bool   `yaml:"stripprefix,omitempty"`
+
+	// Regexp matches the repositories whose whole names match it. If
+	// Rewrite is set, the names requested from the upstream are the
+	// expansion of Rewrite, in which $1 refers to the first submatch.
+	Regexp  string `yaml:"regexp,omitempty"`
+	Rewrite string `yaml:"rewrite,omitempty"`
+
+	// RemoteURLs are the URLs of equivalent mirrors of the upstream, tried
+	// in order when one is unavailable.
+	RemoteURLs []string `yaml:"remoteurls"`
+
+	// Username and Password authenticate with the upstream.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// RefreshToken authenticates with the token server of the upstream
+	// instead of Username and Password.
+	RefreshToken string `yaml:"refreshtoken,omitempty"`
+
+	// TLS configures the connections to the upstream.
+	TLS ProxyTLS `yaml:"tls,omitempty"`
+}
+
+// ProxyTLS configures the TLS connections of the pull through cache to a
+// remote registry and its token server.
+type ProxyTLS struct {
+	// RootCertBundle is the path of a PEM file of the certificate
+	// authorities trusted instead of those of the system.
+	RootCertBundle string `yaml:"rootcertbundle,omitempty"`
+
+	// Certificate and Key are the paths of the client certificate and its
+	// private key, presented to the remote registry.
+	Certificate string `yaml:"certificate,omitempty"`
+	Key         string `yaml:"key,omitempty"`
+
+	// InsecureSkipVerify disables the verification of the certificate of
+	// the remote registry.
+	InsecureSkipVerify bool `yaml:"insecureskipverify,omitempty"`
 }
 
 // Parse parses an input configuration yaml document into a Configuration struct
@@ -595,7 +942,25 @@ type Proxy struct {
 // following the scheme below:
 // Configuration.Abc may be replaced by the value of REGISTRY_ABC,
 // Configuration.Abc.Xyz may be replaced by the value of REGISTRY_ABC_XYZ, and so forth
+//
+// References to secrets in files or environment variables are then resolved,
+// as described by ResolveSecrets.
 func Parse(rd io.Reader) (*Configuration, error) {
+	config, err := ParseUnresolved(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ResolveSecrets(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ParseUnresolved parses a configuration as Parse does, but leaves the
+// references to secrets in place.
+func ParseUnresolved(rd io.Reader) (*Configuration, error) {
 	in, err := ioutil.ReadAll(rd)
 	if err != nil {
 		return nil, err
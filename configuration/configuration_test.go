@@ -2,8 +2,10 @@ package configuration
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -20,7 +22,10 @@ var configStruct = Configuration{
 	Version: "0.1",
 	Log: struct {
 		AccessLog struct {
-			Disabled bool `yaml:"disabled,omitempty"`
+			Disabled bool     `yaml:"disabled,omitempty"`
+			Format   string   `yaml:"format,omitempty"`
+			Fields   []string `yaml:"fields,omitempty"`
+			Path     string   `yaml:"path,omitempty"`
 		} `yaml:"accesslog,omitempty"`
 		Level     Loglevel               `yaml:"level"`
 		Formatter string                 `yaml:"formatter,omitempty"`
@@ -86,6 +91,11 @@ var configStruct = Configuration{
 		Debug   struct {
 			Addr string `yaml:"addr,omitempty"`
 		} `yaml:"debug,omitempty"`
+		Metrics struct {
+			Enabled bool   `yaml:"enabled,omitempty"`
+			Path    string `yaml:"path,omitempty"`
+			Addr    string `yaml:"addr,omitempty"`
+		} `yaml:"metrics,omitempty"`
 		HTTP2 struct {
 			Disabled bool `yaml:"disabled,omitempty"`
 		} `yaml:"http2,omitempty"`
@@ -449,6 +459,52 @@ func (suite *ConfigSuite) TestParseEnvMany(c *C) {
 	c.Assert(err, IsNil)
 }
 
+// TestParseSecretReferences validates that references to secrets in files
+// and environment variables are resolved in typed fields, parameters and
+// headers, including those set by environment overrides.
+func (suite *ConfigSuite) TestParseSecretReferences(c *C) {
+	dir, err := ioutil.TempDir("", "configuration")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	secretKey := filepath.Join(dir, "secretkey")
+	c.Assert(ioutil.WriteFile(secretKey, []byte("FILESECRET\n"), 0600), IsNil)
+
+	os.Setenv("S3_ACCESS_KEY", "ENVACCESSKEY")
+	os.Setenv("REGISTRY_STORAGE_S3_SECRETKEY", "${file:"+secretKey+"}")
+	os.Setenv("REGISTRY_REPORTING_BUGSNAG_APIKEY", "key-${env:S3_ACCESS_KEY}")
+	yml := strings.Replace(configYamlV0_1, "SAMPLEACCESSKEY", "${env:S3_ACCESS_KEY}", 1)
+	yml = strings.Replace(yml, "Bearer <example>", "'Bearer ${file:"+secretKey+"}'", 1)
+
+	suite.expectedConfig.Storage.setParameter("accesskey", "ENVACCESSKEY")
+	suite.expectedConfig.Storage.setParameter("secretkey", "FILESECRET")
+	suite.expectedConfig.Reporting.Bugsnag.APIKey = "key-ENVACCESSKEY"
+	suite.expectedConfig.Notifications.Endpoints[0].Headers = http.Header{"Authorization": []string{"Bearer FILESECRET"}}
+
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, suite.expectedConfig)
+
+	config, err = ParseUnresolved(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	c.Assert(config.Storage.Parameters()["secretkey"], Equals, "${file:"+secretKey+"}")
+}
+
+// TestParseSecretReferenceErrors validates that unresolvable references fail
+// with the key path of the reference.
+func (suite *ConfigSuite) TestParseSecretReferenceErrors(c *C) {
+	os.Setenv("REGISTRY_STORAGE_S3_SECRETKEY", "${file:/nonexistent/secret}")
+	_, err := Parse(bytes.NewReader([]byte(configYamlV0_1)))
+	c.Assert(err, NotNil)
+	c.Assert(strings.HasPrefix(err.Error(), "storage.s3.secretkey: "), Equals, true)
+
+	os.Setenv("REGISTRY_STORAGE_S3_SECRETKEY", "SUPERSECRET")
+	os.Setenv("REGISTRY_HTTP_SECRET", "${env:MISSING_SECRET}")
+	_, err = Parse(bytes.NewReader([]byte(configYamlV0_1)))
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, "http.secret: secret environment variable MISSING_SECRET is not set")
+}
+
 func checkStructs(c *C, t reflect.Type, structsChecked map[string]struct{}) {
 	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Map || t.Kind() == reflect.Slice {
 		t = t.Elem()
@@ -0,0 +1,116 @@
+package configuration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// secretReference matches the references to secrets which may appear in any
+// string of the configuration: ${file:/path/to/secret} is replaced by the
+// contents of the file, without trailing newlines, and ${env:NAME} by the
+// value of the environment variable NAME.
+var secretReference = regexp.MustCompile(`\$\{(file|env):([^}]+)\}`)
+
+// ResolveSecrets replaces the references to secrets in every string of
+// config, including the values of the storage and auth parameters, the
+// middleware options and the HTTP headers. The errors name the key path of
+// the reference but never the resolved value.
+func ResolveSecrets(config *Configuration) error {
+	return resolveSecrets("", reflect.ValueOf(config).Elem())
+}
+
+// resolveSecrets resolves the references in the settable value v, found at
+// the given key path.
+func resolveSecrets(path string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := expandSecrets(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return resolveSecrets(path, v.Elem())
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		e := reflect.New(v.Elem().Type()).Elem()
+		e.Set(v.Elem())
+		if err := resolveSecrets(path, e); err != nil {
+			return err
+		}
+		v.Set(e)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if err := resolveSecrets(joinPath(path, name), v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveSecrets(fmt.Sprintf("%s[%d]", path, i), v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			if err := resolveSecrets(joinPath(path, fmt.Sprint(k.Interface())), e); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+	}
+	return nil
+}
+
+// expandSecrets replaces the references to secrets in s.
+func expandSecrets(s string) (string, error) {
+	var err error
+	expanded := secretReference.ReplaceAllStringFunc(s, func(ref string) string {
+		m := secretReference.FindStringSubmatch(ref)
+		switch m[1] {
+		case "file":
+			p, ferr := ioutil.ReadFile(m[2])
+			if ferr != nil {
+				err = fmt.Errorf("unable to read secret file: %v", ferr)
+				return ""
+			}
+			return strings.TrimRight(string(p), "\r\n")
+		default:
+			value, ok := os.LookupEnv(m[2])
+			if !ok {
+				err = fmt.Errorf("secret environment variable %s is not set", m[2])
+				return ""
+			}
+			return value
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
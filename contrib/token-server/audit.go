@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/registry/audit"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// auditAccess records the decision for each requested access of a token
+// request. If reason is set, the request was refused and all access is
+// recorded as denied.
+func (ts *tokenServer) auditAccess(ctx context.Context, r *http.Request, subject, service string, requested, granted []auth.Access, reason string) {
+	if ts.audit == nil {
+		return
+	}
+
+	grantedSet := make(map[auth.Access]bool, len(granted))
+	for _, access := range granted {
+		grantedSet[access] = true
+	}
+
+	request := notifications.NewRequestRecord(context.GetRequestID(ctx), r)
+	records := make([]audit.Record, 0, len(requested))
+	for _, access := range requested {
+		record := audit.Record{
+			Type:     audit.TypeAccess,
+			Action:   access.Action,
+			Decision: audit.DecisionGranted,
+			User:     subject,
+			Service:  service,
+			Request:  request,
+		}
+		switch {
+		case reason != "":
+			record.Decision, record.Reason = audit.DecisionDenied, reason
+		case !grantedSet[access]:
+			record.Decision, record.Reason = audit.DecisionDenied, "not granted by policy"
+		}
+		if access.Type == "repository" {
+			record.Repository = access.Name
+		} else {
+			record.Resource = access.Type + ":" + access.Name
+		}
+		records = append(records, record)
+	}
+
+	if err := ts.audit.Append(records...); err != nil {
+		context.GetLogger(ctx).Errorf("error writing audit records: %v", err)
+	}
+}
+
+// auditToken records the issuance or revocation of a token. If reason is
+// set, the issuance was refused.
+func (ts *tokenServer) auditToken(ctx context.Context, r *http.Request, action, subject, service, reason string) {
+	if ts.audit == nil {
+		return
+	}
+
+	record := audit.Record{
+		Type:     audit.TypeToken,
+		Action:   action,
+		Decision: audit.DecisionGranted,
+		User:     subject,
+		Service:  service,
+		Request:  notifications.NewRequestRecord(context.GetRequestID(ctx), r),
+	}
+	if reason != "" {
+		record.Decision, record.Reason = audit.DecisionDenied, reason
+	}
+
+	if err := ts.audit.Append(record); err != nil {
+		context.GetLogger(ctx).Errorf("error writing audit record: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/libtrust"
+)
+
+// stringsFlag is a flag which may be given several times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// signingAlg returns the JWS algorithm of the signatures made with key.
+func signingAlg(key libtrust.PublicKey) (string, error) {
+	switch key.KeyType() {
+	case "RSA":
+		return "RS256", nil
+	case "EC":
+		return "ES256", nil
+	default:
+		return "", fmt.Errorf("unsupported signing key type %q", key.KeyType())
+	}
+}
+
+// keySet returns the JSON Web Key Set publishing the given public keys, with
+// which the registry verifies the tokens when configured with the jwks
+// option of the token access controller.
+func keySet(keys []libtrust.PublicKey) ([]byte, error) {
+	jwks := struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}{}
+	for _, key := range keys {
+		alg, err := signingAlg(key)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := key.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		var jwk map[string]interface{}
+		if err := json.Unmarshal(p, &jwk); err != nil {
+			return nil, err
+		}
+		jwk["use"] = "sig"
+		jwk["alg"] = alg
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return json.Marshal(jwks)
+}
+
+// getKeys serves the key set of the token server.
+func (ts *tokenServer) getKeys(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ts.keySet)
+}
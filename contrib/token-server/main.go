@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,7 +11,9 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/audit"
 	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/auth/acl"
 	_ "github.com/docker/distribution/registry/auth/htpasswd"
 	"github.com/docker/libtrust"
 	"github.com/gorilla/mux"
@@ -21,25 +22,40 @@ import (
 func main() {
 	var (
 		issuer = &TokenIssuer{}
-		pkFile string
+		keys   stringsFlag
 		addr   string
 		debug  bool
 		err    error
 
 		passwdFile string
 		realm      string
+		policyFile string
+
+		services          stringsFlag
+		refreshFile       string
+		refreshExpiration time.Duration
+		revokeSubject     string
+		auditFile         string
 
 		cert    string
 		certKey string
 	)
 
 	flag.StringVar(&issuer.Issuer, "issuer", "distribution-token-server", "Issuer string for token")
-	flag.StringVar(&pkFile, "key", "", "Private key file")
+	flag.Var(&keys, "key", "Private key file, may be repeated: the first key signs tokens, all are published")
 	flag.StringVar(&addr, "addr", "localhost:8080", "Address to listen on")
 	flag.BoolVar(&debug, "debug", false, "Debug mode")
 
 	flag.StringVar(&passwdFile, "passwd", ".htpasswd", "Passwd file")
 	flag.StringVar(&realm, "realm", "", "Authentication realm")
+	flag.StringVar(&policyFile, "policy", "", "ACL policy file granting access to repositories")
+
+	flag.Var(&services, "service", "Service accepted as token audience, may be repeated (default any)")
+	flag.DurationVar(&issuer.Expiration, "expiration", 15*time.Minute, "Lifetime of access tokens")
+	flag.StringVar(&refreshFile, "refreshtokens", "", "File persisting refresh tokens (default in memory)")
+	flag.DurationVar(&refreshExpiration, "refreshexpiration", 30*24*time.Hour, "Lifetime of refresh tokens, 0 for no expiry")
+	flag.StringVar(&revokeSubject, "revokesubject", "", "Revoke the refresh tokens of a user and exit")
+	flag.StringVar(&auditFile, "audit", "", "File to which audit records are appended")
 
 	flag.StringVar(&cert, "tlscert", "", "Certificate file for TLS")
 	flag.StringVar(&certKey, "tlskey", "", "Certificate key for TLS")
@@ -50,18 +66,50 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	if pkFile == "" {
+	refreshTokens, err := newRefreshTokenStore(refreshFile)
+	if err != nil {
+		logrus.Fatalf("Error loading refresh tokens: %v", err)
+	}
+	if refreshFile == "" {
+		logrus.Warnf("Refresh tokens are kept in memory and will be lost on restart, set -refreshtokens to persist them")
+	}
+
+	if revokeSubject != "" {
+		if refreshFile == "" {
+			logrus.Fatalf("Must provide the refresh tokens file (-refreshtokens) to revoke")
+		}
+		n, err := refreshTokens.revokeSubject(revokeSubject)
+		if err != nil {
+			logrus.Fatalf("Error revoking refresh tokens: %v", err)
+		}
+		logrus.Infof("Revoked %d refresh tokens of %s", n, revokeSubject)
+		return
+	}
+
+	var publicKeys []libtrust.PublicKey
+	if len(keys) == 0 {
 		issuer.SigningKey, err = libtrust.GenerateECP256PrivateKey()
 		if err != nil {
 			logrus.Fatalf("Error generating private key: %v", err)
 		}
 		logrus.Debugf("Using newly generated key with id %s", issuer.SigningKey.KeyID())
-	} else {
-		issuer.SigningKey, err = libtrust.LoadKeyFile(pkFile)
+		publicKeys = append(publicKeys, issuer.SigningKey.PublicKey())
+	}
+	for i, pkFile := range keys {
+		key, err := libtrust.LoadKeyFile(pkFile)
 		if err != nil {
 			logrus.Fatalf("Error loading key file %s: %v", pkFile, err)
 		}
-		logrus.Debugf("Loaded private key with id %s", issuer.SigningKey.KeyID())
+		if _, err := signingAlg(key.PublicKey()); err != nil {
+			logrus.Fatalf("Error loading key file %s: %v", pkFile, err)
+		}
+		if i == 0 {
+			issuer.SigningKey = key
+			logrus.Debugf("Signing with private key with id %s", key.KeyID())
+		} else {
+			logrus.Debugf("Publishing private key with id %s", key.KeyID())
+		}
+		publicKeys = append(publicKeys, key.PublicKey())
 	}
 
 	if realm == "" {
@@ -76,20 +124,47 @@ func main() {
 		logrus.Fatalf("Error initializing access controller: %v", err)
 	}
 
-	// TODO: Make configurable
-	issuer.Expiration = 15 * time.Minute
-
 	ctx := context.Background()
 
 	ts := &tokenServer{
-		issuer:           issuer,
-		accessController: ac,
-		refreshCache:     map[string]refreshToken{},
+		issuer:            issuer,
+		accessController:  ac,
+		services:          services,
+		refreshTokens:     refreshTokens,
+		refreshExpiration: refreshExpiration,
+	}
+
+	if policyFile != "" {
+		ts.policy, err = acl.NewPolicyFile(policyFile)
+		if err != nil {
+			logrus.Fatalf("Error loading policy: %v", err)
+		}
+	} else {
+		logrus.Warnf("No policy (-policy), users are granted access to the repositories of their namespace and the catalog")
+	}
+
+	ts.keySet, err = keySet(publicKeys)
+	if err != nil {
+		logrus.Fatalf("Error publishing keys: %v", err)
+	}
+
+	if auditFile != "" {
+		backend, err := audit.NewFileBackend(auditFile)
+		if err != nil {
+			logrus.Fatalf("Error opening audit file: %v", err)
+		}
+		ts.audit, err = audit.New(backend)
+		if err != nil {
+			logrus.Fatalf("Error opening audit log: %v", err)
+		}
+		defer ts.audit.Close()
 	}
 
 	router := mux.NewRouter()
 	router.Path("/token/").Methods("GET").Handler(handlerWithContext(ctx, ts.getToken))
 	router.Path("/token/").Methods("POST").Handler(handlerWithContext(ctx, ts.postToken))
+	router.Path("/token/revoke").Methods("POST").Handler(handlerWithContext(ctx, ts.revokeToken))
+	router.Path("/token/keys").Methods("GET").Handler(handlerWithContext(ctx, ts.getKeys))
 
 	if cert == "" {
 		err = http.ListenAndServe(addr, router)
@@ -128,27 +203,18 @@ func handleError(ctx context.Context, err error, w http.ResponseWriter) {
 	context.GetResponseLogger(ctx).Info("application error")
 }
 
-var refreshCharacters = []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-
-const refreshTokenLength = 15
-
-func newRefreshToken() string {
-	s := make([]rune, refreshTokenLength)
-	for i := range s {
-		s[i] = refreshCharacters[rand.Intn(len(refreshCharacters))]
-	}
-	return string(s)
-}
-
-type refreshToken struct {
-	subject string
-	service string
-}
-
 type tokenServer struct {
 	issuer           *TokenIssuer
 	accessController auth.AccessController
-	refreshCache     map[string]refreshToken
+	policy           *acl.PolicyFile
+	keySet           []byte
+	audit            *audit.Log
+
+	// services are the accepted token audiences, any if empty.
+	services []string
+
+	refreshTokens     *refreshTokenStore
+	refreshExpiration time.Duration
 }
 
 type tokenResponse struct {
@@ -157,6 +223,42 @@ type tokenResponse struct {
 	ExpiresIn    int    `json:"expires_in,omitempty"`
 }
 
+// acceptsService returns whether tokens are issued for the service.
+func (ts *tokenServer) acceptsService(service string) bool {
+	if len(ts.services) == 0 {
+		return true
+	}
+	for _, s := range ts.services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// grantAccess returns the requested access granted to the subject by the
+// policy. Without a policy, subjects are granted access to the repositories
+// of their namespace and to the catalog.
+func (ts *tokenServer) grantAccess(ctx context.Context, subject string, requestedAccessList []auth.Access) ([]auth.Access, error) {
+	if ts.policy == nil {
+		return filterAccessList(ctx, subject, requestedAccessList), nil
+	}
+
+	pol, err := ts.policy.Policy()
+	if err != nil {
+		return nil, err
+	}
+	grantedAccessList := make([]auth.Access, 0, len(requestedAccessList))
+	for _, access := range requestedAccessList {
+		if !pol.Granted(subject, access) {
+			context.GetLogger(ctx).Debugf("Access not granted by policy: %s %s:%s", access.Action, access.Type, access.Name)
+			continue
+		}
+		grantedAccessList = append(grantedAccessList, access)
+	}
+	return grantedAccessList, nil
+}
+
 func filterAccessList(ctx context.Context, scope string, requestedAccessList []auth.Access) []auth.Access {
 	if !strings.HasSuffix(scope, "/") {
 		scope = scope + "/"
@@ -201,6 +303,11 @@ func (ts *tokenServer) getToken(ctx context.Context, w http.ResponseWriter, r *h
 		}
 	}
 
+	if !ts.acceptsService(service) {
+		handleError(ctx, ErrorUnsupportedValue.WithDetail("unknown service value"), w)
+		return
+	}
+
 	requestedAccessList := ResolveScopeSpecifiers(ctx, scopeSpecifiers)
 
 	authorizedCtx, err := ts.accessController.Authorized(ctx, requestedAccessList...)
@@ -211,6 +318,9 @@ func (ts *tokenServer) getToken(ctx context.Context, w http.ResponseWriter, r *h
 			return
 		}
 
+		username, _, _ := r.BasicAuth()
+		ts.auditAccess(ctx, r, username, service, requestedAccessList, nil, "authentication failed")
+
 		// Get response context.
 		ctx, w = context.WithResponseWriter(ctx, w)
 
@@ -233,7 +343,11 @@ func (ts *tokenServer) getToken(ctx context.Context, w http.ResponseWriter, r *h
 	ctx = context.WithValue(ctx, "requestedAccess", requestedAccessList)
 	ctx = context.WithLogger(ctx, context.GetLogger(ctx, "requestedAccess"))
 
-	grantedAccessList := filterAccessList(ctx, username, requestedAccessList)
+	grantedAccessList, err := ts.grantAccess(ctx, username, requestedAccessList)
+	if err != nil {
+		handleError(ctx, err, w)
+		return
+	}
 	ctx = context.WithValue(ctx, "grantedAccess", grantedAccessList)
 	ctx = context.WithLogger(ctx, context.GetLogger(ctx, "grantedAccess"))
 
@@ -242,6 +356,7 @@ func (ts *tokenServer) getToken(ctx context.Context, w http.ResponseWriter, r *h
 		handleError(ctx, err, w)
 		return
 	}
+	ts.auditAccess(ctx, r, username, service, requestedAccessList, grantedAccessList, "")
 
 	context.GetLogger(ctx).Info("authorized client")
 
@@ -251,11 +366,12 @@ func (ts *tokenServer) getToken(ctx context.Context, w http.ResponseWriter, r *h
 	}
 
 	if offline {
-		response.RefreshToken = newRefreshToken()
-		ts.refreshCache[response.RefreshToken] = refreshToken{
-			subject: username,
-			service: service,
+		response.RefreshToken, err = ts.refreshTokens.create(username, service, ts.issuer.Issuer, ts.refreshExpiration)
+		if err != nil {
+			handleError(ctx, err, w)
+			return
 		}
+		ts.auditToken(ctx, r, "issue", username, service, "")
 	}
 
 	ctx, w = context.WithResponseWriter(ctx, w)
@@ -289,6 +405,11 @@ func (ts *tokenServer) postToken(ctx context.Context, w http.ResponseWriter, r *
 		return
 	}
 
+	if !ts.acceptsService(service) {
+		handleError(ctx, ErrorUnsupportedValue.WithDetail("unknown service value"), w)
+		return
+	}
+
 	clientID := r.PostFormValue("client_id")
 	if clientID == "" {
 		handleError(ctx, ErrorMissingRequiredField.WithDetail("missing client_id value"), w)
@@ -316,12 +437,19 @@ func (ts *tokenServer) postToken(ctx context.Context, w http.ResponseWriter, r *
 			handleError(ctx, ErrorUnsupportedValue.WithDetail("missing refresh_token value"), w)
 			return
 		}
-		rt, ok := ts.refreshCache[rToken]
-		if !ok || rt.service != service {
+		rt, ok, err := ts.refreshTokens.lookup(rToken)
+		if err != nil {
+			handleError(ctx, err, w)
+			return
+		}
+		// Refresh tokens are only valid for the service and the issuer
+		// they were issued for.
+		if !ok || rt.Service != service || rt.Issuer != ts.issuer.Issuer {
+			ts.auditToken(ctx, r, "refresh", rt.Subject, service, "invalid refresh token")
 			handleError(ctx, errcode.ErrorCodeUnauthorized.WithDetail("invalid refresh token"), w)
 			return
 		}
-		subject = rt.subject
+		subject = rt.Subject
 	case "password":
 		ca, ok := ts.accessController.(auth.CredentialAuthenticator)
 		if !ok {
@@ -339,6 +467,7 @@ func (ts *tokenServer) postToken(ctx context.Context, w http.ResponseWriter, r *
 			return
 		}
 		if err := ca.AuthenticateUser(subject, password); err != nil {
+			ts.auditAccess(ctx, r, subject, service, requestedAccessList, nil, "authentication failed")
 			handleError(ctx, errcode.ErrorCodeUnauthorized.WithDetail("invalid credentials"), w)
 			return
 		}
@@ -355,7 +484,11 @@ func (ts *tokenServer) postToken(ctx context.Context, w http.ResponseWriter, r *
 	ctx = context.WithValue(ctx, "requestedAccess", requestedAccessList)
 	ctx = context.WithLogger(ctx, context.GetLogger(ctx, "requestedAccess"))
 
-	grantedAccessList := filterAccessList(ctx, subject, requestedAccessList)
+	grantedAccessList, err := ts.grantAccess(ctx, subject, requestedAccessList)
+	if err != nil {
+		handleError(ctx, err, w)
+		return
+	}
 	ctx = context.WithValue(ctx, "grantedAccess", grantedAccessList)
 	ctx = context.WithLogger(ctx, context.GetLogger(ctx, "grantedAccess"))
 
@@ -364,6 +497,7 @@ func (ts *tokenServer) postToken(ctx context.Context, w http.ResponseWriter, r *
 		handleError(ctx, err, w)
 		return
 	}
+	ts.auditAccess(ctx, r, subject, service, requestedAccessList, grantedAccessList, "")
 
 	context.GetLogger(ctx).Info("authorized client")
 
@@ -375,11 +509,12 @@ func (ts *tokenServer) postToken(ctx context.Context, w http.ResponseWriter, r *
 	}
 
 	if offline {
-		rToken = newRefreshToken()
-		ts.refreshCache[rToken] = refreshToken{
-			subject: subject,
-			service: service,
+		rToken, err = ts.refreshTokens.create(subject, service, ts.issuer.Issuer, ts.refreshExpiration)
+		if err != nil {
+			handleError(ctx, err, w)
+			return
 		}
+		ts.auditToken(ctx, r, "issue", subject, service, "")
 	}
 
 	if rToken != "" {
@@ -393,3 +528,28 @@ func (ts *tokenServer) postToken(ctx context.Context, w http.ResponseWriter, r *
 
 	context.GetResponseLogger(ctx).Info("post token complete")
 }
+
+// revokeToken handles the revocation of refresh tokens, as described in RFC
+// 7009. Possession of the token is sufficient to revoke it, and the response
+// does not tell whether the token was valid.
+func (ts *tokenServer) revokeToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	if token == "" {
+		handleError(ctx, ErrorMissingRequiredField.WithDetail("missing token value"), w)
+		return
+	}
+
+	rt, ok, err := ts.refreshTokens.revoke(token)
+	if err != nil {
+		handleError(ctx, err, w)
+		return
+	}
+	if ok {
+		ts.auditToken(ctx, r, "revoke", rt.Subject, rt.Service, "")
+		context.GetLogger(ctx).Infof("revoked refresh token of %s", rt.Subject)
+	}
+
+	ctx, w = context.WithResponseWriter(ctx, w)
+	w.WriteHeader(http.StatusOK)
+	context.GetResponseLogger(ctx).Info("revoke token complete")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// refreshToken is the record of an issued refresh token.
+type refreshToken struct {
+	Subject string     `json:"subject"`
+	Service string     `json:"service"`
+	Issuer  string     `json:"issuer"`
+	Issued  time.Time  `json:"issued"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// refreshTokenStore keeps the issued refresh tokens, by the hash of the
+// token, so that the tokens themselves are never stored. If path is set, the
+// tokens are persisted to that file, which is read again when it is modified
+// by another process, such as the -revokesubject command.
+type refreshTokenStore struct {
+	path string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	modtime time.Time
+	tokens  map[string]refreshToken
+}
+
+// newRefreshTokenStore returns a store persisting tokens to the file at path,
+// or keeping them in memory if path is empty.
+func newRefreshTokenStore(path string) (*refreshTokenStore, error) {
+	s := &refreshTokenStore{
+		path:   path,
+		now:    time.Now,
+		tokens: map[string]refreshToken{},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// create issues a refresh token for subject and service, expiring after
+// lifetime unless it is zero.
+func (s *refreshTokenStore) create(subject, service, issuer string, lifetime time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return "", err
+	}
+
+	now := s.now().UTC()
+	rt := refreshToken{
+		Subject: subject,
+		Service: service,
+		Issuer:  issuer,
+		Issued:  now,
+	}
+	if lifetime > 0 {
+		expires := now.Add(lifetime)
+		rt.Expires = &expires
+	}
+	s.tokens[hashRefreshToken(token)] = rt
+
+	if err := s.save(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// lookup returns the record of a refresh token, if it was issued and has
+// neither expired nor been revoked.
+func (s *refreshTokenStore) lookup(token string) (refreshToken, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return refreshToken{}, false, err
+	}
+
+	rt, ok := s.tokens[hashRefreshToken(token)]
+	if !ok || (rt.Expires != nil && !s.now().Before(*rt.Expires)) {
+		return refreshToken{}, false, nil
+	}
+	return rt, true, nil
+}
+
+// revoke revokes a refresh token, returning its record if it was issued.
+func (s *refreshTokenStore) revoke(token string) (refreshToken, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return refreshToken{}, false, err
+	}
+
+	hash := hashRefreshToken(token)
+	rt, ok := s.tokens[hash]
+	if !ok {
+		return refreshToken{}, false, nil
+	}
+	delete(s.tokens, hash)
+	return rt, true, s.save()
+}
+
+// revokeSubject revokes all the refresh tokens of subject, returning how
+// many were revoked.
+func (s *refreshTokenStore) revokeSubject(subject string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return 0, err
+	}
+
+	var n int
+	for hash, rt := range s.tokens {
+		if rt.Subject == subject {
+			delete(s.tokens, hash)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.save()
+}
+
+// reload reads the tokens again if the file was modified since it was last
+// read or written.
+func (s *refreshTokenStore) reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modtime) {
+		return nil
+	}
+
+	p, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	tokens := map[string]refreshToken{}
+	if err := json.Unmarshal(p, &tokens); err != nil {
+		return err
+	}
+	s.tokens, s.modtime = tokens, fi.ModTime()
+	return nil
+}
+
+// save removes the expired tokens and writes the others to the file,
+// replacing it atomically.
+func (s *refreshTokenStore) save() error {
+	now := s.now()
+	for hash, rt := range s.tokens {
+		if rt.Expires != nil && !now.Before(*rt.Expires) {
+			delete(s.tokens, hash)
+		}
+	}
+
+	if s.path == "" {
+		return nil
+	}
+
+	p, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+
+	_, err = fp.Write(p)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(fp.Name(), s.path); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.modtime = fi.ModTime()
+	return nil
+}
+
+// hashRefreshToken returns the hash under which a refresh token is stored.
+// Tokens are random, so a fast hash is sufficient.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token-server")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "refresh.json")
+
+	s, err := newRefreshTokenStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	alice, err := s.create("alice", "registry", "issuer", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error creating token: %v", err)
+	}
+	bob, err := s.create("bob", "registry", "issuer", 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating token: %v", err)
+	}
+
+	// Tokens are persisted by their hash only.
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading store: %v", err)
+	}
+	if strings.Contains(string(p), alice) || !strings.Contains(string(p), hashRefreshToken(alice)) {
+		t.Fatalf("refresh token stored in clear: %s", p)
+	}
+
+	// A restarted server accepts the tokens.
+	restarted, err := newRefreshTokenStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error reloading store: %v", err)
+	}
+	restarted.now = s.now
+	rt, ok, err := restarted.lookup(alice)
+	if err != nil || !ok {
+		t.Fatalf("expected token to be found: %v, %v", ok, err)
+	}
+	if rt.Subject != "alice" || rt.Service != "registry" || rt.Issuer != "issuer" {
+		t.Fatalf("unexpected token: %+v", rt)
+	}
+
+	// Revocations by another process are picked up.
+	if n, err := restarted.revokeSubject("bob"); err != nil || n != 1 {
+		t.Fatalf("unexpected result revoking subject: %d, %v", n, err)
+	}
+	// Ensure the modification time differs on filesystems with a coarse
+	// resolution.
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("unexpected error touching store: %v", err)
+	}
+	if _, ok, err := s.lookup(bob); err != nil || ok {
+		t.Fatalf("expected revoked token to be rejected: %v, %v", ok, err)
+	}
+
+	if _, ok, err := s.revoke(alice); err != nil || !ok {
+		t.Fatalf("unexpected result revoking token: %v, %v", ok, err)
+	}
+	if _, ok, err := s.lookup(alice); err != nil || ok {
+		t.Fatalf("expected revoked token to be rejected: %v, %v", ok, err)
+	}
+
+	// Expired tokens are rejected.
+	token, err := s.create("alice", "registry", "issuer", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error creating token: %v", err)
+	}
+	now = now.Add(time.Hour)
+	if _, ok, err := s.lookup(token); err != nil || ok {
+		t.Fatalf("expected expired token to be rejected: %v, %v", ok, err)
+	}
+}
@@ -117,14 +117,9 @@ func (issuer *TokenIssuer) CreateJWT(subject string, audience string, grantedAcc
 	now := time.Now()
 
 	signingHash := crypto.SHA256
-	var alg string
-	switch issuer.SigningKey.KeyType() {
-	case "RSA":
-		alg = "RS256"
-	case "EC":
-		alg = "ES256"
-	default:
-		panic(fmt.Errorf("unsupported signing key type %q", issuer.SigningKey.KeyType()))
+	alg, err := signingAlg(issuer.SigningKey.PublicKey())
+	if err != nil {
+		return "", err
 	}
 
 	joseHeader := token.Header{
@@ -132,15 +127,13 @@ func (issuer *TokenIssuer) CreateJWT(subject string, audience string, grantedAcc
 		SigningAlg: alg,
 	}
 
+	// Tokens signed by keys without a certificate chain identify their key,
+	// which the registry finds among its trusted keys or in the published
+	// key set, so that keys can be rotated.
 	if x5c := issuer.SigningKey.GetExtendedField("x5c"); x5c != nil {
 		joseHeader.X5c = x5c.([]string)
 	} else {
-		var jwkMessage json.RawMessage
-		jwkMessage, err = issuer.SigningKey.PublicKey().MarshalJSON()
-		if err != nil {
-			return "", err
-		}
-		joseHeader.RawJWK = &jwkMessage
+		joseHeader.KeyID = issuer.SigningKey.KeyID()
 	}
 
 	exp := issuer.Expiration
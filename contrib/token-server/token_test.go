@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/libtrust"
+)
+
+// TestCreateJWTKeyRotation ensures tokens identify their signing key, which
+// the registry finds in the published key set along with the other keys.
+func TestCreateJWTKeyRotation(t *testing.T) {
+	var keys []libtrust.PrivateKey
+	for i := 0; i < 2; i++ {
+		key, err := libtrust.GenerateECP256PrivateKey()
+		if err != nil {
+			t.Fatalf("unexpected error generating key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	p, err := keySet([]libtrust.PublicKey{keys[0].PublicKey(), keys[1].PublicKey()})
+	if err != nil {
+		t.Fatalf("unexpected error publishing keys: %v", err)
+	}
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(p, &jwks); err != nil {
+		t.Fatalf("unexpected error decoding key set: %v", err)
+	}
+	trustedKeys := map[string]libtrust.PublicKey{}
+	for _, raw := range jwks.Keys {
+		key, err := libtrust.UnmarshalPublicKeyJWK(raw)
+		if err != nil {
+			t.Fatalf("unexpected error decoding published key: %v", err)
+		}
+		trustedKeys[key.KeyID()] = key
+	}
+	if len(trustedKeys) != 2 {
+		t.Fatalf("expected 2 published keys, got %d", len(trustedKeys))
+	}
+
+	access := []auth.Access{{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "pull"}}
+	for _, key := range keys {
+		issuer := &TokenIssuer{Issuer: "issuer", SigningKey: key, Expiration: time.Minute}
+		rawToken, err := issuer.CreateJWT("alice", "registry", access)
+		if err != nil {
+			t.Fatalf("unexpected error creating token: %v", err)
+		}
+
+		tok, err := token.NewToken(rawToken)
+		if err != nil {
+			t.Fatalf("unexpected error parsing token: %v", err)
+		}
+		if tok.Header.KeyID != key.KeyID() {
+			t.Fatalf("expected key ID %q, got %q", key.KeyID(), tok.Header.KeyID)
+		}
+		if err := tok.Verify(token.VerifyOptions{
+			TrustedIssuers:    []string{"issuer"},
+			AcceptedAudiences: []string{"registry"},
+			TrustedKeys:       trustedKeys,
+		}); err != nil {
+			t.Fatalf("unexpected error verifying token: %v", err)
+		}
+	}
+}
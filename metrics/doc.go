@@ -0,0 +1,25 @@
+// Package metrics provides a minimal set of instruments for exporting
+// application metrics in the Prometheus text exposition format.
+//
+// Instruments are created with a name, a help string and an optional list of
+// label names, and registered with a Registry:
+//
+//	var requests = metrics.NewCounter("registry_http_requests_total",
+//		"Total number of HTTP requests.", "route", "code")
+//
+//	func init() {
+//		metrics.MustRegister(requests)
+//	}
+//
+// Values are then recorded by providing one value per label, in order:
+//
+//	requests.Inc("manifest", "200")
+//
+// Values that are already tracked elsewhere can be exported without copying
+// them, using NewCounterFunc and NewGaugeFunc, which call a function at
+// collection time.
+//
+// The registry's metrics are served by Handler:
+//
+//	http.Handle("/metrics", metrics.Handler())
+package metrics
@@ -0,0 +1,330 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric types, as reported in the exposition format.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefaultBuckets are the default histogram buckets, tailored to request
+// latencies measured in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Desc describes a metric family.
+type Desc struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels []string
+}
+
+// Label is a name and value pair attached to a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single value of a metric family. Name may differ from the name
+// of the family for histograms, which export suffixed samples.
+type Sample struct {
+	Name   string
+	Labels []Label
+	Value  float64
+}
+
+// LabeledValue is a value along with the values of the labels of its family,
+// in order. It is returned by the functions of NewCounterFunc and
+// NewGaugeFunc.
+type LabeledValue struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Collector is a metric family which can be registered.
+type Collector interface {
+	// Describe returns the description of the family.
+	Describe() Desc
+
+	// Collect returns the current samples of the family.
+	Collect() []Sample
+}
+
+// labelKey joins label values into a map key.
+func labelKey(desc Desc, lvs []string) string {
+	if len(lvs) != len(desc.Labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", desc.Name, len(desc.Labels), len(lvs)))
+	}
+	return strings.Join(lvs, "\xff")
+}
+
+// labels pairs the label names of desc with the given values.
+func labels(desc Desc, lvs []string) []Label {
+	ls := make([]Label, len(lvs))
+	for i, v := range lvs {
+		ls[i] = Label{Name: desc.Labels[i], Value: v}
+	}
+	return ls
+}
+
+// sortedKeys returns the keys of a value map in a stable order.
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+// valueVec holds a float value per combination of label values.
+type valueVec struct {
+	desc   Desc
+	mu     sync.Mutex
+	values map[string]float64
+	lvs    map[string][]string
+}
+
+func newValueVec(desc Desc) valueVec {
+	return valueVec{
+		desc:   desc,
+		values: make(map[string]float64),
+		lvs:    make(map[string][]string),
+	}
+}
+
+func (vv *valueVec) update(lvs []string, f func(float64) float64) {
+	key := labelKey(vv.desc, lvs)
+
+	vv.mu.Lock()
+	defer vv.mu.Unlock()
+
+	if _, ok := vv.lvs[key]; !ok {
+		vv.lvs[key] = append([]string(nil), lvs...)
+	}
+	vv.values[key] = f(vv.values[key])
+}
+
+func (vv *valueVec) Describe() Desc {
+	return vv.desc
+}
+
+func (vv *valueVec) Collect() []Sample {
+	vv.mu.Lock()
+	defer vv.mu.Unlock()
+
+	keys := make([]string, 0, len(vv.values))
+	for k := range vv.values {
+		keys = append(keys, k)
+	}
+
+	samples := make([]Sample, 0, len(keys))
+	for _, k := range sortedKeys(keys) {
+		samples = append(samples, Sample{
+			Name:   vv.desc.Name,
+			Labels: labels(vv.desc, vv.lvs[k]),
+			Value:  vv.values[k],
+		})
+	}
+	return samples
+}
+
+// Counter is a monotonically increasing value per combination of label
+// values.
+type Counter struct {
+	valueVec
+}
+
+// NewCounter creates a counter with the given label names.
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{valueVec: newValueVec(Desc{Name: name, Help: help, Type: TypeCounter, Labels: labelNames})}
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter by v, which must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.desc.Name))
+	}
+	c.update(labelValues, func(old float64) float64 { return old + v })
+}
+
+// Gauge is a value which can go up and down per combination of label
+// values.
+type Gauge struct {
+	valueVec
+}
+
+// NewGauge creates a gauge with the given label names.
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{valueVec: newValueVec(Desc{Name: name, Help: help, Type: TypeGauge, Labels: labelNames})}
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(float64) float64 { return v })
+}
+
+// Add adds v, which may be negative, to the gauge.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.update(labelValues, func(old float64) float64 { return old + v })
+}
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// histogramValue holds the observations of a single label combination.
+type histogramValue struct {
+	lvs    []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations into configurable buckets per combination of
+// label values.
+type Histogram struct {
+	desc    Desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// NewHistogram creates a histogram with the given upper bucket bounds, which
+// must be sorted in increasing order. If buckets is nil, DefaultBuckets is
+// used.
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	return &Histogram{
+		desc:    Desc{Name: name, Help: help, Type: TypeHistogram, Labels: labelNames},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+}
+
+// Observe records a single observation.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := labelKey(h.desc, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{
+			lvs:    append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = hv
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// ObserveSince records the number of seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Describe returns the description of the histogram.
+func (h *Histogram) Describe() Desc {
+	return h.desc
+}
+
+// Collect returns the cumulative bucket counts, the sum and the count of
+// observations of each label combination.
+func (h *Histogram) Collect() []Sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+
+	var samples []Sample
+	for _, k := range sortedKeys(keys) {
+		hv := h.values[k]
+		ls := labels(h.desc, hv.lvs)
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hv.counts[i]
+			samples = append(samples, Sample{
+				Name:   h.desc.Name + "_bucket",
+				Labels: append(ls[:len(ls):len(ls)], Label{Name: "le", Value: formatFloat(upper)}),
+				Value:  float64(cumulative),
+			})
+		}
+		samples = append(samples,
+			Sample{
+				Name:   h.desc.Name + "_bucket",
+				Labels: append(ls[:len(ls):len(ls)], Label{Name: "le", Value: "+Inf"}),
+				Value:  float64(hv.count),
+			},
+			Sample{Name: h.desc.Name + "_sum", Labels: ls, Value: hv.sum},
+			Sample{Name: h.desc.Name + "_count", Labels: ls, Value: float64(hv.count)},
+		)
+	}
+	return samples
+}
+
+// funcCollector exports values computed at collection time.
+type funcCollector struct {
+	desc Desc
+	f    func() []LabeledValue
+}
+
+// NewCounterFunc creates a counter whose values are returned by f when
+// collected. The values returned must never decrease.
+func NewCounterFunc(name, help string, labelNames []string, f func() []LabeledValue) Collector {
+	return &funcCollector{desc: Desc{Name: name, Help: help, Type: TypeCounter, Labels: labelNames}, f: f}
+}
+
+// NewGaugeFunc creates a gauge whose values are returned by f when
+// collected.
+func NewGaugeFunc(name, help string, labelNames []string, f func() []LabeledValue) Collector {
+	return &funcCollector{desc: Desc{Name: name, Help: help, Type: TypeGauge, Labels: labelNames}, f: f}
+}
+
+func (fc *funcCollector) Describe() Desc {
+	return fc.desc
+}
+
+func (fc *funcCollector) Collect() []Sample {
+	values := fc.f()
+	samples := make([]Sample, 0, len(values))
+	for _, v := range values {
+		labelKey(fc.desc, v.LabelValues) // validates the number of values
+		samples = append(samples, Sample{
+			Name:   fc.desc.Name,
+			Labels: labels(fc.desc, v.LabelValues),
+			Value:  v.Value,
+		})
+	}
+	return samples
+}
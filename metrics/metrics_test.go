@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+
+	requests := NewCounter("test_requests_total", "Total requests.", "route", "code")
+	inflight := NewGauge("test_inflight", "Requests in flight.")
+	latency := NewHistogram("test_latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	pending := NewGaugeFunc("test_pending", "Pending events\nper endpoint.", []string{"endpoint"}, func() []LabeledValue {
+		return []LabeledValue{{LabelValues: []string{`a "quoted" \ name`}, Value: 3}}
+	})
+	r.MustRegister(requests, inflight, latency, pending)
+
+	requests.Inc("manifest", "200")
+	requests.Add(2, "manifest", "200")
+	requests.Inc("blob", "404")
+	inflight.Inc()
+	inflight.Inc()
+	inflight.Dec()
+	latency.Observe(0.05, "blob")
+	latency.Observe(0.5, "blob")
+	latency.Observe(5, "blob")
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+
+	expected := `# HELP test_inflight Requests in flight.
+# TYPE test_inflight gauge
+test_inflight 1
+# HELP test_latency_seconds Request latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{route="blob",le="0.1"} 1
+test_latency_seconds_bucket{route="blob",le="1"} 2
+test_latency_seconds_bucket{route="blob",le="+Inf"} 3
+test_latency_seconds_sum{route="blob"} 5.55
+test_latency_seconds_count{route="blob"} 3
+# HELP test_pending Pending events\nper endpoint.
+# TYPE test_pending gauge
+test_pending{endpoint="a \"quoted\" \\ name"} 3
+# HELP test_requests_total Total requests.
+# TYPE test_requests_total counter
+test_requests_total{route="blob",code="404"} 1
+test_requests_total{route="manifest",code="200"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected exposition:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	r := NewRegistry()
+
+	if err := r.Register(NewCounter("test_total", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Register(NewCounter("test_total", "")); err == nil {
+		t.Fatalf("expected error registering duplicate metric")
+	}
+	if err := r.Register(NewCounter("test-invalid", "")); err == nil {
+		t.Fatalf("expected error registering invalid name")
+	}
+	if err := r.Register(NewHistogram("test_histogram", "", nil, "le")); err == nil {
+		t.Fatalf("expected error registering reserved label")
+	}
+}
+
+func TestLabelValueMismatch(t *testing.T) {
+	c := NewCounter("test_total", "", "route")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic on label value mismatch")
+		}
+	}()
+	c.Inc()
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	c := NewCounter("test_total", "Test counter.")
+	r.MustRegister(c)
+	c.Inc()
+
+	server := httptest.NewServer(r.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+		t.Fatalf("unexpected content type: %q", ct)
+	}
+
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	if !strings.Contains(buf.String(), "test_total 1\n") {
+		t.Fatalf("counter missing from response: %q", buf.String())
+	}
+}
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Registry holds a set of collectors which are exported together.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]Collector
+}
+
+// DefaultRegistry is the registry used by the package level functions.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]Collector),
+	}
+}
+
+// Register adds a collector to the registry. An error is returned if the name
+// is invalid or already registered.
+func (r *Registry) Register(c Collector) error {
+	desc := c.Describe()
+	if !metricNameRegexp.MatchString(desc.Name) {
+		return fmt.Errorf("invalid metric name: %q", desc.Name)
+	}
+	for _, l := range desc.Labels {
+		if !metricNameRegexp.MatchString(l) || strings.HasPrefix(l, "__") || l == "le" {
+			return fmt.Errorf("invalid label name for %s: %q", desc.Name, l)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.collectors[desc.Name]; exists {
+		return fmt.Errorf("metric already registered: %s", desc.Name)
+	}
+	r.collectors[desc.Name] = c
+	return nil
+}
+
+// MustRegister adds collectors to the registry, panicking on error.
+func (r *Registry) MustRegister(cs ...Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Unregister removes the collector registered under name.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.collectors, name)
+}
+
+// WriteTo writes all registered metrics to w in the text exposition format,
+// ordered by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]Collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, c := range collectors {
+		desc := c.Describe()
+		fmt.Fprintf(cw, "# HELP %s %s\n", desc.Name, escapeHelp(desc.Help))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", desc.Name, desc.Type)
+		for _, s := range c.Collect() {
+			writeSample(cw, s)
+		}
+	}
+
+	if err := cw.w.(*bufio.Writer).Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+// Handler returns an http.Handler serving the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		if _, err := r.WriteTo(w); err != nil {
+			// Headers are already sent, nothing else can be done.
+			return
+		}
+	})
+}
+
+// Register adds a collector to the default registry.
+func Register(c Collector) error {
+	return DefaultRegistry.Register(c)
+}
+
+// MustRegister adds collectors to the default registry, panicking on error.
+func MustRegister(cs ...Collector) {
+	DefaultRegistry.MustRegister(cs...)
+}
+
+// Handler returns an http.Handler serving the metrics of the default
+// registry.
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+func writeSample(w io.Writer, s Sample) {
+	io.WriteString(w, s.Name)
+	if len(s.Labels) > 0 {
+		io.WriteString(w, "{")
+		for i, l := range s.Labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l.Name, escapeLabelValue(l.Value))
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, " ")
+	io.WriteString(w, formatFloat(s.Value))
+	io.WriteString(w, "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+// countingWriter tracks the bytes written and the first error encountered.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -69,6 +69,13 @@ func NewEndpoint(name, url string, config EndpointConfig) *Endpoint {
 	return &endpoint
 }
 
+// Close closes the endpoint once the queued events are delivered, and stops
+// reporting its metrics.
+func (e *Endpoint) Close() error {
+	unregister(e)
+	return e.Sink.Close()
+}
+
 // Name returns the name of the endpoint, generally used for debugging.
 func (e *Endpoint) Name() string {
 	return e.name
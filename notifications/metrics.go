@@ -4,7 +4,11 @@ import (
 	"expvar"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+
+	"github.com/docker/distribution/metrics"
 )
 
 // EndpointMetrics track various actions taken by the endpoint, typically by
@@ -109,6 +113,19 @@ func register(e *Endpoint) {
 	endpoints.registered = append(endpoints.registered, e)
 }
 
+// unregister removes the endpoint from expvar.
+func unregister(e *Endpoint) {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+
+	for i, registered := range endpoints.registered {
+		if registered == e {
+			endpoints.registered = append(endpoints.registered[:i], endpoints.registered[i+1:]...)
+			return
+		}
+	}
+}
+
 func init() {
 	// NOTE(stevvooe): Setup registry metrics structure to report to expvar.
 	// Ideally, we do more metrics through logging but we need some nice
@@ -149,4 +166,67 @@ func init() {
 	}))
 
 	registry.(*expvar.Map).Set("notifications", &notifications)
+
+	metrics.MustRegister(
+		metrics.NewGaugeFunc("registry_notifications_pending",
+			"The number of events queued for delivery.",
+			[]string{"endpoint"}, func() []metrics.LabeledValue {
+				var values []metrics.LabeledValue
+				readEndpointMetrics(func(name string, m *EndpointMetrics) {
+					values = append(values, metrics.LabeledValue{LabelValues: []string{name}, Value: float64(m.Pending)})
+				})
+				return values
+			}),
+		metrics.NewCounterFunc("registry_notifications_events_total",
+			"The number of events received for delivery.",
+			[]string{"endpoint"}, func() []metrics.LabeledValue {
+				var values []metrics.LabeledValue
+				readEndpointMetrics(func(name string, m *EndpointMetrics) {
+					values = append(values, metrics.LabeledValue{LabelValues: []string{name}, Value: float64(m.Events)})
+				})
+				return values
+			}),
+		metrics.NewCounterFunc("registry_notifications_delivered_total",
+			"The number of events sent to the endpoint, by result.",
+			[]string{"endpoint", "result"}, func() []metrics.LabeledValue {
+				var values []metrics.LabeledValue
+				readEndpointMetrics(func(name string, m *EndpointMetrics) {
+					values = append(values,
+						metrics.LabeledValue{LabelValues: []string{name, "success"}, Value: float64(m.Successes)},
+						metrics.LabeledValue{LabelValues: []string{name, "failure"}, Value: float64(m.Failures)},
+						metrics.LabeledValue{LabelValues: []string{name, "error"}, Value: float64(m.Errors)})
+				})
+				return values
+			}),
+		metrics.NewCounterFunc("registry_notifications_responses_total",
+			"The number of events sent to the endpoint, by response status code.",
+			[]string{"endpoint", "code"}, func() []metrics.LabeledValue {
+				var values []metrics.LabeledValue
+				readEndpointMetrics(func(name string, m *EndpointMetrics) {
+					statuses := make([]string, 0, len(m.Statuses))
+					for status := range m.Statuses {
+						statuses = append(statuses, status)
+					}
+					sort.Strings(statuses)
+					for _, status := range statuses {
+						code := strings.SplitN(status, " ", 2)[0]
+						values = append(values, metrics.LabeledValue{LabelValues: []string{name, code}, Value: float64(m.Statuses[status])})
+					}
+				})
+				return values
+			}),
+	)
+}
+
+// readEndpointMetrics calls fn with a snapshot of the metrics of each
+// registered endpoint.
+func readEndpointMetrics(fn func(name string, m *EndpointMetrics)) {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+
+	for _, e := range endpoints.registered {
+		var m EndpointMetrics
+		e.ReadMetrics(&m)
+		fn(e.Name(), &m)
+	}
 }
@@ -0,0 +1,262 @@
+// Package accesslog provides an http.Handler writing a line to an access log
+// for each request, either in the Apache combined log format or as JSON.
+//
+// Handlers further down the chain may attach application specific fields,
+// such as the repository name, to the line of a request with Set, once the
+// response writer passed down by the handler is bound to the request context
+// with WithAnnotations.
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+	gorhandlers "github.com/gorilla/handlers"
+)
+
+// Supported formats.
+const (
+	FormatCombined = "combined"
+	FormatJSON     = "json"
+)
+
+// Fields of the JSON format. The first group is recorded by the handler
+// itself; the second is provided by the application through Set.
+const (
+	FieldTime          = "time"
+	FieldRemoteAddr    = "remoteaddr"
+	FieldHost          = "host"
+	FieldMethod        = "method"
+	FieldURI           = "uri"
+	FieldProto         = "proto"
+	FieldStatus        = "status"
+	FieldBytesSent     = "bytessent"
+	FieldBytesReceived = "bytesreceived"
+	FieldDuration      = "duration"
+	FieldUserAgent     = "useragent"
+	FieldReferer       = "referer"
+
+	FieldRequestID  = "requestid"
+	FieldRoute      = "route"
+	FieldUser       = "user"
+	FieldRepository = "repository"
+	FieldDigest     = "digest"
+	FieldTag        = "tag"
+	FieldUploadID   = "uploadid"
+)
+
+// DefaultFields are the fields written by the JSON format when none are
+// configured, in order.
+var DefaultFields = []string{
+	FieldTime,
+	FieldRequestID,
+	FieldRemoteAddr,
+	FieldUser,
+	FieldMethod,
+	FieldURI,
+	FieldRoute,
+	FieldRepository,
+	FieldDigest,
+	FieldTag,
+	FieldUploadID,
+	FieldStatus,
+	FieldBytesReceived,
+	FieldBytesSent,
+	FieldDuration,
+	FieldUserAgent,
+}
+
+var knownFields = map[string]bool{
+	FieldTime: true, FieldRemoteAddr: true, FieldHost: true, FieldMethod: true,
+	FieldURI: true, FieldProto: true, FieldStatus: true, FieldBytesSent: true,
+	FieldBytesReceived: true, FieldDuration: true, FieldUserAgent: true,
+	FieldReferer: true, FieldRequestID: true, FieldRoute: true, FieldUser: true,
+	FieldRepository: true, FieldDigest: true, FieldTag: true, FieldUploadID: true,
+}
+
+// Handler returns a handler logging each request served by h to out in the
+// given format. Fields selects the fields of the JSON format and their order;
+// DefaultFields is used if it is empty. Fields are ignored by the combined
+// format.
+func Handler(out io.Writer, format string, fields []string, h http.Handler) (http.Handler, error) {
+	switch format {
+	case "", FormatCombined:
+		return gorhandlers.CombinedLoggingHandler(out, h), nil
+	case FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format: %q", format)
+	}
+
+	if len(fields) == 0 {
+		fields = DefaultFields
+	}
+	for _, field := range fields {
+		if !knownFields[field] {
+			return nil, fmt.Errorf("unknown access log field: %q", field)
+		}
+	}
+
+	return &jsonHandler{
+		out:     out,
+		fields:  fields,
+		handler: h,
+	}, nil
+}
+
+// annotations holds the fields of the access log line of a request.
+type annotations map[string]interface{}
+
+// annotationsKey is the context key of the fields of a request.
+type annotationsKey struct{}
+
+// WithAnnotations returns a context to which fields of the access log line of
+// the request served with w can be attached with Set. W must be the
+// http.ResponseWriter passed down by an access log handler, otherwise ctx is
+// returned.
+func WithAnnotations(ctx context.Context, w http.ResponseWriter) context.Context {
+	rw, ok := w.(*responseWriter)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, annotationsKey{}, rw.annotations)
+}
+
+// Set attaches a field to the access log line of the request of ctx. It has
+// no effect if ctx was not returned by WithAnnotations. Empty values are not
+// logged.
+func Set(ctx context.Context, field string, value interface{}) {
+	if a, ok := ctx.Value(annotationsKey{}).(annotations); ok {
+		a[field] = value
+	}
+}
+
+type jsonHandler struct {
+	mu      sync.Mutex // serializes writes to out
+	out     io.Writer
+	fields  []string
+	handler http.Handler
+}
+
+func (jh *jsonHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	body := &countingReader{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
+	}
+	rw := &responseWriter{ResponseWriter: w, status: http.StatusOK, annotations: make(annotations)}
+
+	defer func() {
+		entry := rw.annotations
+		entry[FieldTime] = start.UTC().Format(time.RFC3339Nano)
+		entry[FieldRemoteAddr] = remoteAddr(r)
+		entry[FieldHost] = r.Host
+		entry[FieldMethod] = r.Method
+		entry[FieldURI] = r.RequestURI
+		entry[FieldProto] = r.Proto
+		entry[FieldStatus] = rw.status
+		entry[FieldBytesSent] = rw.written
+		entry[FieldBytesReceived] = body.read
+		entry[FieldDuration] = time.Since(start).Seconds()
+		entry[FieldUserAgent] = r.UserAgent()
+		entry[FieldReferer] = r.Referer()
+
+		jh.write(entry)
+	}()
+
+	jh.handler.ServeHTTP(rw, r)
+}
+
+// write encodes the configured fields of entry as a single JSON object,
+// preserving their order.
+func (jh *jsonHandler) write(entry annotations) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, field := range jh.fields {
+		value, ok := entry[field]
+		if !ok || value == "" {
+			continue
+		}
+		p, err := json.Marshal(value)
+		if err != nil {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:", field)
+		buf.Write(p)
+	}
+	buf.WriteString("}\n")
+
+	jh.mu.Lock()
+	defer jh.mu.Unlock()
+	jh.out.Write(buf.Bytes())
+}
+
+// remoteAddr returns the host of the remote address of r.
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return strings.Trim(host, "[]")
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.read += int64(n)
+	return n, err
+}
+
+// responseWriter records the status and the number of bytes of a response,
+// and carries the fields set by the application.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+	annotations annotations
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(p)
+	rw.written += int64(n)
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *responseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := rw.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
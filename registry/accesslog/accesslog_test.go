@@ -0,0 +1,84 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/context"
+)
+
+func TestJSONHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := Handler(&buf, FormatJSON, []string{FieldMethod, FieldStatus, FieldRepository, FieldTag, FieldBytesReceived, FieldBytesSent}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		ctx := WithAnnotations(context.Background(), w)
+		Set(ctx, FieldRepository, "foo/bar")
+		Set(ctx, FieldTag, "")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error creating handler: %v", err)
+	}
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v2/foo/bar/blobs/uploads/", "text/plain", strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+
+	expected := `{"method":"POST","status":201,"repository":"foo/bar","bytesreceived":7,"bytessent":7}` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected log line: %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestDefaultFields(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := Handler(&buf, FormatJSON, nil, http.NotFoundHandler())
+	if err != nil {
+		t.Fatalf("unexpected error creating handler: %v", err)
+	}
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("unexpected error decoding log line %q: %v", buf.String(), err)
+	}
+	for _, field := range []string{FieldTime, FieldRemoteAddr, FieldMethod, FieldURI, FieldStatus, FieldDuration} {
+		if _, ok := line[field]; !ok {
+			t.Errorf("field %q missing from log line %q", field, buf.String())
+		}
+	}
+	if line[FieldStatus] != float64(http.StatusNotFound) {
+		t.Errorf("unexpected status: %v", line[FieldStatus])
+	}
+}
+
+func TestInvalidConfiguration(t *testing.T) {
+	if _, err := Handler(ioutil.Discard, "xml", nil, http.NotFoundHandler()); err == nil {
+		t.Fatalf("expected error with unknown format")
+	}
+	if _, err := Handler(ioutil.Discard, FormatJSON, []string{"password"}, http.NotFoundHandler()); err == nil {
+		t.Fatalf("expected error with unknown field")
+	}
+	if _, err := Handler(ioutil.Discard, "", []string{"password"}, http.NotFoundHandler()); err != nil {
+		t.Fatalf("unexpected error with combined format: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+// Package audit maintains a tamper-evident log of authorization decisions and
+// repository operations.
+//
+// Records are written as JSON lines. Each record includes the hash of the
+// record before it, so that any modification, removal or reordering of
+// records is detected by Verify.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// Log appends hash-chained records to a backend. It is safe for concurrent
+// use.
+type Log struct {
+	mu       sync.Mutex
+	backend  Backend
+	sequence uint64
+	previous string
+	closed   bool
+}
+
+// New returns a log writing to backend, continuing the chain of the records
+// already present. An invalid last line, such as one partly written before a
+// crash, is skipped and the chain continues from the last complete record.
+// The skipped line is left in place, so that Verify reports the broken chain.
+func New(backend Backend) (*Log, error) {
+	l := &Log{backend: backend}
+
+	p, err := backend.Tail()
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		var last Record
+		if err := json.Unmarshal(p, &last); err != nil {
+			logrus.Errorf("audit: skipping invalid last record: %v", err)
+			if last, err = lastRecord(backend); err != nil {
+				return nil, err
+			}
+		}
+		l.sequence = last.Sequence
+		l.previous = last.Hash
+	}
+
+	return l, nil
+}
+
+// lastRecord returns the last valid record of the log, or an empty record if
+// there is none.
+func lastRecord(backend Backend) (Record, error) {
+	rc, err := backend.Open()
+	if err != nil {
+		return Record{}, err
+	}
+	defer rc.Close()
+
+	var last Record
+	scanner := bufio.NewScanner(rc)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err == nil {
+			last = record
+		}
+	}
+	return last, scanner.Err()
+}
+
+// Append chains records to the log and writes them to the backend.
+func (l *Log) Append(records ...Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	now := time.Now().UTC()
+	lines := make([][]byte, 0, len(records))
+	sequence, previous := l.sequence, l.previous
+	for _, record := range records {
+		sequence++
+		record.Sequence = sequence
+		record.Previous = previous
+		if record.Timestamp.IsZero() {
+			record.Timestamp = now
+		}
+
+		hash, err := record.computeHash()
+		if err != nil {
+			return err
+		}
+		record.Hash = hash
+
+		p, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, p)
+		previous = hash
+	}
+
+	if err := l.backend.Append(lines); err != nil {
+		return err
+	}
+
+	l.sequence, l.previous = sequence, previous
+	return nil
+}
+
+// Access records the decision of an access check for each of the requested
+// accesses. A nil err means access was granted, an auth.Challenge or an
+// errcode.ErrorCode that it was denied. Any other error is recorded as a
+// failed check.
+func (l *Log) Access(user string, request notifications.RequestRecord, accesses []auth.Access, err error) error {
+	decision, reason := DecisionGranted, ""
+	if err != nil {
+		reason = err.Error()
+		switch err.(type) {
+		case auth.Challenge, errcode.ErrorCode:
+			decision = DecisionDenied
+		default:
+			decision = DecisionError
+		}
+	}
+
+	records := make([]Record, 0, len(accesses))
+	for _, access := range accesses {
+		record := Record{
+			Type:     TypeAccess,
+			Action:   access.Action,
+			Decision: decision,
+			Reason:   reason,
+			User:     user,
+			Request:  request,
+		}
+		if access.Type == "repository" {
+			record.Repository = access.Name
+		} else {
+			record.Resource = access.Type + ":" + access.Name
+		}
+		records = append(records, record)
+	}
+
+	return l.Append(records...)
+}
+
+// Sink returns a notifications sink which records events in the log.
+// Closing the sink does not close the log.
+func (l *Log) Sink() notifications.Sink {
+	return &eventSink{log: l}
+}
+
+// Close flushes and closes the backend.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.backend.Close()
+}
+
+// eventSink converts notification events into records.
+type eventSink struct {
+	log *Log
+}
+
+func (es *eventSink) Write(events ...notifications.Event) error {
+	records := make([]Record, 0, len(events))
+	for _, event := range events {
+		records = append(records, Record{
+			Timestamp:      event.Timestamp.UTC(),
+			Type:           TypeEvent,
+			Action:         event.Action,
+			User:           event.Actor.Name,
+			Repository:     event.Target.Repository,
+			FromRepository: event.Target.FromRepository,
+			Digest:         event.Target.Digest.String(),
+			Tag:            event.Target.Tag,
+			MediaType:      event.Target.MediaType,
+			Size:           event.Target.Size,
+			Request:        event.Request,
+		})
+	}
+	return es.log.Append(records...)
+}
+
+func (es *eventSink) Close() error {
+	return nil
+}
+
+func (es *eventSink) String() string {
+	return "audit"
+}
@@ -0,0 +1,358 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+type testChallenge struct{}
+
+func (testChallenge) SetHeaders(w http.ResponseWriter) {}
+func (testChallenge) Error() string                    { return "authentication required" }
+
+var request = notifications.RequestRecord{ID: "request-id", Addr: "10.0.0.1:1234", Method: "GET"}
+
+func pullAccess(repo string) auth.Access {
+	return auth.Access{Resource: auth.Resource{Type: "repository", Name: repo}, Action: "pull"}
+}
+
+func readAll(t *testing.T, backend Backend, filter Filter) []Record {
+	rc, err := backend.Open()
+	if err != nil {
+		t.Fatalf("unexpected error opening log: %v", err)
+	}
+	defer rc.Close()
+
+	var records []Record
+	if err := Query(rc, filter, func(r Record) error {
+		records = append(records, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error querying log: %v", err)
+	}
+	return records
+}
+
+func TestFileLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	backend, err := NewFileBackend(path)
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %v", err)
+	}
+	log, err := New(backend)
+	if err != nil {
+		t.Fatalf("unexpected error creating log: %v", err)
+	}
+
+	if err := log.Access("alice", request, []auth.Access{pullAccess("foo/bar")}, nil); err != nil {
+		t.Fatalf("unexpected error writing access record: %v", err)
+	}
+	catalog := auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}
+	if err := log.Access("mallory", request, []auth.Access{pullAccess("foo/baz"), catalog}, testChallenge{}); err != nil {
+		t.Fatalf("unexpected error writing access record: %v", err)
+	}
+	if err := log.Access("", request, []auth.Access{pullAccess("foo/bar")}, errors.New("backend down")); err != nil {
+		t.Fatalf("unexpected error writing access record: %v", err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("unexpected error closing log: %v", err)
+	}
+
+	// Reopening the log continues the chain.
+	backend, err = NewFileBackend(path)
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %v", err)
+	}
+	log, err = New(backend)
+	if err != nil {
+		t.Fatalf("unexpected error reopening log: %v", err)
+	}
+	defer log.Close()
+
+	var event notifications.Event
+	event.Action = notifications.EventActionPush
+	event.Timestamp = time.Now()
+	event.Actor.Name = "alice"
+	event.Target.Repository = "foo/bar"
+	event.Target.Tag = "latest"
+	event.Target.Descriptor = distribution.Descriptor{
+		MediaType: "application/vnd.docker.distribution.manifest.v2+json",
+		Size:      1234,
+		Digest:    digest.FromBytes([]byte("manifest")),
+	}
+	event.Request = request
+	if err := log.Sink().Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+
+	records := readAll(t, backend, Filter{})
+	if len(records) != 5 {
+		t.Fatalf("expected 5 records, got %d", len(records))
+	}
+
+	for i, r := range records {
+		if r.Sequence != uint64(i+1) {
+			t.Fatalf("unexpected sequence number %d for record %d", r.Sequence, i)
+		}
+	}
+
+	if r := records[0]; r.Type != TypeAccess || r.Decision != DecisionGranted || r.User != "alice" || r.Repository != "foo/bar" || r.Action != "pull" {
+		t.Fatalf("unexpected granted record: %#v", r)
+	}
+	if r := records[1]; r.Decision != DecisionDenied || r.Reason != "authentication required" || r.User != "mallory" {
+		t.Fatalf("unexpected denied record: %#v", r)
+	}
+	if r := records[2]; r.Resource != "registry:catalog" || r.Repository != "" {
+		t.Fatalf("unexpected catalog record: %#v", r)
+	}
+	if r := records[3]; r.Decision != DecisionError {
+		t.Fatalf("unexpected error record: %#v", r)
+	}
+	if r := records[4]; r.Type != TypeEvent || r.Action != "push" || r.Tag != "latest" || r.Digest != event.Target.Digest.String() || r.Size != 1234 || r.Request.ID != "request-id" {
+		t.Fatalf("unexpected event record: %#v", r)
+	}
+
+	if filtered := readAll(t, backend, Filter{User: "alice", Repository: "foo/bar"}); len(filtered) != 2 {
+		t.Fatalf("expected 2 records of alice in foo/bar, got %d", len(filtered))
+	}
+	if filtered := readAll(t, backend, Filter{Since: time.Now().Add(time.Hour)}); len(filtered) != 0 {
+		t.Fatalf("expected no records in the future, got %d", len(filtered))
+	}
+}
+
+// TestPartialLastRecord ensures a log whose last line was partly written, as
+// by a crash during an append, is reopened and continued from the last
+// complete record.
+func TestPartialLastRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	backend, err := NewFileBackend(path)
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %v", err)
+	}
+	log, err := New(backend)
+	if err != nil {
+		t.Fatalf("unexpected error creating log: %v", err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if err := log.Access(user, request, []auth.Access{pullAccess("foo/bar")}, nil); err != nil {
+			t.Fatalf("unexpected error writing record: %v", err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("unexpected error closing log: %v", err)
+	}
+
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("unexpected error opening log: %v", err)
+	}
+	if _, err := fp.WriteString(`{"sequence":3,"type":"acc`); err != nil {
+		t.Fatalf("unexpected error writing partial record: %v", err)
+	}
+	fp.Close()
+
+	backend, err = NewFileBackend(path)
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %v", err)
+	}
+	log, err = New(backend)
+	if err != nil {
+		t.Fatalf("unexpected error reopening log with a partial record: %v", err)
+	}
+	if err := log.Access("carol", request, []auth.Access{pullAccess("foo/bar")}, nil); err != nil {
+		t.Fatalf("unexpected error writing record: %v", err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("unexpected error closing log: %v", err)
+	}
+
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(p), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected the partial record on its own line, got %q", p)
+	}
+
+	// The partial record breaks the chain, but the record after it
+	// continues from the last complete record.
+	if err := Verify(bytes.NewReader(p)); err == nil {
+		t.Fatal("expected the partial record to break the chain")
+	}
+	withoutPartial := strings.Join(append(lines[:2:2], lines[3]), "\n")
+	if err := Verify(strings.NewReader(withoutPartial)); err != nil {
+		t.Fatalf("unexpected error verifying the log without the partial record: %v", err)
+	}
+}
+
+func TestTamperDetection(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := New(&bufferBackend{buf: &buf})
+	if err != nil {
+		t.Fatalf("unexpected error creating log: %v", err)
+	}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if err := log.Access(user, request, []auth.Access{pullAccess("foo/bar")}, nil); err != nil {
+			t.Fatalf("unexpected error writing record: %v", err)
+		}
+	}
+
+	if err := Verify(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("unexpected error verifying untouched log: %v", err)
+	}
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+
+	modified := strings.Replace(buf.String(), `"user":"bob"`, `"user":"eve"`, 1)
+	removed := lines[0] + lines[2]
+	reordered := lines[1] + lines[0] + lines[2]
+
+	for name, log := range map[string]string{
+		"modified":  modified,
+		"removed":   removed,
+		"reordered": reordered,
+	} {
+		err := Verify(strings.NewReader(log))
+		if _, ok := err.(ErrChainBroken); !ok {
+			t.Errorf("expected broken chain for %s log, got %v", name, err)
+		}
+	}
+}
+
+func TestStorageLog(t *testing.T) {
+	driver := inmemory.New()
+
+	backend, err := NewStorageBackend(driver, "/audit", "registry-1", time.Hour, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %v", err)
+	}
+	log, err := New(backend)
+	if err != nil {
+		t.Fatalf("unexpected error creating log: %v", err)
+	}
+	if err := log.Access("alice", request, []auth.Access{pullAccess("foo/bar")}, nil); err != nil {
+		t.Fatalf("unexpected error writing record: %v", err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("unexpected error closing log: %v", err)
+	}
+
+	backend, err = NewStorageBackend(driver, "/audit", "registry-1", time.Hour, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %v", err)
+	}
+	log, err = New(backend)
+	if err != nil {
+		t.Fatalf("unexpected error reopening log: %v", err)
+	}
+	defer log.Close()
+	if err := log.Access("bob", request, []auth.Access{pullAccess("foo/bar")}, nil); err != nil {
+		t.Fatalf("unexpected error writing record: %v", err)
+	}
+
+	records := readAll(t, backend, Filter{})
+	if len(records) != 2 || records[1].User != "bob" || records[1].Previous != records[0].Hash {
+		t.Fatalf("unexpected records: %#v", records)
+	}
+}
+
+// TestStorageLogInstances checks that instances sharing the storage write
+// separate chains, and that synced records are written before Append
+// returns.
+func TestStorageLogInstances(t *testing.T) {
+	driver := inmemory.New()
+
+	var logs []*Log
+	for _, instance := range []string{"registry-1", "registry/2"} {
+		backend, err := NewStorageBackend(driver, "/audit", instance, time.Hour, true)
+		if err != nil {
+			t.Fatalf("unexpected error creating backend: %v", err)
+		}
+		log, err := New(backend)
+		if err != nil {
+			t.Fatalf("unexpected error creating log: %v", err)
+		}
+		defer log.Close()
+		logs = append(logs, log)
+	}
+	for i, user := range []string{"alice", "bob", "alice", "bob"} {
+		if err := logs[i%2].Access(user, request, []auth.Access{pullAccess("foo/bar")}, nil); err != nil {
+			t.Fatalf("unexpected error writing record: %v", err)
+		}
+	}
+
+	// The records are read without closing the logs.
+	reader, err := NewStorageBackend(driver, "/audit", "reader", time.Hour, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating backend: %v", err)
+	}
+	defer reader.Close()
+	users := make(map[string][]string)
+	if err := QueryBackend(reader, Filter{}, func(chain string, r Record) error {
+		users[chain] = append(users[chain], r.User)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error querying log: %v", err)
+	}
+	expected := map[string]string{"registry-1": "alice,alice", "registry-2": "bob,bob"}
+	if len(users) != len(expected) {
+		t.Fatalf("unexpected chains: %v", users)
+	}
+	for chain, want := range expected {
+		if got := strings.Join(users[chain], ","); got != want {
+			t.Errorf("unexpected users of chain %q: %s", chain, got)
+		}
+	}
+}
+
+// bufferBackend keeps the log in memory.
+type bufferBackend struct {
+	buf *bytes.Buffer
+}
+
+func (bb *bufferBackend) Append(lines [][]byte) error {
+	for _, line := range lines {
+		bb.buf.Write(line)
+		bb.buf.WriteByte('\n')
+	}
+	return nil
+}
+
+func (bb *bufferBackend) Tail() ([]byte, error) {
+	return nil, nil
+}
+
+func (bb *bufferBackend) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(bb.buf.Bytes())), nil
+}
+
+func (bb *bufferBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,498 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// ErrClosed is returned when writing to a closed log.
+var ErrClosed = errors.New("audit: log closed")
+
+// Backend stores the lines of an audit log.
+type Backend interface {
+	// Append adds lines to the end of the log.
+	Append(lines [][]byte) error
+
+	// Tail returns the last line of the log, or nil if it is empty.
+	Tail() ([]byte, error)
+
+	// Open returns a reader over the whole log, in order.
+	Open() (io.ReadCloser, error)
+
+	// Close flushes pending lines and releases the backend.
+	Close() error
+}
+
+// NewBackend returns the backend selected by config. The storage driver is
+// only used if config selects storage.
+func NewBackend(config configuration.Audit, driver storagedriver.StorageDriver) (Backend, error) {
+	switch {
+	case config.File.Path != "" && config.Storage.Enabled:
+		return nil, fmt.Errorf("audit: file and storage are mutually exclusive")
+	case config.File.Path != "":
+		return NewFileBackend(config.File.Path)
+	case config.Storage.Enabled:
+		return NewStorageBackend(driver, config.Storage.RootDirectory, config.Storage.Instance, config.Storage.FlushInterval, config.Storage.Sync)
+	}
+	return nil, fmt.Errorf("audit: no backend configured")
+}
+
+// fileBackend appends lines to a local file.
+type fileBackend struct {
+	path string
+
+	mu sync.Mutex
+	fp *os.File
+
+	// partial is set while the file ends with an unterminated line, which
+	// the next append terminates.
+	partial bool
+}
+
+// NewFileBackend returns a backend appending to the file at path, which is
+// created if it does not exist.
+func NewFileBackend(path string) (Backend, error) {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	partial, err := unterminated(path)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return &fileBackend{path: path, fp: fp, partial: partial}, nil
+}
+
+// unterminated returns whether the file at path is not empty and does not
+// end with a newline.
+func unterminated(path string) (bool, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+
+	end, err := fp.Seek(0, os.SEEK_END)
+	if err != nil || end == 0 {
+		return false, err
+	}
+	last := make([]byte, 1)
+	if _, err := fp.ReadAt(last, end-1); err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+func (fb *fileBackend) Append(lines [][]byte) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if fb.fp == nil {
+		return ErrClosed
+	}
+
+	var buf bytes.Buffer
+	if fb.partial {
+		buf.WriteByte('\n')
+	}
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if _, err := fb.fp.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	fb.partial = false
+	return nil
+}
+
+func (fb *fileBackend) Tail() ([]byte, error) {
+	fp, err := os.Open(fb.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return lastLine(fp)
+}
+
+func (fb *fileBackend) Open() (io.ReadCloser, error) {
+	return os.Open(fb.path)
+}
+
+func (fb *fileBackend) Close() error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if fb.fp == nil {
+		return nil
+	}
+	err := fb.fp.Close()
+	fb.fp = nil
+	return err
+}
+
+// lastLine returns the last non-empty line of the file, reading backwards
+// from its end.
+func lastLine(fp *os.File) ([]byte, error) {
+	const chunkSize = 64 * 1024
+
+	end, err := fp.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+
+	var tail []byte
+	for offset := end; offset > 0; {
+		n := int64(chunkSize)
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+
+		chunk := make([]byte, n)
+		if _, err := fp.ReadAt(chunk, offset); err != nil {
+			return nil, err
+		}
+		tail = append(chunk, tail...)
+
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+
+	trimmed := bytes.TrimRight(tail, "\n")
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	return trimmed, nil
+}
+
+const (
+	defaultStorageRoot          = "/audit"
+	defaultStorageFlushInterval = 5 * time.Second
+
+	// maxSegmentSize is the size at which the storage backend starts a new
+	// segment. Each flush rewrites the current segment, so this bounds the
+	// cost of a flush.
+	maxSegmentSize = 4 << 20
+
+	// maxSyncSegmentSize bounds the segments of backends flushing on each
+	// append, which rewrite the current segment for every record.
+	maxSyncSegmentSize = 256 << 10
+
+	segmentSuffix = ".jsonl"
+)
+
+// QueryBackend reads the records of all the chains of backend, verifying
+// each chain, and calls fn with the chain and each record matched by filter.
+// Backends other than ChainedBackend have a single chain named "".
+func QueryBackend(backend Backend, filter Filter, fn func(chain string, record Record) error) error {
+	chained, ok := backend.(ChainedBackend)
+	if !ok {
+		rc, err := backend.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return Query(rc, filter, func(record Record) error {
+			return fn("", record)
+		})
+	}
+
+	chains, err := chained.Chains()
+	if err != nil {
+		return err
+	}
+	for _, chain := range chains {
+		if err := queryChain(chained, chain, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryChain(backend ChainedBackend, chain string, filter Filter, fn func(string, Record) error) error {
+	rc, err := backend.OpenChain(chain)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	err = Query(rc, filter, func(record Record) error {
+		return fn(chain, record)
+	})
+	if broken, ok := err.(ErrChainBroken); ok {
+		broken.Chain = chain
+		return broken
+	}
+	return err
+}
+
+// invalidInstanceChars are replaced in the names of instances, which are
+// path components.
+var invalidInstanceChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// ChainedBackend is a Backend shared by several writers, each writing its
+// own chain of records.
+type ChainedBackend interface {
+	Backend
+
+	// Chains returns the names of the chains of the log.
+	Chains() ([]string, error)
+
+	// OpenChain returns a reader over the records of a chain, in order.
+	OpenChain(chain string) (io.ReadCloser, error)
+}
+
+// storageBackend writes the log to a storage driver as a sequence of segment
+// files, named by their creation time so that they sort in order. Since
+// storage drivers cannot append to files, lines are buffered and the current
+// segment is rewritten on each flush.
+//
+// Several registry instances may share the storage, so each instance writes
+// its own chain of segments in the directory named after it.
+type storageBackend struct {
+	driver   storagedriver.StorageDriver
+	root     string
+	instance string
+	sync     bool
+
+	mu      sync.Mutex
+	segment string
+	content []byte
+	dirty   bool
+	closed  bool
+
+	done chan struct{}
+}
+
+// NewStorageBackend returns a backend writing the chain of instance as
+// segments below root on driver. Instance defaults to the host name. Lines
+// are flushed every flushInterval, so that lines appended since the last
+// flush are lost if the process exits without closing the backend, unless
+// sync flushes them before Append returns.
+func NewStorageBackend(driver storagedriver.StorageDriver, root, instance string, flushInterval time.Duration, sync bool) (Backend, error) {
+	if driver == nil {
+		return nil, fmt.Errorf("audit: no storage driver provided")
+	}
+	if root == "" {
+		root = defaultStorageRoot
+	}
+	if instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("audit: no instance name configured and no host name: %v", err)
+		}
+		instance = hostname
+	}
+	instance = invalidInstanceChars.ReplaceAllString(instance, "-")
+	if flushInterval <= 0 {
+		flushInterval = defaultStorageFlushInterval
+	}
+
+	sb := &storageBackend{
+		driver:   driver,
+		root:     root,
+		instance: instance,
+		sync:     sync,
+		done:     make(chan struct{}),
+	}
+
+	go sb.run(flushInterval)
+	return sb, nil
+}
+
+// segments returns the paths of the segments of chain, in order.
+func (sb *storageBackend) segments(chain string) ([]string, error) {
+	children, err := sb.driver.List(context.Background(), path.Join(sb.root, chain))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	paths := make([]string, 0, len(children))
+	for _, child := range children {
+		if strings.HasSuffix(child, segmentSuffix) {
+			paths = append(paths, child)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (sb *storageBackend) Append(lines [][]byte) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.closed {
+		return ErrClosed
+	}
+
+	maxSize := maxSegmentSize
+	if sb.sync {
+		maxSize = maxSyncSegmentSize
+	}
+	if sb.segment == "" || len(sb.content) >= maxSize {
+		if err := sb.flushLocked(); err != nil {
+			return err
+		}
+		sb.segment = path.Join(sb.root, sb.instance, fmt.Sprintf("%020d%s", time.Now().UnixNano(), segmentSuffix))
+		sb.content = nil
+	}
+
+	n, dirty := len(sb.content), sb.dirty
+	for _, line := range lines {
+		sb.content = append(sb.content, line...)
+		sb.content = append(sb.content, '\n')
+	}
+	sb.dirty = true
+
+	if sb.sync {
+		if err := sb.flushLocked(); err != nil {
+			// The lines are not acknowledged, and must not be written
+			// by a later flush.
+			sb.content, sb.dirty = sb.content[:n], dirty
+			return err
+		}
+	}
+	return nil
+}
+
+func (sb *storageBackend) flushLocked() error {
+	if !sb.dirty {
+		return nil
+	}
+	if err := sb.driver.PutContent(context.Background(), sb.segment, sb.content); err != nil {
+		return err
+	}
+	sb.dirty = false
+	return nil
+}
+
+func (sb *storageBackend) run(flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sb.mu.Lock()
+			if err := sb.flushLocked(); err != nil {
+				logrus.Errorf("audit: error flushing segment %s: %v", sb.segment, err)
+			}
+			sb.mu.Unlock()
+		case <-sb.done:
+			return
+		}
+	}
+}
+
+func (sb *storageBackend) Tail() ([]byte, error) {
+	sb.mu.Lock()
+	content := sb.content
+	sb.mu.Unlock()
+
+	if len(content) == 0 {
+		segments, err := sb.segments(sb.instance)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(segments) - 1; i >= 0 && len(content) == 0; i-- {
+			content, err = sb.driver.GetContent(context.Background(), segments[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	content = bytes.TrimRight(content, "\n")
+	if len(content) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(content, '\n'); i >= 0 {
+		return content[i+1:], nil
+	}
+	return content, nil
+}
+
+// Open returns a reader over the chain of the instance.
+func (sb *storageBackend) Open() (io.ReadCloser, error) {
+	return sb.OpenChain(sb.instance)
+}
+
+func (sb *storageBackend) Chains() ([]string, error) {
+	children, err := sb.driver.List(context.Background(), sb.root)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Strings(children)
+
+	chains := make([]string, 0, len(children))
+	for _, child := range children {
+		chains = append(chains, path.Base(child))
+	}
+	return chains, nil
+}
+
+func (sb *storageBackend) OpenChain(chain string) (io.ReadCloser, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if chain == sb.instance {
+		if err := sb.flushLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	segments, err := sb.segments(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	readers := make([]io.Reader, 0, len(segments))
+	for _, segment := range segments {
+		content, err := sb.driver.GetContent(context.Background(), segment)
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			content = append(content, '\n')
+		}
+		readers = append(readers, bytes.NewReader(content))
+	}
+	return ioutil.NopCloser(io.MultiReader(readers...)), nil
+}
+
+func (sb *storageBackend) Close() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.closed {
+		return nil
+	}
+	sb.closed = true
+	close(sb.done)
+	return sb.flushLocked()
+}
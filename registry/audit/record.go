@@ -0,0 +1,197 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/distribution/notifications"
+)
+
+// Record types.
+const (
+	// TypeAccess records an authorization decision.
+	TypeAccess = "access"
+
+	// TypeEvent records an operation on a repository, such as a push or
+	// delete.
+	TypeEvent = "event"
+
+	// TypeToken records the issuance or revocation of a token by a token
+	// server.
+	TypeToken = "token"
+)
+
+// Decisions recorded for access records.
+const (
+	DecisionGranted = "granted"
+	DecisionDenied  = "denied"
+	DecisionError   = "error"
+)
+
+// Record is a single entry of the audit log. Each record carries the hash of
+// its predecessor, so that removing or altering a record breaks the chain.
+type Record struct {
+	// Sequence numbers the records of a log, starting at 1.
+	Sequence uint64 `json:"seq"`
+
+	// Timestamp is the time at which the record was written.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Type is one of TypeAccess, TypeEvent or TypeToken.
+	Type string `json:"type"`
+
+	// Action is the requested access action for access records, the event
+	// action, such as push, pull, mount or delete, or the token action, such
+	// as issue or revoke.
+	Action string `json:"action"`
+
+	// Decision is the outcome of an access check.
+	Decision string `json:"decision,omitempty"`
+
+	// Reason explains a denied or failed access check.
+	Reason string `json:"reason,omitempty"`
+
+	// User is the authenticated user. For denied access records, it is the
+	// user name presented by the client, if any.
+	User string `json:"user,omitempty"`
+
+	// Repository is the repository the record applies to.
+	Repository string `json:"repository,omitempty"`
+
+	// Resource identifies the target of access records which are not
+	// repositories, such as "registry:catalog".
+	Resource string `json:"resource,omitempty"`
+
+	// Service is the audience of the token, for the records of a token
+	// server.
+	Service string `json:"service,omitempty"`
+
+	// FromRepository is the source repository of a mount.
+	FromRepository string `json:"fromRepository,omitempty"`
+
+	Digest    string `json:"digest,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+
+	// Request describes the request which produced the record.
+	Request notifications.RequestRecord `json:"request"`
+
+	// Previous is the hash of the preceding record, empty for the first.
+	Previous string `json:"prev"`
+
+	// Hash is the hex encoded SHA-256 of the record, computed with Hash
+	// unset.
+	Hash string `json:"hash"`
+}
+
+// computeHash returns the hash of the record, ignoring its Hash field.
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	p, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Filter selects records. Zero fields match all records.
+type Filter struct {
+	User       string
+	Repository string
+	Since      time.Time
+	Until      time.Time
+}
+
+// Match returns true if the record is selected by the filter.
+func (f Filter) Match(r Record) bool {
+	if f.User != "" && r.User != f.User {
+		return false
+	}
+	if f.Repository != "" && r.Repository != f.Repository && r.FromRepository != f.Repository {
+		return false
+	}
+	if !f.Since.IsZero() && r.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !r.Timestamp.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// ErrChainBroken is returned by Verify and Query when the log has been
+// tampered with.
+type ErrChainBroken struct {
+	// Chain names the broken chain of a ChainedBackend.
+	Chain    string
+	Sequence uint64
+	Reason   string
+}
+
+func (err ErrChainBroken) Error() string {
+	if err.Chain != "" {
+		return fmt.Sprintf("audit log chain %s broken at record %d: %s", err.Chain, err.Sequence, err.Reason)
+	}
+	return fmt.Sprintf("audit log chain broken at record %d: %s", err.Sequence, err.Reason)
+}
+
+// Query reads the records of a log from r, verifying the hash chain, and
+// calls fn with each record matched by filter. Reading stops at the first
+// error, including a broken chain.
+func Query(r io.Reader, filter Filter, fn func(Record) error) error {
+	var (
+		expected uint64 = 1
+		previous string
+	)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			return ErrChainBroken{Sequence: expected, Reason: fmt.Sprintf("invalid record: %v", err)}
+		}
+
+		if record.Sequence != expected {
+			return ErrChainBroken{Sequence: expected, Reason: fmt.Sprintf("unexpected sequence number %d", record.Sequence)}
+		}
+		if record.Previous != previous {
+			return ErrChainBroken{Sequence: expected, Reason: "previous hash does not match"}
+		}
+		hash, err := record.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != record.Hash {
+			return ErrChainBroken{Sequence: expected, Reason: "record hash does not match its content"}
+		}
+
+		if filter.Match(record) {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+
+		expected++
+		previous = record.Hash
+	}
+
+	return scanner.Err()
+}
+
+// Verify checks the hash chain of the log read from r.
+func Verify(r io.Reader) error {
+	return Query(r, Filter{}, func(Record) error { return nil })
+}
@@ -0,0 +1,173 @@
+// Package acl provides an access controller authenticating basic auth
+// credentials with another access controller, such as htpasswd or ldap, and
+// granting access to repositories according to a policy file of rules for
+// users and groups.
+//
+// The authenticating controller is configured under the "authenticator"
+// option as a map with a single key naming the registered access controller,
+// which must implement auth.CredentialAuthenticator:
+//
+//	auth:
+//	  acl:
+//	    realm: basic-realm
+//	    policy: /auth/policy.yml
+//	    authenticator:
+//	      htpasswd:
+//	        path: /auth/htpasswd
+//
+// This authentication method MUST be used under TLS, as basic auth sends the
+// password with each request.
+package acl
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+)
+
+type accessController struct {
+	realm         string
+	policy        *PolicyFile
+	authenticator auth.CredentialAuthenticator
+}
+
+var _ auth.AccessController = &accessController{}
+var _ auth.CredentialAuthenticator = &accessController{}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	realm, ok := options["realm"].(string)
+	if !ok || realm == "" {
+		return nil, fmt.Errorf(`"realm" must be set for acl access controller`)
+	}
+
+	path, ok := options["policy"].(string)
+	if !ok || path == "" {
+		return nil, fmt.Errorf(`"policy" must be set for acl access controller`)
+	}
+
+	authenticator, err := newAuthenticator(realm, options["authenticator"])
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := NewPolicyFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessController{
+		realm:         realm,
+		policy:        policy,
+		authenticator: authenticator,
+	}, nil
+}
+
+// newAuthenticator creates the access controller authenticating the
+// credentials, which defaults to the realm of the acl access controller.
+func newAuthenticator(realm string, v interface{}) (auth.CredentialAuthenticator, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok || len(m) != 1 {
+		return nil, fmt.Errorf(`"authenticator" must provide exactly one access controller type for acl access controller`)
+	}
+
+	var (
+		name    string
+		options interface{}
+	)
+	for k, v := range m {
+		name, options = fmt.Sprint(k), v
+	}
+
+	params := map[string]interface{}{"realm": realm}
+	switch options := options.(type) {
+	case nil:
+	case map[interface{}]interface{}:
+		for k, value := range options {
+			params[fmt.Sprint(k)] = value
+		}
+	default:
+		return nil, fmt.Errorf("authenticator (%s): options must be a map, got %T", name, options)
+	}
+
+	controller, err := auth.GetAccessController(name, params)
+	if err != nil {
+		return nil, fmt.Errorf("authenticator (%s): %v", name, err)
+	}
+	authenticator, ok := controller.(auth.CredentialAuthenticator)
+	if !ok {
+		return nil, fmt.Errorf("authenticator (%s): access controller cannot authenticate credentials", name)
+	}
+	return authenticator, nil
+}
+
+// Authorized authenticates the basic auth credentials of the request and
+// checks the access against the policy. A basic challenge is returned if the
+// credentials are missing or invalid, and errcode.ErrorCodeDenied if the
+// access is denied.
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrInvalidCredential,
+		}
+	}
+
+	if err := ac.authenticator.AuthenticateUser(username, password); err != nil {
+		if err != auth.ErrAuthenticationFailure {
+			return nil, fmt.Errorf("error authenticating user %q: %v", username, err)
+		}
+		context.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrAuthenticationFailure,
+		}
+	}
+
+	pol, err := ac.policy.Policy()
+	if err != nil {
+		return nil, err
+	}
+	for _, access := range accessRecords {
+		if !pol.Granted(username, access) {
+			context.GetLogger(ctx).Warnf("user %q denied %s access to %s %s", username, access.Action, access.Type, access.Name)
+			return nil, errcode.ErrorCodeDenied
+		}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: username}), nil
+}
+
+// AuthenticateUser authenticates the credentials with the authenticator.
+func (ac *accessController) AuthenticateUser(username, password string) error {
+	return ac.authenticator.AuthenticateUser(username, password)
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
+
+func init() {
+	auth.Register("acl", auth.InitFunc(newAccessController))
+}
@@ -0,0 +1,187 @@
+package acl
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+	_ "github.com/docker/distribution/registry/auth/htpasswd"
+)
+
+const testHtpasswd = `bilbo:$2y$05$926C3y10Quzn/LnqQH86VOEVh/18T6RnLaS.khre96jLNL/7e.K5W
+frodo:$2y$05$926C3y10Quzn/LnqQH86VOEVh/18T6RnLaS.khre96jLNL/7e.K5W
+`
+
+const testPolicy = `
+groups:
+  ci: [bilbo]
+  admins: [frodo]
+rules:
+  - repository: builds/*
+    groups: [ci]
+    actions: [pull, push]
+  - repository: library/*
+    users: ["*"]
+    actions: [pull]
+  - repository: "*"
+    groups: [admins]
+    actions: [pull, push, delete]
+  - catalog: true
+    groups: [admins]
+  - admin: [robots]
+    groups: [admins]
+`
+
+func writeFile(t *testing.T, path, content string, modtime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccessController(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	htpasswd := filepath.Join(dir, "htpasswd")
+	policyPath := filepath.Join(dir, "policy.yml")
+	modtime := time.Now().Add(-time.Hour)
+	writeFile(t, htpasswd, testHtpasswd, modtime)
+	writeFile(t, policyPath, testPolicy, modtime)
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":  "test-realm",
+		"policy": policyPath,
+		"authenticator": map[interface{}]interface{}{
+			"htpasswd": map[interface{}]interface{}{"path": htpasswd},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repository := func(name, action string) auth.Access {
+		return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: action}
+	}
+	catalog := auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}
+	robots := auth.Access{Resource: auth.Resource{Type: "registry", Name: "robots"}, Action: "*"}
+	cache := auth.Access{Resource: auth.Resource{Type: "registry", Name: "cache"}, Action: "*"}
+
+	authorized := func(username, password string, access auth.Access) error {
+		req, err := http.NewRequest("GET", "http://example.com/v2/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		authCtx, err := ac.Authorized(context.WithRequest(context.Background(), req), access)
+		if err == nil {
+			if userInfo, ok := authCtx.Value(auth.UserKey).(auth.UserInfo); !ok || userInfo.Name != username {
+				t.Errorf("unexpected user info: %v", authCtx.Value(auth.UserKey))
+			}
+		}
+		return err
+	}
+
+	for _, tc := range []struct {
+		username, password string
+		access             auth.Access
+		granted            bool
+	}{
+		{"bilbo", "baggins", repository("builds/app", "push"), true},
+		{"bilbo", "baggins", repository("library/ubuntu", "pull"), true},
+		{"bilbo", "baggins", repository("library/ubuntu", "push"), false},
+		{"bilbo", "baggins", repository("builds/app", "*"), false},
+		{"bilbo", "baggins", catalog, false},
+		{"frodo", "baggins", repository("other/app", "push"), true},
+		{"frodo", "baggins", repository("other/app", "*"), true},
+		{"frodo", "baggins", catalog, true},
+		{"bilbo", "baggins", robots, false},
+		{"frodo", "baggins", robots, true},
+		{"frodo", "baggins", cache, false},
+		{"frodo", "wrong", repository("library/ubuntu", "pull"), false},
+		{"", "", repository("library/ubuntu", "pull"), false},
+	} {
+		err := authorized(tc.username, tc.password, tc.access)
+		if tc.granted && err != nil {
+			t.Errorf("%s: expected %v to be granted, got %v", tc.username, tc.access, err)
+		}
+		if !tc.granted && tc.password == "baggins" && err != errcode.ErrorCodeDenied {
+			t.Errorf("%s: expected %v to be denied, got %v", tc.username, tc.access, err)
+		}
+		if !tc.granted && tc.password != "baggins" {
+			if _, ok := err.(auth.Challenge); !ok {
+				t.Errorf("%s: expected a challenge for %v, got %v", tc.username, tc.access, err)
+			}
+		}
+	}
+
+	// The policy is reloaded when modified.
+	writeFile(t, policyPath, `
+rules:
+  - repository: builds/*
+    users: [bilbo]
+    actions: ["*"]
+`, modtime.Add(time.Minute))
+	if err := authorized("bilbo", "baggins", repository("builds/app", "*")); err != nil {
+		t.Errorf("expected delete to be granted after reload, got %v", err)
+	}
+	if err := authorized("frodo", "baggins", repository("other/app", "pull")); err == nil {
+		t.Error("expected pull to be denied after reload")
+	}
+
+	// An invalid policy does not replace the previous one.
+	writeFile(t, policyPath, "rules: [{repository: x, actions: [fly]}]", modtime.Add(2*time.Minute))
+	if err := authorized("bilbo", "baggins", repository("builds/app", "pull")); err != nil {
+		t.Errorf("expected the previous policy to be kept, got %v", err)
+	}
+
+	// A removed policy file does not replace the previous one either, and
+	// is read again once it comes back, even with the same modification
+	// time.
+	if err := os.Remove(policyPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorized("bilbo", "baggins", repository("builds/app", "pull")); err != nil {
+		t.Errorf("expected the previous policy to be kept, got %v", err)
+	}
+	writeFile(t, policyPath, testPolicy, modtime.Add(2*time.Minute))
+	if err := authorized("frodo", "baggins", repository("other/app", "pull")); err != nil {
+		t.Errorf("expected the restored policy to be read, got %v", err)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, p := range []string{
+		`rules: [{users: [a], actions: [pull]}]`,
+		`rules: [{repository: a, catalog: true, users: [a]}]`,
+		`rules: [{repository: a, users: [a]}]`,
+		`rules: [{repository: a, users: [a], actions: [fly]}]`,
+		`rules: [{repository: a, groups: [missing], actions: [pull]}]`,
+		`rules: [{repository: a, actions: [pull]}]`,
+		`rules: [{catalog: true, users: [a], actions: [pull]}]`,
+		`rules: [{catalog: true, admin: [robots], users: [a]}]`,
+		`rules: [{admin: [robots], users: [a], actions: [pull]}]`,
+		`rules: [{admin: [users], users: [a]}]`,
+	} {
+		if _, err := ParsePolicy([]byte(p)); err == nil {
+			t.Errorf("expected an error parsing %s", p)
+		}
+	}
+
+	if _, err := ParsePolicy([]byte(`{"rules": [{"repository": "a/*", "users": ["a"], "actions": ["pull"]}]}`)); err != nil {
+		t.Errorf("unexpected error parsing a JSON policy: %v", err)
+	}
+}
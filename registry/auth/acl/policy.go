@@ -0,0 +1,228 @@
+package acl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	"gopkg.in/yaml.v2"
+)
+
+// Policy grants access to users according to a list of rules. Access not
+// granted by any rule is denied.
+type Policy struct {
+	rules []rule
+}
+
+// rule grants actions on the repositories matching a pattern, the catalog or
+// admin resources to some users and to the members of some groups.
+type rule struct {
+	auth.Permission // unset for the catalog and admin resources
+	catalog         bool
+	admin           map[string]bool
+	users           map[string]bool
+}
+
+// adminResources are the resources of the admin endpoints, which are
+// accessed as registry:<name>:*.
+var adminResources = map[string]bool{
+	"robots": true,
+	"cache":  true,
+}
+
+// policyDocument is the YAML or JSON representation of a policy.
+type policyDocument struct {
+	// Groups maps the name of each group to the names of its members.
+	Groups map[string][]string `yaml:"groups"`
+
+	Rules []struct {
+		Repository string   `yaml:"repository"`
+		Catalog    bool     `yaml:"catalog"`
+		Admin      []string `yaml:"admin"`
+		Users      []string `yaml:"users"`
+		Groups     []string `yaml:"groups"`
+		Actions    []string `yaml:"actions"`
+	} `yaml:"rules"`
+}
+
+// ParsePolicy parses a policy in YAML or JSON, such as:
+//
+//	groups:
+//	  ci: [jenkins]
+//	  admins: [alice, bob]
+//	rules:
+//	  - repository: builds/*
+//	    groups: [ci]
+//	    actions: [pull, push]
+//	  - repository: library/*
+//	    users: ["*"]
+//	    actions: [pull]
+//	  - repository: "*"
+//	    groups: [admins]
+//	    actions: [pull, push, delete]
+//	  - catalog: true
+//	    groups: [admins]
+//	  - admin: [robots, cache]
+//	    groups: [admins]
+func ParsePolicy(p []byte) (*Policy, error) {
+	var pf policyDocument
+	if err := yaml.Unmarshal(p, &pf); err != nil {
+		return nil, err
+	}
+
+	pol := &Policy{}
+	for i, r := range pf.Rules {
+		rl := rule{users: make(map[string]bool)}
+
+		exclusive := 0
+		for _, set := range []bool{r.Repository != "", r.Catalog, len(r.Admin) > 0} {
+			if set {
+				exclusive++
+			}
+		}
+
+		switch {
+		case exclusive > 1:
+			return nil, fmt.Errorf("rules[%d]: repository, catalog and admin are mutually exclusive", i)
+		case len(r.Admin) > 0:
+			if len(r.Actions) > 0 {
+				return nil, fmt.Errorf("rules[%d]: admin rules have no actions", i)
+			}
+			rl.admin = make(map[string]bool)
+			for _, resource := range r.Admin {
+				if !adminResources[resource] {
+					return nil, fmt.Errorf("rules[%d]: unknown admin resource %q", i, resource)
+				}
+				rl.admin[resource] = true
+			}
+		case r.Catalog:
+			if len(r.Actions) > 0 {
+				return nil, fmt.Errorf("rules[%d]: catalog rules have no actions", i)
+			}
+			rl.catalog = true
+		case r.Repository != "":
+			permission, err := auth.NewPermission(r.Repository, r.Actions, "pull", "push", "delete", "*")
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d]: %v", i, err)
+			}
+			rl.Permission = permission
+		default:
+			return nil, fmt.Errorf("rules[%d]: one of repository, catalog or admin must be set", i)
+		}
+
+		for _, user := range r.Users {
+			rl.users[user] = true
+		}
+		for _, group := range r.Groups {
+			members, ok := pf.Groups[group]
+			if !ok {
+				return nil, fmt.Errorf("rules[%d]: unknown group %q", i, group)
+			}
+			for _, user := range members {
+				rl.users[user] = true
+			}
+		}
+		if len(rl.users) == 0 {
+			return nil, fmt.Errorf("rules[%d]: users or groups must be set", i)
+		}
+
+		pol.rules = append(pol.rules, rl)
+	}
+	return pol, nil
+}
+
+// Granted returns whether a rule grants access to the user, repository
+// rules granting it as auth.Permission.Granted does. The catalog is also
+// listed with a catalog rule. Admin resources are only granted by admin
+// rules.
+func (pol *Policy) Granted(username string, access auth.Access) bool {
+	for _, r := range pol.rules {
+		if !r.users[username] && !r.users["*"] {
+			continue
+		}
+
+		switch {
+		case r.catalog:
+			if access.Type == "registry" && access.Name == "catalog" {
+				return true
+			}
+		case r.admin != nil:
+			if access.Type == "registry" && r.admin[access.Name] {
+				return true
+			}
+		case r.Granted(access):
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyFile is a policy read from a file, which is parsed again when it is
+// modified. It is safe for concurrent use.
+type PolicyFile struct {
+	path string
+
+	mu      sync.Mutex
+	modtime time.Time
+	policy  *Policy
+	missing bool // the file was removed, which was logged
+}
+
+// NewPolicyFile reads and parses the policy file at path.
+func NewPolicyFile(path string) (*PolicyFile, error) {
+	pf := &PolicyFile{path: path}
+	if _, err := pf.Policy(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// Policy returns the policy, parsing the policy file again if it was
+// modified. If the modified file cannot be read or parsed, the error is
+// logged once and the previous policy is kept.
+func (pf *PolicyFile) Policy() (*Policy, error) {
+	fi, err := os.Stat(pf.path)
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.policy != nil {
+		if err != nil {
+			// The error is logged once, until the file comes back.
+			if !pf.missing {
+				context.GetLogger(context.Background()).Errorf("unable to reload acl policy %s, keeping the previous one: %v", pf.path, err)
+				pf.missing = true
+			}
+			return pf.policy, nil
+		}
+		if !pf.missing && pf.modtime.Equal(fi.ModTime()) {
+			return pf.policy, nil
+		}
+	}
+	pf.missing = false
+
+	var pol *Policy
+	if err == nil {
+		var p []byte
+		if p, err = ioutil.ReadFile(pf.path); err == nil {
+			pol, err = ParsePolicy(p)
+		}
+	}
+
+	switch {
+	case err == nil:
+		pf.policy, pf.modtime = pol, fi.ModTime()
+	case pf.policy == nil:
+		return nil, fmt.Errorf("unable to load acl policy %s: %v", pf.path, err)
+	default:
+		// The modification time is recorded so that the error is only
+		// logged once per change.
+		context.GetLogger(context.Background()).Errorf("unable to reload acl policy %s, keeping the previous one: %v", pf.path, err)
+		pf.modtime = fi.ModTime()
+	}
+	return pf.policy, nil
+}
@@ -48,6 +48,11 @@ const (
 	// UserNameKey is used to get the user name from
 	// a user context
 	UserNameKey = "auth.user.name"
+
+	// BackendKey is used to get the name of the access
+	// controller which authenticated the user, when
+	// several are chained, from a user context
+	BackendKey = "auth.backend"
 )
 
 var (
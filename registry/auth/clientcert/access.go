@@ -0,0 +1,279 @@
+// Package clientcert provides an access controller identifying users by the
+// client certificate verified by the TLS server, as configured with
+// http.tls.clientcas, and granting access to repositories according to
+// patterns of identities.
+//
+// The identity is taken from the leaf certificate of the first verified
+// chain, as its subject common name, its first URI subject alternative name,
+// such as a SPIFFE ID, or a subject attribute given by OID.
+package clientcert
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// Errors returned in challenges.
+var (
+	errNoCertificate = errors.New("no verified client certificate")
+	errNoIdentity    = errors.New("no identity in client certificate")
+)
+
+// oidSubjectAltName is the OID of the subject alternative name extension.
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// tagURI is the context-specific tag of the URIs of GeneralNames.
+const tagURI = 6
+
+// defaultPermissions grant pull access to all repositories to every identity,
+// when no permissions are configured.
+var defaultPermissions = []permission{{Permission: auth.Permission{
+	Repository: auth.NewPattern("*"),
+	Actions:    map[string]bool{"pull": true},
+}}}
+
+type accessController struct {
+	identity    string                // "cn", "uri" or "oid"
+	oid         asn1.ObjectIdentifier // for "oid"
+	permissions []permission
+}
+
+var _ auth.AccessController = &accessController{}
+
+// permission grants actions on the repositories matching a pattern to the
+// identities matching one of some patterns.
+type permission struct {
+	auth.Permission
+	identities []auth.Pattern // nil for any identity
+}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	ac := &accessController{identity: "cn", permissions: defaultPermissions}
+
+	if v, present := options["identity"]; present {
+		identity, ok := v.(string)
+		if !ok || identity == "" {
+			return nil, fmt.Errorf(`"identity" must be cn, uri or an OID for clientcert access controller`)
+		}
+		switch identity {
+		case "cn", "uri":
+			ac.identity = identity
+		default:
+			oid, err := parseOID(identity)
+			if err != nil {
+				return nil, fmt.Errorf(`"identity" must be cn, uri or an OID for clientcert access controller`)
+			}
+			ac.identity, ac.oid = "oid", oid
+		}
+	}
+
+	if v, present := options["permissions"]; present {
+		permissions, err := parsePermissions(v)
+		if err != nil {
+			return nil, err
+		}
+		ac.permissions = permissions
+	}
+
+	return ac, nil
+}
+
+// parseOID parses an OID in dotted notation, such as 0.9.2342.19200300.100.1.1.
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// parsePermissions parses the list of permissions of the options.
+func parsePermissions(v interface{}) ([]permission, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf(`"permissions" must be a list for clientcert access controller`)
+	}
+
+	var permissions []permission
+	for i, item := range list {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("permissions[%d]: must be a map", i)
+		}
+
+		granted, err := auth.ParsePermission(m, "pull", "push", "delete", "*")
+		if err != nil {
+			return nil, fmt.Errorf("permissions[%d]: %v", i, err)
+		}
+		p := permission{Permission: granted}
+
+		if v, present := m["identities"]; present {
+			identities, err := auth.StringList(v)
+			if err != nil {
+				return nil, fmt.Errorf("permissions[%d]: identities must be a list", i)
+			}
+			p.identities = make([]auth.Pattern, 0, len(identities))
+			for _, identity := range identities {
+				p.identities = append(p.identities, auth.NewPattern(identity))
+			}
+		}
+
+		permissions = append(permissions, p)
+	}
+	return permissions, nil
+}
+
+// Authorized identifies the user by the verified client certificate of the
+// request and checks the permissions of the identity. A challenge is returned
+// if there is no verified certificate or identity, and
+// errcode.ErrorCodeDenied if the access is denied.
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, challenge{err: errNoCertificate}
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	identity, err := ac.identify(cert)
+	if err != nil {
+		return nil, err
+	}
+	if identity == "" {
+		context.GetLogger(ctx).Errorf("no %s identity in client certificate %q", ac.identity, cert.Subject.CommonName)
+		return nil, challenge{err: errNoIdentity}
+	}
+
+	for _, access := range accessRecords {
+		if !ac.granted(identity, access) {
+			context.GetLogger(ctx).Warnf("certificate %q denied %s access to %s %s", identity, access.Action, access.Type, access.Name)
+			return nil, errcode.ErrorCodeDenied
+		}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: identity}), nil
+}
+
+// identify returns the identity of the certificate, or an empty string if it
+// has none.
+func (ac *accessController) identify(cert *x509.Certificate) (string, error) {
+	switch ac.identity {
+	case "uri":
+		uris, err := subjectAltURIs(cert)
+		if err != nil || len(uris) == 0 {
+			return "", err
+		}
+		return uris[0], nil
+	case "oid":
+		for _, name := range cert.Subject.Names {
+			if name.Type.Equal(ac.oid) {
+				if s, ok := name.Value.(string); ok {
+					return s, nil
+				}
+			}
+		}
+		return "", nil
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// subjectAltURIs returns the URIs in the subject alternative names of the
+// certificate.
+func subjectAltURIs(cert *x509.Certificate) ([]string, error) {
+	var uris []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+
+		var seq asn1.RawValue
+		if rest, err := asn1.Unmarshal(ext.Value, &seq); err != nil {
+			return nil, fmt.Errorf("invalid subject alternative name extension: %v", err)
+		} else if len(rest) != 0 || !seq.IsCompound || seq.Tag != asn1.TagSequence {
+			return nil, errors.New("invalid subject alternative name extension")
+		}
+
+		rest := seq.Bytes
+		for len(rest) > 0 {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				return nil, fmt.Errorf("invalid subject alternative name: %v", err)
+			}
+			if name.Class == asn1.ClassContextSpecific && name.Tag == tagURI {
+				uris = append(uris, string(name.Bytes))
+			}
+		}
+	}
+	return uris, nil
+}
+
+// granted returns whether the permissions grant access to the identity. The
+// catalog is listed to identities granted all actions on all repositories.
+// The other registry resources, such as the admin endpoints, are granted to
+// every identity, and restricted to the administrators by the registry.
+func (ac *accessController) granted(identity string, access auth.Access) bool {
+	if access.Type == "registry" && access.Name != "catalog" {
+		return true
+	}
+
+	for _, p := range ac.permissions {
+		if p.matches(identity) && p.Granted(access) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns whether the permission applies to the identity.
+func (p permission) matches(identity string) bool {
+	if p.identities == nil {
+		return true
+	}
+	for _, pattern := range p.identities {
+		if pattern.Match(identity) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge implements the auth.Challenge interface. Clients cannot be asked
+// for a certificate over HTTP, so no header is set.
+type challenge struct {
+	err error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders does nothing, since the certificate is requested by the TLS
+// handshake.
+func (ch challenge) SetHeaders(w http.ResponseWriter) {}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("client certificate challenge: %s", ch.err)
+}
+
+func init() {
+	auth.Register("clientcert", auth.InitFunc(newAccessController))
+}
@@ -0,0 +1,187 @@
+package clientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+)
+
+var oidUID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// makeCert returns a self-signed certificate with the given common name, user
+// ID and URI subject alternative name.
+func makeCert(t *testing.T, cn, uid, uri string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: cn,
+			ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidUID, Value: uid}},
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	if uri != "" {
+		san, err := asn1.Marshal([]asn1.RawValue{
+			{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte("client.example.com")},
+			{Class: asn1.ClassContextSpecific, Tag: tagURI, Bytes: []byte(uri)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: oidSubjectAltName, Value: san}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func authorize(t *testing.T, ac auth.AccessController, cert *x509.Certificate, access ...auth.Access) (string, error) {
+	req, err := http.NewRequest("GET", "https://example.com/v2/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.TLS = &tls.ConnectionState{}
+	if cert != nil {
+		req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+
+	authCtx, err := ac.Authorized(context.WithRequest(context.Background(), req), access...)
+	if err != nil {
+		return "", err
+	}
+	userInfo, ok := authCtx.Value(auth.UserKey).(auth.UserInfo)
+	if !ok {
+		t.Fatal("no user info in the context")
+	}
+	return userInfo.Name, nil
+}
+
+func TestIdentity(t *testing.T) {
+	cert := makeCert(t, "jdoe", "u1234", "spiffe://example.com/ci/builder")
+
+	for identity, expected := range map[string]string{
+		"cn":                        "jdoe",
+		"uri":                       "spiffe://example.com/ci/builder",
+		"0.9.2342.19200300.100.1.1": "u1234",
+	} {
+		ac, err := newAccessController(map[string]interface{}{"identity": identity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, err := authorize(t, ac, cert)
+		if err != nil {
+			t.Fatalf("%s: %v", identity, err)
+		}
+		if name != expected {
+			t.Errorf("%s: expected identity %q, got %q", identity, expected, name)
+		}
+	}
+
+	ac, err := newAccessController(map[string]interface{}{"identity": "uri"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authorize(t, ac, makeCert(t, "jdoe", "u1234", "")); err == nil {
+		t.Error("expected an error for a certificate without URI")
+	}
+	if _, err := authorize(t, ac, nil); err == nil {
+		t.Error("expected an error without certificate")
+	} else if _, ok := err.(auth.Challenge); !ok {
+		t.Errorf("expected a challenge without certificate, got %v", err)
+	}
+
+	if _, err := newAccessController(map[string]interface{}{"identity": "email"}); err == nil {
+		t.Error("expected an error for an invalid identity")
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	ac, err := newAccessController(map[string]interface{}{
+		"identity": "uri",
+		"permissions": []interface{}{
+			map[interface{}]interface{}{
+				"repository": "builds/*",
+				"identities": []interface{}{"spiffe://example.com/ci/*"},
+				"actions":    []interface{}{"pull", "push", "delete"},
+			},
+			map[interface{}]interface{}{
+				"repository": "library/*",
+				"actions":    []interface{}{"pull"},
+			},
+			map[interface{}]interface{}{
+				"repository": "*",
+				"identities": []interface{}{"spiffe://example.com/admin"},
+				"actions":    []interface{}{"*"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := makeCert(t, "builder", "", "spiffe://example.com/ci/builder")
+	admin := makeCert(t, "admin", "", "spiffe://example.com/admin")
+	repository := func(name, action string) auth.Access {
+		return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: action}
+	}
+	catalog := auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}
+	robots := auth.Access{Resource: auth.Resource{Type: "registry", Name: "robots"}, Action: "*"}
+
+	defaults, err := newAccessController(map[string]interface{}{"identity": "uri"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ac      auth.AccessController
+		cert    *x509.Certificate
+		access  auth.Access
+		granted bool
+	}{
+		{ac, builder, repository("builds/app", "push"), true},
+		{ac, builder, repository("builds/app", "*"), true},
+		{ac, builder, repository("library/ubuntu", "pull"), true},
+		{ac, builder, repository("library/ubuntu", "push"), false},
+		{ac, builder, catalog, false},
+		{ac, builder, robots, true},
+		{ac, admin, repository("builds/app", "*"), true},
+		{ac, admin, catalog, true},
+		// Without permissions, identities are only granted pull access.
+		{defaults, admin, repository("builds/app", "pull"), true},
+		{defaults, admin, repository("builds/app", "push"), false},
+		{defaults, admin, repository("builds/app", "*"), false},
+		{defaults, admin, catalog, false},
+	} {
+		_, err := authorize(t, tc.ac, tc.cert, tc.access)
+		if tc.granted && err != nil {
+			t.Errorf("%s: expected %v to be granted, got %v", tc.cert.Subject.CommonName, tc.access, err)
+		}
+		if !tc.granted && err != errcode.ErrorCodeDenied {
+			t.Errorf("%s: expected %v to be denied, got %v", tc.cert.Subject.CommonName, tc.access, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package composite provides an access controller chaining other access
+// controllers, so that several authentication schemes can be accepted by a
+// single registry, for example basic authentication with an htpasswd file for
+// robot accounts and bearer tokens for humans.
+//
+// The controllers are configured in order under the "controllers" option,
+// each as a map with a single key naming the registered access controller:
+//
+//	auth:
+//	  composite:
+//	    controllers:
+//	      - htpasswd:
+//	          realm: basic-realm
+//	          path: /auth/htpasswd
+//	      - token:
+//	          realm: https://auth.example.com/token
+//	          service: registry.example.com
+//	          issuer: auth.example.com
+//	          rootcertbundle: /auth/root.crt
+package composite
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// backend is a chained access controller and the name it is registered as.
+type backend struct {
+	name       string
+	controller auth.AccessController
+}
+
+type accessController struct {
+	backends []backend
+}
+
+var _ auth.AccessController = &accessController{}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	controllers, ok := options["controllers"].([]interface{})
+	if !ok || len(controllers) == 0 {
+		return nil, fmt.Errorf(`"controllers" must be set to a list of access controllers for composite access controller`)
+	}
+
+	ac := &accessController{}
+	for i, c := range controllers {
+		m, ok := c.(map[interface{}]interface{})
+		if !ok || len(m) != 1 {
+			return nil, fmt.Errorf("controllers[%d]: must provide exactly one access controller type", i)
+		}
+
+		for k, v := range m {
+			name := fmt.Sprint(k)
+			if name == "composite" {
+				return nil, fmt.Errorf("controllers[%d]: composite access controllers cannot be nested", i)
+			}
+
+			params, err := parameters(v)
+			if err != nil {
+				return nil, fmt.Errorf("controllers[%d] (%s): %v", i, name, err)
+			}
+
+			controller, err := auth.GetAccessController(name, params)
+			if err != nil {
+				return nil, fmt.Errorf("controllers[%d] (%s): %v", i, name, err)
+			}
+			ac.backends = append(ac.backends, backend{name: name, controller: controller})
+		}
+	}
+
+	return ac, nil
+}
+
+// parameters converts the options of a chained access controller, as decoded
+// from YAML, to a parameter map.
+func parameters(v interface{}) (map[string]interface{}, error) {
+	params := make(map[string]interface{})
+	switch v := v.(type) {
+	case nil:
+	case map[interface{}]interface{}:
+		for k, value := range v {
+			params[fmt.Sprint(k)] = value
+		}
+	case map[string]interface{}:
+		for k, value := range v {
+			params[k] = value
+		}
+	default:
+		return nil, fmt.Errorf("options must be a map, got %T", v)
+	}
+	return params, nil
+}
+
+// Authorized tries each access controller in order and returns the context
+// of the first one granting access, recording its name under
+// auth.BackendKey. If none does, the first error other than a challenge is
+// returned, such as a denial of the access or a failure of the backend, so
+// that it is not hidden from clients by a request for other credentials.
+// Otherwise, the challenges of all of them are returned together, so that
+// clients may choose a scheme.
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	var (
+		challenges challenge
+		firstErr   error
+	)
+
+	for _, b := range ac.backends {
+		authCtx, err := b.controller.Authorized(ctx, accessRecords...)
+		if err == nil {
+			return context.WithValue(authCtx, auth.BackendKey, b.name), nil
+		}
+
+		if ch, ok := err.(auth.Challenge); ok {
+			challenges = append(challenges, ch)
+			continue
+		}
+
+		if _, ok := err.(errcode.ErrorCode); !ok {
+			context.GetLogger(ctx).Errorf("error checking authorization with %s access controller: %v", b.name, err)
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, challenges
+}
+
+// challenge is the union of the challenges of the chained access
+// controllers.
+type challenge []auth.Challenge
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the headers of each challenge on the response, adding one
+// WWW-Authenticate header per challenge.
+func (ch challenge) SetHeaders(w http.ResponseWriter) {
+	var authenticate []string
+	for _, c := range ch {
+		hw := headerWriter{header: make(http.Header)}
+		c.SetHeaders(hw)
+
+		for k, v := range hw.header {
+			if k == "Www-Authenticate" {
+				authenticate = append(authenticate, v...)
+				continue
+			}
+			w.Header()[k] = v
+		}
+	}
+
+	w.Header()["Www-Authenticate"] = authenticate
+}
+
+func (ch challenge) Error() string {
+	errs := make([]string, len(ch))
+	for i, c := range ch {
+		errs[i] = c.Error()
+	}
+	return strings.Join(errs, "; ")
+}
+
+// headerWriter collects the headers set by a challenge.
+type headerWriter struct {
+	header http.Header
+}
+
+func (hw headerWriter) Header() http.Header         { return hw.header }
+func (hw headerWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (hw headerWriter) WriteHeader(int)             {}
+
+// init registers the composite auth backend.
+func init() {
+	auth.Register("composite", auth.InitFunc(newAccessController))
+}
@@ -0,0 +1,156 @@
+package composite
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	_ "github.com/docker/distribution/registry/auth/htpasswd"
+	_ "github.com/docker/distribution/registry/auth/silly"
+)
+
+// errUnavailable is returned by the unavailable-test access controller.
+var errUnavailable = errors.New("directory unavailable")
+
+func init() {
+	auth.Register("unavailable-test", auth.InitFunc(func(map[string]interface{}) (auth.AccessController, error) {
+		return unavailableAccessController{}, nil
+	}))
+}
+
+// unavailableAccessController fails as a backend which cannot be reached.
+type unavailableAccessController struct{}
+
+func (unavailableAccessController) Authorized(ctx context.Context, access ...auth.Access) (context.Context, error) {
+	return nil, errUnavailable
+}
+
+func TestCompositeAccessController(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "htpasswd-test")
+	if err != nil {
+		t.Fatal("could not create temporary htpasswd file")
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err = tempFile.WriteString("frodo:$2y$05$926C3y10Quzn/LnqQH86VOEVh/18T6RnLaS.khre96jLNL/7e.K5W\n"); err != nil {
+		t.Fatal("could not write temporary htpasswd file")
+	}
+	tempFile.Close()
+
+	accessController, err := auth.GetAccessController("composite", map[string]interface{}{
+		"controllers": []interface{}{
+			map[interface{}]interface{}{"htpasswd": map[interface{}]interface{}{
+				"realm": "basic-realm",
+				"path":  tempFile.Name(),
+			}},
+			map[interface{}]interface{}{"silly": map[interface{}]interface{}{
+				"realm":   "silly-realm",
+				"service": "silly-service",
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	authorize := func(setAuth func(*http.Request)) (context.Context, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest("GET", "/v2/", nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		setAuth(req)
+
+		rec := httptest.NewRecorder()
+		authCtx, err := accessController.Authorized(context.WithRequest(context.Background(), req))
+		if err != nil {
+			ch, ok := err.(auth.Challenge)
+			if !ok {
+				t.Fatalf("unexpected error authorizing request: %v", err)
+			}
+			ch.SetHeaders(rec)
+		}
+		return authCtx, rec
+	}
+
+	// Without credentials, both schemes are offered in order.
+	authCtx, rec := authorize(func(req *http.Request) {})
+	if authCtx != nil {
+		t.Fatal("expected request without credentials to be challenged")
+	}
+	expected := []string{`Basic realm="basic-realm"`, `Bearer realm="silly-realm",service="silly-service"`}
+	if challenges := rec.Header()["Www-Authenticate"]; !reflect.DeepEqual(challenges, expected) {
+		t.Fatalf("unexpected challenges: %v != %v", challenges, expected)
+	}
+
+	// Basic credentials are accepted by the first controller.
+	authCtx, _ = authorize(func(req *http.Request) { req.SetBasicAuth("frodo", "baggins") })
+	if authCtx == nil {
+		t.Fatal("expected basic credentials to be accepted")
+	}
+	if user := context.GetStringValue(authCtx, auth.UserNameKey); user != "frodo" {
+		t.Fatalf("unexpected user: %q", user)
+	}
+	if backend := context.GetStringValue(authCtx, auth.BackendKey); backend != "htpasswd" {
+		t.Fatalf("unexpected backend: %q", backend)
+	}
+
+	// Other credentials fall through to the second controller.
+	authCtx, _ = authorize(func(req *http.Request) { req.Header.Set("Authorization", "Bearer token") })
+	if authCtx == nil {
+		t.Fatal("expected bearer credentials to be accepted")
+	}
+	if backend := context.GetStringValue(authCtx, auth.BackendKey); backend != "silly" {
+		t.Fatalf("unexpected backend: %q", backend)
+	}
+}
+
+// TestCompositeAccessControllerError ensures the failure of a backend is not
+// hidden by the challenges of the others.
+func TestCompositeAccessControllerError(t *testing.T) {
+	accessController, err := auth.GetAccessController("composite", map[string]interface{}{
+		"controllers": []interface{}{
+			map[interface{}]interface{}{"silly": map[interface{}]interface{}{
+				"realm":   "silly-realm",
+				"service": "silly-service",
+			}},
+			map[interface{}]interface{}{"unavailable-test": nil},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "/v2/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	if _, err := accessController.Authorized(context.WithRequest(context.Background(), req)); err != errUnavailable {
+		t.Fatalf("expected the error of the unavailable backend, got %v", err)
+	}
+
+	// The backends granting access are still used.
+	req.Header.Set("Authorization", "Bearer token")
+	if _, err := accessController.Authorized(context.WithRequest(context.Background(), req)); err != nil {
+		t.Fatalf("unexpected error authorizing bearer credentials: %v", err)
+	}
+}
+
+func TestCompositeAccessControllerOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"controllers": []interface{}{}},
+		{"controllers": []interface{}{"silly"}},
+		{"controllers": []interface{}{map[interface{}]interface{}{"nosuchauth": nil}}},
+		{"controllers": []interface{}{map[interface{}]interface{}{"silly": map[interface{}]interface{}{}}}},
+		{"controllers": []interface{}{map[interface{}]interface{}{"composite": nil}}},
+	} {
+		if _, err := auth.GetAccessController("composite", options); err == nil {
+			t.Errorf("expected error for options %v", options)
+		}
+	}
+}
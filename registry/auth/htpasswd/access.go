@@ -25,6 +25,7 @@ type accessController struct {
 }
 
 var _ auth.AccessController = &accessController{}
+var _ auth.CredentialAuthenticator = &accessController{}
 
 func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
 	realm, present := options["realm"]
@@ -54,10 +55,28 @@ func (ac *accessController) Authorized(ctx context.Context, accessRecords ...aut
 		}
 	}
 
+	if err := ac.AuthenticateUser(username, password); err != nil {
+		if err != auth.ErrAuthenticationFailure {
+			return nil, err
+		}
+		context.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrAuthenticationFailure,
+		}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: username}), nil
+}
+
+// AuthenticateUser checks the credentials against the htpasswd file, which
+// is parsed again whenever it is modified. auth.ErrAuthenticationFailure is
+// returned for unknown users and wrong passwords.
+func (ac *accessController) AuthenticateUser(username, password string) error {
 	// Dynamically parsing the latest account list
 	fstat, err := os.Stat(ac.path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	lastModified := fstat.ModTime()
@@ -68,29 +87,21 @@ func (ac *accessController) Authorized(ctx context.Context, accessRecords ...aut
 		f, err := os.Open(ac.path)
 		if err != nil {
 			ac.mu.Unlock()
-			return nil, err
+			return err
 		}
 		defer f.Close()
 
 		h, err := newHTPasswd(f)
 		if err != nil {
 			ac.mu.Unlock()
-			return nil, err
+			return err
 		}
 		ac.htpasswd = h
 	}
 	localHTPasswd := ac.htpasswd
 	ac.mu.Unlock()
 
-	if err := localHTPasswd.authenticateUser(username, password); err != nil {
-		context.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
-		return nil, &challenge{
-			realm: ac.realm,
-			err:   auth.ErrAuthenticationFailure,
-		}
-	}
-
-	return auth.WithUser(ctx, auth.UserInfo{Name: username}), nil
+	return localHTPasswd.authenticateUser(username, password)
 }
 
 // challenge implements the auth.Challenge interface.
@@ -0,0 +1,487 @@
+// Package ldap provides an access controller authenticating basic auth
+// credentials by binding to an LDAP directory, and granting access to
+// repositories according to the groups of the user in the directory.
+//
+// This authentication method MUST be used under TLS, as basic auth sends the
+// password with each request.
+package ldap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+	goldap "gopkg.in/ldap.v3"
+)
+
+const (
+	defaultFilter         = "(uid={username})"
+	defaultGroupFilter    = "(|(member={dn})(uniqueMember={dn}))"
+	defaultGroupAttribute = "cn"
+	defaultCacheTTL       = time.Minute
+	defaultTimeout        = 10 * time.Second
+)
+
+type accessController struct {
+	realm              string
+	url                string
+	startTLS           bool
+	rootCAs            *x509.CertPool
+	insecureSkipVerify bool
+	bindDN             string
+	bindPassword       string
+	base               string
+	filter             string
+	groupBase          string
+	groupFilter        string
+	groupAttribute     string
+	permissions        []permission
+	timeout            time.Duration
+	cache              *bindCache
+}
+
+var _ auth.AccessController = &accessController{}
+var _ auth.CredentialAuthenticator = &accessController{}
+
+// permission grants actions on the repositories matching a pattern to the
+// members of some groups.
+type permission struct {
+	auth.Permission
+	groups map[string]bool // nil for any authenticated user
+}
+
+// defaultPermissions grant pull access to all repositories to every
+// authenticated user, when no permissions are configured.
+var defaultPermissions = []permission{{Permission: auth.Permission{
+	Repository: auth.NewPattern("*"),
+	Actions:    map[string]bool{"pull": true},
+}}}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	ac := &accessController{
+		filter:         defaultFilter,
+		groupFilter:    defaultGroupFilter,
+		groupAttribute: defaultGroupAttribute,
+		permissions:    defaultPermissions,
+		timeout:        defaultTimeout,
+	}
+
+	params := []struct {
+		name     string
+		value    *string
+		required bool
+	}{
+		{"realm", &ac.realm, true},
+		{"url", &ac.url, true},
+		{"base", &ac.base, true},
+		{"filter", &ac.filter, false},
+		{"binddn", &ac.bindDN, false},
+		{"bindpassword", &ac.bindPassword, false},
+		{"groupbase", &ac.groupBase, false},
+		{"groupfilter", &ac.groupFilter, false},
+		{"groupattribute", &ac.groupAttribute, false},
+	}
+	for _, s := range params {
+		v, present := options[s.name]
+		if !present {
+			if s.required {
+				return nil, fmt.Errorf("%q must be set for ldap access controller", s.name)
+			}
+			continue
+		}
+		str, ok := v.(string)
+		if !ok || str == "" {
+			return nil, fmt.Errorf("%q must be a non-empty string for ldap access controller", s.name)
+		}
+		*s.value = str
+	}
+
+	if !(strings.HasPrefix(ac.url, "ldap://") || strings.HasPrefix(ac.url, "ldaps://")) {
+		return nil, fmt.Errorf(`"url" must be an ldap:// or ldaps:// URL for ldap access controller`)
+	}
+	if !strings.Contains(ac.filter, "{username}") {
+		return nil, fmt.Errorf(`"filter" must contain {username} for ldap access controller`)
+	}
+	// Validate the filters by compilation.
+	for _, filter := range []string{
+		strings.Replace(ac.filter, "{username}", "x", -1),
+		strings.Replace(ac.groupFilter, "{dn}", "x", -1),
+	} {
+		if _, err := goldap.CompileFilter(filter); err != nil {
+			return nil, fmt.Errorf("invalid filter %q for ldap access controller: %v", filter, err)
+		}
+	}
+
+	if v, present := options["rootcertbundle"]; present {
+		path, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf(`"rootcertbundle" must be a string for ldap access controller`)
+		}
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read root certificate bundle: %v", err)
+		}
+		ac.rootCAs = x509.NewCertPool()
+		if !ac.rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in root certificate bundle %s", path)
+		}
+	}
+	for _, b := range []struct {
+		name  string
+		value *bool
+	}{
+		{"starttls", &ac.startTLS},
+		{"insecureskipverify", &ac.insecureSkipVerify},
+	} {
+		v, present := options[b.name]
+		if !present {
+			continue
+		}
+		value, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%q must be a boolean for ldap access controller", b.name)
+		}
+		*b.value = value
+	}
+	if ac.startTLS && strings.HasPrefix(ac.url, "ldaps://") {
+		return nil, fmt.Errorf(`"starttls" requires an ldap:// URL for ldap access controller`)
+	}
+
+	cacheTTL := defaultCacheTTL
+	for _, d := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"cachettl", &cacheTTL},
+		{"timeout", &ac.timeout},
+	} {
+		v, present := options[d.name]
+		if !present {
+			continue
+		}
+		duration, err := parseDuration(v)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("%q must be a non-negative duration for ldap access controller", d.name)
+		}
+		*d.value = duration
+	}
+	if ac.timeout == 0 {
+		ac.timeout = defaultTimeout
+	}
+	if cacheTTL > 0 {
+		ac.cache = newBindCache(cacheTTL)
+	}
+
+	if v, present := options["permissions"]; present {
+		permissions, err := parsePermissions(v)
+		if err != nil {
+			return nil, err
+		}
+		ac.permissions = permissions
+	}
+
+	return ac, nil
+}
+
+// parsePermissions parses the list of permissions of the options.
+func parsePermissions(v interface{}) ([]permission, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf(`"permissions" must be a list for ldap access controller`)
+	}
+
+	var permissions []permission
+	for i, item := range list {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("permissions[%d]: must be a map", i)
+		}
+
+		granted, err := auth.ParsePermission(m, "pull", "push", "delete", "*")
+		if err != nil {
+			return nil, fmt.Errorf("permissions[%d]: %v", i, err)
+		}
+		p := permission{Permission: granted}
+
+		if g, present := m["groups"]; present {
+			groups, err := auth.StringList(g)
+			if err != nil {
+				return nil, fmt.Errorf("permissions[%d]: groups must be a list", i)
+			}
+			p.groups = make(map[string]bool)
+			for _, group := range groups {
+				p.groups[strings.ToLower(group)] = true
+			}
+		}
+
+		permissions = append(permissions, p)
+	}
+	return permissions, nil
+}
+
+// Authorized authenticates the basic auth credentials of the request against
+// the directory and checks the permissions of the groups of the user. A
+// basic challenge is returned if the credentials are missing or invalid, and
+// errcode.ErrorCodeDenied if the access is denied.
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrInvalidCredential,
+		}
+	}
+
+	groups, err := ac.authenticate(username, password)
+	if err == errAuthenticationFailure {
+		context.GetLogger(ctx).Errorf("error authenticating user %q: invalid credentials", username)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrAuthenticationFailure,
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating user %q with ldap: %v", username, err)
+	}
+
+	for _, access := range accessRecords {
+		if !ac.granted(groups, access) {
+			context.GetLogger(ctx).Warnf("user %q denied %s access to %s %s", username, access.Action, access.Type, access.Name)
+			return nil, errcode.ErrorCodeDenied
+		}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: username}), nil
+}
+
+// AuthenticateUser binds to the directory as the user, returning
+// auth.ErrAuthenticationFailure for unknown users and wrong passwords.
+func (ac *accessController) AuthenticateUser(username, password string) error {
+	_, err := ac.authenticate(username, password)
+	if err == errAuthenticationFailure {
+		return auth.ErrAuthenticationFailure
+	}
+	return err
+}
+
+// errAuthenticationFailure is returned by authenticate for unknown users and
+// wrong passwords.
+var errAuthenticationFailure = errors.New("invalid credentials")
+
+// authenticate binds as the user and returns the names of their groups.
+func (ac *accessController) authenticate(username, password string) ([]string, error) {
+	if password == "" {
+		return nil, errAuthenticationFailure
+	}
+	if ac.cache != nil {
+		if groups, ok := ac.cache.get(username, password); ok {
+			return groups, nil
+		}
+	}
+
+	c, err := dial(ac.url, ac.startTLS, ac.rootCAs, ac.insecureSkipVerify, ac.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if ac.bindDN != "" {
+		if err := c.Bind(ac.bindDN, ac.bindPassword); err != nil {
+			return nil, fmt.Errorf("unable to bind as %s: %v", ac.bindDN, err)
+		}
+	}
+
+	// "1.1" requests no attributes, only the DN is needed. The size limit
+	// detects filters matching several entries.
+	result, err := c.Search(goldap.NewSearchRequest(ac.base, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 2, 0, false,
+		strings.Replace(ac.filter, "{username}", goldap.EscapeFilter(username), -1), []string{"1.1"}, nil))
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("multiple entries match user %q", username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, errAuthenticationFailure
+	case 1:
+	default:
+		return nil, fmt.Errorf("multiple entries match user %q", username)
+	}
+	dn := result.Entries[0].DN
+
+	// Groups are searched before binding as the user, who may not be allowed
+	// to search the directory.
+	var groups []string
+	if ac.groupBase != "" {
+		result, err := c.Search(goldap.NewSearchRequest(ac.groupBase, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, 0, false,
+			strings.Replace(ac.groupFilter, "{dn}", goldap.EscapeFilter(dn), -1), []string{ac.groupAttribute}, nil))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range result.Entries {
+			for _, attr := range e.Attributes {
+				if strings.EqualFold(attr.Name, ac.groupAttribute) {
+					groups = append(groups, attr.Values...)
+				}
+			}
+		}
+	}
+
+	// Directories treat binds with an empty password as unauthenticated
+	// binds, which always succeed; they are rejected above.
+	if err := c.Bind(dn, password); err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			return nil, errAuthenticationFailure
+		}
+		return nil, err
+	}
+
+	if ac.cache != nil {
+		ac.cache.put(username, password, groups)
+	}
+	return groups, nil
+}
+
+// granted returns whether the permissions grant access to a user with the
+// given groups. The catalog is listed to users granted all actions on all
+// repositories. The other registry resources, such as the admin endpoints,
+// are granted to every authenticated user, and restricted to the
+// administrators by the registry.
+func (ac *accessController) granted(groups []string, access auth.Access) bool {
+	if access.Type == "registry" && access.Name != "catalog" {
+		return true
+	}
+
+	for _, p := range ac.permissions {
+		if p.member(groups) && p.Granted(access) {
+			return true
+		}
+	}
+	return false
+}
+
+// member returns whether one of groups is granted the permission.
+func (p permission) member(groups []string) bool {
+	if p.groups == nil {
+		return true
+	}
+	for _, group := range groups {
+		if p.groups[strings.ToLower(group)] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDuration parses a duration given as a string, such as "30s".
+func parseDuration(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case string:
+		return time.ParseDuration(v)
+	case time.Duration:
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid duration %v", v)
+}
+
+// bindCache remembers the groups of the users who recently bound
+// successfully. Credentials are keyed by a keyed hash, so that passwords are
+// not kept in memory.
+type bindCache struct {
+	mu      sync.Mutex
+	key     []byte
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]cachedBind
+}
+
+type cachedBind struct {
+	groups  []string
+	expires time.Time
+}
+
+func newBindCache(ttl time.Duration) *bindCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("unable to generate ldap cache key: %v", err))
+	}
+	return &bindCache{
+		key:     key,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]cachedBind),
+	}
+}
+
+func (bc *bindCache) hash(username, password string) string {
+	mac := hmac.New(sha256.New, bc.key)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (bc *bindCache) get(username, password string) ([]string, bool) {
+	key := bc.hash(username, password)
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	cb, ok := bc.entries[key]
+	if !ok || !bc.now().Before(cb.expires) {
+		return nil, false
+	}
+	return cb.groups, true
+}
+
+func (bc *bindCache) put(username, password string, groups []string) {
+	key := bc.hash(username, password)
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	now := bc.now()
+	for k, cb := range bc.entries {
+		if !now.Before(cb.expires) {
+			delete(bc.entries, k)
+		}
+	}
+	bc.entries[key] = cachedBind{groups: groups, expires: now.Add(bc.ttl)}
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
+
+func init() {
+	auth.Register("ldap", auth.InitFunc(newAccessController))
+}
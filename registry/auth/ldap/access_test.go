@@ -0,0 +1,547 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+	"gopkg.in/asn1-ber.v1"
+	goldap "gopkg.in/ldap.v3"
+)
+
+// startTLSOID is the name of the StartTLS extended operation.
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// testEntry is an entry of the test directory.
+type testEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// testDirectory is an in-process LDAP server answering simple binds,
+// searches and StartTLS over a fixed set of entries. If requireTLS is set,
+// binds over connections without TLS are refused.
+type testDirectory struct {
+	listener   net.Listener
+	passwords  map[string]string
+	entries    []testEntry
+	tlsConfig  *tls.Config
+	requireTLS bool
+
+	mu    sync.Mutex
+	binds int
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+
+	d := &testDirectory{
+		listener: l,
+		passwords: map[string]string{
+			"cn=admin,dc=example,dc=org":            "adminpw",
+			"uid=alice,ou=people,dc=example,dc=org": "alicepw",
+			"uid=bob,ou=people,dc=example,dc=org":   "bobpw",
+		},
+		entries: []testEntry{
+			{dn: "uid=alice,ou=people,dc=example,dc=org", attributes: map[string][]string{
+				"objectClass": {"person"}, "uid": {"alice"},
+			}},
+			{dn: "uid=bob,ou=people,dc=example,dc=org", attributes: map[string][]string{
+				"objectClass": {"person"}, "uid": {"bob"},
+			}},
+			{dn: "cn=developers,ou=groups,dc=example,dc=org", attributes: map[string][]string{
+				"objectClass": {"groupOfNames"}, "cn": {"developers"},
+				"member": {"uid=alice,ou=people,dc=example,dc=org", "uid=bob,ou=people,dc=example,dc=org"},
+			}},
+			{dn: "cn=admins,ou=groups,dc=example,dc=org", attributes: map[string][]string{
+				"objectClass": {"groupOfNames"}, "cn": {"Admins"},
+				"member": {"uid=bob,ou=people,dc=example,dc=org"},
+			}},
+		},
+	}
+	go d.serve()
+	return d
+}
+
+func (d *testDirectory) url() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *testDirectory) bindCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.binds
+}
+
+func (d *testDirectory) serve() {
+	for {
+		c, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(c)
+	}
+}
+
+func (d *testDirectory) handle(c net.Conn) {
+	defer func() { c.Close() }()
+	secure := false
+	for {
+		msg, err := ber.ReadPacket(c)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+		id, op := msg.Children[0], msg.Children[1]
+		reply := func(op *ber.Packet) {
+			p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id.Value, ""))
+			p.AppendChild(op)
+			c.Write(p.Bytes())
+		}
+		done := func(tag ber.Tag, code int64) {
+			p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+			p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+			p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+			p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+			reply(p)
+		}
+
+		switch op.Tag {
+		case goldap.ApplicationBindRequest:
+			d.mu.Lock()
+			d.binds++
+			d.mu.Unlock()
+			if d.requireTLS && !secure {
+				done(goldap.ApplicationBindResponse, goldap.LDAPResultConfidentialityRequired)
+				continue
+			}
+			dn, password := op.Children[1].Value.(string), op.Children[2].Data.String()
+			if pw, ok := d.passwords[dn]; ok && pw == password {
+				done(goldap.ApplicationBindResponse, goldap.LDAPResultSuccess)
+			} else {
+				done(goldap.ApplicationBindResponse, goldap.LDAPResultInvalidCredentials)
+			}
+		case goldap.ApplicationSearchRequest:
+			base := strings.ToLower(op.Children[0].Value.(string))
+			for _, e := range d.entries {
+				if !strings.HasSuffix(strings.ToLower(e.dn), base) || !matches(op.Children[6], e) {
+					continue
+				}
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, values := range e.attributes {
+					attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range values {
+						vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					}
+					attr.AppendChild(vals)
+					attrs.AppendChild(attr)
+				}
+				result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "")
+				result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+				result.AppendChild(attrs)
+				reply(result)
+			}
+			done(goldap.ApplicationSearchResultDone, goldap.LDAPResultSuccess)
+		case goldap.ApplicationExtendedRequest:
+			if d.tlsConfig == nil || secure || op.Children[0].Data.String() != startTLSOID {
+				done(goldap.ApplicationExtendedResponse, goldap.LDAPResultUnwillingToPerform)
+				continue
+			}
+			done(goldap.ApplicationExtendedResponse, goldap.LDAPResultSuccess)
+			c = tls.Server(c, d.tlsConfig)
+			secure = true
+		default:
+			return
+		}
+	}
+}
+
+// matches evaluates a filter against an entry.
+func matches(f *ber.Packet, e testEntry) bool {
+	values := func(attr string) []string {
+		for name, values := range e.attributes {
+			if strings.EqualFold(name, attr) {
+				return values
+			}
+		}
+		return nil
+	}
+
+	switch f.Tag {
+	case goldap.FilterAnd:
+		for _, child := range f.Children {
+			if !matches(child, e) {
+				return false
+			}
+		}
+		return true
+	case goldap.FilterOr:
+		for _, child := range f.Children {
+			if matches(child, e) {
+				return true
+			}
+		}
+		return false
+	case goldap.FilterNot:
+		return !matches(f.Children[0], e)
+	case goldap.FilterEqualityMatch:
+		for _, v := range values(f.Children[0].Value.(string)) {
+			if strings.EqualFold(v, f.Children[1].Value.(string)) {
+				return true
+			}
+		}
+	case goldap.FilterPresent:
+		return len(values(f.Data.String())) > 0
+	case goldap.FilterSubstrings:
+		for _, v := range values(f.Children[0].Value.(string)) {
+			rest := strings.ToLower(v)
+			ok := true
+			for _, s := range f.Children[1].Children {
+				sub := strings.ToLower(s.Data.String())
+				switch s.Tag {
+				case goldap.FilterSubstringsInitial:
+					ok = ok && strings.HasPrefix(rest, sub)
+				case goldap.FilterSubstringsFinal:
+					ok = ok && strings.HasSuffix(rest, sub)
+				default:
+					i := strings.Index(rest, sub)
+					ok = ok && i >= 0
+					if i >= 0 {
+						rest = rest[i+len(sub):]
+					}
+				}
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func testOptions(d *testDirectory) map[string]interface{} {
+	return map[string]interface{}{
+		"realm":        "ldap-realm",
+		"url":          d.url(),
+		"binddn":       "cn=admin,dc=example,dc=org",
+		"bindpassword": "adminpw",
+		"base":         "ou=people,dc=example,dc=org",
+		"filter":       "(&(objectClass=person)(uid={username}))",
+		"groupbase":    "ou=groups,dc=example,dc=org",
+		"permissions": []interface{}{
+			map[interface{}]interface{}{
+				"repository": "team/*",
+				"groups":     []interface{}{"developers"},
+				"actions":    []interface{}{"pull", "push"},
+			},
+			map[interface{}]interface{}{
+				"repository": "*",
+				"groups":     []interface{}{"admins"},
+				"actions":    []interface{}{"*"},
+			},
+			map[interface{}]interface{}{
+				"repository": "library/*",
+				"actions":    []interface{}{"pull"},
+			},
+		},
+	}
+}
+
+func authorize(t *testing.T, ac auth.AccessController, username, password string, access ...auth.Access) (context.Context, error) {
+	req, err := http.NewRequest("GET", "/v2/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	return ac.Authorized(context.WithRequest(context.Background(), req), access...)
+}
+
+func repositoryAccess(name, action string) auth.Access {
+	return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: action}
+}
+
+func TestLDAPAccessController(t *testing.T) {
+	d := newTestDirectory(t)
+	defer d.listener.Close()
+
+	options := testOptions(d)
+	options["cachettl"] = "0s"
+	ac, err := newAccessController(options)
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	catalog := auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}
+	robots := auth.Access{Resource: auth.Resource{Type: "registry", Name: "robots"}, Action: "*"}
+	for _, tc := range []struct {
+		username, password string
+		access             []auth.Access
+		err                error
+	}{
+		{"", "", nil, auth.ErrInvalidCredential},
+		{"alice", "wrong", nil, auth.ErrAuthenticationFailure},
+		{"alice", "", nil, auth.ErrAuthenticationFailure},
+		{"carol", "carolpw", nil, auth.ErrAuthenticationFailure},
+		{"*", "alicepw", nil, auth.ErrAuthenticationFailure},
+		{"alice", "alicepw", nil, nil},
+		{"alice", "alicepw", []auth.Access{repositoryAccess("team/app", "pull"), repositoryAccess("team/app", "push")}, nil},
+		{"alice", "alicepw", []auth.Access{repositoryAccess("team/app", "*")}, errcode.ErrorCodeDenied},
+		{"alice", "alicepw", []auth.Access{repositoryAccess("library/ubuntu", "pull")}, nil},
+		{"alice", "alicepw", []auth.Access{repositoryAccess("library/ubuntu", "push")}, errcode.ErrorCodeDenied},
+		{"alice", "alicepw", []auth.Access{catalog}, errcode.ErrorCodeDenied},
+		{"bob", "bobpw", []auth.Access{repositoryAccess("other/app", "*"), catalog}, nil},
+		{"alice", "alicepw", []auth.Access{robots}, nil},
+	} {
+		ctx, err := authorize(t, ac, tc.username, tc.password, tc.access...)
+		if tc.err == nil {
+			if err != nil {
+				t.Errorf("%s %v: unexpected error: %v", tc.username, tc.access, err)
+				continue
+			}
+			if user := context.GetStringValue(ctx, auth.UserNameKey); user != tc.username {
+				t.Errorf("%s %v: unexpected user %q", tc.username, tc.access, user)
+			}
+			continue
+		}
+
+		if tc.err == errcode.ErrorCodeDenied {
+			if err != tc.err {
+				t.Errorf("%s %v: expected %v, got %v", tc.username, tc.access, tc.err, err)
+			}
+			continue
+		}
+
+		ch, ok := err.(*challenge)
+		if !ok {
+			t.Errorf("%s %v: expected challenge, got %v", tc.username, tc.access, err)
+			continue
+		}
+		if ch.err != tc.err {
+			t.Errorf("%s %v: expected %v, got %v", tc.username, tc.access, tc.err, ch.err)
+		}
+	}
+}
+
+// TestLDAPDefaultPermissions ensures authenticated users are only granted
+// pull access without permissions.
+func TestLDAPDefaultPermissions(t *testing.T) {
+	d := newTestDirectory(t)
+	defer d.listener.Close()
+
+	options := testOptions(d)
+	delete(options, "permissions")
+	ac, err := newAccessController(options)
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	catalog := auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}
+	for _, tc := range []struct {
+		access  auth.Access
+		granted bool
+	}{
+		{repositoryAccess("team/app", "pull"), true},
+		{repositoryAccess("team/app", "push"), false},
+		{repositoryAccess("team/app", "*"), false},
+		{catalog, false},
+	} {
+		_, err := authorize(t, ac, "bob", "bobpw", tc.access)
+		if tc.granted && err != nil {
+			t.Errorf("expected %v to be granted, got %v", tc.access, err)
+		}
+		if !tc.granted && err != errcode.ErrorCodeDenied {
+			t.Errorf("expected %v to be denied, got %v", tc.access, err)
+		}
+	}
+}
+
+func TestLDAPBindCache(t *testing.T) {
+	d := newTestDirectory(t)
+	defer d.listener.Close()
+
+	ac, err := newAccessController(testOptions(d))
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	cache := ac.(*accessController).cache
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	push := repositoryAccess("team/app", "push")
+	if _, err := authorize(t, ac, "alice", "alicepw", push); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	binds := d.bindCount()
+
+	// Cached binds are reused, with their groups.
+	if _, err := authorize(t, ac, "alice", "alicepw", push); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := d.bindCount(); n != binds {
+		t.Fatalf("expected cached bind to be reused, got %d binds", n-binds)
+	}
+
+	// Other passwords are checked against the directory.
+	if _, err := authorize(t, ac, "alice", "wrong", push); err == nil {
+		t.Fatal("expected wrong password to be rejected")
+	}
+	binds = d.bindCount()
+
+	// Expired binds are checked again.
+	now = now.Add(defaultCacheTTL)
+	if _, err := authorize(t, ac, "alice", "alicepw", push); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := d.bindCount(); n == binds {
+		t.Fatal("expected expired bind to be checked against the directory")
+	}
+}
+
+func TestLDAPAccessControllerOptions(t *testing.T) {
+	valid := map[string]interface{}{
+		"realm": "ldap-realm",
+		"url":   "ldap://localhost",
+		"base":  "dc=example,dc=org",
+	}
+	if _, err := newAccessController(valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	withDelete := map[string]interface{}{
+		"permissions": []interface{}{map[interface{}]interface{}{"repository": "*", "actions": []interface{}{"pull", "delete"}}},
+	}
+	for k, v := range valid {
+		withDelete[k] = v
+	}
+	if _, err := newAccessController(withDelete); err != nil {
+		t.Fatalf("unexpected error with the delete action: %v", err)
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"url": "http://localhost"},
+		{"url": nil},
+		{"filter": "(uid=jdoe)"},
+		{"filter": "(uid={username}"},
+		{"groupfilter": "member={dn}"},
+		{"starttls": "yes"},
+		{"url": "ldaps://localhost", "starttls": true},
+		{"cachettl": "soon"},
+		{"permissions": []interface{}{map[interface{}]interface{}{"repository": "*", "actions": []interface{}{"fly"}}}},
+		{"permissions": []interface{}{map[interface{}]interface{}{"actions": []interface{}{"pull"}}}},
+	} {
+		options := make(map[string]interface{})
+		for k, v := range valid {
+			options[k] = v
+		}
+		for k, v := range invalid {
+			if v == nil {
+				delete(options, k)
+			} else {
+				options[k] = v
+			}
+		}
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("expected error for options %v", invalid)
+		}
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	d := newTestDirectory(t)
+	defer d.listener.Close()
+	d.requireTLS = true
+
+	certificate, bundle := newTestCertificate(t)
+	defer os.Remove(bundle)
+	d.tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+
+	options := testOptions(d)
+	options["cachettl"] = "0s"
+	ac, err := newAccessController(options)
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	if _, err := authorize(t, ac, "alice", "alicepw"); err == nil {
+		t.Fatal("expected binds without TLS to be refused")
+	}
+
+	options["starttls"] = true
+	options["rootcertbundle"] = bundle
+	ac, err = newAccessController(options)
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	if _, err := authorize(t, ac, "alice", "alicepw", repositoryAccess("team/app", "push")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := authorize(t, ac, "alice", "wrong"); err == nil {
+		t.Fatal("expected wrong password to be rejected")
+	}
+
+	// The certificate of the directory is verified.
+	delete(options, "rootcertbundle")
+	ac, err = newAccessController(options)
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	if _, err := authorize(t, ac, "alice", "alicepw"); err == nil {
+		t.Fatal("expected an unknown certificate to be rejected")
+	}
+}
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1, and
+// the path of a bundle holding it.
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "directory"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "ldap-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, f.Name()
+}
@@ -0,0 +1,61 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	goldap "gopkg.in/ldap.v3"
+)
+
+// dial connects to the directory at the ldap:// or ldaps:// URL, upgrading
+// ldap:// connections with StartTLS if startTLS is set. The certificate of
+// the directory is verified with rootCAs, or the system roots if it is nil.
+// The timeout bounds the connection and each request made on it.
+func dial(rawurl string, startTLS bool, rootCAs *x509.CertPool, insecureSkipVerify bool, timeout time.Duration) (*goldap.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	port := map[string]string{"ldap": "389", "ldaps": "636"}[u.Scheme]
+	if port == "" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	addr, host := u.Host, u.Host
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+	} else {
+		addr = net.JoinHostPort(u.Host, port)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var c net.Conn
+	if u.Scheme == "ldaps" {
+		c, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		c, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn := goldap.NewConn(c, u.Scheme == "ldaps")
+	conn.SetTimeout(timeout)
+	conn.Start()
+	if startTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pattern matches names, such as repository names, against a pattern in
+// which * matches any sequence of characters, including slashes.
+type Pattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// NewPattern compiles pattern.
+func NewPattern(pattern string) Pattern {
+	return Pattern{
+		pattern: pattern,
+		re:      regexp.MustCompile("^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"),
+	}
+}
+
+// Match returns whether name matches the pattern.
+func (p Pattern) Match(name string) bool {
+	return p.re != nil && p.re.MatchString(name)
+}
+
+// All returns whether the pattern matches all names.
+func (p Pattern) All() bool {
+	return p.pattern == "*"
+}
+
+func (p Pattern) String() string {
+	return p.pattern
+}
+
+// Permission grants actions on the repositories matching a pattern. The
+// action * grants all actions.
+type Permission struct {
+	Repository Pattern
+	Actions    map[string]bool
+}
+
+// NewPermission returns the permission of actions on the repositories
+// matching repository. The actions must be among allowed.
+func NewPermission(repository string, actions []string, allowed ...string) (Permission, error) {
+	if repository == "" {
+		return Permission{}, errors.New("repository must be set")
+	}
+	if len(actions) == 0 {
+		return Permission{}, fmt.Errorf("actions must be a list of %s", alternatives(allowed))
+	}
+
+	p := Permission{
+		Repository: NewPattern(repository),
+		Actions:    make(map[string]bool),
+	}
+	for _, action := range actions {
+		known := false
+		for _, a := range allowed {
+			known = known || a == action
+		}
+		if !known {
+			return Permission{}, fmt.Errorf("unknown action %q", action)
+		}
+		p.Actions[action] = true
+	}
+	return p, nil
+}
+
+// ParsePermission parses the repository and the actions of a permission
+// given in the options of an access controller, as a map decoded from YAML.
+func ParsePermission(m map[interface{}]interface{}, allowed ...string) (Permission, error) {
+	repository, ok := m["repository"].(string)
+	if !ok || repository == "" {
+		return Permission{}, errors.New("repository must be set")
+	}
+	actions, err := StringList(m["actions"])
+	if err != nil {
+		return Permission{}, fmt.Errorf("actions must be a list of %s", alternatives(allowed))
+	}
+	return NewPermission(repository, actions, allowed...)
+}
+
+// Granted returns whether the permission grants access. The registry
+// requests all actions ("*") on a repository to delete from it, which is
+// granted by the delete action. The catalog is listed with all actions on
+// all repositories.
+func (p Permission) Granted(access Access) bool {
+	switch access.Type {
+	case "repository":
+		if !p.Repository.Match(access.Name) {
+			return false
+		}
+		return p.Actions["*"] || p.Actions[access.Action] || (access.Action == "*" && p.Actions["delete"])
+	case "registry":
+		return access.Name == "catalog" && p.Repository.All() && p.Actions["*"]
+	}
+	return false
+}
+
+// StringList converts a list decoded from YAML to strings.
+func StringList(v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("expected a list")
+	}
+	strs := make([]string, len(list))
+	for i, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, errors.New("expected a list of strings")
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+// alternatives formats values as "a, b or c".
+func alternatives(values []string) string {
+	if len(values) < 2 {
+		return strings.Join(values, "")
+	}
+	return strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+}
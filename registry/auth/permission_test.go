@@ -0,0 +1,52 @@
+package auth
+
+import "testing"
+
+func TestPermission(t *testing.T) {
+	p, err := NewPermission("library/*", []string{"pull", "delete"}, "pull", "push", "delete", "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := NewPermission("*", []string{"*"}, "pull", "push", "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		permission Permission
+		access     Access
+		granted    bool
+	}{
+		{p, Access{Resource{"repository", "library/app"}, "pull"}, true},
+		{p, Access{Resource{"repository", "library/team/app"}, "pull"}, true},
+		{p, Access{Resource{"repository", "library/app"}, "push"}, false},
+		{p, Access{Resource{"repository", "library/app"}, "*"}, true},
+		{p, Access{Resource{"repository", "other/library/app"}, "pull"}, false},
+		{p, Access{Resource{"registry", "catalog"}, "*"}, false},
+		{all, Access{Resource{"repository", "any"}, "push"}, true},
+		{all, Access{Resource{"registry", "catalog"}, "*"}, true},
+		{Permission{}, Access{Resource{"repository", ""}, "pull"}, false},
+	} {
+		if granted := tc.permission.Granted(tc.access); granted != tc.granted {
+			t.Errorf("%s granted %+v: expected %v, got %v", tc.permission.Repository, tc.access, tc.granted, granted)
+		}
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	for _, tc := range []struct {
+		m   map[interface{}]interface{}
+		err string
+	}{
+		{map[interface{}]interface{}{"repository": "*", "actions": []interface{}{"pull"}}, ""},
+		{map[interface{}]interface{}{"actions": []interface{}{"pull"}}, "repository must be set"},
+		{map[interface{}]interface{}{"repository": "*"}, "actions must be a list of pull, push or *"},
+		{map[interface{}]interface{}{"repository": "*", "actions": []interface{}{}}, "actions must be a list of pull, push or *"},
+		{map[interface{}]interface{}{"repository": "*", "actions": []interface{}{"delete"}}, `unknown action "delete"`},
+	} {
+		_, err := ParsePermission(tc.m, "pull", "push", "*")
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("parsing %v: expected error %q, got %v", tc.m, tc.err, err)
+		}
+	}
+}
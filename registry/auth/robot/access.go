@@ -0,0 +1,99 @@
+package robot
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// accessController authenticates robot accounts and delegates the other
+// requests.
+type accessController struct {
+	store *Store
+	next  auth.AccessController
+}
+
+var _ auth.AccessController = &accessController{}
+
+// NewAccessController returns an access controller authenticating the robot
+// accounts of store and checking their scopes. Requests without robot
+// credentials are authorized by next.
+func NewAccessController(store *Store, next auth.AccessController) auth.AccessController {
+	return &accessController{store: store, next: next}
+}
+
+// credentials returns the name and secret of the robot account of the
+// request, if any.
+func credentials(req *http.Request) (name, secret string, ok bool) {
+	if username, password, ok := req.BasicAuth(); ok {
+		if !strings.HasPrefix(username, UserPrefix) {
+			return "", "", false
+		}
+		return strings.TrimPrefix(username, UserPrefix), password, true
+	}
+
+	parts := strings.Split(req.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || !strings.HasPrefix(parts[1], tokenPrefix) {
+		return "", "", false
+	}
+	token := strings.TrimPrefix(parts[1], tokenPrefix)
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	return token[:i], token[i+1:], true
+}
+
+// Authorized authenticates the robot account of the request and checks its
+// scopes, returning a basic challenge if the credentials are invalid and
+// errcode.ErrorCodeDenied if the access is out of its scopes. Requests
+// without robot credentials are passed to the next access controller.
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name, secret, ok := credentials(req)
+	if !ok {
+		return ac.next.Authorized(ctx, accessRecords...)
+	}
+
+	account, err := ac.store.Authenticate(ctx, name, secret)
+	if err == auth.ErrAuthenticationFailure {
+		context.GetLogger(ctx).Errorf("error authenticating robot account %q: invalid or expired credentials", name)
+		return nil, challenge{err: auth.ErrAuthenticationFailure}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating robot account %q: %v", name, err)
+	}
+
+	for _, access := range accessRecords {
+		if !account.Granted(access) {
+			context.GetLogger(ctx).Warnf("robot account %q denied %s access to %s %s", name, access.Action, access.Type, access.Name)
+			return nil, errcode.ErrorCodeDenied
+		}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: account.UserName()}), nil
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	err error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="robot"`)
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("robot account challenge: %s", ch.err)
+}
@@ -0,0 +1,452 @@
+// Package robot manages robot accounts: credentials minted by the registry
+// for automation, such as CI pipelines, with a name, repository scopes and an
+// optional expiry. Accounts are persisted through the storage driver, so that
+// all the instances of a registry sharing storage accept them.
+//
+// Robot accounts authenticate with basic auth, as user "robot$<name>", or
+// with a bearer token of the form "robot.<name>.<secret>".
+package robot
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+const (
+	// UserPrefix prefixes the names of robot accounts to form their user
+	// names.
+	UserPrefix = "robot$"
+
+	// tokenPrefix prefixes the bearer tokens of robot accounts.
+	tokenPrefix = "robot."
+
+	// cacheTTL is the interval at which accounts are read again from
+	// storage, to pick up the changes made by other instances.
+	cacheTTL = 30 * time.Second
+
+	// lastUsedInterval is the minimum interval between the updates of the
+	// last-used timestamp of an account in storage.
+	lastUsedInterval = time.Minute
+)
+
+// Errors returned by the store.
+var (
+	ErrAccountExists  = errors.New("robot account already exists")
+	ErrAccountUnknown = errors.New("robot account unknown")
+)
+
+// nameRegexp matches valid account names.
+var nameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+
+// Account is a robot account.
+type Account struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Scopes      []Scope    `json:"scopes"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	LastUsed    *time.Time `json:"lastUsed,omitempty"`
+}
+
+// Scope grants actions on the repositories matching a pattern, in which *
+// matches any sequence of characters, including slashes. The actions are
+// pull, push, delete and *, which grants all of them.
+type Scope struct {
+	Repository string   `json:"repository"`
+	Actions    []string `json:"actions"`
+}
+
+// UserName returns the user name of the account.
+func (a Account) UserName() string {
+	return UserPrefix + a.Name
+}
+
+// Token returns the bearer token of the account with the given secret.
+func (a Account) Token(secret string) string {
+	return tokenPrefix + a.Name + "." + secret
+}
+
+// Granted returns whether the scopes of the account grant access, as
+// auth.Permission.Granted does. Robot accounts cannot list the catalog.
+func (a Account) Granted(access auth.Access) bool {
+	if access.Type != "repository" {
+		return false
+	}
+	for _, s := range a.Scopes {
+		if s.permission().Granted(access) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the name and the scopes of the account.
+func (a Account) Validate() error {
+	if !nameRegexp.MatchString(a.Name) {
+		return fmt.Errorf("invalid robot account name %q", a.Name)
+	}
+	if len(a.Scopes) == 0 {
+		return errors.New("robot accounts require at least one scope")
+	}
+	for i, s := range a.Scopes {
+		if _, err := auth.NewPermission(s.Repository, s.Actions, scopeActions...); err != nil {
+			return fmt.Errorf("scopes[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// scopeActions are the actions scopes grant.
+var scopeActions = []string{"pull", "push", "delete", "*"}
+
+// permission returns the permission of the scope, which is validated.
+func (s Scope) permission() auth.Permission {
+	p, _ := auth.NewPermission(s.Repository, s.Actions, scopeActions...)
+	return p
+}
+
+// storedAccount is an account as persisted, with the hash of its secret.
+type storedAccount struct {
+	Account
+	SecretHash string `json:"secretHash"`
+
+	// persistedLastUsed is the last-used timestamp in storage.
+	persistedLastUsed time.Time
+}
+
+// Store persists robot accounts in a directory of a storage driver, one
+// JSON file per account. Accounts are cached, so that authenticating them
+// does not read storage on each request.
+type Store struct {
+	driver storagedriver.StorageDriver
+	root   string
+	now    func() time.Time
+
+	// changing serializes the writes of accounts: their creation,
+	// revocation and the recording of their use.
+	changing sync.Mutex
+
+	// mu protects the cache, which is never held while storage is accessed.
+	// The accounts map is replaced rather than modified, so that it is read
+	// without the lock, but the last-used timestamps of its accounts are
+	// protected by mu.
+	mu       sync.Mutex
+	accounts map[string]*storedAccount
+	loaded   time.Time
+	loading  *load
+	changes  int // of the cached accounts, to discard the reads they race
+}
+
+// load is a read of the accounts from storage, shared by the callers
+// needing them meanwhile.
+type load struct {
+	done     chan struct{}
+	accounts map[string]*storedAccount
+	err      error
+}
+
+// NewStore returns a store of the accounts in the root directory of driver.
+func NewStore(driver storagedriver.StorageDriver, root string) *Store {
+	return &Store{
+		driver: driver,
+		root:   root,
+		now:    time.Now,
+	}
+}
+
+func (s *Store) path(name string) string {
+	return path.Join(s.root, name+".json")
+}
+
+// Create creates an account and returns it with its secret, which is only
+// available at creation. The creation time is set by the store.
+func (s *Store) Create(ctx context.Context, account Account) (Account, string, error) {
+	if err := account.Validate(); err != nil {
+		return Account{}, "", err
+	}
+
+	s.changing.Lock()
+	defer s.changing.Unlock()
+
+	p := s.path(account.Name)
+	if _, err := s.driver.GetContent(ctx, p); err == nil {
+		return Account{}, "", ErrAccountExists
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		return Account{}, "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Account{}, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	account.Created = s.now().UTC()
+	account.LastUsed = nil
+	stored := &storedAccount{Account: account, SecretHash: hashSecret(secret)}
+	if err := s.put(ctx, stored); err != nil {
+		return Account{}, "", err
+	}
+	s.cache(account.Name, stored)
+	return account, secret, nil
+}
+
+// List returns the accounts, read from storage.
+func (s *Store) List(ctx context.Context) ([]Account, error) {
+	cached, err := s.cached(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accounts := make([]Account, 0, len(cached))
+	for _, stored := range cached {
+		accounts = append(accounts, stored.Account)
+	}
+	return accounts, nil
+}
+
+// Revoke deletes an account.
+func (s *Store) Revoke(ctx context.Context, name string) error {
+	if !nameRegexp.MatchString(name) {
+		return ErrAccountUnknown
+	}
+
+	s.changing.Lock()
+	defer s.changing.Unlock()
+
+	if err := s.driver.Delete(ctx, s.path(name)); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return ErrAccountUnknown
+		}
+		return err
+	}
+	s.cache(name, nil)
+	return nil
+}
+
+// Authenticate returns the account with the given name if secret is its
+// secret and it has not expired, recording its use. Otherwise,
+// auth.ErrAuthenticationFailure is returned.
+func (s *Store) Authenticate(ctx context.Context, name, secret string) (Account, error) {
+	accounts, err := s.cached(ctx, cacheTTL)
+	if err != nil {
+		return Account{}, err
+	}
+
+	now := s.now()
+	stored, ok := accounts[name]
+	if !ok {
+		// timing attack paranoia
+		subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(hashSecret("")))
+		return Account{}, auth.ErrAuthenticationFailure
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(stored.SecretHash)) != 1 {
+		return Account{}, auth.ErrAuthenticationFailure
+	}
+	if stored.Expires != nil && !now.Before(*stored.Expires) {
+		return Account{}, auth.ErrAuthenticationFailure
+	}
+
+	// The use is recorded by the first authentication past the interval,
+	// the others not waiting for it to be written.
+	used := now.UTC()
+	s.mu.Lock()
+	stored.LastUsed = &used
+	account := stored.Account
+	persisted := stored.persistedLastUsed
+	record := now.Sub(persisted) >= lastUsedInterval
+	if record {
+		stored.persistedLastUsed = now
+	}
+	s.mu.Unlock()
+
+	if record && !s.recordUse(ctx, name, stored, used, persisted) {
+		return Account{}, auth.ErrAuthenticationFailure
+	}
+	return account, nil
+}
+
+// recordUse writes the last-used timestamp of the account stored in
+// storage, returning false if the account was revoked meanwhile. If the
+// write fails, it is made again by the next authentication.
+func (s *Store) recordUse(ctx context.Context, name string, stored *storedAccount, used, persisted time.Time) bool {
+	s.changing.Lock()
+	defer s.changing.Unlock()
+
+	// The account is read again so that an account revoked by another
+	// instance is not written back.
+	current, err := s.get(ctx, name)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		s.mu.Lock()
+		if s.accounts[name] == stored {
+			s.replace(name, nil)
+		}
+		s.mu.Unlock()
+		return false
+	}
+	if err == nil {
+		current.LastUsed = &used
+		err = s.put(ctx, current)
+	}
+	if err != nil {
+		context.GetLogger(ctx).Errorf("error recording the use of robot account %q: %v", name, err)
+		s.mu.Lock()
+		stored.persistedLastUsed = persisted
+		s.mu.Unlock()
+	}
+	return true
+}
+
+// cached returns the cached accounts, reading them again from storage if
+// they were read more than maxAge ago. Concurrent callers share a single
+// read, made without holding the lock.
+func (s *Store) cached(ctx context.Context, maxAge time.Duration) (map[string]*storedAccount, error) {
+	s.mu.Lock()
+	if s.accounts != nil && s.now().Sub(s.loaded) < maxAge {
+		accounts := s.accounts
+		s.mu.Unlock()
+		return accounts, nil
+	}
+	if l := s.loading; l != nil {
+		s.mu.Unlock()
+		select {
+		case <-l.done:
+			return l.accounts, l.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	l := &load{done: make(chan struct{})}
+	s.loading = l
+	changes := s.changes
+	s.mu.Unlock()
+
+	accounts, err := s.read(ctx)
+
+	s.mu.Lock()
+	if err == nil && s.changes != changes && s.accounts != nil {
+		// The accounts read may miss a change made meanwhile, so the
+		// cached ones are kept and read again by the next caller.
+		accounts = s.accounts
+	} else if err == nil {
+		for name, stored := range accounts {
+			if previous, ok := s.accounts[name]; ok {
+				stored.persistedLastUsed = previous.persistedLastUsed
+				if previous.LastUsed != nil && (stored.LastUsed == nil || previous.LastUsed.After(*stored.LastUsed)) {
+					stored.LastUsed = previous.LastUsed
+				}
+			}
+		}
+		s.accounts = accounts
+		s.loaded = s.now()
+	}
+	s.loading = nil
+	s.mu.Unlock()
+
+	l.accounts, l.err = accounts, err
+	close(l.done)
+	return accounts, err
+}
+
+// cache replaces the cached account with the given name by stored, or
+// removes it if stored is nil.
+func (s *Store) cache(name string, stored *storedAccount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replace(name, stored)
+}
+
+// replace replaces the cached account with the given name by stored, or
+// removes it if stored is nil, unless the accounts were never read. The
+// lock must be held.
+func (s *Store) replace(name string, stored *storedAccount) {
+	if s.accounts == nil {
+		return
+	}
+	accounts := make(map[string]*storedAccount, len(s.accounts)+1)
+	for n, a := range s.accounts {
+		accounts[n] = a
+	}
+	if stored != nil {
+		accounts[name] = stored
+	} else {
+		delete(accounts, name)
+	}
+	s.accounts = accounts
+	s.changes++
+}
+
+// read reads all the accounts from storage.
+func (s *Store) read(ctx context.Context) (map[string]*storedAccount, error) {
+	paths, err := s.driver.List(ctx, s.root)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		paths, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make(map[string]*storedAccount, len(paths))
+	for _, p := range paths {
+		name := strings.TrimSuffix(path.Base(p), ".json")
+		if !strings.HasSuffix(p, ".json") || !nameRegexp.MatchString(name) {
+			continue
+		}
+		stored, err := s.get(ctx, name)
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			continue // revoked meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		accounts[name] = stored
+	}
+	return accounts, nil
+}
+
+func (s *Store) get(ctx context.Context, name string) (*storedAccount, error) {
+	p, err := s.driver.GetContent(ctx, s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	var stored storedAccount
+	if err := json.Unmarshal(p, &stored); err != nil {
+		return nil, fmt.Errorf("invalid robot account %s: %v", s.path(name), err)
+	}
+	if stored.LastUsed != nil {
+		stored.persistedLastUsed = *stored.LastUsed
+	}
+	return &stored, nil
+}
+
+func (s *Store) put(ctx context.Context, stored *storedAccount) error {
+	p, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return s.driver.PutContent(ctx, s.path(stored.Name), p)
+}
+
+// hashSecret returns the hash under which a secret is stored. Secrets are
+// random, so a fast hash is sufficient.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
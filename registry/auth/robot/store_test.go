@@ -0,0 +1,162 @@
+package robot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s1, s2 := NewStore(driver, "/robots"), NewStore(driver, "/robots")
+	s1.now, s2.now = clock, clock
+
+	expires := now.Add(time.Hour)
+	account, secret, err := s1.Create(ctx, Account{
+		Name:    "ci",
+		Scopes:  []Scope{{Repository: "builds/*", Actions: []string{"pull", "delete"}}},
+		Expires: &expires,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !account.Created.Equal(now) {
+		t.Fatalf("unexpected creation time: %v", account.Created)
+	}
+	if _, _, err := s2.Create(ctx, Account{Name: "ci", Scopes: account.Scopes}); err != ErrAccountExists {
+		t.Fatalf("expected ErrAccountExists, got %v", err)
+	}
+	if _, _, err := s1.Create(ctx, Account{Name: "CI"}); err == nil {
+		t.Fatal("expected an error creating an invalid account")
+	}
+
+	// Accounts created by other instances are accepted.
+	authenticated, err := s2.Authenticate(ctx, "ci", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authenticated.LastUsed == nil || !authenticated.LastUsed.Equal(now) {
+		t.Fatalf("unexpected last use: %v", authenticated.LastUsed)
+	}
+	if _, err := s2.Authenticate(ctx, "ci", "wrong"); err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected an authentication failure, got %v", err)
+	}
+
+	for access, granted := range map[auth.Access]bool{
+		{Resource: auth.Resource{Type: "repository", Name: "builds/app"}, Action: "pull"}: true,
+		{Resource: auth.Resource{Type: "repository", Name: "builds/app"}, Action: "*"}:    true,
+		{Resource: auth.Resource{Type: "repository", Name: "builds/app"}, Action: "push"}: false,
+		{Resource: auth.Resource{Type: "repository", Name: "other/app"}, Action: "pull"}:  false,
+		{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}:         false,
+	} {
+		if authenticated.Granted(access) != granted {
+			t.Errorf("expected %v to be granted: %v", access, granted)
+		}
+	}
+
+	// The use is persisted at most every lastUsedInterval.
+	now = now.Add(lastUsedInterval / 2)
+	if _, err := s2.Authenticate(ctx, "ci", secret); err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := s1.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || !accounts[0].LastUsed.Equal(now.Add(-lastUsedInterval/2)) {
+		t.Fatalf("unexpected accounts: %+v", accounts)
+	}
+
+	// Revocations by other instances apply once the cache expires.
+	if err := s1.Revoke(ctx, "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Revoke(ctx, "ci"); err != ErrAccountUnknown {
+		t.Fatalf("expected ErrAccountUnknown, got %v", err)
+	}
+	now = now.Add(cacheTTL)
+	if _, err := s2.Authenticate(ctx, "ci", secret); err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected a revoked account to fail authentication, got %v", err)
+	}
+
+	// Expired accounts are rejected.
+	account, secret, err = s1.Create(ctx, Account{
+		Name:    "ci",
+		Scopes:  account.Scopes,
+		Expires: &expires,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = expires
+	if _, err := s1.Authenticate(ctx, "ci", secret); err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected an expired account to fail authentication, got %v", err)
+	}
+}
+
+// blockingDriver blocks writes while blocked is set.
+type blockingDriver struct {
+	storagedriver.StorageDriver
+	blocked chan struct{}
+	writing chan struct{}
+}
+
+func (d *blockingDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if d.blocked != nil {
+		d.writing <- struct{}{}
+		<-d.blocked
+	}
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+// TestAuthenticateDuringWrite ensures accounts are authenticated while the
+// use of another one is written to storage.
+func TestAuthenticateDuringWrite(t *testing.T) {
+	ctx := context.Background()
+	driver := &blockingDriver{StorageDriver: inmemory.New()}
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewStore(driver, "/robots")
+	s.now = func() time.Time { return now }
+
+	scopes := []Scope{{Repository: "*", Actions: []string{"pull"}}}
+	_, secretA, err := s.Create(ctx, Account{Name: "a", Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secretB, err := s.Create(ctx, Account{Name: "b", Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(ctx, "b", secretB); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(lastUsedInterval / 2)
+	driver.blocked, driver.writing = make(chan struct{}), make(chan struct{})
+	defer close(driver.blocked)
+	go s.Authenticate(ctx, "a", secretA)
+	<-driver.writing
+
+	authenticated := make(chan error)
+	go func() {
+		_, err := s.Authenticate(ctx, "b", secretB)
+		authenticated <- err
+	}()
+	select {
+	case err := <-authenticated:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("authentication blocked by the write of another account")
+	}
+}
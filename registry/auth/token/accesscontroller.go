@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/registry/auth"
@@ -117,13 +118,28 @@ func (ac authChallenge) SetHeaders(w http.ResponseWriter) {
 	w.Header().Add("WWW-Authenticate", ac.challengeParams())
 }
 
+// defaultAccessClaim is the claim holding the access granted by the tokens
+// of a docker token server.
+const defaultAccessClaim = "access"
+
 // accessController implements the auth.AccessController interface.
 type accessController struct {
-	realm       string
-	issuer      string
-	service     string
-	rootCerts   *x509.CertPool
-	trustedKeys map[string]libtrust.PublicKey
+	realm         string
+	issuer        string
+	service       string
+	rootCerts     *x509.CertPool
+	trustedKeys   map[string]libtrust.PublicKey
+	keySet        *jwksKeySet
+	accessClaim   string
+	usernameClaim string
+	permissions   []permission
+}
+
+// permission grants actions on the repositories matching a pattern to the
+// tokens with one of the given values in their access claim.
+type permission struct {
+	auth.Permission
+	values map[string]bool
 }
 
 // tokenAccessOptions is a convenience type for handling
@@ -133,6 +149,12 @@ type tokenAccessOptions struct {
 	issuer         string
 	service        string
 	rootCertBundle string
+	jwks           string
+	oidcDiscovery  bool
+	jwksRefresh    time.Duration
+	accessClaim    string
+	usernameClaim  string
+	permissions    []permission
 }
 
 // checkOptions gathers the necessary options
@@ -140,7 +162,7 @@ type tokenAccessOptions struct {
 func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 	var opts tokenAccessOptions
 
-	keys := []string{"realm", "issuer", "service", "rootcertbundle"}
+	keys := []string{"realm", "issuer", "service"}
 	vals := make([]string, 0, len(keys))
 	for _, key := range keys {
 		val, ok := options[key].(string)
@@ -150,11 +172,110 @@ func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 		vals = append(vals, val)
 	}
 
-	opts.realm, opts.issuer, opts.service, opts.rootCertBundle = vals[0], vals[1], vals[2], vals[3]
+	opts.realm, opts.issuer, opts.service = vals[0], vals[1], vals[2]
+
+	optional := map[string]*string{
+		"rootcertbundle": &opts.rootCertBundle,
+		"jwks":           &opts.jwks,
+		"accessclaim":    &opts.accessClaim,
+		"usernameclaim":  &opts.usernameClaim,
+	}
+	for key, val := range optional {
+		if v, present := options[key]; present {
+			s, ok := v.(string)
+			if !ok {
+				return opts, fmt.Errorf("token auth requires a valid option string: %q", key)
+			}
+			*val = s
+		}
+	}
+
+	if v, present := options["oidcdiscovery"]; present {
+		b, ok := v.(bool)
+		if !ok {
+			return opts, fmt.Errorf("token auth requires a valid option bool: %q", "oidcdiscovery")
+		}
+		opts.oidcDiscovery = b
+	}
+
+	if v, present := options["jwksrefresh"]; present {
+		d, err := parseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("token auth requires a valid option duration: %q", "jwksrefresh")
+		}
+		opts.jwksRefresh = d
+	}
+
+	if opts.rootCertBundle == "" && opts.jwks == "" && !opts.oidcDiscovery {
+		return opts, errors.New(`token auth requires one of the "rootcertbundle", "jwks" or "oidcdiscovery" options`)
+	}
+	if opts.jwks != "" && opts.oidcDiscovery {
+		return opts, errors.New(`token auth options "jwks" and "oidcdiscovery" are mutually exclusive`)
+	}
+
+	if opts.accessClaim == "" {
+		opts.accessClaim = defaultAccessClaim
+	}
+	if v, present := options["permissions"]; present {
+		if opts.accessClaim == defaultAccessClaim {
+			return opts, fmt.Errorf(`token auth option "permissions" requires an "accessclaim" other than %q`, defaultAccessClaim)
+		}
+		permissions, err := parsePermissions(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.permissions = permissions
+	} else if opts.accessClaim != defaultAccessClaim {
+		return opts, errors.New(`token auth option "accessclaim" requires "permissions"`)
+	}
 
 	return opts, nil
 }
 
+// parsePermissions parses the list of permissions of the options.
+func parsePermissions(v interface{}) ([]permission, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New(`token auth option "permissions" must be a list`)
+	}
+
+	var permissions []permission
+	for i, item := range list {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("permissions[%d]: must be a map", i)
+		}
+
+		granted, err := auth.ParsePermission(m, "pull", "push", "delete", "*")
+		if err != nil {
+			return nil, fmt.Errorf("permissions[%d]: %v", i, err)
+		}
+		p := permission{Permission: granted, values: make(map[string]bool)}
+
+		values, err := auth.StringList(m["values"])
+		if err != nil || len(values) == 0 {
+			return nil, fmt.Errorf("permissions[%d]: values must be a list of claim values", i)
+		}
+		for _, value := range values {
+			p.values[value] = true
+		}
+
+		permissions = append(permissions, p)
+	}
+	return permissions, nil
+}
+
+// parseDuration parses a duration given as a string, such as "30s".
+func parseDuration(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case string:
+		return time.ParseDuration(v)
+	case time.Duration:
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid duration %v", v)
+}
+
 // newAccessController creates an accessController using the given options.
 func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
 	config, err := checkOptions(options)
@@ -162,15 +283,42 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		return nil, err
 	}
 
-	fp, err := os.Open(config.rootCertBundle)
+	ac := &accessController{
+		realm:         config.realm,
+		issuer:        config.issuer,
+		service:       config.service,
+		rootCerts:     x509.NewCertPool(),
+		trustedKeys:   make(map[string]libtrust.PublicKey),
+		accessClaim:   config.accessClaim,
+		usernameClaim: config.usernameClaim,
+		permissions:   config.permissions,
+	}
+
+	if config.jwks != "" || config.oidcDiscovery {
+		ac.keySet = newJWKSKeySet(config.jwks, config.issuer, config.jwksRefresh)
+	}
+
+	if config.rootCertBundle != "" {
+		if err := ac.loadRootCertBundle(config.rootCertBundle); err != nil {
+			return nil, err
+		}
+	}
+
+	return ac, nil
+}
+
+// loadRootCertBundle trusts the token signing root certificates of the
+// given bundle and their keys.
+func (ac *accessController) loadRootCertBundle(rootCertBundle string) error {
+	fp, err := os.Open(rootCertBundle)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
+		return fmt.Errorf("unable to open token auth root certificate bundle file %q: %s", rootCertBundle, err)
 	}
 	defer fp.Close()
 
 	rawCertBundle, err := ioutil.ReadAll(fp)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
+		return fmt.Errorf("unable to read token auth root certificate bundle file %q: %s", rootCertBundle, err)
 	}
 
 	var rootCerts []*x509.Certificate
@@ -179,7 +327,7 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		if pemBlock.Type == "CERTIFICATE" {
 			cert, err := x509.ParseCertificate(pemBlock.Bytes)
 			if err != nil {
-				return nil, fmt.Errorf("unable to parse token auth root certificate: %s", err)
+				return fmt.Errorf("unable to parse token auth root certificate: %s", err)
 			}
 
 			rootCerts = append(rootCerts, cert)
@@ -189,27 +337,19 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 	}
 
 	if len(rootCerts) == 0 {
-		return nil, errors.New("token auth requires at least one token signing root certificate")
+		return errors.New("token auth requires at least one token signing root certificate")
 	}
 
-	rootPool := x509.NewCertPool()
-	trustedKeys := make(map[string]libtrust.PublicKey, len(rootCerts))
 	for _, rootCert := range rootCerts {
-		rootPool.AddCert(rootCert)
+		ac.rootCerts.AddCert(rootCert)
 		pubKey, err := libtrust.FromCryptoPublicKey(crypto.PublicKey(rootCert.PublicKey))
 		if err != nil {
-			return nil, fmt.Errorf("unable to get public key from token auth root certificate: %s", err)
+			return fmt.Errorf("unable to get public key from token auth root certificate: %s", err)
 		}
-		trustedKeys[pubKey.KeyID()] = pubKey
+		ac.trustedKeys[pubKey.KeyID()] = pubKey
 	}
 
-	return &accessController{
-		realm:       config.realm,
-		issuer:      config.issuer,
-		service:     config.service,
-		rootCerts:   rootPool,
-		trustedKeys: trustedKeys,
-	}, nil
+	return nil
 }
 
 // Authorized handles checking whether the given request is authorized
@@ -247,21 +387,53 @@ func (ac *accessController) Authorized(ctx context.Context, accessItems ...auth.
 		Roots:             ac.rootCerts,
 		TrustedKeys:       ac.trustedKeys,
 	}
+	if ac.keySet != nil {
+		verifyOpts.KeyFunc = ac.keySet.key
+	}
 
 	if err = token.Verify(verifyOpts); err != nil {
 		challenge.err = err
 		return nil, challenge
 	}
 
-	accessSet := token.accessSet()
+	granted := token.accessSet().contains
+	if ac.accessClaim != defaultAccessClaim {
+		values := token.claim(ac.accessClaim)
+		granted = func(access auth.Access) bool {
+			return ac.granted(values, access)
+		}
+	}
 	for _, access := range accessItems {
-		if !accessSet.contains(access) {
+		if !granted(access) {
 			challenge.err = ErrInsufficientScope
 			return nil, challenge
 		}
 	}
 
-	return auth.WithUser(ctx, auth.UserInfo{Name: token.Claims.Subject}), nil
+	username := token.Claims.Subject
+	if ac.usernameClaim != "" {
+		if values := token.claim(ac.usernameClaim); len(values) == 1 {
+			username = values[0]
+		}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: username}), nil
+}
+
+// granted returns whether the permissions grant access to a token with the
+// given values in its access claim. The catalog is listed to tokens granted
+// all actions on all repositories.
+func (ac *accessController) granted(values []string, access auth.Access) bool {
+	for _, p := range ac.permissions {
+		member := false
+		for _, value := range values {
+			member = member || p.values[value]
+		}
+		if member && p.Granted(access) {
+			return true
+		}
+	}
+	return false
 }
 
 // init handles registering the token auth backend.
@@ -0,0 +1,199 @@
+package token
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libtrust"
+)
+
+const (
+	// defaultJWKSRefresh is the interval at which a JSON Web Key Set is
+	// fetched again, to pick up rotated keys.
+	defaultJWKSRefresh = time.Hour
+
+	// minJWKSRefresh is the minimum interval between attempts to fetch a
+	// key set, so that tokens signed by unknown keys, or an unavailable
+	// provider, do not cause a fetch for each request.
+	minJWKSRefresh = 10 * time.Second
+)
+
+// jwksKeySet resolves the signing keys of tokens from a JSON Web Key Set,
+// fetched from a URL or found through the OpenID Connect discovery document
+// of an issuer. Keys are indexed by their "kid" as published, rather than by
+// their libtrust fingerprint. The set is fetched without holding the lock,
+// one fetch at a time, so that verifications are served from the current
+// keys meanwhile.
+type jwksKeySet struct {
+	url     string // URL of the key set, if not discovered
+	issuer  string // issuer whose discovery document is used, if url is empty
+	refresh time.Duration
+	client  *http.Client
+	now     func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]libtrust.PublicKey
+	fetched time.Time // time of the last successful fetch
+	tried   time.Time // time of the last attempt
+
+	// fetching is closed once the fetch in flight completes, and nil when
+	// none is.
+	fetching chan struct{}
+}
+
+func newJWKSKeySet(url, issuer string, refresh time.Duration) *jwksKeySet {
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	return &jwksKeySet{
+		url:     url,
+		issuer:  issuer,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+	}
+}
+
+// key returns the key with the given ID. The key set is fetched again if it
+// is older than the refresh interval, or if the key is unknown, once the last
+// attempt is older than minJWKSRefresh. Known keys are returned while the set
+// is refreshed in the background; lookups of unknown keys wait for the fetch
+// in flight. If fetching fails, the previous keys are used. An empty ID
+// resolves to the only key of a set of one.
+func (ks *jwksKeySet) key(keyID string) (libtrust.PublicKey, error) {
+	ks.mu.Lock()
+	now := ks.now()
+	_, known := ks.lookup(keyID)
+	if (now.Sub(ks.fetched) >= ks.refresh || !known) && now.Sub(ks.tried) >= minJWKSRefresh {
+		ks.startFetch(now)
+	}
+	fetching := ks.fetching
+	ks.mu.Unlock()
+
+	if !known && fetching != nil {
+		<-fetching
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	key, ok := ks.lookup(keyID)
+	if !ok {
+		return nil, fmt.Errorf("token signed by unknown key with ID: %q", keyID)
+	}
+	return key, nil
+}
+
+// startFetch fetches the key set in the background, unless a fetch is in
+// flight. It must be called with the lock held.
+func (ks *jwksKeySet) startFetch(now time.Time) {
+	if ks.fetching != nil {
+		return
+	}
+	ks.tried = now
+	done := make(chan struct{})
+	ks.fetching = done
+
+	go func() {
+		defer close(done)
+		keys, err := ks.fetch()
+
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		if err != nil {
+			log.Errorf("error fetching JSON web key set: %v", err)
+		} else {
+			ks.keys = keys
+			ks.fetched = now
+		}
+		ks.fetching = nil
+	}()
+}
+
+func (ks *jwksKeySet) lookup(keyID string) (libtrust.PublicKey, bool) {
+	if keyID == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[keyID]
+	return key, ok
+}
+
+// fetch retrieves the keys of the set.
+func (ks *jwksKeySet) fetch() (map[string]libtrust.PublicKey, error) {
+	url := ks.url
+	if url == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := ks.get(strings.TrimRight(ks.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.Issuer != ks.issuer {
+			return nil, fmt.Errorf("discovery document issued for %q, expected %q", discovery.Issuer, ks.issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("discovery document has no jwks_uri")
+		}
+		url = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := ks.get(url, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]libtrust.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if use, ok := jwk["use"].(string); ok && use != "sig" {
+			continue
+		}
+		kid, _ := jwk["kid"].(string)
+
+		// libtrust requires the ID of a key to be its fingerprint.
+		delete(jwk, "kid")
+		p, err := json.Marshal(jwk)
+		if err != nil {
+			return nil, err
+		}
+		key, err := libtrust.UnmarshalPublicKeyJWK(p)
+		if err != nil {
+			// Keys of unsupported types are skipped.
+			log.Infof("skipping JSON web key %q: %v", kid, err)
+			continue
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+// get decodes the JSON document at url into v.
+func (ks *jwksKeySet) get(url string, v interface{}) error {
+	resp, err := ks.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(p, v); err != nil {
+		return fmt.Errorf("unable to decode %s: %v", url, err)
+	}
+	return nil
+}
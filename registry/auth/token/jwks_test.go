@@ -0,0 +1,352 @@
+package token
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/libtrust"
+)
+
+// testIdentityProvider serves an OpenID Connect discovery document and the
+// JSON web key set it references.
+type testIdentityProvider struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	keys map[string]libtrust.PrivateKey
+	down bool
+}
+
+func newTestIdentityProvider(keys map[string]libtrust.PrivateKey) *testIdentityProvider {
+	idp := &testIdentityProvider{keys: keys}
+	idp.Server = httptest.NewServer(http.HandlerFunc(idp.serveHTTP))
+	return idp
+}
+
+func (idp *testIdentityProvider) setKeys(keys map[string]libtrust.PrivateKey, down bool) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys, idp.down = keys, down
+}
+
+func (idp *testIdentityProvider) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	if idp.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   idp.URL,
+			"jwks_uri": idp.URL + "/keys",
+		})
+	case "/keys":
+		var keys []map[string]interface{}
+		for kid, key := range idp.keys {
+			// Identity providers choose key IDs other than libtrust
+			// fingerprints.
+			p, err := key.PublicKey().MarshalJSON()
+			if err != nil {
+				panic(err)
+			}
+			var jwk map[string]interface{}
+			if err := json.Unmarshal(p, &jwk); err != nil {
+				panic(err)
+			}
+			jwk["kid"], jwk["use"] = kid, "sig"
+			keys = append(keys, jwk)
+		}
+		// Keys for other uses are ignored.
+		keys = append(keys, map[string]interface{}{"kty": "RSA", "use": "enc", "kid": "encryption", "n": "AQAB", "e": "AQAB"})
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// makeJWT signs the given claims with key, identified by kid.
+func makeJWT(t *testing.T, key libtrust.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256", "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := fmt.Sprintf("%s.%s", joseBase64UrlEncode(header), joseBase64UrlEncode(payload))
+	sig, _, err := key.Sign(strings.NewReader(signed), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s.%s", signed, joseBase64UrlEncode(sig))
+}
+
+func TestClaimSetAudiences(t *testing.T) {
+	var claims ClaimSet
+	if err := json.Unmarshal([]byte(`{"sub":"foo","aud":["a","b"]}`), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "foo" || claims.Audience != "a" || len(claims.Audiences) != 2 || claims.Audiences[1] != "b" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	claims = ClaimSet{}
+	if err := json.Unmarshal([]byte(`{"aud":"a"}`), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "a" || len(claims.Audiences) != 1 {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	if err := json.Unmarshal([]byte(`{"aud":1}`), &claims); err == nil {
+		t.Fatal("expected an error for an invalid audience")
+	}
+}
+
+func TestJWKSAccessController(t *testing.T) {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := newTestIdentityProvider(map[string]libtrust.PrivateKey{"key-1": key})
+	defer idp.Close()
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":         "https://auth.example.com/token/",
+		"issuer":        idp.URL,
+		"service":       "registry.example.com",
+		"oidcdiscovery": true,
+		"accessclaim":   "realm_access.roles",
+		"usernameclaim": "preferred_username",
+		"permissions": []interface{}{
+			map[interface{}]interface{}{
+				"repository": "team/*",
+				"values":     []interface{}{"developers"},
+				"actions":    []interface{}{"pull"},
+			},
+			map[interface{}]interface{}{
+				"repository": "team/*",
+				"values":     []interface{}{"maintainers"},
+				"actions":    []interface{}{"delete"},
+			},
+			map[interface{}]interface{}{
+				"repository": "*",
+				"values":     []interface{}{"admins"},
+				"actions":    []interface{}{"*"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(roles ...string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":                idp.URL,
+			"sub":                "6c0f3d4e",
+			"preferred_username": "jdoe",
+			"aud":                []string{"account", "registry.example.com"},
+			"exp":                now.Add(time.Hour).Unix(),
+			"nbf":                now.Unix(),
+			"iat":                now.Unix(),
+			"realm_access":       map[string]interface{}{"roles": roles},
+		}
+	}
+
+	access := func(typ, name, action string) auth.Access {
+		return auth.Access{Resource: auth.Resource{Type: typ, Name: name}, Action: action}
+	}
+
+	for _, tc := range []struct {
+		token   string
+		access  auth.Access
+		wantErr error
+	}{
+		{makeJWT(t, key, "key-1", claims("developers")), access("repository", "team/app", "pull"), nil},
+		{makeJWT(t, key, "key-1", claims("developers")), access("repository", "team/app", "push"), ErrInsufficientScope},
+		{makeJWT(t, key, "key-1", claims("developers")), access("repository", "other/app", "pull"), ErrInsufficientScope},
+		{makeJWT(t, key, "key-1", claims("developers")), access("registry", "catalog", "*"), ErrInsufficientScope},
+		// Deletes request all actions, which the delete action grants.
+		{makeJWT(t, key, "key-1", claims("maintainers")), access("repository", "team/app", "*"), nil},
+		{makeJWT(t, key, "key-1", claims("maintainers")), access("repository", "team/app", "push"), ErrInsufficientScope},
+		{makeJWT(t, key, "key-1", claims("maintainers")), access("repository", "other/app", "*"), ErrInsufficientScope},
+		{makeJWT(t, key, "key-1", claims("admins")), access("registry", "catalog", "*"), nil},
+		{makeJWT(t, key, "key-1", claims("admins")), access("repository", "other/app", "push"), nil},
+		{makeJWT(t, untrusted, "key-1", claims("admins")), access("repository", "team/app", "pull"), ErrInvalidToken},
+		{makeJWT(t, untrusted, "key-2", claims("admins")), access("repository", "team/app", "pull"), ErrInvalidToken},
+	} {
+		req, err := http.NewRequest("GET", "http://example.com/v2/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+
+		ctx := context.WithValue(nil, "http.request", req)
+		authCtx, err := ac.Authorized(ctx, tc.access)
+		if tc.wantErr != nil {
+			challenge, ok := err.(auth.Challenge)
+			if !ok || challenge.Error() != tc.wantErr.Error() {
+				t.Errorf("%v: expected %v, got %v", tc.access, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.access, err)
+			continue
+		}
+		if userInfo, ok := authCtx.Value("auth.user").(auth.UserInfo); !ok || userInfo.Name != "jdoe" {
+			t.Errorf("%v: unexpected user info: %v", tc.access, authCtx.Value("auth.user"))
+		}
+	}
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	oldKey, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := newTestIdentityProvider(map[string]libtrust.PrivateKey{"old": oldKey})
+	defer idp.Close()
+
+	now := time.Now()
+	ks := newJWKSKeySet(idp.URL+"/keys", "", time.Hour)
+	ks.now = func() time.Time { return now }
+
+	expectKey := func(kid string, want libtrust.PrivateKey) {
+		key, err := ks.key(kid)
+		if want == nil {
+			if err == nil {
+				t.Fatalf("expected no key %q", kid)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.KeyID() != want.KeyID() {
+			t.Fatalf("unexpected key %q: %s", kid, key.KeyID())
+		}
+	}
+
+	expectKey("old", oldKey)
+	expectKey("", oldKey)
+
+	// Unknown keys are not fetched again within minJWKSRefresh.
+	idp.setKeys(map[string]libtrust.PrivateKey{"old": oldKey, "new": newKey}, false)
+	now = now.Add(minJWKSRefresh / 2)
+	expectKey("new", nil)
+	now = now.Add(minJWKSRefresh)
+	expectKey("new", newKey)
+	expectKey("", nil)
+
+	// The previous keys are kept while the provider is unavailable.
+	idp.setKeys(nil, true)
+	now = now.Add(2 * time.Hour)
+	expectKey("old", oldKey)
+
+	// Retired keys disappear with the periodic refresh, which is made in
+	// the background.
+	idp.setKeys(map[string]libtrust.PrivateKey{"new": newKey}, false)
+	now = now.Add(2 * time.Hour)
+	expectKey("old", oldKey)
+	waitForFetch(ks)
+	expectKey("old", nil)
+	expectKey("new", newKey)
+}
+
+// waitForFetch waits for the fetch in flight of ks, if any.
+func waitForFetch(ks *jwksKeySet) {
+	ks.mu.Lock()
+	fetching := ks.fetching
+	ks.mu.Unlock()
+	if fetching != nil {
+		<-fetching
+	}
+}
+
+// TestJWKSConcurrentFetch checks that verifications with known keys are not
+// blocked by a fetch, and that concurrent lookups share a single fetch.
+func TestJWKSConcurrentFetch(t *testing.T) {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		fetches int
+		gate    = make(chan struct{})
+	)
+	idp := newTestIdentityProvider(map[string]libtrust.PrivateKey{"key": key})
+	defer idp.Close()
+	serve := idp.Config.Handler
+	idp.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		n := fetches
+		mu.Unlock()
+		if n > 1 {
+			<-gate
+		}
+		serve.ServeHTTP(w, r)
+	})
+
+	now := time.Now()
+	ks := newJWKSKeySet(idp.URL+"/keys", "", time.Hour)
+	ks.now = func() time.Time { return now }
+	if _, err := ks.key("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The refresh blocks until the gate is opened.
+	now = now.Add(2 * time.Hour)
+	for i := 0; i < 10; i++ {
+		if _, err := ks.key("key"); err != nil {
+			t.Fatalf("unexpected error during refresh: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ks.key("unknown")
+		}()
+	}
+	close(gate)
+	wg.Wait()
+	waitForFetch(ks)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 2 {
+		t.Fatalf("expected a single refresh, got %d fetches", fetches-1)
+	}
+}
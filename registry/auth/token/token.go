@@ -51,6 +51,46 @@ type ClaimSet struct {
 
 	// Private claims
 	Access []*ResourceActions `json:"access"`
+
+	// Audiences lists all the audiences of a token issued for several of
+	// them, in which case Audience is the first one.
+	Audiences []string `json:"-"`
+}
+
+// UnmarshalJSON decodes a claim set, accepting the list of audiences which
+// OpenID Connect providers may issue in place of a single one.
+func (c *ClaimSet) UnmarshalJSON(p []byte) error {
+	type claimSet ClaimSet
+	aux := struct {
+		*claimSet
+		Audience interface{} `json:"aud"`
+	}{
+		claimSet: (*claimSet)(c),
+	}
+	if err := json.Unmarshal(p, &aux); err != nil {
+		return err
+	}
+
+	switch aud := aux.Audience.(type) {
+	case nil:
+	case string:
+		c.Audience = aud
+		c.Audiences = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			s, ok := a.(string)
+			if !ok {
+				return errors.New("invalid audience claim")
+			}
+			c.Audiences = append(c.Audiences, s)
+		}
+		if len(c.Audiences) > 0 {
+			c.Audience = c.Audiences[0]
+		}
+	default:
+		return errors.New("invalid audience claim")
+	}
+	return nil
 }
 
 // Header describes the header section of a JSON Web Token.
@@ -68,6 +108,10 @@ type Token struct {
 	Header    *Header
 	Claims    *ClaimSet
 	Signature []byte
+
+	// claims holds all the claims of the token, including those which are
+	// not part of the ClaimSet.
+	claims map[string]interface{}
 }
 
 // VerifyOptions is used to specify
@@ -77,6 +121,12 @@ type VerifyOptions struct {
 	AcceptedAudiences []string
 	Roots             *x509.CertPool
 	TrustedKeys       map[string]libtrust.PublicKey
+
+	// KeyFunc, if set, resolves the signing keys which are identified by a
+	// `kid` header but are not in TrustedKeys, such as the keys published
+	// by an identity provider. It is called with an empty ID for tokens
+	// without any of the supported headers.
+	KeyFunc func(keyID string) (libtrust.PublicKey, error)
 }
 
 // NewToken parses the given raw token string
@@ -127,6 +177,10 @@ func NewToken(rawToken string) (*Token, error) {
 		return nil, ErrMalformedToken
 	}
 
+	if err = json.Unmarshal(claimsJSON, &token.claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+
 	return token, nil
 }
 
@@ -139,9 +193,17 @@ func (t *Token) Verify(verifyOpts VerifyOptions) error {
 		return ErrInvalidToken
 	}
 
-	// Verify that the Audience claim is allowed.
-	if !contains(verifyOpts.AcceptedAudiences, t.Claims.Audience) {
-		log.Infof("token intended for another audience: %q", t.Claims.Audience)
+	// Verify that one of the audiences is allowed.
+	audiences := t.Claims.Audiences
+	if len(audiences) == 0 {
+		audiences = []string{t.Claims.Audience}
+	}
+	accepted := false
+	for _, audience := range audiences {
+		accepted = accepted || contains(verifyOpts.AcceptedAudiences, audience)
+	}
+	if !accepted {
+		log.Infof("token intended for another audience: %q", audiences)
 		return ErrInvalidToken
 	}
 
@@ -190,7 +252,8 @@ func (t *Token) Verify(verifyOpts VerifyOptions) error {
 //              May contain its own `x5c` field which needs to be verified.
 //      `kid` - The unique identifier for the key. This library interprets it
 //              as a libtrust fingerprint. The key itself can be looked up in
-//              the trustedKeys field of the given verify options.
+//              the trustedKeys field of the given verify options, or else
+//              resolved by its KeyFunc.
 // Each of these methods are tried in that order of preference until the
 // signing key is found or an error is returned.
 func (t *Token) VerifySigningKey(verifyOpts VerifyOptions) (signingKey libtrust.PublicKey, err error) {
@@ -208,9 +271,13 @@ func (t *Token) VerifySigningKey(verifyOpts VerifyOptions) (signingKey libtrust.
 		signingKey, err = parseAndVerifyRawJWK(rawJWK, verifyOpts)
 	case len(keyID) > 0:
 		signingKey = verifyOpts.TrustedKeys[keyID]
-		if signingKey == nil {
+		if signingKey == nil && verifyOpts.KeyFunc != nil {
+			signingKey, err = verifyOpts.KeyFunc(keyID)
+		} else if signingKey == nil {
 			err = fmt.Errorf("token signed by untrusted key with ID: %q", keyID)
 		}
+	case verifyOpts.KeyFunc != nil:
+		signingKey, err = verifyOpts.KeyFunc("")
 	default:
 		err = errors.New("unable to get token signing key")
 	}
@@ -349,6 +416,34 @@ func (t *Token) accessSet() accessSet {
 	return accessSet
 }
 
+// claim returns the values of the claim at the given path, in which dots
+// separate the names of nested claims, such as "realm_access.roles". A
+// string claim has a single value.
+func (t *Token) claim(path string) []string {
+	var v interface{} = t.claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
 func (t *Token) compactRaw() string {
 	return fmt.Sprintf("%s.%s", t.Raw, joseBase64UrlEncode(t.Signature))
 }
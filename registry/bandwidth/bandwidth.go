@@ -0,0 +1,205 @@
+// Package bandwidth paces data transfers so that they stay within a global
+// bandwidth ceiling as well as per-client and per-user rates.
+//
+// Each limit is shared evenly between the transfers it applies to: a transfer
+// runs at the smallest of its shares, recomputed as transfers start and
+// finish.
+package bandwidth
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// chunkSize bounds the bytes read or written between two pauses, so that
+// transfers are paced smoothly.
+const chunkSize = 32 << 10
+
+// Limits are rates in bytes per second. A zero rate is unlimited.
+type Limits struct {
+	Global int64
+	Client int64
+	User   int64
+}
+
+// Enabled reports whether any limit is set.
+func (l Limits) Enabled() bool {
+	return l.Global > 0 || l.Client > 0 || l.User > 0
+}
+
+// Shaper tracks the active transfers sharing a set of limits.
+type Shaper struct {
+	limits Limits
+
+	mu      sync.Mutex
+	active  int
+	clients map[string]int
+	users   map[string]int
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewShaper returns a shaper enforcing limits.
+func NewShaper(limits Limits) *Shaper {
+	return &Shaper{
+		limits:  limits,
+		clients: make(map[string]int),
+		users:   make(map[string]int),
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}
+}
+
+// Start registers a transfer of client on behalf of user, which may be empty
+// for anonymous transfers. Done must be called on the transfer once
+// complete.
+func (s *Shaper) Start(client, user string) *Transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active++
+	s.clients[client]++
+	if user != "" {
+		s.users[user]++
+	}
+
+	return &Transfer{
+		shaper: s,
+		client: client,
+		user:   user,
+	}
+}
+
+// Transfer paces the data of a single transfer.
+type Transfer struct {
+	shaper *Shaper
+	client string
+	user   string
+
+	mu   sync.Mutex
+	next time.Time // time at which the bytes sent so far are due
+	done bool
+}
+
+// Rate returns the rate of the transfer in bytes per second, or zero if it
+// is unlimited.
+func (t *Transfer) Rate() float64 {
+	s := t.shaper
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rate float64
+	share := func(limit int64, active int) {
+		if limit <= 0 || active <= 0 {
+			return
+		}
+		r := float64(limit) / float64(active)
+		if rate == 0 || r < rate {
+			rate = r
+		}
+	}
+	share(s.limits.Global, s.active)
+	share(s.limits.Client, s.clients[t.client])
+	if t.user != "" {
+		share(s.limits.User, s.users[t.user])
+	}
+	return rate
+}
+
+// wait blocks until n more bytes may be transferred at the current rate.
+func (t *Transfer) wait(n int) {
+	rate := t.Rate()
+	if rate == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	now := t.shaper.now()
+	if t.next.Before(now) {
+		// Idle time is not saved up for later bursts.
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+	delay := t.next.Sub(now)
+	t.mu.Unlock()
+
+	if delay > 0 {
+		t.shaper.sleep(delay)
+	}
+}
+
+// Done unregisters the transfer, increasing the share of the remaining
+// transfers. It may be called more than once.
+func (t *Transfer) Done() {
+	s := t.shaper
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.done {
+		return
+	}
+	t.done = true
+
+	s.active--
+	if s.clients[t.client]--; s.clients[t.client] <= 0 {
+		delete(s.clients, t.client)
+	}
+	if t.user != "" {
+		if s.users[t.user]--; s.users[t.user] <= 0 {
+			delete(s.users, t.user)
+		}
+	}
+}
+
+// Reader returns a reader pacing reads from r.
+func (t *Transfer) Reader(r io.Reader) io.Reader {
+	return &reader{Reader: r, transfer: t}
+}
+
+// Writer returns a writer pacing writes to w.
+func (t *Transfer) Writer(w io.Writer) io.Writer {
+	return &writer{Writer: w, transfer: t}
+}
+
+type reader struct {
+	io.Reader
+	transfer *Transfer
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.transfer.wait(n)
+	}
+	return n, err
+}
+
+type writer struct {
+	io.Writer
+	transfer *Transfer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		n, err := w.Writer.Write(chunk)
+		written += n
+		if n > 0 {
+			w.transfer.wait(n)
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
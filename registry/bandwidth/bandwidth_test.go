@@ -0,0 +1,102 @@
+package bandwidth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// newTestShaper returns a shaper with a fake clock, advanced by sleeping.
+func newTestShaper(limits Limits) (*Shaper, *time.Time) {
+	s := NewShaper(limits)
+	now := time.Unix(0, 0)
+	s.now = func() time.Time { return now }
+	s.sleep = func(d time.Duration) { now = now.Add(d) }
+	return s, &now
+}
+
+func TestPacing(t *testing.T) {
+	s, now := newTestShaper(Limits{Global: 1000})
+	start := *now
+
+	transfer := s.Start("10.0.0.1", "")
+	defer transfer.Done()
+
+	var buf bytes.Buffer
+	if _, err := transfer.Writer(&buf).Write(make([]byte, 4000)); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if elapsed := now.Sub(start); elapsed != 4*time.Second {
+		t.Fatalf("unexpected time to write 4000 bytes at 1000B/s: %v", elapsed)
+	}
+
+	p, err := ioutil.ReadAll(transfer.Reader(&buf))
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if len(p) != 4000 {
+		t.Fatalf("unexpected number of bytes read: %d", len(p))
+	}
+	if elapsed := now.Sub(start); elapsed != 8*time.Second {
+		t.Fatalf("unexpected time to read 4000 bytes at 1000B/s: %v", elapsed)
+	}
+}
+
+func TestFairSharing(t *testing.T) {
+	s, _ := newTestShaper(Limits{Global: 900, Client: 600, User: 300})
+
+	t1 := s.Start("client1", "user1")
+	t2 := s.Start("client1", "user2")
+	t3 := s.Start("client2", "user1")
+	anonymous := s.Start("client3", "")
+
+	for _, tc := range []struct {
+		transfer *Transfer
+		rate     float64
+	}{
+		{t1, 150},        // user1 is shared with t3
+		{t2, 225},        // the global limit is shared by four transfers
+		{t3, 150},        // user1 is shared with t1
+		{anonymous, 225}, // no user limit applies
+	} {
+		if rate := tc.transfer.Rate(); rate != tc.rate {
+			t.Errorf("unexpected rate for %s/%s: %v != %v", tc.transfer.client, tc.transfer.user, rate, tc.rate)
+		}
+	}
+
+	t1.Done()
+	t1.Done()
+	anonymous.Done()
+
+	if rate := t2.Rate(); rate != 300 {
+		t.Errorf("unexpected rate after transfers completed: %v", rate)
+	}
+	if rate := t3.Rate(); rate != 300 {
+		t.Errorf("unexpected rate after transfers completed: %v", rate)
+	}
+
+	t2.Done()
+	t3.Done()
+	if s.active != 0 || len(s.clients) != 0 || len(s.users) != 0 {
+		t.Fatalf("transfers not released: %d active, clients %v, users %v", s.active, s.clients, s.users)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	s, now := newTestShaper(Limits{User: 1000})
+	start := *now
+
+	transfer := s.Start("10.0.0.1", "")
+	defer transfer.Done()
+
+	if rate := transfer.Rate(); rate != 0 {
+		t.Fatalf("unexpected rate for anonymous transfer: %v", rate)
+	}
+	if _, err := transfer.Writer(ioutil.Discard).Write(make([]byte, 1<<20)); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if !now.Equal(start) {
+		t.Fatalf("unlimited transfer was paced")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/docker/distribution/registry/client/transport"
 	"github.com/docker/distribution/registry/storage/cache"
 	"github.com/docker/distribution/registry/storage/cache/memory"
+	"github.com/docker/distribution/tracing"
 )
 
 // Registry provides an interface for calling Repositories, which returns a catalog of repositories.
@@ -61,7 +62,8 @@ func checkHTTPRedirect(req *http.Request, via []*http.Request) error {
 	return nil
 }
 
-// NewRegistry creates a registry namespace which can be used to get a listing of repositories
+// NewRegistry creates a registry namespace which can be used to get a listing of repositories.
+// Requests are traced as children of the span in ctx, if any.
 func NewRegistry(ctx context.Context, baseURL string, transport http.RoundTripper) (Registry, error) {
 	ub, err := v2.NewURLBuilderFromString(baseURL, false)
 	if err != nil {
@@ -69,7 +71,7 @@ func NewRegistry(ctx context.Context, baseURL string, transport http.RoundTrippe
 	}
 
 	client := &http.Client{
-		Transport:     transport,
+		Transport:     tracing.NewTransport(ctx, transport),
 		Timeout:       1 * time.Minute,
 		CheckRedirect: checkHTTPRedirect,
 	}
@@ -133,6 +135,7 @@ func (r *registry) Repositories(ctx context.Context, entries []string, last stri
 }
 
 // NewRepository creates a new Repository for the given repository name and base URL.
+// Requests are traced as children of the span in ctx, if any.
 func NewRepository(ctx context.Context, name reference.Named, baseURL string, transport http.RoundTripper) (distribution.Repository, error) {
 	ub, err := v2.NewURLBuilderFromString(baseURL, false)
 	if err != nil {
@@ -140,7 +143,7 @@ func NewRepository(ctx context.Context, name reference.Named, baseURL string, tr
 	}
 
 	client := &http.Client{
-		Transport:     transport,
+		Transport:     tracing.NewTransport(ctx, transport),
 		CheckRedirect: checkHTTPRedirect,
 		// TODO(dmcgowan): create cookie jar
 	}
@@ -0,0 +1,130 @@
+package registry
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/handlers"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	RootCmd.AddCommand(ConfigCmd)
+	ConfigCmd.AddCommand(ValidateConfigCmd)
+}
+
+// ConfigCmd is the cobra command that corresponds to the config subcommand
+var ConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "`config` inspects the configuration",
+	Long:  "`config` inspects the configuration",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+	},
+}
+
+// ValidateConfigCmd is the cobra command that corresponds to the config
+// validate subcommand
+var ValidateConfigCmd = &cobra.Command{
+	Use:   "validate <config>",
+	Short: "`validate` checks the configuration and prints it",
+	Long:  "`validate` parses the configuration file and the environment overrides, runs the option validation of the storage driver, access controller and middlewares, and prints the effective configuration with secrets redacted",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := readConfiguration(args, configuration.ParseUnresolved)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		// The configuration is printed before the references to secrets
+		// are resolved, so that their values are never shown.
+		p, err := redactedConfiguration(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to print configuration: %v\n", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(p)
+
+		if err := configuration.ResolveSecrets(config); err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if errs := handlers.ValidateConfiguration(context.Background(), config); len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			}
+			os.Exit(1)
+		}
+	},
+}
+
+// sensitiveKeys are the substrings of the keys whose values are redacted.
+var sensitiveKeys = []string{
+	"secret",
+	"password",
+	"passwd",
+	"accesskey",
+	"accountkey",
+	"apikey",
+	"licensekey",
+	"authorization",
+	"token",
+}
+
+const redacted = "<redacted>"
+
+// redactedConfiguration returns config as YAML, replacing the values of the
+// keys which may hold credentials.
+func redactedConfiguration(config *configuration.Configuration) ([]byte, error) {
+	p, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(p, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(redact("", doc))
+}
+
+// redact returns v with the scalars below sensitive keys replaced. Maps and
+// sequences are descended into, so that a key such as auth.token only
+// redacts its own sensitive values.
+func redact(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i := range v {
+			v[i].Value = redact(fmt.Sprint(v[i].Key), v[i].Value)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(key, v[i])
+		}
+		return v
+	case nil:
+		return v
+	}
+
+	if v == "" || !isSensitive(key) {
+		return v
+	}
+	return redacted
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
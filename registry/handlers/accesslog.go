@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/registry/accesslog"
+	"github.com/gorilla/mux"
+)
+
+// annotateAccessLog attaches the application fields of the request to its
+// access log line. It is called once the request has been dispatched, so that
+// values only known to the handlers, such as the UUID of a new upload, are
+// available from the response headers.
+func annotateAccessLog(context *Context, w http.ResponseWriter, r *http.Request) {
+	accesslog.Set(context, accesslog.FieldRequestID, ctxu.GetRequestID(context))
+	accesslog.Set(context, accesslog.FieldUser, getUserName(context, r))
+	accesslog.Set(context, accesslog.FieldRepository, getName(context))
+
+	if route := mux.CurrentRoute(r); route != nil {
+		accesslog.Set(context, accesslog.FieldRoute, route.GetName())
+	}
+
+	dgst := ctxu.GetStringValue(context, "vars.digest")
+	if reference := getReference(context); reference != "" {
+		if _, err := digest.ParseDigest(reference); err == nil {
+			dgst = reference
+		} else {
+			accesslog.Set(context, accesslog.FieldTag, reference)
+		}
+	}
+	if dgst == "" {
+		dgst = w.Header().Get("Docker-Content-Digest")
+	}
+	accesslog.Set(context, accesslog.FieldDigest, dgst)
+
+	uploadID := getUploadUUID(context)
+	if uploadID == "" {
+		uploadID = w.Header().Get("Docker-Upload-UUID")
+	}
+	accesslog.Set(context, accesslog.FieldUploadID, uploadID)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/accesslog"
+	"github.com/docker/distribution/registry/api/v2"
+)
+
+// TestAccessLogFields ensures the application fields of a request are
+// attached to its access log line.
+func TestAccessLogFields(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	app := NewApp(context.Background(), &config)
+
+	var buf bytes.Buffer
+	handler, err := accesslog.Handler(&buf, accesslog.FormatJSON, nil, app)
+	if err != nil {
+		t.Fatalf("unexpected error creating access log handler: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, err := http.NewRequest("POST", server.URL+"/v2/foo/bar/blobs/uploads/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	req.SetBasicAuth("alice", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status starting upload: %v", resp.Status)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("unexpected error decoding log line %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		accesslog.FieldUser:       "alice",
+		accesslog.FieldRepository: "foo/bar",
+		accesslog.FieldRoute:      v2.RouteNameBlobUpload,
+		accesslog.FieldUploadID:   resp.Header.Get("Docker-Upload-UUID"),
+		accesslog.FieldStatus:     float64(http.StatusAccepted),
+	}
+	for field, value := range expected {
+		if line[field] != value {
+			t.Errorf("unexpected value for %q: %v != %v", field, line[field], value)
+		}
+	}
+	if line[accesslog.FieldRequestID] == nil {
+		t.Errorf("request id missing from log line %q", buf.String())
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"net/http"
+
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// admin returns a handler serving requests of the users granted access by
+// the access controller with handle. If admins returns users, access is
+// further restricted to them; otherwise it is only granted by the access
+// controllers granting admin resources explicitly. What describes the
+// administered feature in logs. The endpoint is unavailable while no access
+// controller is configured, since a reload may remove it.
+func (app *App) admin(access auth.Access, what string, admins func() []string, handle func(ctx *Context, w http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := app.context(w, r)
+
+		app.mu.RLock()
+		accessController, explicit := app.accessController, app.explicitAdmins
+		app.mu.RUnlock()
+		if accessController == nil {
+			ctxu.GetLogger(ctx).Warnf("no access controller authenticates %s", what)
+			serveJSONError(ctx, w, errcode.ErrorCodeUnavailable)
+			return
+		}
+
+		authCtx, err := accessController.Authorized(ctx.Context, access)
+		user := getUserName(ctx, r)
+		if err == nil {
+			user = ctxu.GetStringValue(authCtx, auth.UserNameKey)
+			if !isAdmin(admins(), explicit, user) {
+				err = errcode.ErrorCodeDenied
+			}
+		}
+		if app.audit != nil {
+			request := notifications.NewRequestRecord(ctxu.GetRequestID(ctx), r)
+			if err := app.audit.Access(user, request, []auth.Access{access}, err); err != nil {
+				ctxu.GetLogger(ctx).Errorf("error writing audit record: %v", err)
+			}
+		}
+
+		switch err := err.(type) {
+		case nil:
+			ctx.Context = authCtx
+			handle(ctx, w, r)
+		case auth.Challenge:
+			err.SetHeaders(w)
+			serveJSONError(ctx, w, errcode.ErrorCodeUnauthorized.WithDetail([]auth.Access{access}))
+		case errcode.ErrorCode:
+			ctxu.GetLogger(ctx).Warnf("user %q denied %s", user, what)
+			serveJSONError(ctx, w, err)
+		default:
+			ctxu.GetLogger(ctx).Errorf("error checking authorization: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
+
+// isAdmin returns whether user is one of admins. If admins is empty, the
+// users granted access are administrators only if the access controller
+// grants admin resources explicitly.
+func isAdmin(admins []string, explicit bool, user string) bool {
+	if len(admins) == 0 {
+		return explicit
+	}
+	for _, admin := range admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// grantsAdminExplicitly returns whether the access controllers of authType
+// only grant the admin resources explicitly: by acl rules, or by the access
+// claims of tokens. The others grant them to any authenticated user.
+func grantsAdminExplicitly(authType string) bool {
+	switch authType {
+	case "acl", "token":
+		return true
+	}
+	return false
+}
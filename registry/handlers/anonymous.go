@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// anonymousUser is the user name of the requests allowed anonymously, as
+// recorded in events and logs.
+const anonymousUser = "anonymous"
+
+// anonymousRules compiles the anonymous access rules of config, which allow
+// actions on the repositories matching a pattern to clients without
+// credentials.
+func anonymousRules(config *configuration.Configuration) ([]auth.Permission, error) {
+	var rules []auth.Permission
+	for i, r := range config.Anonymous.Rules {
+		rule, err := auth.NewPermission(r.Repository, r.Actions, "pull", "push", "delete", "*")
+		if err != nil {
+			return nil, fmt.Errorf("anonymous.rules[%d]: %v", i, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// allowedAnonymously returns whether the request, which the access
+// controller challenged, has no credentials and all of accessRecords are
+// allowed anonymously. Requests are checked by the access controller first,
+// so that users identified without an Authorization header, such as by
+// client certificates, are not served as anonymous; requests with invalid
+// credentials are not served either.
+func (app *App) allowedAnonymously(r *http.Request, accessRecords []auth.Access) bool {
+	if len(accessRecords) == 0 || r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	app.mu.RLock()
+	rules := app.anonymous
+	app.mu.RUnlock()
+
+	for _, access := range accessRecords {
+		if !anonymousAllows(rules, access) {
+			return false
+		}
+	}
+	return true
+}
+
+// anonymousAllows returns whether one of rules allows access. The catalog
+// is never listed anonymously.
+func anonymousAllows(rules []auth.Permission, access auth.Access) bool {
+	if access.Type != "repository" {
+		return false
+	}
+	for _, rule := range rules {
+		if rule.Granted(access) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/audit"
+	"github.com/docker/distribution/registry/auth"
+)
+
+func init() {
+	auth.Register("identity-test", auth.InitFunc(func(map[string]interface{}) (auth.AccessController, error) {
+		return identityAccessController{}, nil
+	}))
+}
+
+// identityAccessController identifies users by the X-Identity header rather
+// than the Authorization header, as the clientcert access controller does
+// with client certificates.
+type identityAccessController struct{}
+
+func (identityAccessController) Authorized(ctx context.Context, access ...auth.Access) (context.Context, error) {
+	req, err := context.GetRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user := req.Header.Get("X-Identity")
+	if user == "" {
+		return nil, identityChallenge{}
+	}
+	return auth.WithUser(ctx, auth.UserInfo{Name: user}), nil
+}
+
+type identityChallenge struct{}
+
+func (identityChallenge) Error() string                    { return "no identity" }
+func (identityChallenge) SetHeaders(w http.ResponseWriter) {}
+
+// TestAnonymousAccess ensures requests without credentials are served if
+// allowed by the anonymous rules, and challenged otherwise.
+func TestAnonymousAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonymous")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+		Anonymous: configuration.Anonymous{
+			Rules: []configuration.AnonymousRule{
+				{Repository: "library/*", Actions: []string{"pull"}},
+			},
+		},
+	}
+	config.Audit.File.Path = path
+
+	app := NewApp(context.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		// The repository is unknown, but access is allowed.
+		{"GET", "/v2/library/ubuntu/tags/list", http.StatusNotFound},
+		{"POST", "/v2/library/ubuntu/blobs/uploads/", http.StatusUnauthorized},
+		{"GET", "/v2/foo/bar/tags/list", http.StatusUnauthorized},
+		{"GET", "/v2/_catalog", http.StatusUnauthorized},
+		{"GET", "/v2/", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(tc.method, server.URL+tc.path, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s: expected status %d, got %v", tc.method, tc.path, tc.status, resp.Status)
+		}
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening audit log: %v", err)
+	}
+	var records []audit.Record
+	err = audit.Query(fp, audit.Filter{Repository: "library/ubuntu"}, func(r audit.Record) error {
+		records = append(records, r)
+		return nil
+	})
+	fp.Close()
+	if err != nil {
+		t.Fatalf("unexpected error querying audit log: %v", err)
+	}
+	if len(records) == 0 || records[0].User != anonymousUser || records[0].Decision != audit.DecisionGranted {
+		t.Fatalf("expected anonymous access to be recorded, got %+v", records)
+	}
+
+	// The rules are replaced on reload.
+	reloaded := config
+	reloaded.Anonymous = configuration.Anonymous{}
+	if err := app.Reload(&reloaded); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	resp, err := http.Get(server.URL + "/v2/library/ubuntu/tags/list")
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status after removing anonymous rules: %v", resp.Status)
+	}
+}
+
+// TestAnonymousAccessIdentified ensures users identified without an
+// Authorization header are not served as anonymous.
+func TestAnonymousAccessIdentified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonymous")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{"identity-test": {}},
+		Anonymous: configuration.Anonymous{
+			Rules: []configuration.AnonymousRule{
+				{Repository: "library/*", Actions: []string{"pull"}},
+			},
+		},
+	}
+	config.Audit.File.Path = path
+
+	app := NewApp(context.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	for _, identity := range []string{"alice", ""} {
+		req, err := http.NewRequest("GET", server.URL+"/v2/library/ubuntu/tags/list", nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.Header.Set("X-Identity", identity)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("unexpected status pulling as %q: %v", identity, resp.Status)
+		}
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening audit log: %v", err)
+	}
+	var users []string
+	err = audit.Query(fp, audit.Filter{Repository: "library/ubuntu"}, func(r audit.Record) error {
+		users = append(users, r.User)
+		return nil
+	})
+	fp.Close()
+	if err != nil {
+		t.Fatalf("unexpected error querying audit log: %v", err)
+	}
+	if len(users) != 2 || users[0] != "alice" || users[1] != anonymousUser {
+		t.Fatalf("expected the identified user and then anonymous to be recorded, got %v", users)
+	}
+}
@@ -11,7 +11,8 @@ import (
 	"os"
 	"regexp"
 	"runtime"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -24,7 +25,10 @@ import (
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/api/errcode"
 	"github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/audit"
 	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/auth/robot"
+	"github.com/docker/distribution/registry/bandwidth"
 	registrymiddleware "github.com/docker/distribution/registry/middleware/registry"
 	repositorymiddleware "github.com/docker/distribution/registry/middleware/repository"
 	"github.com/docker/distribution/registry/proxy"
@@ -59,7 +63,7 @@ type App struct {
 	router           *mux.Router                 // main application router, configured with dispatchers
 	driver           storagedriver.StorageDriver // driver maintains the app global storage driver instance.
 	registry         distribution.Namespace      // registry is the primary registry backend for the app instance.
-	accessController auth.AccessController       // main access controller for application
+	accessController auth.AccessController       // main access controller for application, protected by mu
 
 	// httpHost is a parsed representation of the http.host parameter from
 	// the configuration. Only the Scheme and Host fields are used.
@@ -67,12 +71,28 @@ type App struct {
 
 	// events contains notification related configuration.
 	events struct {
-		sink   notifications.Sink
+		sink   *swappableSink
 		source notifications.SourceRecord
 	}
 
 	redis *redis.Pool
 
+	// audit records authorization decisions and repository operations, if
+	// configured.
+	audit *audit.Log
+
+	// robots stores the robot accounts, if enabled.
+	robots *robot.Store
+
+	// rateLimiter rejects requests exceeding the configured rate limits, if
+	// any.
+	rateLimiter *rateLimiter
+
+	// downloads and uploads pace blob transfers within the configured
+	// bandwidth limits, if any.
+	downloads *bandwidth.Shaper
+	uploads   *bandwidth.Shaper
+
 	// trustKey is a deprecated key used to sign manifests converted to
 	// schema1 for backward compatibility. It should not be used for any
 	// other purposes.
@@ -81,8 +101,30 @@ type App struct {
 	// isCache is true if this registry is configured as a pull through cache
 	isCache bool
 
-	// readOnly is true if the registry is in a read-only maintenance mode
+	// readOnly is true if the registry is in a read-only maintenance mode,
+	// protected by mu
 	readOnly bool
+
+	// headers are added to each response, protected by mu.
+	headers http.Header
+
+	// anonymous are the rules of the access allowed without credentials,
+	// protected by mu.
+	anonymous []auth.Permission
+
+	// explicitAdmins is true if the access controller grants the admin
+	// resources explicitly, so that the admin endpoints are served without
+	// configured admins, protected by mu.
+	explicitAdmins bool
+
+	// manifestURLs are the manifest URL validation rules, protected by mu.
+	manifestURLs struct {
+		allow *regexp.Regexp
+		deny  *regexp.Regexp
+	}
+
+	// mu protects the fields which can be replaced by Reload.
+	mu sync.RWMutex
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
@@ -93,7 +135,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		Config:  config,
 		Context: ctx,
 		router:  v2.RouterWithPrefix(config.HTTP.Prefix),
-		isCache: config.Proxy.RemoteURL != "",
+		isCache: config.Proxy.Enabled(),
 	}
 
 	// Register the handler dispatchers.
@@ -108,13 +150,17 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
 
 	// override the storage driver's UA string for registry outbound HTTP requests
-	storageParams := config.Storage.Parameters()
-	if storageParams == nil {
-		storageParams = make(configuration.Parameters)
+	storageParams := make(configuration.Parameters)
+	for k, v := range config.Storage.Parameters() {
+		storageParams[k] = v
 	}
 	storageParams["useragent"] = fmt.Sprintf("docker-distribution/%s %s", version.Version, runtime.Version())
 
 	var err error
+	if err := app.configureTracing(config); err != nil {
+		panic(fmt.Sprintf("error configuring tracing: %v", err))
+	}
+
 	app.driver, err = factory.Create(config.Storage.Type(), storageParams)
 	if err != nil {
 		// TODO(stevvooe): Move the creation of a service into a protected
@@ -131,18 +177,15 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				panic("uploadpurging config key must contain additional keys")
 			}
 		}
-		if v, ok := mc["readonly"]; ok {
-			readOnly, ok := v.(map[interface{}]interface{})
-			if !ok {
-				panic("readonly config key must contain additional keys")
-			}
-			if readOnlyEnabled, ok := readOnly["enabled"]; ok {
-				app.readOnly, ok = readOnlyEnabled.(bool)
-				if !ok {
-					panic("readonly's enabled config key must have a boolean value")
-				}
-			}
-		}
+	}
+	app.readOnly, err = maintenanceReadOnly(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	app.headers = config.HTTP.Headers
+	app.anonymous, err = anonymousRules(config)
+	if err != nil {
+		panic(err.Error())
 	}
 
 	startUploadPurger(app, app.driver, ctxu.GetLogger(app), purgeConfig)
@@ -153,8 +196,12 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	app.configureSecret(config)
+	app.configureAudit(config)
+	app.configureRobots(config)
 	app.configureEvents(config)
 	app.configureRedis(config)
+	app.configureRateLimit(config)
+	app.configureBandwidth(config)
 	app.configureLogHook(config)
 
 	options := registrymiddleware.GetRegistryOptions()
@@ -214,37 +261,11 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	// configure validation
-	if config.Validation.Enabled {
-		if len(config.Validation.Manifests.URLs.Allow) == 0 && len(config.Validation.Manifests.URLs.Deny) == 0 {
-			// If Allow and Deny are empty, allow nothing.
-			options = append(options, storage.ManifestURLsAllowRegexp(regexp.MustCompile("^$")))
-		} else {
-			if len(config.Validation.Manifests.URLs.Allow) > 0 {
-				for i, s := range config.Validation.Manifests.URLs.Allow {
-					// Validate via compilation.
-					if _, err := regexp.Compile(s); err != nil {
-						panic(fmt.Sprintf("validation.manifests.urls.allow: %s", err))
-					}
-					// Wrap with non-capturing group.
-					config.Validation.Manifests.URLs.Allow[i] = fmt.Sprintf("(?:%s)", s)
-				}
-				re := regexp.MustCompile(strings.Join(config.Validation.Manifests.URLs.Allow, "|"))
-				options = append(options, storage.ManifestURLsAllowRegexp(re))
-			}
-			if len(config.Validation.Manifests.URLs.Deny) > 0 {
-				for i, s := range config.Validation.Manifests.URLs.Deny {
-					// Validate via compilation.
-					if _, err := regexp.Compile(s); err != nil {
-						panic(fmt.Sprintf("validation.manifests.urls.deny: %s", err))
-					}
-					// Wrap with non-capturing group.
-					config.Validation.Manifests.URLs.Deny[i] = fmt.Sprintf("(?:%s)", s)
-				}
-				re := regexp.MustCompile(strings.Join(config.Validation.Manifests.URLs.Deny, "|"))
-				options = append(options, storage.ManifestURLsDenyRegexp(re))
-			}
-		}
+	app.manifestURLs.allow, app.manifestURLs.deny, err = manifestURLRegexps(config)
+	if err != nil {
+		panic(err.Error())
 	}
+	options = append(options, storage.ManifestURLsFunc(app.currentManifestURLs))
 
 	// configure storage caches
 	if cc, ok := config.Storage["cache"]; ok {
@@ -301,18 +322,27 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		if err != nil {
 			panic(fmt.Sprintf("unable to configure authorization (%s): %v", authType, err))
 		}
-		app.accessController = accessController
+		app.accessController = app.withRobots(accessController)
+		app.explicitAdmins = grantsAdminExplicitly(authType)
 		ctxu.GetLogger(app).Debugf("configured %q access controller", authType)
 	}
 
 	// configure as a pull through cache
-	if config.Proxy.RemoteURL != "" {
-		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy)
+	if config.Proxy.Enabled() {
+		if config.Proxy.Coordination.Redis && app.redis == nil {
+			panic("redis configuration required to coordinate proxy fetches")
+		}
+		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy, proxy.WithRedis(app.redis))
 		if err != nil {
 			panic(err.Error())
 		}
 		app.isCache = true
-		ctxu.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		if config.Proxy.RemoteURL != "" {
+			ctxu.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		} else {
+			ctxu.GetLogger(app).Infof("Registry configured as a proxy cache to %d upstreams", len(config.Proxy.Upstreams))
+		}
+		app.configureWarm(config)
 	}
 
 	return app
@@ -412,11 +442,34 @@ func (app *App) register(routeName string, dispatch dispatchFunc) {
 	// replace it with manual routing and structure-based dispatch for better
 	// control over the request execution.
 
-	app.router.GetRoute(routeName).Handler(app.dispatcher(dispatch))
+	app.router.GetRoute(routeName).Handler(instrumentRoute(routeName, app.dispatcher(dispatch)))
 }
 
 // configureEvents prepares the event sink for action.
 func (app *App) configureEvents(configuration *configuration.Configuration) {
+	app.events.sink = &swappableSink{sink: app.newEventSink(configuration)}
+
+	// Populate registry event source
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = configuration.HTTP.Addr
+	} else {
+		// try to pick the port off the config
+		_, port, err := net.SplitHostPort(configuration.HTTP.Addr)
+		if err == nil {
+			hostname = net.JoinHostPort(hostname, port)
+		}
+	}
+
+	app.events.source = notifications.SourceRecord{
+		Addr:       hostname,
+		InstanceID: ctxu.GetStringValue(app, "instance.id"),
+	}
+}
+
+// newEventSink returns a sink broadcasting events to the configured
+// endpoints and to the audit log.
+func (app *App) newEventSink(configuration *configuration.Configuration) notifications.Sink {
 	// Configure all of the endpoint sinks.
 	var sinks []notifications.Sink
 	for _, endpoint := range configuration.Notifications.Endpoints {
@@ -425,7 +478,13 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 			continue
 		}
 
-		ctxu.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
+		// Only the header names are logged, as the values may hold credentials.
+		var headers []string
+		for name := range endpoint.Headers {
+			headers = append(headers, name)
+		}
+		sort.Strings(headers)
+		ctxu.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, headers)
 		endpoint := notifications.NewEndpoint(endpoint.Name, endpoint.URL, notifications.EndpointConfig{
 			Timeout:           endpoint.Timeout,
 			Threshold:         endpoint.Threshold,
@@ -437,28 +496,42 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 		sinks = append(sinks, endpoint)
 	}
 
+	if app.audit != nil {
+		sinks = append(sinks, app.audit.Sink())
+	}
+
 	// NOTE(stevvooe): Moving to a new queuing implementation is as easy as
 	// replacing broadcaster with a rabbitmq implementation. It's recommended
 	// that the registry instances also act as the workers to keep deployment
 	// simple.
-	app.events.sink = notifications.NewBroadcaster(sinks...)
+	return notifications.NewBroadcaster(sinks...)
+}
 
-	// Populate registry event source
-	hostname, err := os.Hostname()
+// configureAudit opens the audit log, if configured.
+func (app *App) configureAudit(configuration *configuration.Configuration) {
+	if !configuration.Audit.Enabled() {
+		return
+	}
+
+	backend, err := audit.NewBackend(configuration.Audit, app.driver)
 	if err != nil {
-		hostname = configuration.HTTP.Addr
-	} else {
-		// try to pick the port off the config
-		_, port, err := net.SplitHostPort(configuration.HTTP.Addr)
-		if err == nil {
-			hostname = net.JoinHostPort(hostname, port)
-		}
+		panic(fmt.Sprintf("error configuring audit log: %v", err))
 	}
 
-	app.events.source = notifications.SourceRecord{
-		Addr:       hostname,
-		InstanceID: ctxu.GetStringValue(app, "instance.id"),
+	app.audit, err = audit.New(backend)
+	if err != nil {
+		panic(fmt.Sprintf("error opening audit log: %v", err))
 	}
+	ctxu.GetLogger(app).Info("audit log enabled")
+}
+
+// Close releases the resources of the application, writing out the audit
+// records it buffers. The application must not serve requests afterwards.
+func (app *App) Close() error {
+	if app.audit != nil {
+		return app.audit.Close()
+	}
+	return nil
 }
 
 func (app *App) configureRedis(configuration *configuration.Configuration) {
@@ -545,14 +618,31 @@ func (app *App) configureRedis(configuration *configuration.Configuration) {
 
 // configureLogHook prepares logging hook parameters.
 func (app *App) configureLogHook(configuration *configuration.Configuration) {
+	app.setLogHooks(newLogHooks(configuration))
+}
+
+// setLogHooks replaces the log hooks fired by the logger, installing
+// logHooks on the logger the first time hooks are set.
+func (app *App) setLogHooks(hooks []log.Hook) {
+	logHooks.set(hooks)
+	if len(hooks) == 0 {
+		return
+	}
+
 	entry, ok := ctxu.GetLogger(app).(*log.Entry)
 	if !ok {
 		// somehow, we are not using logrus
 		return
 	}
 
-	logger := entry.Logger
+	installLogHooks.Do(func() {
+		entry.Logger.Hooks.Add(&logHooks)
+	})
+}
 
+// newLogHooks returns the log hooks of the configuration.
+func newLogHooks(configuration *configuration.Configuration) []log.Hook {
+	var hooks []log.Hook
 	for _, configHook := range configuration.Log.Hooks {
 		if !configHook.Disabled {
 			switch configHook.Type {
@@ -567,11 +657,12 @@ func (app *App) configureLogHook(configuration *configuration.Configuration) {
 					From:     configHook.MailOptions.From,
 					To:       configHook.MailOptions.To,
 				}
-				logger.Hooks.Add(hook)
+				hooks = append(hooks, hook)
 			default:
 			}
 		}
 	}
+	return hooks
 }
 
 // configureSecret creates a random secret if a secret wasn't included in the
@@ -627,13 +718,17 @@ type dispatchFunc func(ctx *Context, r *http.Request) http.Handler
 // handler, using the dispatch factory function.
 func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		for headerName, headerValues := range app.Config.HTTP.Headers {
+		for headerName, headerValues := range app.getHeaders() {
 			for _, value := range headerValues {
 				w.Header().Add(headerName, value)
 			}
 		}
 
 		context := app.context(w, r)
+		defer annotateAccessLog(context, w, r)
+
+		endSpan := startRequestSpan(context, w, r)
+		defer endSpan()
 
 		if err := app.authorized(w, r, context); err != nil {
 			ctxu.GetLogger(context).Warnf("error authorizing context: %v", err)
@@ -641,7 +736,11 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 		}
 
 		// Add username to request logging
-		context.Context = ctxu.WithLogger(context.Context, ctxu.GetLogger(context.Context, auth.UserNameKey))
+		context.Context = ctxu.WithLogger(context.Context, ctxu.GetLogger(context.Context, auth.UserNameKey, auth.BackendKey))
+
+		if app.rateLimited(context, w, r) {
+			return
+		}
 
 		if app.nameRequired(r) {
 			nameRef, err := reference.ParseNamed(getName(context))
@@ -691,6 +790,8 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 				}
 				return
 			}
+
+			context.Repository = traceRepository(context.Repository)
 		}
 
 		dispatch(context, r).ServeHTTP(w, r)
@@ -770,7 +871,8 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 	ctxu.GetLogger(context).Debug("authorizing request")
 	repo := getName(context)
 
-	if app.accessController == nil {
+	accessController := app.getAccessController()
+	if accessController == nil {
 		return nil // access controller is not enabled.
 	}
 
@@ -800,7 +902,20 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 		accessRecords = appendCatalogAccessRecord(accessRecords, r)
 	}
 
-	ctx, err := app.accessController.Authorized(context.Context, accessRecords...)
+	ctx, err := accessController.Authorized(context.Context, accessRecords...)
+	if _, ok := err.(auth.Challenge); ok && app.allowedAnonymously(r, accessRecords) {
+		ctx, err = auth.WithUser(context.Context, auth.UserInfo{Name: anonymousUser}), nil
+	}
+	if app.audit != nil && len(accessRecords) > 0 {
+		user := getUserName(context, r)
+		if err == nil {
+			user = ctxu.GetStringValue(ctx, auth.UserNameKey)
+		}
+		request := notifications.NewRequestRecord(ctxu.GetRequestID(context), r)
+		if err := app.audit.Access(user, request, accessRecords, err); err != nil {
+			ctxu.GetLogger(context).Errorf("error writing audit record: %v", err)
+		}
+	}
 	if err != nil {
 		switch err := err.(type) {
 		case auth.Challenge:
@@ -810,6 +925,12 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			if err := errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized.WithDetail(accessRecords)); err != nil {
 				ctxu.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
 			}
+		case errcode.ErrorCode:
+			// The client was authenticated, but is not granted the access.
+			// No challenge is issued, as other credentials would not help.
+			if err := errcode.ServeJSON(w, err.WithDetail(accessRecords)); err != nil {
+				ctxu.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+			}
 		default:
 			// This condition is a potential security problem either in
 			// the configuration or whatever is backing the access
@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -13,6 +16,8 @@ import (
 	"github.com/docker/distribution/registry/api/errcode"
 	"github.com/docker/distribution/registry/api/v2"
 	"github.com/docker/distribution/registry/auth"
+	_ "github.com/docker/distribution/registry/auth/acl"
+	_ "github.com/docker/distribution/registry/auth/htpasswd"
 	_ "github.com/docker/distribution/registry/auth/silly"
 	"github.com/docker/distribution/registry/storage"
 	memorycache "github.com/docker/distribution/registry/storage/cache/memory"
@@ -212,6 +217,76 @@ func TestNewApp(t *testing.T) {
 	}
 }
 
+// TestDeniedAccess ensures an authenticated client which is not granted the
+// access is served a 403 Forbidden error, without a challenge.
+func TestDeniedAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "denied")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	htpasswd := filepath.Join(dir, "htpasswd")
+	if err := ioutil.WriteFile(htpasswd, []byte("bilbo:$2y$05$926C3y10Quzn/LnqQH86VOEVh/18T6RnLaS.khre96jLNL/7e.K5W\n"), 0644); err != nil {
+		t.Fatalf("unexpected error writing htpasswd: %v", err)
+	}
+	policy := filepath.Join(dir, "policy.yml")
+	if err := ioutil.WriteFile(policy, []byte("rules: [{repository: foo/*, users: [bilbo], actions: [pull]}]\n"), 0644); err != nil {
+		t.Fatalf("unexpected error writing policy: %v", err)
+	}
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"acl": {
+				"realm":  "realm-test",
+				"policy": policy,
+				"authenticator": map[interface{}]interface{}{
+					"htpasswd": map[interface{}]interface{}{"path": htpasswd},
+				},
+			},
+		},
+	}
+
+	app := NewApp(context.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	req, err := http.NewRequest("POST", server.URL+"/v2/foo/bar/blobs/uploads/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	req.SetBasicAuth("bilbo", "baggins")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status pushing without access: %v", resp.Status)
+	}
+	if challenge := resp.Header.Get("WWW-Authenticate"); challenge != "" {
+		t.Fatalf("unexpected WWW-Authenticate header: %q", challenge)
+	}
+
+	var errs errcode.Errors
+	if err := json.NewDecoder(resp.Body).Decode(&errs); err != nil {
+		t.Fatalf("error decoding error response: %v", err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if err, ok := errs[0].(errcode.ErrorCoder); !ok || err.ErrorCode() != errcode.ErrorCodeDenied {
+		t.Fatalf("unexpected error: %#v", errs[0])
+	}
+}
+
 // Test the access record accumulator
 func TestAppendAccessRecords(t *testing.T) {
 	repo := "testRepo"
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/registry/audit"
+)
+
+// TestAuditLog ensures authorization decisions and repository operations are
+// written to the audit log.
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	config.Audit.File.Path = path
+
+	app := NewApp(context.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	do := func(method, u string, body []byte, authorized bool) *http.Response {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		if authorized {
+			req.Header.Set("Authorization", "Bearer token")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := do("GET", server.URL+"/v2/foo/bar/tags/list", nil, false); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status listing tags without credentials: %v", resp.Status)
+	}
+
+	resp := do("POST", server.URL+"/v2/foo/bar/blobs/uploads/", nil, true)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status starting upload: %v", resp.Status)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing location: %v", err)
+	}
+
+	content := []byte("audited layer")
+	dgst := digest.FromBytes(content)
+	q := location.Query()
+	q.Set("digest", dgst.String())
+	location.RawQuery = q.Encode()
+	if resp := do("PUT", location.String(), content, true); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status completing upload: %v", resp.Status)
+	}
+
+	// Events reach the log asynchronously.
+	var records []audit.Record
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		records = nil
+		fp, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("unexpected error opening audit log: %v", err)
+		}
+		err = audit.Query(fp, audit.Filter{Repository: "foo/bar"}, func(r audit.Record) error {
+			records = append(records, r)
+			return nil
+		})
+		fp.Close()
+		if err != nil {
+			t.Fatalf("unexpected error querying audit log: %v", err)
+		}
+		if len(records) > 0 && records[len(records)-1].Type == audit.TypeEvent {
+			break
+		}
+	}
+
+	var denied, granted, pushed bool
+	for _, r := range records {
+		switch {
+		case r.Type == audit.TypeAccess && r.Decision == audit.DecisionDenied && r.Action == "pull":
+			denied = true
+		case r.Type == audit.TypeAccess && r.Decision == audit.DecisionGranted && r.Action == "push" && r.User == "silly":
+			granted = true
+		case r.Type == audit.TypeEvent && r.Action == "push" && r.Digest == dgst.String() && r.User == "silly":
+			pushed = true
+		}
+	}
+	if !denied || !granted || !pushed {
+		t.Fatalf("missing audit records (denied=%v, granted=%v, pushed=%v): %#v", denied, granted, pushed, records)
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/docker/distribution/configuration"
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/bandwidth"
+)
+
+func (app *App) configureBandwidth(config *configuration.Configuration) {
+	limits := func(direction string, l configuration.BandwidthLimits) bandwidth.Limits {
+		if l.Global < 0 || l.Client < 0 || l.User < 0 {
+			panic(fmt.Sprintf("invalid %s bandwidth limits: rates must not be negative", direction))
+		}
+		return bandwidth.Limits{Global: l.Global, Client: l.Client, User: l.User}
+	}
+
+	if download := limits("download", config.Bandwidth.Download); download.Enabled() {
+		app.downloads = bandwidth.NewShaper(download)
+		ctxu.GetLogger(app).Info("download bandwidth limits enabled")
+	}
+	if upload := limits("upload", config.Bandwidth.Upload); upload.Enabled() {
+		app.uploads = bandwidth.NewShaper(upload)
+		ctxu.GetLogger(app).Info("upload bandwidth limits enabled")
+	}
+}
+
+// shapeDownload returns a response writer pacing the body of a blob
+// response, and a function to call once the response is complete. Redirects
+// are not paced, and do not take a share of the bandwidth.
+func (app *App) shapeDownload(context *Context, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if app.downloads == nil {
+		return w, func() {}
+	}
+
+	sw := &shapedResponseWriter{
+		ResponseWriter: w,
+		shaper:         app.downloads,
+		client:         ctxu.RemoteIP(r),
+		user:           ctxu.GetStringValue(context, auth.UserNameKey),
+	}
+	return sw, sw.done
+}
+
+// shapeUpload paces the reads of the body of r, and returns a function to
+// call once the body has been read.
+func (app *App) shapeUpload(context *Context, r *http.Request) func() {
+	if app.uploads == nil || r.Body == nil {
+		return func() {}
+	}
+
+	transfer := app.uploads.Start(ctxu.RemoteIP(r), ctxu.GetStringValue(context, auth.UserNameKey))
+	r.Body = readCloser{Reader: transfer.Reader(r.Body), Closer: r.Body}
+	return transfer.Done
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// shapedResponseWriter starts a transfer on the first write of a body which
+// is not part of a redirect.
+type shapedResponseWriter struct {
+	http.ResponseWriter
+	shaper       *bandwidth.Shaper
+	client, user string
+
+	transfer *bandwidth.Transfer
+	body     io.Writer
+	bypass   bool
+}
+
+func (sw *shapedResponseWriter) WriteHeader(status int) {
+	if status >= 300 && status < 400 {
+		sw.bypass = true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *shapedResponseWriter) Write(p []byte) (int, error) {
+	if sw.bypass {
+		return sw.ResponseWriter.Write(p)
+	}
+	if sw.transfer == nil {
+		sw.transfer = sw.shaper.Start(sw.client, sw.user)
+		sw.body = sw.transfer.Writer(sw.ResponseWriter)
+	}
+	return sw.body.Write(p)
+}
+
+func (sw *shapedResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := sw.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (sw *shapedResponseWriter) done() {
+	if sw.transfer != nil {
+		sw.transfer.Done()
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/bandwidth"
+)
+
+// TestBandwidthLimits ensures blob uploads and downloads are paced within the
+// configured bandwidth limits.
+func TestBandwidthLimits(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Bandwidth.Download.Global = 256 << 10
+	config.Bandwidth.Upload.Client = 256 << 10
+
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	// At 256KiB/s, 128KiB take half a second. The pause following the last
+	// chunk is not seen by the client.
+	content := make([]byte, 128<<10)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("unexpected error generating content: %v", err)
+	}
+	dgst := digest.FromBytes(content)
+	name, _ := reference.ParseNamed("foo/bar")
+
+	start := time.Now()
+	uploadURLBase, _ := startPushLayer(t, env, name)
+	blobURL := pushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("upload not paced: %v", elapsed)
+	}
+
+	start = time.Now()
+	resp, err := http.Get(blobURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching blob: %v", err)
+	}
+	defer resp.Body.Close()
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading blob: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("download not paced: %v", elapsed)
+	}
+	if !bytes.Equal(p, content) {
+		t.Fatalf("unexpected blob content")
+	}
+}
+
+// TestBandwidthRedirectBypass ensures redirects do not take a share of the
+// bandwidth.
+func TestBandwidthRedirectBypass(t *testing.T) {
+	shaper := bandwidth.NewShaper(bandwidth.Limits{Global: 1})
+	sw := &shapedResponseWriter{
+		ResponseWriter: httptest.NewRecorder(),
+		shaper:         shaper,
+		client:         "10.0.0.1",
+	}
+
+	sw.WriteHeader(http.StatusTemporaryRedirect)
+	sw.Write([]byte("<a href=\"https://storage.example.com/blob\">Temporary Redirect</a>.\n"))
+	sw.done()
+
+	if sw.transfer != nil {
+		t.Fatalf("transfer started for redirect")
+	}
+}
@@ -28,7 +28,7 @@ func blobUploadDispatcher(ctx *Context, r *http.Request) http.Handler {
 		"HEAD": http.HandlerFunc(buh.GetUploadStatus),
 	}
 
-	if !ctx.readOnly {
+	if !ctx.isReadOnly() {
 		handler["POST"] = http.HandlerFunc(buh.StartBlobUpload)
 		handler["PATCH"] = http.HandlerFunc(buh.PatchBlobData)
 		handler["PUT"] = http.HandlerFunc(buh.PutBlobUploadComplete)
@@ -179,7 +179,10 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 
 	// TODO(dmcgowan): support Content-Range header to seek and write range
 
-	if err := copyFullPayload(w, r, buh.Upload, buh, "blob PATCH", &buh.Errors); err != nil {
+	done := buh.shapeUpload(buh.Context, r)
+	err := copyFullPayload(w, r, buh.Upload, buh, "blob PATCH", &buh.Errors)
+	done()
+	if err != nil {
 		// copyFullPayload reports the error if necessary
 		return
 	}
@@ -218,7 +221,10 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		return
 	}
 
-	if err := copyFullPayload(w, r, buh.Upload, buh, "blob PUT", &buh.Errors); err != nil {
+	done := buh.shapeUpload(buh.Context, r)
+	err = copyFullPayload(w, r, buh.Upload, buh, "blob PUT", &buh.Errors)
+	done()
+	if err != nil {
 		// copyFullPayload reports the error if necessary
 		return
 	}
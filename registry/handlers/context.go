@@ -8,6 +8,7 @@ import (
 	"github.com/docker/distribution"
 	ctxu "github.com/docker/distribution/context"
 	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/registry/accesslog"
 	"github.com/docker/distribution/registry/api/errcode"
 	"github.com/docker/distribution/registry/api/v2"
 	"github.com/docker/distribution/registry/auth"
@@ -131,6 +132,7 @@ func (cm *contextManager) context(parent context.Context, w http.ResponseWriter,
 	}
 
 	ctx = ctxu.WithRequest(parent, r)
+	ctx = accesslog.WithAnnotations(ctx, w)
 	ctx, w = ctxu.WithResponseWriter(ctx, w)
 	ctx = ctxu.WithLogger(ctx, ctxu.GetRequestLogger(ctx))
 	cm.contexts[r] = ctx
@@ -45,7 +45,7 @@ func imageManifestDispatcher(ctx *Context, r *http.Request) http.Handler {
 		"HEAD": http.HandlerFunc(imageManifestHandler.GetImageManifest),
 	}
 
-	if !ctx.readOnly {
+	if !ctx.isReadOnly() {
 		mhandler["PUT"] = http.HandlerFunc(imageManifestHandler.PutImageManifest)
 		mhandler["DELETE"] = http.HandlerFunc(imageManifestHandler.DeleteImageManifest)
 	}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/metrics"
+)
+
+var (
+	// httpRequests counts the requests handled by each route.
+	httpRequests = metrics.NewCounter("registry_http_requests_total",
+		"The number of HTTP requests, by route, method and status code.", "route", "method", "code")
+
+	// httpRequestDuration tracks the time taken to serve each route.
+	httpRequestDuration = metrics.NewHistogram("registry_http_request_duration_seconds",
+		"The latency of HTTP requests, by route and method.", nil, "route", "method")
+
+	// httpInFlight tracks the requests currently being served by each route.
+	httpInFlight = metrics.NewGauge("registry_http_in_flight_requests",
+		"The number of HTTP requests being served, by route.", "route")
+)
+
+func init() {
+	metrics.MustRegister(httpRequests, httpRequestDuration, httpInFlight)
+}
+
+// instrumentRoute wraps handler to record request metrics under the route
+// name. The response writer is expected to be the instrumented writer set up
+// by App.ServeHTTP, from which the response status is read.
+func instrumentRoute(routeName string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpInFlight.Inc(routeName)
+
+		defer func() {
+			httpInFlight.Dec(routeName)
+			httpRequestDuration.ObserveSince(start, routeName, r.Method)
+			httpRequests.Inc(routeName, r.Method, strconv.Itoa(responseStatus(w)))
+		}()
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// responseStatus returns the status code written to w. Responses with no
+// explicit status are reported as 200.
+func responseStatus(w http.ResponseWriter) int {
+	if ctx, ok := w.(ctxu.Context); ok {
+		if status, ok := ctx.Value("http.response.status").(int); ok && status != 0 {
+			return status
+		}
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/metrics"
+)
+
+// TestRouteMetrics ensures requests are counted under their route name.
+func TestRouteMetrics(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	baseURL, err := env.builder.BuildBaseURL()
+	if err != nil {
+		t.Fatalf("unexpected error building base url: %v", err)
+	}
+
+	resp, err := http.Get(baseURL)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+
+	manifestURL := baseURL + "foo/bar/manifests/missing"
+	resp, err = http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+
+	var buf bytes.Buffer
+	if _, err := metrics.DefaultRegistry.WriteTo(&buf); err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+
+	for _, expected := range []string{
+		`registry_http_requests_total{route="base",method="GET",code="200"}`,
+		`registry_http_requests_total{route="manifest",method="GET",code="404"}`,
+		`registry_http_request_duration_seconds_count{route="manifest",method="GET"}`,
+		`registry_http_in_flight_requests{route="base"} 0`,
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("metric %s missing from output:\n%s", expected, buf.String())
+		}
+	}
+}
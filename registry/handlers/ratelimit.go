@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/metrics"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+// rateLimitedRequests counts the requests rejected by each limit.
+var rateLimitedRequests = metrics.NewCounter("registry_http_rate_limited_requests_total",
+	"The number of HTTP requests rejected by rate limits, by route class and key.", "class", "key")
+
+func init() {
+	metrics.MustRegister(rateLimitedRequests)
+}
+
+// rateLimitClasses maps route names to the class of their limits.
+var rateLimitClasses = map[string]string{
+	v2.RouteNameManifest:        "manifest",
+	v2.RouteNameTags:            "manifest",
+	v2.RouteNameBlob:            "blob",
+	v2.RouteNameBlobUpload:      "upload",
+	v2.RouteNameBlobUploadChunk: "upload",
+	v2.RouteNameCatalog:         "catalog",
+}
+
+// rateLimiter applies the configured limits to requests.
+type rateLimiter struct {
+	limiter ratelimit.Limiter
+	classes map[string]configuration.RateLimitClass
+}
+
+func (app *App) configureRateLimit(config *configuration.Configuration) {
+	classes := map[string]configuration.RateLimitClass{
+		"manifest": config.RateLimit.Manifest,
+		"blob":     config.RateLimit.Blob,
+		"upload":   config.RateLimit.Upload,
+		"catalog":  config.RateLimit.Catalog,
+	}
+
+	enabled := false
+	for name, class := range classes {
+		for key, bucket := range map[string]configuration.RateLimitBucket{
+			"user":       class.User,
+			"ip":         class.IP,
+			"repository": class.Repository,
+		} {
+			if bucket.Rate < 0 || bucket.Burst < 0 {
+				panic(fmt.Sprintf("invalid %s rate limit for %s: rate and burst must not be negative", key, name))
+			}
+			enabled = enabled || bucket.Rate > 0
+		}
+	}
+	if !enabled {
+		return
+	}
+
+	var limiter ratelimit.Limiter
+	if config.RateLimit.Redis {
+		if app.redis == nil {
+			panic("redis configuration required to share rate limits")
+		}
+		limiter = ratelimit.NewRedisLimiter(app.redis)
+	} else {
+		limiter = ratelimit.NewInMemoryLimiter()
+	}
+
+	app.rateLimiter = &rateLimiter{
+		limiter: limiter,
+		classes: classes,
+	}
+	ctxu.GetLogger(app).Info("rate limiting enabled")
+}
+
+// rateLimited takes a token from each bucket applying to the request, if
+// none of them is empty. Otherwise, a TOOMANYREQUESTS error is served and true
+// is returned. Requests are allowed if the state of the limits cannot be
+// read.
+func (app *App) rateLimited(context *Context, w http.ResponseWriter, r *http.Request) bool {
+	if app.rateLimiter == nil {
+		return false
+	}
+
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	name, ok := rateLimitClasses[route.GetName()]
+	if !ok {
+		return false
+	}
+	class := app.rateLimiter.classes[name]
+
+	type key struct {
+		key   string
+		value string
+	}
+	var (
+		keys    []key
+		buckets []ratelimit.Bucket
+	)
+	for _, k := range []struct {
+		key
+		bucket configuration.RateLimitBucket
+	}{
+		{key{"ip", ctxu.RemoteIP(r)}, class.IP},
+		{key{"user", ctxu.GetStringValue(context, auth.UserNameKey)}, class.User},
+		{key{"repository", getName(context)}, class.Repository},
+	} {
+		if k.value == "" || k.bucket.Rate <= 0 {
+			continue
+		}
+		keys = append(keys, k.key)
+		buckets = append(buckets, ratelimit.Bucket{
+			Key:   name + ":" + k.key.key + ":" + k.value,
+			Limit: ratelimit.Limit{Rate: k.bucket.Rate, Burst: k.bucket.Burst},
+		})
+	}
+	if len(buckets) == 0 {
+		return false
+	}
+
+	empty, wait, err := app.rateLimiter.limiter.Allow(buckets...)
+	if err != nil {
+		ctxu.GetLogger(context).Errorf("error checking %s rate limits: %v", name, err)
+		return false
+	}
+	if empty < 0 {
+		return false
+	}
+
+	k := keys[empty]
+	rateLimitedRequests.Inc(name, k.key)
+	ctxu.GetLogger(context).Warnf("%s rate limit exceeded for %s %q", name, k.key, k.value)
+
+	wait = roundUp(wait)
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+	context.Errors = append(context.Errors, errcode.ErrorCodeTooManyRequests.WithDetail(
+		fmt.Sprintf("%s rate limit exceeded, retry in %v", k.key, wait)))
+	if err := errcode.ServeJSON(w, context.Errors); err != nil {
+		ctxu.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+	}
+	return true
+}
+
+// roundUp rounds d up to the second.
+func roundUp(d time.Duration) time.Duration {
+	return time.Duration(math.Ceil(d.Seconds())) * time.Second
+}
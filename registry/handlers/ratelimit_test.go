@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+)
+
+// TestRateLimit ensures requests beyond the configured limits are rejected
+// with a TOOMANYREQUESTS error, and that limits only apply to their class.
+func TestRateLimit(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.RateLimit.Manifest.Repository = configuration.RateLimitBucket{Rate: 0.01, Burst: 2}
+	config.RateLimit.Manifest.IP = configuration.RateLimitBucket{Rate: 0.01, Burst: 4}
+
+	app := NewApp(context.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := get("/v2/foo/bar/tags/list")
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("request %d rate limited within burst", i)
+		}
+	}
+
+	resp := get("/v2/foo/bar/tags/list")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status beyond repository limit: %v", resp.Status)
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "100" {
+		t.Fatalf("unexpected Retry-After header: %q", retryAfter)
+	}
+	var errs errcode.Errors
+	if err := json.NewDecoder(resp.Body).Decode(&errs); err != nil {
+		t.Fatalf("unexpected error decoding error response: %v", err)
+	}
+	if len(errs) != 1 || errs[0].(errcode.Error).Code != errcode.ErrorCodeTooManyRequests {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// Rejected requests do not count against the limit of the client, which
+	// has two tokens left for other repositories.
+	for _, repo := range []string{"foo/baz", "foo/qux"} {
+		resp = get("/v2/" + repo + "/tags/list")
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("request for %s rate limited", repo)
+		}
+	}
+	resp = get("/v2/foo/quux/tags/list")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status beyond ip limit: %v", resp.Status)
+	}
+
+	// Other classes are not limited.
+	resp = get("/v2/_catalog")
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		t.Fatalf("catalog request rate limited")
+	}
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/configuration"
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// Reload applies config to the running application. Only the access
+// controller, the anonymous access rules, the notification endpoints, the log
+// hooks, the read-only mode, the manifest URL validation rules and the HTTP
+// headers are replaced; the log level is left to the caller. If config
+// changes any other field, an error naming the fields is returned and
+// nothing is applied.
+func (app *App) Reload(config *configuration.Configuration) error {
+	if changed := nonReloadableChanges(app.Config, config); len(changed) > 0 {
+		return fmt.Errorf("changes to %s cannot be applied without a restart", strings.Join(changed, ", "))
+	}
+
+	var accessController auth.AccessController
+	if authType := config.Auth.Type(); authType != "" {
+		var err error
+		accessController, err = auth.GetAccessController(authType, config.Auth.Parameters())
+		if err != nil {
+			return fmt.Errorf("unable to configure authorization (%s): %v", authType, err)
+		}
+	}
+
+	readOnly, err := maintenanceReadOnly(config)
+	if err != nil {
+		return err
+	}
+
+	allow, deny, err := manifestURLRegexps(config)
+	if err != nil {
+		return err
+	}
+
+	anonymous, err := anonymousRules(config)
+	if err != nil {
+		return err
+	}
+
+	// Nothing can fail past this point.
+	app.mu.Lock()
+	app.accessController = app.withRobots(accessController)
+	app.explicitAdmins = grantsAdminExplicitly(config.Auth.Type())
+	app.readOnly = readOnly
+	app.manifestURLs.allow = allow
+	app.manifestURLs.deny = deny
+	app.headers = config.HTTP.Headers
+	app.anonymous = anonymous
+	app.mu.Unlock()
+
+	app.setLogHooks(newLogHooks(config))
+
+	old := app.events.sink.swap(app.newEventSink(config))
+	go func() {
+		// Closing waits for the queued events to be delivered.
+		if err := old.Close(); err != nil {
+			ctxu.GetLogger(app).Errorf("error closing previous notification endpoints: %v", err)
+		}
+	}()
+
+	ctxu.GetLogger(app).Infof("configuration reloaded")
+	return nil
+}
+
+// nonReloadableChanges returns the names of the fields which differ between
+// the running configuration and config, other than those applied by Reload.
+func nonReloadableChanges(running, config *configuration.Configuration) []string {
+	a, b := withoutReloadable(*running), withoutReloadable(*config)
+
+	// A random secret is generated at startup when none is configured.
+	if config.HTTP.Secret == "" {
+		b.HTTP.Secret = a.HTTP.Secret
+	}
+
+	var changed []string
+	diffFields("", reflect.ValueOf(a), reflect.ValueOf(b), &changed)
+	return changed
+}
+
+// withoutReloadable clears the reloadable fields of config.
+func withoutReloadable(config configuration.Configuration) configuration.Configuration {
+	config.Loglevel = ""
+	config.Log.Level = ""
+	config.Log.Hooks = nil
+	config.Auth = nil
+	config.Anonymous = configuration.Anonymous{}
+	config.Notifications = configuration.Notifications{}
+	config.HTTP.Headers = nil
+	config.Validation.Enabled = false
+	config.Validation.Manifests.URLs.Allow = nil
+	config.Validation.Manifests.URLs.Deny = nil
+
+	// Only maintenance.readonly can be reloaded in the storage section.
+	storage := make(configuration.Storage, len(config.Storage))
+	for k, v := range config.Storage {
+		storage[k] = v
+	}
+	if maintenance, ok := storage["maintenance"]; ok {
+		params := make(configuration.Parameters, len(maintenance))
+		for k, v := range maintenance {
+			params[k] = v
+		}
+		delete(params, "readonly")
+		if len(params) == 0 {
+			delete(storage, "maintenance")
+		} else {
+			storage["maintenance"] = params
+		}
+	}
+	config.Storage = storage
+
+	return config
+}
+
+// diffFields appends the yaml path of each field which differs between a and
+// b, descending into nested structs.
+func diffFields(prefix string, a, b reflect.Value, changed *[]string) {
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		fa, fb := a.Field(i), b.Field(i)
+		if reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			continue
+		}
+		if fa.Kind() == reflect.Struct {
+			diffFields(name, fa, fb, changed)
+			continue
+		}
+		*changed = append(*changed, name)
+	}
+}
+
+// maintenanceReadOnly returns whether the read-only maintenance mode is
+// enabled by config.
+func maintenanceReadOnly(config *configuration.Configuration) (bool, error) {
+	mc, ok := config.Storage["maintenance"]
+	if !ok {
+		return false, nil
+	}
+	v, ok := mc["readonly"]
+	if !ok {
+		return false, nil
+	}
+	readOnly, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return false, fmt.Errorf("readonly config key must contain additional keys")
+	}
+	readOnlyEnabled, ok := readOnly["enabled"]
+	if !ok {
+		return false, nil
+	}
+	enabled, ok := readOnlyEnabled.(bool)
+	if !ok {
+		return false, fmt.Errorf("readonly's enabled config key must have a boolean value")
+	}
+	return enabled, nil
+}
+
+// manifestURLRegexps compiles the manifest URL validation rules of config.
+// Nil regular expressions do not restrict URLs.
+func manifestURLRegexps(config *configuration.Configuration) (allow, deny *regexp.Regexp, err error) {
+	if !config.Validation.Enabled {
+		return nil, nil, nil
+	}
+
+	urls := config.Validation.Manifests.URLs
+	if len(urls.Allow) == 0 && len(urls.Deny) == 0 {
+		// If Allow and Deny are empty, allow nothing.
+		return regexp.MustCompile("^$"), nil, nil
+	}
+
+	compile := func(key string, exprs []string) (*regexp.Regexp, error) {
+		if len(exprs) == 0 {
+			return nil, nil
+		}
+		groups := make([]string, len(exprs))
+		for i, s := range exprs {
+			// Validate via compilation.
+			if _, err := regexp.Compile(s); err != nil {
+				return nil, fmt.Errorf("validation.manifests.urls.%s: %s", key, err)
+			}
+			// Wrap with non-capturing group.
+			groups[i] = fmt.Sprintf("(?:%s)", s)
+		}
+		return regexp.MustCompile(strings.Join(groups, "|")), nil
+	}
+
+	if allow, err = compile("allow", urls.Allow); err != nil {
+		return nil, nil, err
+	}
+	if deny, err = compile("deny", urls.Deny); err != nil {
+		return nil, nil, err
+	}
+	return allow, deny, nil
+}
+
+// getAccessController returns the current access controller, which may be
+// nil.
+func (app *App) getAccessController() auth.AccessController {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	return app.accessController
+}
+
+// isReadOnly returns whether the registry is in read-only maintenance mode.
+func (app *App) isReadOnly() bool {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	return app.readOnly
+}
+
+// getHeaders returns the headers added to each response.
+func (app *App) getHeaders() http.Header {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	return app.headers
+}
+
+// currentManifestURLs returns the current manifest URL validation rules.
+func (app *App) currentManifestURLs() (allow, deny *regexp.Regexp) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	return app.manifestURLs.allow, app.manifestURLs.deny
+}
+
+// swappableSink forwards events to a sink which can be replaced. Writes in
+// progress complete on the previous sink before it is returned by swap.
+type swappableSink struct {
+	mu   sync.RWMutex
+	sink notifications.Sink
+}
+
+func (ss *swappableSink) Write(events ...notifications.Event) error {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.sink.Write(events...)
+}
+
+func (ss *swappableSink) Close() error {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.sink.Close()
+}
+
+// swap replaces the sink, returning the previous one.
+func (ss *swappableSink) swap(sink notifications.Sink) notifications.Sink {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	old := ss.sink
+	ss.sink = sink
+	return old
+}
+
+// logHooks is installed once on the logger, which is shared by all the
+// applications of the process, and fires the hooks of the latest
+// configuration, so that they can be replaced while logging.
+var (
+	logHooks        logHookSet
+	installLogHooks sync.Once
+)
+
+// logHookSet fires a set of hooks which can be replaced.
+type logHookSet struct {
+	mu    sync.RWMutex
+	hooks []log.Hook
+}
+
+func (hs *logHookSet) set(hooks []log.Hook) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.hooks = hooks
+}
+
+// Levels returns all levels, the hooks filtering their own levels on fire.
+func (hs *logHookSet) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel, log.DebugLevel}
+}
+
+func (hs *logHookSet) Fire(entry *log.Entry) error {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	for _, hook := range hs.hooks {
+		for _, level := range hook.Levels() {
+			if level == entry.Level {
+				if err := hook.Fire(entry); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
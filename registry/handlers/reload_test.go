@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+)
+
+func reloadTestConfig() *configuration.Configuration {
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Addr = ":5000"
+	config.HTTP.Headers = http.Header{"X-Content-Type-Options": []string{"nosniff"}}
+	return config
+}
+
+// TestReload ensures the reloadable parts of the configuration are applied
+// to a running application.
+func TestReload(t *testing.T) {
+	app := NewApp(context.Background(), reloadTestConfig())
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	events := make(chan *http.Request, 10)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r
+	}))
+	defer endpoint.Close()
+
+	post := func() *http.Response {
+		resp, err := http.Post(server.URL+"/v2/foo/bar/blobs/uploads/", "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error starting upload: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := post()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status before reload: %v", resp.Status)
+	}
+	if resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("configured header missing before reload")
+	}
+
+	config := reloadTestConfig()
+	config.HTTP.Headers = http.Header{"X-Reloaded": []string{"true"}}
+	config.Notifications.Endpoints = []configuration.Endpoint{{Name: "reloaded", URL: endpoint.URL}}
+	if err := app.Reload(config); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+
+	resp = post()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status after reload: %v", resp.Status)
+	}
+	if resp.Header.Get("X-Reloaded") != "true" || resp.Header.Get("X-Content-Type-Options") != "" {
+		t.Fatalf("headers not reloaded: %v", resp.Header)
+	}
+
+	// Events are sent to the new endpoint.
+	app.events.sink.Write(notifications.Event{Action: notifications.EventActionPull})
+	if r := <-events; r.Method != "POST" {
+		t.Fatalf("unexpected notification request: %v", r.Method)
+	}
+
+	config.Auth = configuration.Auth{"silly": {"realm": "realm-test", "service": "service-test"}}
+	config.Storage["maintenance"]["readonly"] = map[interface{}]interface{}{"enabled": true}
+	if err := app.Reload(config); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+
+	if resp := post(); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status after enabling authentication: %v", resp.Status)
+	}
+	if !app.isReadOnly() {
+		t.Fatalf("read-only mode not reloaded")
+	}
+}
+
+// TestReloadRejected ensures a reload changing fields which cannot be
+// reloaded is rejected as a whole.
+func TestReloadRejected(t *testing.T) {
+	app := NewApp(context.Background(), reloadTestConfig())
+
+	config := reloadTestConfig()
+	config.HTTP.Addr = ":5001"
+	config.HTTP.Headers = http.Header{"X-Reloaded": []string{"true"}}
+	config.Storage["delete"] = configuration.Parameters{"enabled": true}
+	config.Storage["maintenance"]["readonly"] = map[interface{}]interface{}{"enabled": true}
+
+	err := app.Reload(config)
+	if err == nil {
+		t.Fatalf("expected reload to be rejected")
+	}
+	if !strings.Contains(err.Error(), "storage, http.addr") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if app.isReadOnly() || app.getHeaders().Get("X-Reloaded") != "" {
+		t.Fatalf("rejected configuration was partially applied")
+	}
+
+	// Only maintenance.readonly is reloadable in the storage section.
+	config = reloadTestConfig()
+	config.Storage["maintenance"]["readonly"] = map[interface{}]interface{}{"enabled": true}
+	config.Log.Level = "debug"
+	if changed := nonReloadableChanges(app.Config, config); len(changed) != 0 {
+		t.Fatalf("unexpected changes: %v", changed)
+	}
+
+	config.Storage["maintenance"]["uploadpurging"] = map[interface{}]interface{}{"enabled": true}
+	config.Log.Formatter = "json"
+	if changed := nonReloadableChanges(app.Config, config); !reflect.DeepEqual(changed, []string{"log.formatter", "storage"}) {
+		t.Fatalf("unexpected changes: %v", changed)
+	}
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/auth/robot"
+	"github.com/gorilla/mux"
+)
+
+// robotsAdminPath is the path of the endpoints managing robot accounts,
+// below the http prefix.
+const robotsAdminPath = "/admin/robots"
+
+// robotsAdminAccess is the access required to manage robot accounts.
+var robotsAdminAccess = auth.Access{
+	Resource: auth.Resource{
+		Type: "registry",
+		Name: "robots",
+	},
+	Action: "*",
+}
+
+// Errors returned by the robot account endpoints.
+var (
+	errorCodeRobotInvalid = errcode.Register("registry.api.robots", errcode.ErrorDescriptor{
+		Value:          "ROBOT_INVALID",
+		Message:        "invalid robot account",
+		Description:    `The robot account in the request body is invalid.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	errorCodeRobotUnknown = errcode.Register("registry.api.robots", errcode.ErrorDescriptor{
+		Value:          "ROBOT_UNKNOWN",
+		Message:        "robot account unknown",
+		Description:    `The robot account does not exist.`,
+		HTTPStatusCode: http.StatusNotFound,
+	})
+
+	errorCodeRobotExists = errcode.Register("registry.api.robots", errcode.ErrorDescriptor{
+		Value:          "ROBOT_EXISTS",
+		Message:        "robot account already exists",
+		Description:    `A robot account with the same name already exists.`,
+		HTTPStatusCode: http.StatusConflict,
+	})
+)
+
+// configureRobots opens the robot account store and registers the endpoints
+// managing it, if enabled.
+func (app *App) configureRobots(config *configuration.Configuration) {
+	if !config.Robots.Enabled {
+		return
+	}
+	if config.Auth.Type() == "" {
+		panic("robot accounts require an auth provider to authenticate their administrators")
+	}
+
+	root := config.Robots.RootDirectory
+	if root == "" {
+		root = "/robots"
+	}
+	app.robots = robot.NewStore(app.driver, root)
+
+	prefix := strings.TrimSuffix(config.HTTP.Prefix, "/")
+	app.router.Path(prefix + robotsAdminPath).Methods("GET").Handler(app.robotsAdmin(app.listRobots))
+	app.router.Path(prefix + robotsAdminPath).Methods("POST").Handler(app.robotsAdmin(app.createRobot))
+	app.router.Path(prefix + robotsAdminPath + "/{name}").Methods("DELETE").Handler(app.robotsAdmin(app.revokeRobot))
+	ctxu.GetLogger(app).Infof("robot accounts enabled, stored in %s", root)
+	if len(config.Robots.Admins) == 0 && !grantsAdminExplicitly(config.Auth.Type()) {
+		ctxu.GetLogger(app).Warnf("robots.admins must list the users managing robot accounts with the %q access controller", config.Auth.Type())
+	}
+}
+
+// withRobots returns an access controller accepting robot accounts, if
+// enabled, and delegating other requests to accessController.
+func (app *App) withRobots(accessController auth.AccessController) auth.AccessController {
+	if app.robots == nil || accessController == nil {
+		return accessController
+	}
+	return robot.NewAccessController(app.robots, accessController)
+}
+
+// robotsAdmin returns a handler serving requests of the administrators of
+// robot accounts with handle.
+func (app *App) robotsAdmin(handle func(ctx *Context, w http.ResponseWriter, r *http.Request)) http.Handler {
+	return app.admin(robotsAdminAccess, "the administration of robot accounts", func() []string {
+		return app.Config.Robots.Admins
+	}, handle)
+}
+
+// listRobots lists the robot accounts, by name.
+func (app *App) listRobots(ctx *Context, w http.ResponseWriter, r *http.Request) {
+	accounts, err := app.robots.List(ctx)
+	if err != nil {
+		serveJSONError(ctx, w, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	sort.Sort(accountsByName(accounts))
+
+	serveJSON(ctx, w, http.StatusOK, struct {
+		Robots []robot.Account `json:"robots"`
+	}{accounts})
+}
+
+// createRobot creates a robot account and returns it with its credentials,
+// which cannot be retrieved later.
+func (app *App) createRobot(ctx *Context, w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name        string        `json:"name"`
+		Description string        `json:"description"`
+		Scopes      []robot.Scope `json:"scopes"`
+		Expires     *time.Time    `json:"expires"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		serveJSONError(ctx, w, errorCodeRobotInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	account := robot.Account{
+		Name:        request.Name,
+		Description: request.Description,
+		Scopes:      request.Scopes,
+		Expires:     request.Expires,
+	}
+	if err := account.Validate(); err != nil {
+		serveJSONError(ctx, w, errorCodeRobotInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	account, secret, err := app.robots.Create(ctx, account)
+	switch err {
+	case nil:
+	case robot.ErrAccountExists:
+		serveJSONError(ctx, w, errorCodeRobotExists.WithDetail(request.Name))
+		return
+	default:
+		serveJSONError(ctx, w, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	ctxu.GetLogger(ctx).Infof("robot account %q created", account.Name)
+	w.Header().Set("Location", r.URL.Path+"/"+account.Name)
+	serveJSON(ctx, w, http.StatusCreated, struct {
+		robot.Account
+		Username string `json:"username"`
+		Secret   string `json:"secret"`
+		Token    string `json:"token"`
+	}{account, account.UserName(), secret, account.Token(secret)})
+}
+
+// revokeRobot deletes a robot account.
+func (app *App) revokeRobot(ctx *Context, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	switch err := app.robots.Revoke(ctx, name); err {
+	case nil:
+		ctxu.GetLogger(ctx).Infof("robot account %q revoked", name)
+		w.WriteHeader(http.StatusNoContent)
+	case robot.ErrAccountUnknown:
+		serveJSONError(ctx, w, errorCodeRobotUnknown.WithDetail(name))
+	default:
+		serveJSONError(ctx, w, errcode.ErrorCodeUnknown.WithDetail(err))
+	}
+}
+
+func serveJSON(ctx *Context, w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ctxu.GetLogger(ctx).Errorf("error encoding response: %v", err)
+	}
+}
+
+func serveJSONError(ctx *Context, w http.ResponseWriter, err error) {
+	if err := errcode.ServeJSON(w, err); err != nil {
+		ctxu.GetLogger(ctx).Errorf("error serving error json: %v", err)
+	}
+}
+
+// accountsByName sorts robot accounts by name.
+type accountsByName []robot.Account
+
+func (a accountsByName) Len() int           { return len(a) }
+func (a accountsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a accountsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
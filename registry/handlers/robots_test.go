@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth/robot"
+)
+
+// TestRobotAccounts ensures robot accounts are managed by administrators and
+// authenticated within their scopes until revoked.
+func TestRobotAccounts(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	config.Robots.Enabled = true
+	config.Robots.Admins = []string{"silly"}
+
+	app := NewApp(context.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	do := func(method, path string, body interface{}, setAuth func(*http.Request)) *http.Response {
+		var p []byte
+		if body != nil {
+			var err error
+			if p, err = json.Marshal(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(p))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		if setAuth != nil {
+			setAuth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		return resp
+	}
+	admin := func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer token")
+	}
+
+	create := map[string]interface{}{
+		"name":        "ci",
+		"description": "builds",
+		"scopes":      []robot.Scope{{Repository: "builds/*", Actions: []string{"pull", "push"}}},
+	}
+	resp := do("POST", "/admin/robots", create, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status creating a robot account without credentials: %v", resp.Status)
+	}
+
+	resp = do("POST", "/admin/robots", create, admin)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status creating a robot account: %v", resp.Status)
+	}
+	var created struct {
+		Username string `json:"username"`
+		Secret   string `json:"secret"`
+		Token    string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("unexpected error decoding the robot account: %v", err)
+	}
+	resp.Body.Close()
+	if created.Username != "robot$ci" || created.Secret == "" || created.Token != "robot.ci."+created.Secret {
+		t.Fatalf("unexpected robot account credentials: %+v", created)
+	}
+
+	resp = do("POST", "/admin/robots", create, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("unexpected status creating a duplicate robot account: %v", resp.Status)
+	}
+	resp = do("POST", "/admin/robots", map[string]interface{}{"name": "Bad Name"}, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status creating an invalid robot account: %v", resp.Status)
+	}
+
+	basic := func(req *http.Request) {
+		req.SetBasicAuth(created.Username, created.Secret)
+	}
+	bearer := func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+created.Token)
+	}
+	wrong := func(req *http.Request) {
+		req.SetBasicAuth(created.Username, "wrong")
+	}
+
+	for _, tc := range []struct {
+		path    string
+		setAuth func(*http.Request)
+		status  int
+	}{
+		// The repository is unknown, but access is granted.
+		{"/v2/builds/app/tags/list", basic, http.StatusNotFound},
+		{"/v2/builds/app/tags/list", bearer, http.StatusNotFound},
+		{"/v2/builds/app/tags/list", wrong, http.StatusUnauthorized},
+		{"/v2/other/app/tags/list", basic, http.StatusForbidden},
+		{"/v2/_catalog", basic, http.StatusForbidden},
+		{"/admin/robots", basic, http.StatusForbidden},
+	} {
+		resp := do("GET", tc.path, nil, tc.setAuth)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("GET %s: expected status %d, got %v", tc.path, tc.status, resp.Status)
+		}
+	}
+
+	resp = do("GET", "/admin/robots", nil, admin)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status listing robot accounts: %v", resp.Status)
+	}
+	var list struct {
+		Robots []robot.Account `json:"robots"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("unexpected error decoding robot accounts: %v", err)
+	}
+	resp.Body.Close()
+	if len(list.Robots) != 1 || list.Robots[0].Name != "ci" || list.Robots[0].LastUsed == nil {
+		t.Fatalf("unexpected robot accounts: %+v", list.Robots)
+	}
+
+	resp = do("DELETE", "/admin/robots/ci", nil, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status revoking a robot account: %v", resp.Status)
+	}
+	resp = do("DELETE", "/admin/robots/ci", nil, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status revoking an unknown robot account: %v", resp.Status)
+	}
+
+	resp = do("GET", "/v2/builds/app/tags/list", nil, basic)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status using a revoked robot account: %v", resp.Status)
+	}
+
+	// Only the configured administrators manage robot accounts.
+	app.Config.Robots.Admins = []string{"someone-else"}
+	resp = do("GET", "/admin/robots", nil, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status listing robot accounts as a non-administrator: %v", resp.Status)
+	}
+
+	// Without administrators, the silly access controller, which grants all
+	// access, allows no one.
+	app.Config.Robots.Admins = nil
+	resp = do("GET", "/admin/robots", nil, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status listing robot accounts without administrators: %v", resp.Status)
+	}
+
+	// The endpoints are unavailable once a reload removes the access
+	// controller.
+	reloaded := *app.Config
+	reloaded.Auth = nil
+	if err := app.Reload(&reloaded); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	resp = do("GET", "/admin/robots", nil, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status listing robot accounts without an access controller: %v", resp.Status)
+	}
+}
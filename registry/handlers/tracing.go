@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/tracing"
+	"github.com/gorilla/mux"
+)
+
+// configureTracing installs a tracer exporting to the configured
+// destinations. Tracing is left disabled if none are configured.
+func (app *App) configureTracing(config *configuration.Configuration) error {
+	serviceName := config.Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = "registry"
+	}
+
+	var exporters []tracing.Exporter
+	if config.Tracing.OTLP.Endpoint != "" {
+		exporter, err := tracing.NewOTLPExporter(tracing.OTLPOptions{
+			Endpoint:    config.Tracing.OTLP.Endpoint,
+			Headers:     config.Tracing.OTLP.Headers,
+			Timeout:     config.Tracing.OTLP.Timeout,
+			ServiceName: serviceName,
+		})
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, exporter)
+	}
+
+	if config.Tracing.File.Path != "" {
+		exporter, err := tracing.NewFileExporter(config.Tracing.File.Path, serviceName)
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, exporter)
+	}
+
+	if len(exporters) == 0 {
+		return nil
+	}
+
+	if previous := tracing.SetTracer(tracing.NewTracer(tracing.NewMultiExporter(exporters...))); previous != nil {
+		previous.Close()
+	}
+	ctxu.GetLogger(app).Infof("tracing enabled, exporting spans as %q", serviceName)
+	return nil
+}
+
+// startRequestSpan starts the server span of a request, continuing the trace
+// of the client if it sent a traceparent header. The returned function ends
+// the span once the response has been written.
+func startRequestSpan(ctx *Context, w http.ResponseWriter, r *http.Request) func() {
+	if !tracing.Enabled() {
+		return func() {}
+	}
+
+	if parent, ok := tracing.Extract(r.Header); ok {
+		ctx.Context = tracing.WithRemoteParent(ctx.Context, parent)
+	}
+
+	routeName := "unknown"
+	if route := mux.CurrentRoute(r); route != nil {
+		routeName = route.GetName()
+	}
+
+	var span *tracing.Span
+	ctx.Context, span = tracing.StartSpan(ctx.Context, "registry."+routeName, tracing.WithKind(tracing.SpanKindServer), tracing.WithAttributes(map[string]interface{}{
+		"http.method": r.Method,
+		"http.route":  routeName,
+		"http.target": r.URL.Path,
+	}))
+
+	return func() {
+		if name := getName(ctx); name != "" {
+			span.SetAttribute("registry.repository", name)
+		}
+		status := responseStatus(w)
+		span.SetAttribute("http.status_code", status)
+		if ctx.Errors.Len() > 0 {
+			span.SetError(ctx.Errors)
+		} else if status >= 500 {
+			span.SetError(errorStatus(status))
+		}
+		span.End()
+	}
+}
+
+// errorStatus reports a server error status as an error.
+type errorStatus int
+
+func (es errorStatus) Error() string {
+	return http.StatusText(int(es))
+}
+
+// tracedRepository starts a span around each call to the manifest, blob and
+// tag services of a repository.
+type tracedRepository struct {
+	distribution.Repository
+}
+
+func traceRepository(repository distribution.Repository) distribution.Repository {
+	if !tracing.Enabled() {
+		return repository
+	}
+	return &tracedRepository{Repository: repository}
+}
+
+func (tr *tracedRepository) Manifests(ctx ctxu.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
+	manifests, err := tr.Repository.Manifests(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedManifestService{ManifestService: manifests}, nil
+}
+
+func (tr *tracedRepository) Blobs(ctx ctxu.Context) distribution.BlobStore {
+	return &tracedBlobStore{BlobStore: tr.Repository.Blobs(ctx)}
+}
+
+func (tr *tracedRepository) Tags(ctx ctxu.Context) distribution.TagService {
+	return &tracedTagService{TagService: tr.Repository.Tags(ctx)}
+}
+
+// startSpan starts a span for a call to a repository service. The returned
+// function records err on the span and ends it.
+func startSpan(ctx ctxu.Context, name string, attributes map[string]interface{}) (ctxu.Context, func(err error)) {
+	ctx, span := tracing.StartSpan(ctx, name, tracing.WithAttributes(attributes))
+	return ctx, func(err error) {
+		if _, ok := err.(distribution.ErrBlobMounted); !ok {
+			span.SetError(err)
+		}
+		span.End()
+	}
+}
+
+type tracedManifestService struct {
+	distribution.ManifestService
+}
+
+func (tms *tracedManifestService) Exists(ctx ctxu.Context, dgst digest.Digest) (exists bool, err error) {
+	ctx, finish := startSpan(ctx, "manifests.Exists", map[string]interface{}{"digest": dgst.String()})
+	defer func() { finish(err) }()
+	return tms.ManifestService.Exists(ctx, dgst)
+}
+
+func (tms *tracedManifestService) Get(ctx ctxu.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (manifest distribution.Manifest, err error) {
+	ctx, finish := startSpan(ctx, "manifests.Get", map[string]interface{}{"digest": dgst.String()})
+	defer func() { finish(err) }()
+	return tms.ManifestService.Get(ctx, dgst, options...)
+}
+
+func (tms *tracedManifestService) Put(ctx ctxu.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (dgst digest.Digest, err error) {
+	ctx, finish := startSpan(ctx, "manifests.Put", nil)
+	defer func() { finish(err) }()
+	return tms.ManifestService.Put(ctx, manifest, options...)
+}
+
+func (tms *tracedManifestService) Delete(ctx ctxu.Context, dgst digest.Digest) (err error) {
+	ctx, finish := startSpan(ctx, "manifests.Delete", map[string]interface{}{"digest": dgst.String()})
+	defer func() { finish(err) }()
+	return tms.ManifestService.Delete(ctx, dgst)
+}
+
+type tracedBlobStore struct {
+	distribution.BlobStore
+}
+
+func (tbs *tracedBlobStore) Stat(ctx ctxu.Context, dgst digest.Digest) (desc distribution.Descriptor, err error) {
+	ctx, finish := startSpan(ctx, "blobs.Stat", map[string]interface{}{"digest": dgst.String()})
+	defer func() { finish(err) }()
+	return tbs.BlobStore.Stat(ctx, dgst)
+}
+
+func (tbs *tracedBlobStore) Get(ctx ctxu.Context, dgst digest.Digest) (p []byte, err error) {
+	ctx, finish := startSpan(ctx, "blobs.Get", map[string]interface{}{"digest": dgst.String()})
+	defer func() { finish(err) }()
+	return tbs.BlobStore.Get(ctx, dgst)
+}
+
+func (tbs *tracedBlobStore) Open(ctx ctxu.Context, dgst digest.Digest) (rsc distribution.ReadSeekCloser, err error) {
+	ctx, finish := startSpan(ctx, "blobs.Open", map[string]interface{}{"digest": dgst.String()})
+	defer func() { finish(err) }()
+	return tbs.BlobStore.Open(ctx, dgst)
+}
+
+func (tbs *tracedBlobStore) ServeBlob(ctx ctxu.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) (err error) {
+	ctx, finish := startSpan(ctx, "blobs.ServeBlob", map[string]interface{}{"digest": dgst.String()})
+	defer func() { finish(err) }()
+	return tbs.BlobStore.ServeBlob(ctx, w, r, dgst)
+}
+
+func (tbs *tracedBlobStore) Put(ctx ctxu.Context, mediaType string, p []byte) (desc distribution.Descriptor, err error) {
+	ctx, finish := startSpan(ctx, "blobs.Put", map[string]interface{}{"size": len(p)})
+	defer func() { finish(err) }()
+	return tbs.BlobStore.Put(ctx, mediaType, p)
+}
+
+func (tbs *tracedBlobStore) Create(ctx ctxu.Context, options ...distribution.BlobCreateOption) (bw distribution.BlobWriter, err error) {
+	ctx, finish := startSpan(ctx, "blobs.Create", nil)
+	defer func() { finish(err) }()
+	bw, err = tbs.BlobStore.Create(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedBlobWriter{BlobWriter: bw}, nil
+}
+
+func (tbs *tracedBlobStore) Resume(ctx ctxu.Context, id string) (bw distribution.BlobWriter, err error) {
+	ctx, finish := startSpan(ctx, "blobs.Resume", map[string]interface{}{"upload": id})
+	defer func() { finish(err) }()
+	bw, err = tbs.BlobStore.Resume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedBlobWriter{BlobWriter: bw}, nil
+}
+
+func (tbs *tracedBlobStore) Delete(ctx ctxu.Context, dgst digest.Digest) (err error) {
+	ctx, finish := startSpan(ctx, "blobs.Delete", map[string]interface{}{"digest": dgst.String()})
+	defer func() { finish(err) }()
+	return tbs.BlobStore.Delete(ctx, dgst)
+}
+
+type tracedBlobWriter struct {
+	distribution.BlobWriter
+}
+
+func (tbw *tracedBlobWriter) Commit(ctx ctxu.Context, provisional distribution.Descriptor) (desc distribution.Descriptor, err error) {
+	ctx, finish := startSpan(ctx, "blobs.Commit", map[string]interface{}{
+		"digest": provisional.Digest.String(),
+		"upload": tbw.ID(),
+	})
+	defer func() { finish(err) }()
+	return tbw.BlobWriter.Commit(ctx, provisional)
+}
+
+type tracedTagService struct {
+	distribution.TagService
+}
+
+func (tts *tracedTagService) Get(ctx ctxu.Context, tag string) (desc distribution.Descriptor, err error) {
+	ctx, finish := startSpan(ctx, "tags.Get", map[string]interface{}{"tag": tag})
+	defer func() { finish(err) }()
+	return tts.TagService.Get(ctx, tag)
+}
+
+func (tts *tracedTagService) Tag(ctx ctxu.Context, tag string, desc distribution.Descriptor) (err error) {
+	ctx, finish := startSpan(ctx, "tags.Tag", map[string]interface{}{"tag": tag, "digest": desc.Digest.String()})
+	defer func() { finish(err) }()
+	return tts.TagService.Tag(ctx, tag, desc)
+}
+
+func (tts *tracedTagService) Untag(ctx ctxu.Context, tag string) (err error) {
+	ctx, finish := startSpan(ctx, "tags.Untag", map[string]interface{}{"tag": tag})
+	defer func() { finish(err) }()
+	return tts.TagService.Untag(ctx, tag)
+}
+
+func (tts *tracedTagService) All(ctx ctxu.Context) (tags []string, err error) {
+	ctx, finish := startSpan(ctx, "tags.All", nil)
+	defer func() { finish(err) }()
+	return tts.TagService.All(ctx)
+}
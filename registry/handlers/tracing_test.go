@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/tracing"
+)
+
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+// TestRequestTracing ensures a request continues the trace of the client
+// and that service and storage calls are recorded as its descendants.
+func TestRequestTracing(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		spans []collectedSpan
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []collectedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding export request: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Tracing.OTLP.Endpoint = collector.URL + "/v1/traces"
+
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+	defer func() {
+		if tracer := tracing.SetTracer(nil); tracer != nil {
+			tracer.Close()
+		}
+	}()
+
+	tagsURL := env.server.URL + "/v2/foo/bar/tags/list"
+	req, err := http.NewRequest("GET", tagsURL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+	checkResponse(t, "listing tags", resp, http.StatusNotFound)
+
+	tracing.SetTracer(nil).Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	byID := make(map[string]collectedSpan)
+	byName := make(map[string]collectedSpan)
+	for _, span := range spans {
+		if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("span %q is not part of the client's trace: %s", span.Name, span.TraceID)
+		}
+		byID[span.SpanID] = span
+		byName[span.Name] = span
+	}
+
+	server, ok := byName["registry.tags"]
+	if !ok {
+		t.Fatalf("request span not exported: %v", spans)
+	}
+	if server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("request span should be a child of the client span: %v", server)
+	}
+
+	for _, name := range []string{"tags.All", "storage.List"} {
+		span, ok := byName[name]
+		if !ok {
+			t.Fatalf("span %q not exported: %v", name, spans)
+		}
+		// Walk up to the request span.
+		for span.SpanID != server.SpanID {
+			parent, ok := byID[span.ParentSpanID]
+			if !ok {
+				t.Fatalf("span %q is not a descendant of the request span", name)
+			}
+			span = parent
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+// ValidateConfiguration runs the option validation of the storage driver,
+// the access controller and the middlewares of config, as NewApp would,
+// without serving. Each error names the key path of the offending section.
+// The storage driver is constructed but not accessed.
+func ValidateConfiguration(ctx context.Context, config *configuration.Configuration) []error {
+	var errs []error
+	check := func(path string, fn func() error) {
+		if err := catch(fn); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+		}
+	}
+
+	driverType := config.Storage.Type()
+	driverPath := "storage." + driverType
+	check(driverPath, func() error {
+		driver, err := factory.Create(driverType, config.Storage.Parameters())
+		if err != nil {
+			return err
+		}
+
+		for i, mw := range config.Middleware["storage"] {
+			check(fmt.Sprintf("middleware.storage[%d] (%s)", i, mw.Name), func() error {
+				_, err := applyStorageMiddleware(driver, []configuration.Middleware{mw})
+				return err
+			})
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			return err
+		}
+		for i, mw := range config.Middleware["registry"] {
+			check(fmt.Sprintf("middleware.registry[%d] (%s)", i, mw.Name), func() error {
+				_, err := applyRegistryMiddleware(ctx, registry, []configuration.Middleware{mw})
+				return err
+			})
+		}
+
+		named, err := reference.WithName("validate/configuration")
+		if err != nil {
+			return err
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			return err
+		}
+		for i, mw := range config.Middleware["repository"] {
+			check(fmt.Sprintf("middleware.repository[%d] (%s)", i, mw.Name), func() error {
+				_, err := applyRepoMiddleware(ctx, repository, []configuration.Middleware{mw})
+				return err
+			})
+		}
+		return nil
+	})
+
+	if _, err := maintenanceReadOnly(config); err != nil {
+		errs = append(errs, fmt.Errorf("storage.maintenance.readonly: %v", err))
+	}
+	if _, _, err := manifestURLRegexps(config); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := anonymousRules(config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if authType := config.Auth.Type(); authType != "" {
+		check("auth."+authType, func() error {
+			_, err := auth.GetAccessController(authType, config.Auth.Parameters())
+			return err
+		})
+	}
+	if config.Robots.Enabled && config.Auth.Type() == "" {
+		errs = append(errs, fmt.Errorf("robots: robot accounts require an auth provider to authenticate their administrators"))
+	}
+
+	return errs
+}
+
+// catch calls fn, turning a panic into an error.
+func catch(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/redirect"
+)
+
+// TestValidateConfiguration ensures option errors are reported with the key
+// path of the offending section.
+func TestValidateConfiguration(t *testing.T) {
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{"inmemory": nil},
+	}
+	if errs := ValidateConfiguration(context.Background(), config); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	config.Storage["maintenance"] = configuration.Parameters{"readonly": "yes"}
+	config.Auth = configuration.Auth{"nosuchauth": nil}
+	config.Middleware = map[string][]configuration.Middleware{
+		"storage": {{Name: "redirect", Options: configuration.Parameters{}}},
+	}
+
+	errs := ValidateConfiguration(context.Background(), config)
+	expected := []string{"middleware.storage[0] (redirect): ", "storage.maintenance.readonly: ", "auth.nosuchauth: "}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(errs[i].Error(), prefix) {
+			t.Errorf("expected error %d to start with %q, got %q", i, prefix, errs[i])
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/configuration"
+	ctxu "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/auth"
+	"github.com/docker/distribution/registry/proxy"
+)
+
+// warmAdminPath is the path of the endpoint warming the cache, below the
+// http prefix.
+const warmAdminPath = "/admin/cache/warm"
+
+// maxWarmConcurrency bounds the concurrency requested from the endpoint
+// warming the cache.
+const maxWarmConcurrency = 32
+
+// warmAdminAccess is the access required to warm the cache.
+var warmAdminAccess = auth.Access{
+	Resource: auth.Resource{
+		Type: "registry",
+		Name: "cache",
+	},
+	Action: "*",
+}
+
+// Errors returned by the endpoint warming the cache.
+var errorCodeWarmInvalid = errcode.Register("registry.api.cache", errcode.ErrorDescriptor{
+	Value:          "WARM_INVALID",
+	Message:        "invalid cache warming request",
+	Description:    "The request to warm the cache is malformed.",
+	HTTPStatusCode: http.StatusBadRequest,
+})
+
+// configureWarm registers the endpoint warming the cache, when an access
+// controller authenticates its administrators.
+func (app *App) configureWarm(config *configuration.Configuration) {
+	if config.Auth.Type() == "" {
+		return
+	}
+	if len(config.Proxy.Warm.Admins) == 0 && !grantsAdminExplicitly(config.Auth.Type()) {
+		ctxu.GetLogger(app).Warnf("proxy.warm.admins must list the users warming the cache with the %q access controller", config.Auth.Type())
+	}
+	prefix := strings.TrimSuffix(config.HTTP.Prefix, "/")
+	app.router.Path(prefix + warmAdminPath).Methods("POST").Handler(app.admin(warmAdminAccess, "warming the cache", func() []string {
+		return app.Config.Proxy.Warm.Admins
+	}, app.warmCache))
+}
+
+// warmRequest is a request to warm the cache.
+type warmRequest struct {
+	Images      []string `json:"images"`
+	Platforms   []string `json:"platforms"`
+	Concurrency int      `json:"concurrency"`
+}
+
+// warmSummary ends the response warming the cache.
+type warmSummary struct {
+	Images int   `json:"images"`
+	Failed int   `json:"failed"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// warmCache pulls the images of the request into the cache. The request is
+// either JSON, or text listing an image per line. The result of each image
+// is streamed as a line of JSON once it is warmed, followed by a summary.
+func (app *App) warmCache(ctx *Context, w http.ResponseWriter, r *http.Request) {
+	request, err := parseWarmRequest(r)
+	if err != nil {
+		serveJSONError(ctx, w, errorCodeWarmInvalid.WithDetail(err.Error()))
+		return
+	}
+	if len(request.Images) == 0 {
+		serveJSONError(ctx, w, errorCodeWarmInvalid.WithDetail("no images"))
+		return
+	}
+	if request.Concurrency < 0 || request.Concurrency > maxWarmConcurrency {
+		serveJSONError(ctx, w, errorCodeWarmInvalid.WithDetail(fmt.Sprintf("concurrency must be between 0 and %d", maxWarmConcurrency)))
+		return
+	}
+
+	var (
+		encoder    = json.NewEncoder(w)
+		flusher, _ = w.(http.Flusher)
+		started    bool
+	)
+	write := func(v interface{}) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if err := encoder.Encode(v); err != nil {
+			ctxu.GetLogger(ctx).Errorf("error encoding response: %v", err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	ctxu.GetLogger(ctx).Infof("warming the cache with %d images", len(request.Images))
+	results, err := proxy.Warm(ctx, app.registry, request.Images, proxy.WarmOptions{
+		Platforms:   request.Platforms,
+		Concurrency: request.Concurrency,
+		Progress: func(result proxy.WarmResult) {
+			if result.Error != "" {
+				ctxu.GetLogger(ctx).Warnf("error warming the cache with %s: %s", result.Image, result.Error)
+			}
+			write(result)
+		},
+	})
+	if err != nil {
+		// Warm fails before warming any image.
+		serveJSONError(ctx, w, errorCodeWarmInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	summary := warmSummary{Images: len(results)}
+	for _, result := range results {
+		if result.Error != "" {
+			summary.Failed++
+		}
+		summary.Bytes += result.Bytes
+	}
+	write(summary)
+}
+
+// parseWarmRequest reads the request to warm the cache. Platforms may also
+// be given by platform query parameters.
+func parseWarmRequest(r *http.Request) (warmRequest, error) {
+	var request warmRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			return warmRequest{}, err
+		}
+	} else {
+		images, err := proxy.ReadImageList(r.Body)
+		if err != nil {
+			return warmRequest{}, err
+		}
+		request.Images = images
+	}
+	request.Platforms = append(request.Platforms, r.URL.Query()["platform"]...)
+	return request, nil
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+)
+
+// TestWarmCache ensures the cache is warmed by its administrators, with the
+// result of each image streamed before a summary.
+func TestWarmCache(t *testing.T) {
+	storage := configuration.Storage{
+		"testdriver": nil,
+		"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+			"enabled": false,
+		}},
+	}
+	upstream := httptest.NewServer(NewApp(context.Background(), &configuration.Configuration{Storage: storage}))
+	defer upstream.Close()
+
+	config := configuration.Configuration{
+		Storage: storage,
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+		Proxy: configuration.Proxy{RemoteURL: upstream.URL},
+	}
+	config.Proxy.Warm.Admins = []string{"silly"}
+
+	app := NewApp(context.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	do := func(path, contentType, body string, admin bool) *http.Response {
+		req, err := http.NewRequest("POST", server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		if admin {
+			req.Header.Set("Authorization", "Bearer token")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		return resp
+	}
+
+	resp := do("/admin/cache/warm", "text/plain", "library/app\n", false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status warming the cache without credentials: %v", resp.Status)
+	}
+
+	resp = do("/admin/cache/warm", "application/json", `{"images":["library/app"],"concurrency":1000}`, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status warming the cache with an invalid concurrency: %v", resp.Status)
+	}
+
+	resp = do("/admin/cache/warm?platform=linux/amd64", "text/plain", "# images\nlibrary/app:missing\nlibrary/other\n", true)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status warming the cache: %v", resp.Status)
+	}
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("unexpected error decoding %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected the results of 2 images and a summary, got %v", lines)
+	}
+	for _, line := range lines[:2] {
+		if line["error"] == nil {
+			t.Errorf("expected an error warming %v, which is not upstream", line["image"])
+		}
+	}
+	if summary := lines[2]; summary["images"] != 2.0 || summary["failed"] != 2.0 {
+		t.Errorf("unexpected summary %v", summary)
+	}
+
+	app.Config.Proxy.Warm.Admins = []string{"someone-else"}
+	resp = do("/admin/cache/warm", "text/plain", "library/app\n", true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status warming the cache as another user: %v", resp.Status)
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// defaultCacheTTL is the time content is kept in the cache after it was last
+// accessed, unless configured otherwise.
+const defaultCacheTTL = 24 * 7 * time.Hour
+
+// cachePolicy determines how long the content of repositories is kept in
+// the cache.
+type cachePolicy struct {
+	ttl  time.Duration
+	ttls []cacheTTL
+}
+
+// cacheTTL is the TTL of the repositories matching pattern.
+type cacheTTL struct {
+	pattern auth.Pattern
+	ttl     time.Duration
+}
+
+// newCachePolicy returns the cache policy of config.
+func newCachePolicy(config configuration.ProxyCache) (cachePolicy, error) {
+	policy := cachePolicy{ttl: config.TTL}
+	switch {
+	case config.TTL < 0:
+		return cachePolicy{}, fmt.Errorf("proxy: cache.ttl must not be negative")
+	case config.TTL == 0:
+		policy.ttl = defaultCacheTTL
+	}
+	if config.MaxSize < 0 {
+		return cachePolicy{}, fmt.Errorf("proxy: cache.maxsize must not be negative")
+	}
+
+	for i, t := range config.TTLs {
+		if t.Repository == "" {
+			return cachePolicy{}, fmt.Errorf("proxy: cache.ttls[%d]: repository must be set", i)
+		}
+		if t.TTL <= 0 {
+			return cachePolicy{}, fmt.Errorf("proxy: cache.ttls[%d]: ttl must be positive", i)
+		}
+		policy.ttls = append(policy.ttls, cacheTTL{
+			pattern: auth.NewPattern(t.Repository),
+			ttl:     t.TTL,
+		})
+	}
+	return policy, nil
+}
+
+// repositoryTTL returns the TTL of the content of the repository name.
+func (p cachePolicy) repositoryTTL(name string) time.Duration {
+	for _, t := range p.ttls {
+		if t.pattern.Match(name) {
+			return t.ttl
+		}
+	}
+	return p.ttl
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+)
+
+func TestCachePolicy(t *testing.T) {
+	policy, err := newCachePolicy(configuration.ProxyCache{
+		TTL: time.Hour,
+		TTLs: []configuration.ProxyCacheTTL{
+			{Repository: "hub/library/*", TTL: 30 * 24 * time.Hour},
+			{Repository: "*/nightly", TTL: 10 * time.Minute},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error configuring cache: %v", err)
+	}
+	for name, expected := range map[string]time.Duration{
+		"hub/library/ubuntu": 30 * 24 * time.Hour,
+		"app/nightly":        10 * time.Minute,
+		"app/stable":         time.Hour,
+	} {
+		if ttl := policy.repositoryTTL(name); ttl != expected {
+			t.Errorf("%s: expected ttl %s, got %s", name, expected, ttl)
+		}
+	}
+
+	policy, err = newCachePolicy(configuration.ProxyCache{})
+	if err != nil {
+		t.Fatalf("unexpected error configuring cache: %v", err)
+	}
+	if ttl := policy.repositoryTTL("app"); ttl != defaultCacheTTL {
+		t.Errorf("expected default ttl %s, got %s", defaultCacheTTL, ttl)
+	}
+
+	for _, config := range []configuration.ProxyCache{
+		{TTL: -time.Hour},
+		{MaxSize: -1},
+		{TTLs: []configuration.ProxyCacheTTL{{TTL: time.Hour}}},
+		{TTLs: []configuration.ProxyCacheTTL{{Repository: "app"}}},
+	} {
+		if _, err := newCachePolicy(config); err == nil {
+			t.Errorf("expected an error configuring %+v", config)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/uuid"
+)
+
+// Defaults of the coordination of blob fetches across registry instances.
+const (
+	defaultLeaseTTL  = 15 * time.Second
+	defaultLeaseWait = time.Minute
+	defaultMaxWait   = 30 * time.Second
+	leasePoll        = 250 * time.Millisecond
+)
+
+// leases are locks with an expiry shared by the registry instances, held by
+// the instance knowing their token.
+type leases interface {
+	// acquire takes the lease of key for ttl, unless it is held.
+	acquire(key, token string, ttl time.Duration) (bool, error)
+
+	// renew extends the lease of key for ttl, unless it is not held with
+	// token anymore.
+	renew(key, token string, ttl time.Duration) (bool, error)
+
+	// release releases the lease of key, if it is held with token.
+	release(key, token string) error
+
+	// held returns whether the lease of key is held, and the time left
+	// until it expires, which is negative if it does not.
+	held(key string) (time.Duration, bool, error)
+}
+
+// fetchCoordinator de-duplicates the fetches of blobs from the remote by the
+// registry instances sharing the storage of the cache: the instance holding
+// the lease of a blob fetches it, while the others wait for it to be stored.
+// A lease is renewed while its blob is fetched, so that it expires shortly
+// after its instance crashed; the others give up waiting once it is no
+// longer renewed. As nothing is sent to a client while its request waits,
+// requests also give up after maxWait, while warming the cache waits as long
+// as the fetch takes.
+type fetchCoordinator struct {
+	leases  leases
+	ttl     time.Duration
+	wait    time.Duration
+	maxWait time.Duration
+	poll    time.Duration
+}
+
+func newFetchCoordinator(l leases, config configuration.ProxyCoordination) (*fetchCoordinator, error) {
+	if config.LeaseTTL < 0 || config.Wait < 0 || config.MaxWait < 0 {
+		return nil, fmt.Errorf("proxy: coordination.leasettl, coordination.wait and coordination.maxwait must not be negative")
+	}
+	fc := &fetchCoordinator{
+		leases:  l,
+		ttl:     config.LeaseTTL,
+		wait:    config.Wait,
+		maxWait: config.MaxWait,
+		poll:    leasePoll,
+	}
+	if fc.ttl == 0 {
+		fc.ttl = defaultLeaseTTL
+	}
+	if fc.wait == 0 {
+		fc.wait = defaultLeaseWait
+	}
+	if fc.maxWait == 0 {
+		fc.maxWait = defaultMaxWait
+	}
+	return fc, nil
+}
+
+// leaseKey returns the key of the lease of fetching dgst in the repository
+// name. Blobs are fetched per repository, as they are only served by the
+// repositories they are linked in.
+func leaseKey(name reference.Named, dgst digest.Digest) string {
+	return "proxy::fetch::" + name.Name() + "@" + dgst.String()
+}
+
+// lead takes the lease of key, returning whether it was taken and the
+// function releasing it. The lease is renewed until released.
+func (fc *fetchCoordinator) lead(ctx context.Context, key string) (func(), bool, error) {
+	token := uuid.Generate().String()
+	ok, err := fc.leases.acquire(key, token, fc.ttl)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(fc.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ok, err := fc.leases.renew(key, token, fc.ttl)
+				if err != nil {
+					context.GetLogger(ctx).Warnf("Error renewing fetch lease %s: %v", key, err)
+				} else if !ok {
+					context.GetLogger(ctx).Warnf("Fetch lease %s lost", key)
+					return
+				}
+			}
+		}
+	}()
+
+	release := func() {
+		close(done)
+		if err := fc.leases.release(key, token); err != nil {
+			context.GetLogger(ctx).Warnf("Error releasing fetch lease %s: %v", key, err)
+		}
+	}
+	return release, true, nil
+}
+
+// await waits until the lease of key is released or expires, returning
+// false if it is held without being renewed for the wait of fc, such as a
+// lease taken with a longer TTL by an instance which crashed, or if it is
+// still held at until, unless until is zero.
+func (fc *fetchCoordinator) await(ctx context.Context, key string, until time.Time) (bool, error) {
+	var expires, deadline time.Time
+	for {
+		left, held, err := fc.leases.held(key)
+		if err != nil {
+			return false, err
+		}
+		if !held {
+			return true, nil
+		}
+
+		// Renewals push the expiry of the lease back by a fraction of its
+		// TTL, more than the time between polls.
+		now := time.Now()
+		if deadline.IsZero() || (left >= 0 && now.Add(left).Sub(expires) > fc.poll) {
+			expires = now.Add(left)
+			deadline = now.Add(fc.wait)
+		}
+		if !now.Before(deadline) || (!until.IsZero() && !now.Before(until)) {
+			return false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(fc.poll):
+		}
+	}
+}
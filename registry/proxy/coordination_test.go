@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/garyburd/redigo/redis"
+)
+
+// memoryLeases keeps leases in memory, standing for redis.
+type memoryLeases struct {
+	mu     sync.Mutex
+	leases map[string]memoryLease
+}
+
+type memoryLease struct {
+	token  string
+	expiry time.Time
+}
+
+func newMemoryLeases() *memoryLeases {
+	return &memoryLeases{leases: make(map[string]memoryLease)}
+}
+
+func (l *memoryLeases) holder(key string) string {
+	lease, ok := l.leases[key]
+	if !ok || !time.Now().Before(lease.expiry) {
+		return ""
+	}
+	return lease.token
+}
+
+func (l *memoryLeases) acquire(key, token string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder(key) != "" {
+		return false, nil
+	}
+	l.leases[key] = memoryLease{token: token, expiry: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (l *memoryLeases) renew(key, token string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder(key) != token {
+		return false, nil
+	}
+	l.leases[key] = memoryLease{token: token, expiry: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (l *memoryLeases) release(key, token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder(key) == token {
+		delete(l.leases, key)
+	}
+	return nil
+}
+
+func (l *memoryLeases) held(key string) (time.Duration, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder(key) == "" {
+		return 0, false, nil
+	}
+	return l.leases[key].expiry.Sub(time.Now()), true, nil
+}
+
+// testInstance is a registry instance of a cache shared by several.
+type testInstance struct {
+	cache distribution.Namespace
+	blobs *proxyBlobStore
+}
+
+func newTestInstance(t *testing.T, remoteURL string, local distribution.Namespace, leases leases, wait time.Duration) testInstance {
+	ctx := context.Background()
+	cache, err := NewRegistryPullThroughCache(ctx, local, inmemory.New(), configuration.Proxy{RemoteURL: remoteURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches, err := newFetchCoordinator(leases, configuration.ProxyCoordination{LeaseTTL: 300 * time.Millisecond, Wait: wait})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches.poll = 10 * time.Millisecond
+	cache.(*proxyingRegistry).fetches = fetches
+
+	name, _ := reference.ParseNamed("library/app")
+	repo, err := cache.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testInstance{cache: cache, blobs: repo.Blobs(ctx).(*proxyBlobStore)}
+}
+
+func (i testInstance) serve(t *testing.T, desc distribution.Descriptor) <-chan *httptest.ResponseRecorder {
+	served := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		if err := i.blobs.ServeBlob(context.Background(), w, r, desc.Digest); err != nil {
+			t.Errorf("unexpected error serving blob: %v", err)
+		}
+		served <- w
+	}()
+	return served
+}
+
+func (i testInstance) close() {
+	i.cache.(*proxyingRegistry).Close()
+}
+
+func newCoordinationEnv(t *testing.T) (*testUpstream, distribution.Descriptor, *httptest.Server, distribution.Namespace) {
+	upstream := newTestUpstream()
+	desc := upstream.add("application/octet-stream", []byte("a big layer"))
+	server := httptest.NewServer(upstream)
+
+	local, err := storage.NewRegistry(context.Background(), inmemory.New(), storage.EnableDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upstream, desc, server, local
+}
+
+// TestCoordinatedFetch checks that a blob requested from two instances at
+// once is fetched by one of them, and served to the other once stored, even
+// if fetching it takes longer than the wait while the lease is renewed.
+func TestCoordinatedFetch(t *testing.T) {
+	upstream, desc, server, local := newCoordinationEnv(t)
+	defer server.Close()
+	upstream.gate = make(chan struct{})
+
+	leases := newMemoryLeases()
+	leader := newTestInstance(t, server.URL, local, leases, time.Minute)
+	defer leader.close()
+	follower := newTestInstance(t, server.URL, local, leases, 200*time.Millisecond)
+	defer follower.close()
+
+	key := leaseKey(leader.blobs.repositoryName, desc.Digest)
+	led := leader.serve(t, desc)
+	for _, held, _ := leases.held(key); !held; _, held, _ = leases.held(key) {
+		time.Sleep(time.Millisecond)
+	}
+	coalesced := atomic.LoadUint64(&proxyMetrics.blobMetrics.Coalesced)
+	followed := follower.serve(t, desc)
+
+	// The lease is renewed while the blob is fetched.
+	time.Sleep(500 * time.Millisecond)
+	close(upstream.gate)
+
+	for _, served := range []<-chan *httptest.ResponseRecorder{led, followed} {
+		if w := <-served; w.Body.String() != "a big layer" {
+			t.Errorf("unexpected blob %q", w.Body.String())
+		}
+	}
+	// The leader fetches the blob to store it, and to serve it.
+	upstream.mu.Lock()
+	if upstream.blobs != 2 {
+		t.Errorf("expected the blob fetched by the leader only, got %d fetches", upstream.blobs)
+	}
+	upstream.mu.Unlock()
+	if atomic.LoadUint64(&proxyMetrics.blobMetrics.Coalesced) != coalesced+1 {
+		t.Errorf("expected the fetch counted as coalesced")
+	}
+	if _, held, _ := leases.held(key); held {
+		t.Errorf("expected the lease released")
+	}
+}
+
+// TestCoordinatedFetchTakeover checks that the fetch of an instance which
+// crashed is taken over once its lease expires, or once it is not renewed
+// within the wait.
+func TestCoordinatedFetchTakeover(t *testing.T) {
+	upstream, desc, server, local := newCoordinationEnv(t)
+	defer server.Close()
+
+	leases := newMemoryLeases()
+	instance := newTestInstance(t, server.URL, local, leases, time.Minute)
+	defer instance.close()
+	key := leaseKey(instance.blobs.repositoryName, desc.Digest)
+
+	leases.acquire(key, "crashed", 100*time.Millisecond)
+	start := time.Now()
+	if w := <-instance.serve(t, desc); w.Body.String() != "a big layer" {
+		t.Errorf("unexpected blob %q", w.Body.String())
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("expected the blob fetched once the lease expired")
+	}
+	for i := 0; ; i++ {
+		if _, err := instance.blobs.localStore.Stat(context.Background(), desc.Digest); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected the blob stored once the lease was taken over")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	other := upstream.add("application/octet-stream", []byte("another layer"))
+	impatient := newTestInstance(t, server.URL, local, leases, 50*time.Millisecond)
+	defer impatient.close()
+	leases.acquire(leaseKey(impatient.blobs.repositoryName, other.Digest), "stuck", time.Hour)
+	if w := <-impatient.serve(t, other); w.Body.String() != "another layer" {
+		t.Errorf("unexpected blob %q", w.Body.String())
+	}
+	for i := 0; ; i++ {
+		if _, err := impatient.blobs.localStore.Stat(context.Background(), other.Digest); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected the blob stored once the lease was not renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Warming takes a lease which is not renewed over as well.
+	warmed := upstream.add("application/octet-stream", []byte("a warmed layer"))
+	leases.acquire(leaseKey(impatient.blobs.repositoryName, warmed.Digest), "stuck", time.Hour)
+	if n, err := impatient.blobs.fetch(context.Background(), warmed.Digest); err != nil || n == 0 {
+		t.Fatalf("expected the blob warmed once the lease was not renewed: %d, %v", n, err)
+	}
+}
+
+// TestCoordinatedFetchMaxWait checks that a blob request stops waiting for a
+// blob fetched by another instance after the max wait, however long its
+// lease is renewed, while warming the cache waits for the whole fetch.
+func TestCoordinatedFetchMaxWait(t *testing.T) {
+	_, desc, server, local := newCoordinationEnv(t)
+	defer server.Close()
+
+	leases := newMemoryLeases()
+	leader := newTestInstance(t, server.URL, local, leases, time.Minute)
+	defer leader.close()
+	follower := newTestInstance(t, server.URL, local, leases, time.Minute)
+	defer follower.close()
+	follower.blobs.fetches.maxWait = 100 * time.Millisecond
+
+	key := leaseKey(leader.blobs.repositoryName, desc.Digest)
+	release, ok, err := leader.blobs.fetches.lead(context.Background(), key)
+	if err != nil || !ok {
+		t.Fatalf("expected the lease taken: %v, %v", ok, err)
+	}
+
+	start := time.Now()
+	if w := <-follower.serve(t, desc); w.Body.String() != "a big layer" {
+		t.Errorf("unexpected blob %q", w.Body.String())
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond || waited > 5*time.Second {
+		t.Errorf("expected the blob streamed after the max wait, got %v", waited)
+	}
+	if _, err := follower.blobs.localStore.Stat(context.Background(), desc.Digest); err == nil {
+		t.Errorf("expected the blob streamed without being stored")
+	}
+
+	time.AfterFunc(300*time.Millisecond, release)
+	start = time.Now()
+	if _, err := follower.blobs.fetch(context.Background(), desc.Digest); err != nil {
+		t.Fatalf("unexpected error warming the blob: %v", err)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Errorf("expected warming to wait for the lease to be released")
+	}
+	if _, err := follower.blobs.localStore.Stat(context.Background(), desc.Digest); err != nil {
+		t.Errorf("expected the blob stored once warmed: %v", err)
+	}
+}
+
+// TestRedisLeases exercises a live redis instance. It is skipped unless
+// TEST_REGISTRY_PROXY_REDIS_ADDR is set.
+func TestRedisLeases(t *testing.T) {
+	addr := os.Getenv("TEST_REGISTRY_PROXY_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("please set TEST_REGISTRY_PROXY_REDIS_ADDR to test the fetch leases against redis")
+	}
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+		MaxIdle: 1,
+	}
+	defer pool.Close()
+	l := &redisLeases{pool: pool}
+	key := "proxy::fetch::test"
+	l.release(key, "a")
+	l.release(key, "b")
+
+	if ok, err := l.acquire(key, "a", time.Second); err != nil || !ok {
+		t.Fatalf("expected the lease acquired: %v, %v", ok, err)
+	}
+	if ok, err := l.acquire(key, "b", time.Second); err != nil || ok {
+		t.Fatalf("expected the lease held: %v, %v", ok, err)
+	}
+	if ok, err := l.renew(key, "b", time.Second); err != nil || ok {
+		t.Fatalf("expected the lease not renewed by another holder: %v, %v", ok, err)
+	}
+	if ok, err := l.renew(key, "a", 100*time.Millisecond); err != nil || !ok {
+		t.Fatalf("expected the lease renewed: %v, %v", ok, err)
+	}
+	if err := l.release(key, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if left, held, err := l.held(key); err != nil || !held || left <= 0 || left > 100*time.Millisecond {
+		t.Fatalf("expected the lease not released by another holder: %v, %v, %v", left, held, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, held, err := l.held(key); err != nil || held {
+		t.Fatalf("expected the lease expired: %v, %v", held, err)
+	}
+	if ok, err := l.acquire(key, "b", time.Second); err != nil || !ok {
+		t.Fatalf("expected the expired lease acquired: %v, %v", ok, err)
+	}
+	if err := l.release(key, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, held, err := l.held(key); err != nil || held {
+		t.Fatalf("expected the lease released: %v, %v", held, err)
+	}
+}
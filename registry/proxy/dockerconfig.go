@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// dockerConfig holds the credentials of a docker config.json file, by
+// registry host.
+type dockerConfig map[string]userpass
+
+// dockerConfigFile is the format of a docker config.json file, of which only
+// the credentials are read.
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+}
+
+// hubHosts are the hosts of Docker Hub, whose credentials docker stores
+// under the index.
+var hubHosts = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+const hubIndexHost = "index.docker.io"
+
+// loadDockerConfig reads the credentials of the docker config.json file at
+// path.
+func loadDockerConfig(path string) (dockerConfig, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file dockerConfigFile
+	if err := json.Unmarshal(p, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	config := make(dockerConfig, len(file.Auths))
+	for key, a := range file.Auths {
+		up := userpass{
+			username:     a.Username,
+			password:     a.Password,
+			refreshToken: a.IdentityToken,
+		}
+		if a.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid auth of %s: %v", path, key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("%s: invalid auth of %s", path, key)
+			}
+			up.username, up.password = parts[0], parts[1]
+		}
+		config[dockerConfigHost(key)] = up
+	}
+	return config, nil
+}
+
+// dockerConfigHost returns the host of a key of a docker config.json file,
+// which is either a host or a URL.
+func dockerConfigHost(key string) string {
+	if strings.Contains(key, "://") {
+		if u, err := url.Parse(key); err == nil {
+			key = u.Host
+		}
+	}
+	key = strings.ToLower(strings.SplitN(key, "/", 2)[0])
+	if hubHosts[key] {
+		return hubIndexHost
+	}
+	return key
+}
+
+// credentials returns the credentials of the registry at remoteURL.
+func (dc dockerConfig) credentials(remoteURL url.URL) userpass {
+	return dc[dockerConfigHost(remoteURL.Host)]
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+)
+
+// failoverManifests reads manifests from the first available mirror.
+type failoverManifests struct {
+	mirrors   []*mirror
+	manifests []distribution.ManifestService
+}
+
+var _ distribution.ManifestService = failoverManifests{}
+
+func (fm failoverManifests) Exists(ctx context.Context, dgst digest.Digest) (exists bool, err error) {
+	err = tryMirrors(ctx, fm.mirrors, func(i int) error {
+		exists, err = fm.manifests[i].Exists(ctx, dgst)
+		return err
+	})
+	return exists, err
+}
+
+func (fm failoverManifests) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (manifest distribution.Manifest, err error) {
+	err = tryMirrors(ctx, fm.mirrors, func(i int) error {
+		manifest, err = fm.manifests[i].Get(ctx, dgst, options...)
+		return err
+	})
+	return manifest, err
+}
+
+func (fm failoverManifests) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	return "", distribution.ErrUnsupported
+}
+
+func (fm failoverManifests) Delete(ctx context.Context, dgst digest.Digest) error {
+	return distribution.ErrUnsupported
+}
+
+// failoverBlobs reads blobs from the first available mirror.
+type failoverBlobs struct {
+	mirrors []*mirror
+	blobs   []distribution.BlobService
+}
+
+var _ distribution.BlobService = failoverBlobs{}
+
+func (fb failoverBlobs) Stat(ctx context.Context, dgst digest.Digest) (desc distribution.Descriptor, err error) {
+	err = tryMirrors(ctx, fb.mirrors, func(i int) error {
+		desc, err = fb.blobs[i].Stat(ctx, dgst)
+		return err
+	})
+	return desc, err
+}
+
+func (fb failoverBlobs) Get(ctx context.Context, dgst digest.Digest) (p []byte, err error) {
+	err = tryMirrors(ctx, fb.mirrors, func(i int) error {
+		p, err = fb.blobs[i].Get(ctx, dgst)
+		return err
+	})
+	return p, err
+}
+
+// Open returns a reader of the blob from the first mirror which has it.
+// Readers of remote blobs only connect on the first read, so the blob is
+// checked beforehand.
+func (fb failoverBlobs) Open(ctx context.Context, dgst digest.Digest) (rsc distribution.ReadSeekCloser, err error) {
+	err = tryMirrors(ctx, fb.mirrors, func(i int) error {
+		if _, err := fb.blobs[i].Stat(ctx, dgst); err != nil {
+			return err
+		}
+		rsc, err = fb.blobs[i].Open(ctx, dgst)
+		return err
+	})
+	return rsc, err
+}
+
+func (fb failoverBlobs) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
+	return distribution.Descriptor{}, distribution.ErrUnsupported
+}
+
+func (fb failoverBlobs) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+func (fb failoverBlobs) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+// failoverTags reads tags from the first available mirror.
+type failoverTags struct {
+	mirrors []*mirror
+	tags    []distribution.TagService
+}
+
+var _ distribution.TagService = failoverTags{}
+
+func (ft failoverTags) Get(ctx context.Context, tag string) (desc distribution.Descriptor, err error) {
+	err = tryMirrors(ctx, ft.mirrors, func(i int) error {
+		desc, err = ft.tags[i].Get(ctx, tag)
+		return err
+	})
+	return desc, err
+}
+
+func (ft failoverTags) All(ctx context.Context) (tags []string, err error) {
+	err = tryMirrors(ctx, ft.mirrors, func(i int) error {
+		tags, err = ft.tags[i].All(ctx)
+		return err
+	})
+	return tags, err
+}
+
+func (ft failoverTags) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	return distribution.ErrUnsupported
+}
+
+func (ft failoverTags) Untag(ctx context.Context, tag string) error {
+	return distribution.ErrUnsupported
+}
+
+func (ft failoverTags) Lookup(ctx context.Context, digest distribution.Descriptor) ([]string, error) {
+	return nil, distribution.ErrUnsupported
+}
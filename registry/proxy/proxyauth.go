@@ -1,50 +1,176 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/docker/distribution/configuration"
 	"github.com/docker/distribution/registry/client/auth"
 )
 
-const tokenURL = "https://auth.docker.io/token"
 const challengeHeader = "Docker-Distribution-Api-Version"
 
+// userpass are the credentials of a remote registry. Either the username
+// and password or the refresh token are set.
 type userpass struct {
-	username string
-	password string
+	username     string
+	password     string
+	refreshToken string
 }
 
+// credentials holds the credentials of a remote registry. They are only
+// given to the registry itself, with basic authentication, and to the token
+// servers it challenges the cache to authenticate with, whose realms are
+// learnt from its challenges.
 type credentials struct {
-	creds map[string]userpass
+	host string
+	userpass
+
+	mu sync.Mutex
+	// realms are the token realms learnt from the challenges of the
+	// registry.
+	realms map[string]bool
+	// refreshTokens are the refresh tokens issued by the token servers,
+	// by realm and service.
+	refreshTokens map[string]string
 }
 
-func (c credentials) Basic(u *url.URL) (string, string) {
-	up := c.creds[u.String()]
+// configureAuth stores credentials for challenge responses of the registry
+// at remoteURL.
+func configureAuth(remoteURL url.URL, up userpass) *credentials {
+	return &credentials{
+		host:          strings.ToLower(remoteURL.Host),
+		userpass:      up,
+		realms:        make(map[string]bool),
+		refreshTokens: make(map[string]string),
+	}
+}
 
-	return up.username, up.password
+func (c *credentials) Basic(u *url.URL) (string, string) {
+	if !c.knows(u) {
+		return "", ""
+	}
+	return c.username, c.password
 }
 
-func (c credentials) RefreshToken(u *url.URL, service string) string {
-	return ""
+func (c *credentials) RefreshToken(u *url.URL, service string) string {
+	if !c.knows(u) {
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if token, ok := c.refreshTokens[u.String()+" "+service]; ok {
+		return token
+	}
+	return c.refreshToken
 }
 
-func (c credentials) SetRefreshToken(u *url.URL, service, token string) {
+func (c *credentials) SetRefreshToken(u *url.URL, service, token string) {
+	if !c.knows(u) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshTokens[u.String()+" "+service] = token
 }
 
-// configureAuth stores credentials for challenge responses
-func configureAuth(username, password string) (auth.CredentialStore, error) {
-	creds := map[string]userpass{
-		tokenURL: {
-			username: username,
-			password: password,
-		},
+// knows returns whether u is the registry or one of its token realms.
+func (c *credentials) knows(u *url.URL) bool {
+	if strings.ToLower(u.Host) == c.host {
+		return true
 	}
-	return credentials{creds: creds}, nil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.realms[u.String()]
+}
+
+// learnRealms records the token realms of challenges.
+func (c *credentials) learnRealms(challenges []auth.Challenge) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, challenge := range challenges {
+		if challenge.Scheme != "bearer" {
+			continue
+		}
+		realm, err := url.Parse(challenge.Parameters["realm"])
+		if err != nil || realm.Host == "" {
+			continue
+		}
+		c.realms[realm.String()] = true
+	}
+}
+
+// learningChallengeManager is a challenge manager which teaches the
+// credentials of a registry the token realms of its challenges.
+type learningChallengeManager struct {
+	auth.ChallengeManager
+	creds *credentials
 }
 
-func ping(manager auth.ChallengeManager, endpoint, versionHeader string) error {
-	resp, err := http.Get(endpoint)
+func (m learningChallengeManager) AddResponse(resp *http.Response) error {
+	if err := m.ChallengeManager.AddResponse(resp); err != nil {
+		return err
+	}
+	m.creds.learnRealms(auth.ResponseChallenges(resp))
+	return nil
+}
+
+// newTransport returns the transport of the connections to a remote
+// registry and its token servers.
+func newTransport(config configuration.ProxyTLS) (http.RoundTripper, error) {
+	if config == (configuration.ProxyTLS{}) {
+		return http.DefaultTransport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.RootCertBundle != "" {
+		pem, err := ioutil.ReadFile(config.RootCertBundle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read root certificate bundle: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in root certificate bundle %s", config.RootCertBundle)
+		}
+	}
+	if config.Certificate != "" || config.Key != "" {
+		cert, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}, nil
+}
+
+func ping(manager auth.ChallengeManager, transport http.RoundTripper, endpoint, versionHeader string) error {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   15 * time.Second,
+	}
+	resp, err := client.Get(endpoint)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+)
+
+// TestUpstreamTokenAuth checks that the credentials of an upstream served
+// under TLS are given to the token server its challenge names.
+func TestUpstreamTokenAuth(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "granted"})
+	}))
+	defer tokenServer.Close()
+
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer granted" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenServer.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/v2/private/app/tags/list" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": "private/app", "tags": []string{"latest"}})
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer registry.Close()
+
+	dir, err := ioutil.TempDir("", "proxyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.TLS.Certificates[0].Certificate[0]})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams, err := newUpstreams(configuration.Proxy{
+		Upstreams: []configuration.ProxyUpstream{{
+			RemoteURLs: []string{registry.URL},
+			Username:   "user",
+			Password:   "secret",
+			TLS:        configuration.ProxyTLS{RootCertBundle: caFile},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error configuring upstreams: %v", err)
+	}
+
+	ctx := context.Background()
+	u := upstreams[0]
+	if err := u.challenger().tryEstablishChallenges(ctx); err != nil {
+		t.Fatalf("unexpected error establishing challenges: %v", err)
+	}
+	cs := u.challenger().credentialStore()
+	if username, _ := cs.Basic(&url.URL{Scheme: "https", Host: "elsewhere.example.com", Path: "/token"}); username != "" {
+		t.Fatalf("credentials given to a realm not named by the upstream")
+	}
+
+	name, _ := reference.ParseNamed("private/app")
+	_, _, tags, err := u.remoteServices(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := tags.All(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing tags: %v", err)
+	}
+	if len(all) != 1 || all[0] != "latest" {
+		t.Fatalf("unexpected tags: %v", all)
+	}
+}
+
+func TestLoadDockerConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOnNlY3JldA=="},
+		"quay.example.com": {"identitytoken": "refresh"}
+	}}`)
+	f.Close()
+
+	config, err := loadDockerConfig(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	for _, tc := range []struct {
+		remoteURL string
+		expected  userpass
+	}{
+		{"https://registry-1.docker.io", userpass{username: "hub", password: "secret"}},
+		{"https://QUAY.example.com", userpass{refreshToken: "refresh"}},
+		{"https://registry.example.com", userpass{}},
+	} {
+		u, _ := url.Parse(tc.remoteURL)
+		if up := config.credentials(*u); up != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.remoteURL, tc.expected, up)
+		}
+	}
+}
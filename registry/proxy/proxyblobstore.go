@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -14,21 +15,21 @@ import (
 	"github.com/docker/distribution/registry/proxy/scheduler"
 )
 
-// todo(richardscothern): from cache control header or config file
-const blobTTL = time.Duration(24 * 7 * time.Hour)
-
 type proxyBlobStore struct {
 	localStore     distribution.BlobStore
 	remoteStore    distribution.BlobService
 	scheduler      *scheduler.TTLExpirationScheduler
+	ttl            time.Duration
 	repositoryName reference.Named
 	authChallenger authChallenger
+	fetches        *fetchCoordinator
 }
 
 var _ distribution.BlobStore = &proxyBlobStore{}
 
-// inflight tracks currently downloading blobs
-var inflight = make(map[digest.Digest]struct{})
+// inflight tracks currently downloading blobs, closing their channel once
+// they are downloaded
+var inflight = make(map[digest.Digest]chan struct{})
 
 // mu protects inflight
 var mu sync.Mutex
@@ -77,6 +78,9 @@ func (pbs *proxyBlobStore) serveLocal(ctx context.Context, w http.ResponseWriter
 
 	if err == nil {
 		proxyMetrics.BlobPush(uint64(localDesc.Size))
+		if blobRef, err := reference.WithDigest(pbs.repositoryName, dgst); err == nil {
+			pbs.scheduler.Access(blobRef)
+		}
 		return true, pbs.localStore.ServeBlob(ctx, w, r, dgst)
 	}
 
@@ -84,9 +88,10 @@ func (pbs *proxyBlobStore) serveLocal(ctx context.Context, w http.ResponseWriter
 
 }
 
-func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) error {
+func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
 	defer func() {
 		mu.Lock()
+		close(inflight[dgst])
 		delete(inflight, dgst)
 		mu.Unlock()
 	}()
@@ -97,20 +102,20 @@ func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) e
 
 	bw, err = pbs.localStore.Create(ctx)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
 	desc, err = pbs.copyContent(ctx, dgst, bw)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
 	_, err = bw.Commit(ctx, desc)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
-	return nil
+	return desc, nil
 }
 
 func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
@@ -128,28 +133,35 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 		return err
 	}
 
+	release, lead := pbs.coordinate(ctx, dgst, true)
+	if !lead {
+		served, err := pbs.serveLocal(ctx, w, r, dgst)
+		if err != nil || served {
+			return err
+		}
+		_, err = pbs.copyContent(ctx, dgst, w)
+		return err
+	}
+
 	mu.Lock()
 	_, ok := inflight[dgst]
 	if ok {
 		mu.Unlock()
+		release()
 		_, err := pbs.copyContent(ctx, dgst, w)
 		return err
 	}
-	inflight[dgst] = struct{}{}
+	inflight[dgst] = make(chan struct{})
 	mu.Unlock()
 
 	go func(dgst digest.Digest) {
-		if err := pbs.storeLocal(ctx, dgst); err != nil {
-			context.GetLogger(ctx).Errorf("Error committing to storage: %s", err.Error())
-		}
-
-		blobRef, err := reference.WithDigest(pbs.repositoryName, dgst)
+		defer release()
+		desc, err := pbs.storeLocal(ctx, dgst)
 		if err != nil {
-			context.GetLogger(ctx).Errorf("Error creating reference: %s", err)
+			context.GetLogger(ctx).Errorf("Error committing to storage: %s", err.Error())
 			return
 		}
-
-		pbs.scheduler.AddBlob(blobRef, repositoryTTL)
+		pbs.schedule(ctx, dgst, desc.Size)
 	}(dgst)
 
 	_, err = pbs.copyContent(ctx, dgst, w)
@@ -159,6 +171,131 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 	return nil
 }
 
+// schedule schedules the removal of a blob stored in the cache.
+func (pbs *proxyBlobStore) schedule(ctx context.Context, dgst digest.Digest, size int64) {
+	blobRef, err := reference.WithDigest(pbs.repositoryName, dgst)
+	if err != nil {
+		context.GetLogger(ctx).Errorf("Error creating reference: %s", err)
+		return
+	}
+
+	pbs.scheduler.AddBlob(blobRef, pbs.ttl, size)
+}
+
+// fetch stores the blob in the cache, unless it is already cached, and
+// returns the number of bytes pulled from the remote. If the blob is being
+// pulled by a concurrent request, fetch waits for it to be stored.
+func (pbs *proxyBlobStore) fetch(ctx context.Context, dgst digest.Digest) (int64, error) {
+	if _, err := pbs.localStore.Stat(ctx, dgst); err == nil {
+		if blobRef, err := reference.WithDigest(pbs.repositoryName, dgst); err == nil {
+			pbs.scheduler.Access(blobRef)
+		}
+		return 0, nil
+	}
+
+	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return 0, err
+	}
+
+	release, lead := pbs.coordinate(ctx, dgst, false)
+	if !lead {
+		if _, err := pbs.localStore.Stat(ctx, dgst); err != nil {
+			return 0, fmt.Errorf("blob %s is being fetched by another registry instance", dgst)
+		}
+		return 0, nil
+	}
+	defer release()
+
+	// A blob downloaded by a concurrent request is only cached once it is
+	// stored, which is fetched again if the download failed.
+	for {
+		mu.Lock()
+		done, ok := inflight[dgst]
+		if !ok {
+			inflight[dgst] = make(chan struct{})
+			mu.Unlock()
+			break
+		}
+		mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		if _, err := pbs.localStore.Stat(ctx, dgst); err == nil {
+			return 0, nil
+		}
+	}
+
+	desc, err := pbs.storeLocal(ctx, dgst)
+	if err != nil {
+		return 0, err
+	}
+	proxyMetrics.BlobPull(uint64(desc.Size))
+	pbs.schedule(ctx, dgst, desc.Size)
+	return desc.Size, nil
+}
+
+// coordinate takes the lease of fetching dgst from the remote, if fetches
+// are coordinated with other registry instances, and returns the function
+// releasing it. If another instance holds the lease, coordinate waits for it
+// to store the blob, taking the lease over if it is released or expires
+// first, and returns false once the blob is stored. If the lease is not
+// renewed within the wait, the blob is fetched without coordination. The
+// wait lasts as long as the other instance
+// renews the lease, which is the whole fetch of the blob; if serving, it
+// ends after the maxWait of the coordinator instead, so that the blob is
+// streamed from the remote rather than holding the client without a reply.
+// Fetches are not coordinated while the leases are unavailable.
+func (pbs *proxyBlobStore) coordinate(ctx context.Context, dgst digest.Digest, serving bool) (func(), bool) {
+	noop := func() {}
+	if pbs.fetches == nil {
+		return noop, true
+	}
+
+	var until time.Time
+	if serving {
+		until = time.Now().Add(pbs.fetches.maxWait)
+	}
+	key := leaseKey(pbs.repositoryName, dgst)
+	for {
+		release, ok, err := pbs.fetches.lead(ctx, key)
+		if err != nil {
+			context.GetLogger(ctx).Warnf("Error taking fetch lease %s, fetching uncoordinated: %v", key, err)
+			return noop, true
+		}
+		if ok {
+			// Another instance may have stored the blob since it was
+			// looked up.
+			if _, err := pbs.localStore.Stat(ctx, dgst); err == nil {
+				release()
+				return noop, false
+			}
+			return release, true
+		}
+
+		released, err := pbs.fetches.await(ctx, key, until)
+		if err != nil {
+			context.GetLogger(ctx).Warnf("Error waiting for fetch lease %s: %v", key, err)
+			return noop, false
+		}
+		if !released && !until.IsZero() && !time.Now().Before(until) {
+			context.GetLogger(ctx).Infof("Fetch lease %s is still held after %v, streaming from the remote", key, pbs.fetches.maxWait)
+			return noop, false
+		}
+		if !released {
+			context.GetLogger(ctx).Warnf("Fetch lease %s is not renewed, fetching uncoordinated", key)
+			return noop, true
+		}
+		if _, err := pbs.localStore.Stat(ctx, dgst); err == nil {
+			proxyMetrics.BlobCoalesced()
+			return noop, false
+		}
+		// The other instance failed to store the blob, or crashed.
+	}
+}
+
 func (pbs *proxyBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
 	desc, err := pbs.localStore.Stat(ctx, dgst)
 	if err == nil {
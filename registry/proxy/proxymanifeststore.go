@@ -10,15 +10,13 @@ import (
 	"github.com/docker/distribution/registry/proxy/scheduler"
 )
 
-// todo(richardscothern): from cache control header or config
-const repositoryTTL = time.Duration(24 * 7 * time.Hour)
-
 type proxyManifestStore struct {
 	ctx             context.Context
 	localManifests  distribution.ManifestService
 	remoteManifests distribution.ManifestService
 	repositoryName  reference.Named
 	scheduler       *scheduler.TTLExpirationScheduler
+	ttl             time.Duration
 	authChallenger  authChallenger
 }
 
@@ -76,15 +74,35 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 			return nil, err
 		}
 
-		pms.scheduler.AddManifest(repoBlob, repositoryTTL)
+		pms.scheduler.AddManifest(repoBlob, pms.ttl, int64(len(payload)))
 		// Ensure the manifest blob is cleaned up
 		//pms.scheduler.AddBlob(blobRef, repositoryTTL)
 
+	} else if repoBlob, err := reference.WithDigest(pms.repositoryName, dgst); err == nil {
+		pms.scheduler.Access(repoBlob)
 	}
 
 	return manifest, err
 }
 
+// fetch gets the manifest, storing it in the cache if it is not already,
+// and returns the number of bytes pulled from the remote.
+func (pms proxyManifestStore) fetch(ctx context.Context, dgst digest.Digest) (distribution.Manifest, int64, error) {
+	exists, err := pms.localManifests.Exists(ctx, dgst)
+	if err != nil {
+		return nil, 0, err
+	}
+	manifest, err := pms.Get(ctx, dgst)
+	if err != nil || exists {
+		return manifest, 0, err
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return nil, 0, err
+	}
+	return manifest, int64(len(payload)), nil
+}
+
 func (pms proxyManifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	var d digest.Digest
 	return d, distribution.ErrUnsupported
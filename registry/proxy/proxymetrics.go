@@ -2,7 +2,11 @@ package proxy
 
 import (
 	"expvar"
+	"sync"
 	"sync/atomic"
+
+	"github.com/docker/distribution/metrics"
+	"github.com/docker/distribution/registry/proxy/scheduler"
 )
 
 // Metrics is used to hold metric counters
@@ -13,11 +17,36 @@ type Metrics struct {
 	Misses      uint64
 	BytesPulled uint64
 	BytesPushed uint64
+	Stale       uint64
+	Coalesced   uint64
 }
 
 type proxyMetricsCollector struct {
 	blobMetrics     Metrics
 	manifestMetrics Metrics
+
+	// scheduler tracks the content of the cache, once it is configured.
+	mu        sync.Mutex
+	scheduler *scheduler.TTLExpirationScheduler
+}
+
+// setScheduler sets the scheduler reporting the occupancy of the cache.
+func (pmc *proxyMetricsCollector) setScheduler(s *scheduler.TTLExpirationScheduler) {
+	pmc.mu.Lock()
+	defer pmc.mu.Unlock()
+	pmc.scheduler = s
+}
+
+// CacheStats returns the occupancy of the cache.
+func (pmc *proxyMetricsCollector) CacheStats() scheduler.Stats {
+	pmc.mu.Lock()
+	s := pmc.scheduler
+	pmc.mu.Unlock()
+
+	if s == nil {
+		return scheduler.Stats{}
+	}
+	return s.Stats()
 }
 
 // BlobPull tracks metrics about blobs pulled into the cache
@@ -33,6 +62,12 @@ func (pmc *proxyMetricsCollector) BlobPush(bytesPushed uint64) {
 	atomic.AddUint64(&pmc.blobMetrics.BytesPushed, bytesPushed)
 }
 
+// BlobCoalesced tracks blobs served once fetched by another registry
+// instance, instead of fetching them from the upstream
+func (pmc *proxyMetricsCollector) BlobCoalesced() {
+	atomic.AddUint64(&pmc.blobMetrics.Coalesced, 1)
+}
+
 // ManifestPull tracks metrics related to Manifests pulled into the cache
 func (pmc *proxyMetricsCollector) ManifestPull(bytesPulled uint64) {
 	atomic.AddUint64(&pmc.manifestMetrics.Misses, 1)
@@ -46,6 +81,12 @@ func (pmc *proxyMetricsCollector) ManifestPush(bytesPushed uint64) {
 	atomic.AddUint64(&pmc.manifestMetrics.BytesPushed, bytesPushed)
 }
 
+// ManifestStale tracks manifests resolved from cached tags while the
+// upstream is unavailable
+func (pmc *proxyMetricsCollector) ManifestStale() {
+	atomic.AddUint64(&pmc.manifestMetrics.Stale, 1)
+}
+
 // proxyMetrics tracks metrics about the proxy cache.  This is
 // kept globally and made available via expvar.
 var proxyMetrics = &proxyMetricsCollector{}
@@ -71,4 +112,74 @@ func init() {
 		return proxyMetrics.manifestMetrics
 	}))
 
+	pm.(*expvar.Map).Set("cache", expvar.Func(func() interface{} {
+		return proxyMetrics.CacheStats()
+	}))
+
+	metrics.MustRegister(
+		proxyCounterFunc("registry_proxy_requests_total",
+			"The number of requests served from the proxy cache.",
+			func(m *Metrics) *uint64 { return &m.Requests }),
+		proxyCounterFunc("registry_proxy_hits_total",
+			"The number of requests served from local storage.",
+			func(m *Metrics) *uint64 { return &m.Hits }),
+		proxyCounterFunc("registry_proxy_misses_total",
+			"The number of requests fetched from the upstream registry.",
+			func(m *Metrics) *uint64 { return &m.Misses }),
+		proxyCounterFunc("registry_proxy_pulled_bytes_total",
+			"The number of bytes pulled from the upstream registry.",
+			func(m *Metrics) *uint64 { return &m.BytesPulled }),
+		proxyCounterFunc("registry_proxy_pushed_bytes_total",
+			"The number of bytes served to clients.",
+			func(m *Metrics) *uint64 { return &m.BytesPushed }),
+		proxyCounterFunc("registry_proxy_stale_total",
+			"The number of requests served from the cache while the upstream registry was unavailable.",
+			func(m *Metrics) *uint64 { return &m.Stale }),
+		proxyCounterFunc("registry_proxy_coalesced_total",
+			"The number of blobs served once fetched by another registry instance.",
+			func(m *Metrics) *uint64 { return &m.Coalesced }),
+		metrics.NewGaugeFunc("registry_proxy_cache_entries",
+			"The number of blobs and manifests in the proxy cache.",
+			[]string{"type"}, func() []metrics.LabeledValue {
+				stats := proxyMetrics.CacheStats()
+				return []metrics.LabeledValue{
+					{LabelValues: []string{"blob"}, Value: float64(stats.Blobs)},
+					{LabelValues: []string{"manifest"}, Value: float64(stats.Manifests)},
+				}
+			}),
+		metrics.NewGaugeFunc("registry_proxy_cache_bytes",
+			"The size of the blobs and manifests in the proxy cache.",
+			[]string{"type"}, func() []metrics.LabeledValue {
+				stats := proxyMetrics.CacheStats()
+				return []metrics.LabeledValue{
+					{LabelValues: []string{"blob"}, Value: float64(stats.BlobBytes)},
+					{LabelValues: []string{"manifest"}, Value: float64(stats.ManifestBytes)},
+				}
+			}),
+		metrics.NewGaugeFunc("registry_proxy_cache_max_bytes",
+			"The maximum size of the proxy cache, or 0 if it is unbounded.",
+			nil, func() []metrics.LabeledValue {
+				return []metrics.LabeledValue{{Value: float64(proxyMetrics.CacheStats().MaxSize)}}
+			}),
+		metrics.NewCounterFunc("registry_proxy_cache_removals_total",
+			"The number of blobs and manifests removed from the proxy cache.",
+			[]string{"reason"}, func() []metrics.LabeledValue {
+				stats := proxyMetrics.CacheStats()
+				return []metrics.LabeledValue{
+					{LabelValues: []string{"expired"}, Value: float64(stats.Expired)},
+					{LabelValues: []string{"evicted"}, Value: float64(stats.Evicted)},
+				}
+			}),
+	)
+}
+
+// proxyCounterFunc exports the counter selected by field for both blobs and
+// manifests.
+func proxyCounterFunc(name, help string, field func(*Metrics) *uint64) metrics.Collector {
+	return metrics.NewCounterFunc(name, help, []string{"type"}, func() []metrics.LabeledValue {
+		return []metrics.LabeledValue{
+			{LabelValues: []string{"blob"}, Value: float64(atomic.LoadUint64(field(&proxyMetrics.blobMetrics)))},
+			{LabelValues: []string{"manifest"}, Value: float64(atomic.LoadUint64(field(&proxyMetrics.manifestMetrics)))},
+		}
+	})
 }
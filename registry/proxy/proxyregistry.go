@@ -10,31 +10,70 @@ import (
 	"github.com/docker/distribution/configuration"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/reference"
-	"github.com/docker/distribution/registry/client"
 	"github.com/docker/distribution/registry/client/auth"
-	"github.com/docker/distribution/registry/client/transport"
 	"github.com/docker/distribution/registry/proxy/scheduler"
 	"github.com/docker/distribution/registry/storage"
 	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/garyburd/redigo/redis"
 )
 
-// proxyingRegistry fetches content from a remote registry and caches it locally
+// proxyingRegistry fetches content from remote registries and caches it locally
 type proxyingRegistry struct {
-	embedded       distribution.Namespace // provides local registry functionality
-	scheduler      *scheduler.TTLExpirationScheduler
-	remoteURL      url.URL
-	authChallenger authChallenger
+	embedded  distribution.Namespace // provides local registry functionality
+	scheduler *scheduler.TTLExpirationScheduler
+	cache     cachePolicy
+	upstreams []*upstream
+
+	// fetches coordinates the blob fetches with other registry instances,
+	// if configured.
+	fetches *fetchCoordinator
 }
 
-// NewRegistryPullThroughCache creates a registry acting as a pull through cache
-func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy) (distribution.Namespace, error) {
-	remoteURL, err := url.Parse(config.RemoteURL)
+// Option configures the pull through cache.
+type Option func(*options)
+
+type options struct {
+	redis *redis.Pool
+}
+
+// WithRedis sets the redis instance of the registry, which coordinates the
+// registry instances sharing the cache if configured.
+func WithRedis(pool *redis.Pool) Option {
+	return func(o *options) {
+		o.redis = pool
+	}
+}
+
+// NewRegistryPullThroughCache creates a registry acting as a pull through
+// cache of the upstreams of config, or of its single remote URL.
+func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy, opts ...Option) (distribution.Namespace, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	upstreams, err := newUpstreams(config)
 	if err != nil {
 		return nil, err
 	}
+	cache, err := newCachePolicy(config.Cache)
+	if err != nil {
+		return nil, err
+	}
+	var fetches *fetchCoordinator
+	if config.Coordination.Redis {
+		if o.redis == nil {
+			return nil, fmt.Errorf("proxy: coordination.redis requires the redis configuration")
+		}
+		fetches, err = newFetchCoordinator(&redisLeases{pool: o.redis}, config.Coordination)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	v := storage.NewVacuum(ctx, driver)
-	s := scheduler.New(ctx, driver, "/scheduler-state.json")
+	s := scheduler.New(ctx, driver, "/scheduler-state")
+	s.SetMaxSize(config.Cache.MaxSize)
 	s.OnBlobExpire(func(ref reference.Reference) error {
 		var r reference.Canonical
 		var ok bool
@@ -90,21 +129,14 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 	if err != nil {
 		return nil, err
 	}
-
-	cs, err := configureAuth(config.Username, config.Password)
-	if err != nil {
-		return nil, err
-	}
+	proxyMetrics.setScheduler(s)
 
 	return &proxyingRegistry{
 		embedded:  registry,
 		scheduler: s,
-		remoteURL: *remoteURL,
-		authChallenger: &remoteAuthChallenger{
-			remoteURL: *remoteURL,
-			cm:        auth.NewSimpleChallengeManager(),
-			cs:        cs,
-		},
+		cache:     cache,
+		upstreams: upstreams,
+		fetches:   fetches,
 	}, nil
 }
 
@@ -116,11 +148,27 @@ func (pr *proxyingRegistry) Repositories(ctx context.Context, repos []string, la
 	return pr.embedded.Repositories(ctx, repos, last)
 }
 
+// Repository returns the repository from the first upstream serving it,
+// which may request it under another name. Repositories served by no
+// upstream are unknown.
 func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
-	c := pr.authChallenger
-
-	tr := transport.NewTransport(http.DefaultTransport,
-		auth.NewAuthorizer(c.challengeManager(), auth.NewTokenHandler(http.DefaultTransport, c.credentialStore(), name.Name(), "pull")))
+	var (
+		u          *upstream
+		remoteName string
+	)
+	for _, candidate := range pr.upstreams {
+		if n, ok := candidate.remoteName(name.Name()); ok {
+			u, remoteName = candidate, n
+			break
+		}
+	}
+	if u == nil {
+		return nil, distribution.ErrRepositoryUnknown{Name: name.Name()}
+	}
+	remoteNamed, err := reference.ParseNamed(remoteName)
+	if err != nil {
+		return nil, distribution.ErrRepositoryNameInvalid{Name: name.Name(), Reason: err}
+	}
 
 	localRepo, err := pr.embedded.Repository(ctx, name)
 	if err != nil {
@@ -131,23 +179,21 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 		return nil, err
 	}
 
-	remoteRepo, err := client.NewRepository(ctx, name, pr.remoteURL.String(), tr)
-	if err != nil {
-		return nil, err
-	}
-
-	remoteManifests, err := remoteRepo.Manifests(ctx)
+	remoteManifests, remoteBlobs, remoteTags, err := u.remoteServices(ctx, remoteNamed)
 	if err != nil {
 		return nil, err
 	}
 
+	ttl := pr.cache.repositoryTTL(name.Name())
 	return &proxiedRepository{
 		blobStore: &proxyBlobStore{
 			localStore:     localRepo.Blobs(ctx),
-			remoteStore:    remoteRepo.Blobs(ctx),
+			remoteStore:    remoteBlobs,
 			scheduler:      pr.scheduler,
+			ttl:            ttl,
 			repositoryName: name,
-			authChallenger: pr.authChallenger,
+			authChallenger: u.challenger(),
+			fetches:        pr.fetches,
 		},
 		manifests: &proxyManifestStore{
 			repositoryName:  name,
@@ -155,17 +201,24 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 			remoteManifests: remoteManifests,
 			ctx:             ctx,
 			scheduler:       pr.scheduler,
-			authChallenger:  pr.authChallenger,
+			ttl:             ttl,
+			authChallenger:  u.challenger(),
 		},
 		name: name,
 		tags: &proxyTagService{
 			localTags:      localRepo.Tags(ctx),
-			remoteTags:     remoteRepo.Tags(ctx),
-			authChallenger: pr.authChallenger,
+			remoteTags:     remoteTags,
+			authChallenger: u.challenger(),
 		},
 	}, nil
 }
 
+// Close stops the scheduler of the cache, saving its state.
+func (pr *proxyingRegistry) Close() error {
+	pr.scheduler.Stop()
+	return nil
+}
+
 func (pr *proxyingRegistry) Blobs() distribution.BlobEnumerator {
 	return pr.embedded.Blobs()
 }
@@ -183,6 +236,7 @@ type authChallenger interface {
 
 type remoteAuthChallenger struct {
 	remoteURL url.URL
+	transport http.RoundTripper
 	sync.Mutex
 	cm auth.ChallengeManager
 	cs auth.CredentialStore
@@ -213,11 +267,11 @@ func (r *remoteAuthChallenger) tryEstablishChallenges(ctx context.Context) error
 	}
 
 	// establish challenge type with upstream
-	if err := ping(r.cm, remoteURL.String(), challengeHeader); err != nil {
+	if err := ping(r.cm, r.transport, remoteURL.String(), challengeHeader); err != nil {
 		return err
 	}
 
-	context.GetLogger(ctx).Infof("Challenge established with upstream : %s %s", remoteURL, r.cm)
+	context.GetLogger(ctx).Infof("Challenge established with upstream : %s", remoteURL.String())
 	return nil
 }
 
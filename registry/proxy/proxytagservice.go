@@ -15,12 +15,13 @@ type proxyTagService struct {
 var _ distribution.TagService = proxyTagService{}
 
 // Get attempts to get the most recent digest for the tag by checking the remote
-// tag service first and then caching it locally.  If the remote is unavailable
-// the local association is returned
+// tag service first and then caching it locally.  If the remote fails the
+// local association is returned, marked as stale if the remote is unavailable
 func (pt proxyTagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
 	err := pt.authChallenger.tryEstablishChallenges(ctx)
 	if err == nil {
-		desc, err := pt.remoteTags.Get(ctx, tag)
+		var desc distribution.Descriptor
+		desc, err = pt.remoteTags.Get(ctx, tag)
 		if err == nil {
 			err := pt.localTags.Tag(ctx, tag, desc)
 			if err != nil {
@@ -29,10 +30,12 @@ func (pt proxyTagService) Get(ctx context.Context, tag string) (distribution.Des
 			return desc, nil
 		}
 	}
-
-	desc, err := pt.localTags.Get(ctx, tag)
-	if err != nil {
-		return distribution.Descriptor{}, err
+	desc, localErr := pt.localTags.Get(ctx, tag)
+	if localErr != nil {
+		return distribution.Descriptor{}, localErr
+	}
+	if isUnavailable(err) {
+		markStale(ctx, err)
 	}
 	return desc, nil
 }
@@ -52,12 +55,20 @@ func (pt proxyTagService) Untag(ctx context.Context, tag string) error {
 func (pt proxyTagService) All(ctx context.Context) ([]string, error) {
 	err := pt.authChallenger.tryEstablishChallenges(ctx)
 	if err == nil {
-		tags, err := pt.remoteTags.All(ctx)
+		var tags []string
+		tags, err = pt.remoteTags.All(ctx)
 		if err == nil {
 			return tags, err
 		}
 	}
-	return pt.localTags.All(ctx)
+	tags, localErr := pt.localTags.All(ctx)
+	if localErr != nil {
+		return nil, localErr
+	}
+	if isUnavailable(err) {
+		markStale(ctx, err)
+	}
+	return tags, nil
 }
 
 func (pt proxyTagService) Lookup(ctx context.Context, digest distribution.Descriptor) ([]string, error) {
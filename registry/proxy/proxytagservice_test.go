@@ -1,9 +1,11 @@
 package proxy
 
 import (
+	"net/http/httptest"
 	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/docker/distribution"
@@ -180,3 +182,31 @@ func TestGet(t *testing.T) {
 		t.Fatalf("Expected 4 auth challenge calls, got %#v", proxyTags.authChallenger)
 	}
 }
+
+func TestGetStale(t *testing.T) {
+	localDesc := distribution.Descriptor{Size: 42}
+	proxyTags := testProxyTagService(map[string]distribution.Descriptor{"cached": localDesc}, nil)
+	proxyTags.remoteTags = &unavailableTagStore{}
+
+	recorder := httptest.NewRecorder()
+	ctx, _ := context.WithResponseWriter(context.Background(), recorder)
+	stale := atomic.LoadUint64(&proxyMetrics.manifestMetrics.Stale)
+
+	d, err := proxyTags.Get(ctx, "cached")
+	if err != nil {
+		t.Fatalf("unexpected error getting cached tag: %v", err)
+	}
+	if !reflect.DeepEqual(d, localDesc) {
+		t.Fatalf("expected cached descriptor %v, got %v", localDesc, d)
+	}
+	if warning := recorder.Header().Get("Warning"); warning != staleWarning {
+		t.Fatalf("expected stale warning, got %q", warning)
+	}
+	if n := atomic.LoadUint64(&proxyMetrics.manifestMetrics.Stale); n != stale+1 {
+		t.Fatalf("expected stale count %d, got %d", stale+1, n)
+	}
+
+	if _, err := proxyTags.Get(ctx, "uncached"); err == nil {
+		t.Fatalf("expected an error getting uncached tag")
+	}
+}
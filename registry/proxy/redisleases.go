@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisLeases keeps leases in redis, as keys holding the token of their
+// holder and expiring with the lease.
+type redisLeases struct {
+	pool *redis.Pool
+}
+
+func (l *redisLeases) acquire(key, token string, ttl time.Duration) (bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", key, token, "NX", "PX", milliseconds(ttl))
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+func (l *redisLeases) renew(key, token string, ttl time.Duration) (bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	renewed, err := redis.Int(renewScript.Do(conn, key, token, milliseconds(ttl)))
+	return renewed == 1, err
+}
+
+func (l *redisLeases) release(key, token string) error {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	_, err := releaseScript.Do(conn, key, token)
+	return err
+}
+
+func (l *redisLeases) held(key string) (time.Duration, bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	// PTTL replies -2 for missing keys, and -1 for keys without expiry.
+	left, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil || left == -2 {
+		return 0, false, err
+	}
+	if left < 0 {
+		return -1, true, nil
+	}
+	return time.Duration(left) * time.Millisecond, true, nil
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
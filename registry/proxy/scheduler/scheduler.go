@@ -1,8 +1,9 @@
 package scheduler
 
 import (
-	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,6 +19,15 @@ const (
 	entryTypeBlob = iota
 	entryTypeManifest
 	indexSaveFrequency = 5 * time.Second
+
+	// defaultTick is the resolution of the expiry of entries, and
+	// wheelSlots the number of ticks of a revolution of the timer wheel.
+	defaultTick = time.Second
+	wheelSlots  = 3600
+
+	// accessGranularity is how far the access time of an entry moves
+	// before it is written, unless its expiry moves to another shard.
+	accessGranularity = time.Minute
 )
 
 // schedulerEntry represents an entry in the scheduler
@@ -27,41 +37,155 @@ type schedulerEntry struct {
 	Expiry    time.Time `json:"ExpiryData"`
 	EntryType int       `json:"EntryType"`
 
-	timer *time.Timer
+	// TTL is the time the entry is kept after its last access, and Size
+	// the size of its content. They are not known for the entries of
+	// older state files, which expire at their original expiry.
+	TTL        time.Duration `json:"TTL,omitempty"`
+	Size       int64         `json:"Size,omitempty"`
+	LastAccess time.Time     `json:"LastAccess,omitempty"`
+
+	// slot is the slot of the entry in the timer wheel, or -1, bucket the
+	// bucket of the shard storing it, and saved its access time when the
+	// shard was last written.
+	slot   int
+	bucket int64
+	saved  time.Time
+}
+
+// bucket holds the entries of a shard in memory.
+type bucket struct {
+	summary summary
+
+	// loaded is whether entries holds all the entries of the shard.
+	// Otherwise, entries holds those changed since the shard was written,
+	// and removed the keys of those removed.
+	loaded  bool
+	entries map[string]*schedulerEntry
+	removed map[string]bool
+}
+
+// summary accounts for the entries of a shard, whether they are held in
+// memory or not.
+type summary struct {
+	Bucket int64    `json:"Bucket"`
+	Counts [2]int   `json:"Counts"`
+	Bytes  [2]int64 `json:"Bytes"`
+
+	// Oldest is at most the earliest access time of the entries. It is
+	// exact once the shard is read.
+	Oldest time.Time `json:"Oldest"`
+}
+
+func (s *summary) add(entry *schedulerEntry) {
+	s.Counts[entry.EntryType]++
+	s.Bytes[entry.EntryType] += entry.Size
+	if s.Counts[entryTypeBlob]+s.Counts[entryTypeManifest] == 1 || entry.LastAccess.Before(s.Oldest) {
+		s.Oldest = entry.LastAccess
+	}
+}
+
+func (s *summary) remove(entry *schedulerEntry) {
+	s.Counts[entry.EntryType]--
+	s.Bytes[entry.EntryType] -= entry.Size
+}
+
+func (s *summary) empty() bool {
+	return s.Counts[entryTypeBlob]+s.Counts[entryTypeManifest] == 0
+}
+
+// Stats describes the entries of the scheduler.
+type Stats struct {
+	Blobs         int
+	Manifests     int
+	BlobBytes     int64
+	ManifestBytes int64
+
+	// MaxSize is the maximum total size of the entries, or 0 if the size
+	// is unbounded.
+	MaxSize int64
+
+	// Expired and Evicted count the entries removed because their TTL
+	// expired and to bound the total size.
+	Expired uint64
+	Evicted uint64
 }
 
-// New returns a new instance of the scheduler
+// New returns a new instance of the scheduler, storing its state below
+// path. The state file of earlier versions, path with a ".json" extension,
+// is migrated on start.
 func New(ctx context.Context, driver driver.StorageDriver, path string) *TTLExpirationScheduler {
 	return &TTLExpirationScheduler{
-		entries:         make(map[string]*schedulerEntry),
-		driver:          driver,
-		pathToStateFile: path,
-		ctx:             ctx,
-		stopped:         true,
-		doneChan:        make(chan struct{}),
-		saveTimer:       time.NewTicker(indexSaveFrequency),
+		entries:   make(map[string]*schedulerEntry),
+		buckets:   make(map[int64]*bucket),
+		dirty:     make(map[int64]bool),
+		accessed:  make(map[string]time.Time),
+		tick:      defaultTick,
+		driver:    driver,
+		root:      path,
+		ctx:       ctx,
+		stopped:   true,
+		doneChan:  make(chan struct{}),
+		saveTimer: time.NewTicker(indexSaveFrequency),
 	}
 }
 
 // TTLExpirationScheduler is a scheduler used to perform actions
-// when TTLs expire
+// when TTLs expire. Only the entries expiring up to the end of the next
+// bucket are held in memory, with those changed since their shard was
+// written; the shards of the others are read as the timer wheel reaches
+// them, or to evict their entries, and their size is accounted for by the
+// summaries of the shards.
 type TTLExpirationScheduler struct {
 	sync.Mutex
 
-	entries map[string]*schedulerEntry
+	// storage serializes the reads and writes of shards, which are made
+	// without holding the lock.
+	storage sync.Mutex
+
+	// entries are the entries held in memory, buckets the buckets of the
+	// shards and dirty the buckets whose shards must be written.
+	entries    map[string]*schedulerEntry
+	buckets    map[int64]*bucket
+	dirty      map[int64]bool
+	indexDirty bool
 
-	driver          driver.StorageDriver
-	ctx             context.Context
-	pathToStateFile string
+	// accessed are the access times of the entries not held in memory,
+	// applied when their shard is read. The shards are read in turn to
+	// apply them, from the one following swept; once all were, the
+	// accesses made before sweepStart are dropped, as their entries are
+	// not scheduled.
+	accessed      map[string]time.Time
+	accessesDirty bool
+	swept         int64
+	sweepStart    time.Time
+
+	// horizon is the last bucket held in memory, whose entries are in the
+	// timer wheel.
+	horizon int64
+	tick    time.Duration
+	wheel   *timerWheel
+
+	driver driver.StorageDriver
+	ctx    context.Context
+	root   string
 
 	stopped bool
 
 	onBlobExpire     expiryFunc
 	onManifestExpire expiryFunc
 
-	indexDirty bool
-	saveTimer  *time.Ticker
-	doneChan   chan struct{}
+	// size is the total size of the entries, bounded by maxSize if set.
+	size     int64
+	maxSize  int64
+	evicting bool
+	counts   [2]int
+	bytes    [2]int64
+	expired  uint64
+	evicted  uint64
+
+	saveTimer *time.Ticker
+	tickTimer *time.Ticker
+	doneChan  chan struct{}
 }
 
 // OnBlobExpire is called when a scheduled blob's TTL expires
@@ -80,8 +204,18 @@ func (ttles *TTLExpirationScheduler) OnManifestExpire(f expiryFunc) {
 	ttles.onManifestExpire = f
 }
 
-// AddBlob schedules a blob cleanup after ttl expires
-func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl time.Duration) error {
+// SetMaxSize bounds the total size of the entries. When it is exceeded,
+// the least recently accessed entries are removed first, as if they
+// expired. A size of 0 leaves it unbounded.
+func (ttles *TTLExpirationScheduler) SetMaxSize(size int64) {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	ttles.maxSize = size
+}
+
+// AddBlob schedules a blob cleanup once it was not accessed for ttl
+func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl time.Duration, size int64) error {
 	ttles.Lock()
 	defer ttles.Unlock()
 
@@ -89,12 +223,12 @@ func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl ti
 		return fmt.Errorf("scheduler not started")
 	}
 
-	ttles.add(blobRef, ttl, entryTypeBlob)
+	ttles.add(blobRef, ttl, size, entryTypeBlob)
 	return nil
 }
 
-// AddManifest schedules a manifest cleanup after ttl expires
-func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical, ttl time.Duration) error {
+// AddManifest schedules a manifest cleanup once it was not accessed for ttl
+func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical, ttl time.Duration, size int64) error {
 	ttles.Lock()
 	defer ttles.Unlock()
 
@@ -102,51 +236,85 @@ func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical
 		return fmt.Errorf("scheduler not started")
 	}
 
-	ttles.add(manifestRef, ttl, entryTypeManifest)
+	ttles.add(manifestRef, ttl, size, entryTypeManifest)
 	return nil
 }
 
+// Access records an access to a scheduled blob or manifest, postponing its
+// expiry by its TTL. References which are not scheduled are ignored. The
+// access of an entry not held in memory is applied once its shard is read.
+func (ttles *TTLExpirationScheduler) Access(ref reference.Canonical) {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	if ttles.stopped {
+		return
+	}
+
+	now := time.Now()
+	key := ref.String()
+	entry, ok := ttles.entries[key]
+	if !ok {
+		if last, ok := ttles.accessed[key]; !ok || now.Sub(last) >= accessGranularity {
+			ttles.accessed[key] = now
+			ttles.accessesDirty = true
+		}
+		return
+	}
+	ttles.touch(entry, now)
+}
+
+// Stats returns statistics about the entries.
+func (ttles *TTLExpirationScheduler) Stats() Stats {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	return Stats{
+		Blobs:         ttles.counts[entryTypeBlob],
+		Manifests:     ttles.counts[entryTypeManifest],
+		BlobBytes:     ttles.bytes[entryTypeBlob],
+		ManifestBytes: ttles.bytes[entryTypeManifest],
+		MaxSize:       ttles.maxSize,
+		Expired:       ttles.expired,
+		Evicted:       ttles.evicted,
+	}
+}
+
 // Start starts the scheduler
 func (ttles *TTLExpirationScheduler) Start() error {
 	ttles.Lock()
 	defer ttles.Unlock()
 
+	if !ttles.stopped {
+		return fmt.Errorf("Scheduler already started")
+	}
+
+	now := time.Now()
+	ttles.wheel = newTimerWheel(ttles.tick, wheelSlots, now)
+	ttles.horizon = horizonAt(now)
+	ttles.swept, ttles.sweepStart = math.MinInt64, now
 	err := ttles.readState()
 	if err != nil {
 		return err
 	}
 
-	if !ttles.stopped {
-		return fmt.Errorf("Scheduler already started")
-	}
-
 	context.GetLogger(ttles.ctx).Infof("Starting cached object TTL expiration scheduler...")
 	ttles.stopped = false
+	ttles.checkSize()
 
-	// Start timer for each deserialized entry
-	for _, entry := range ttles.entries {
-		entry.timer = ttles.startTimer(entry, entry.Expiry.Sub(time.Now()))
-	}
-
-	// Start a ticker to periodically save the entries index
-
+	// Start a ticker to advance the timer wheel, and another to
+	// periodically save the shards which changed
+	ttles.tickTimer = time.NewTicker(ttles.tick)
 	go func() {
 		for {
 			select {
-			case <-ttles.saveTimer.C:
-				ttles.Lock()
-				if !ttles.indexDirty {
-					ttles.Unlock()
-					continue
-				}
+			case now := <-ttles.tickTimer.C:
+				ttles.advance(now)
 
-				err := ttles.writeState()
-				if err != nil {
+			case <-ttles.saveTimer.C:
+				if err := ttles.saveState(); err != nil {
 					context.GetLogger(ttles.ctx).Errorf("Error writing scheduler state: %s", err)
-				} else {
-					ttles.indexDirty = false
 				}
-				ttles.Unlock()
 
 			case <-ttles.doneChan:
 				return
@@ -157,103 +325,298 @@ func (ttles *TTLExpirationScheduler) Start() error {
 	return nil
 }
 
-func (ttles *TTLExpirationScheduler) add(r reference.Reference, ttl time.Duration, eType int) {
+// advance reads the shards reaching the horizon, and removes the entries
+// of the timer wheel which expired by now.
+func (ttles *TTLExpirationScheduler) advance(now time.Time) {
+	if err := ttles.extendHorizon(horizonAt(now)); err != nil {
+		context.GetLogger(ttles.ctx).Errorf("Error reading scheduler state: %s", err)
+	}
+
+	var expired []expiry
+	ttles.Lock()
+	for _, entry := range ttles.wheel.advance(now) {
+		// The entry may have been removed since it was added to the
+		// wheel.
+		if ttles.entries[entry.Key] == entry {
+			expired = append(expired, ttles.remove(entry))
+			ttles.expired++
+		}
+	}
+	ttles.Unlock()
+	ttles.expire(expired)
+}
+
+func (ttles *TTLExpirationScheduler) add(r reference.Reference, ttl time.Duration, size int64, eType int) {
+	now := time.Now()
 	entry := &schedulerEntry{
-		Key:       r.String(),
-		Expiry:    time.Now().Add(ttl),
-		EntryType: eType,
+		Key:        r.String(),
+		Expiry:     now.Add(ttl),
+		EntryType:  eType,
+		TTL:        ttl,
+		Size:       size,
+		LastAccess: now,
+		slot:       -1,
 	}
 	context.GetLogger(ttles.ctx).Infof("Adding new scheduler entry for %s with ttl=%s", entry.Key, entry.Expiry.Sub(time.Now()))
-	if oldEntry, present := ttles.entries[entry.Key]; present && oldEntry.timer != nil {
-		oldEntry.timer.Stop()
+	if oldEntry, present := ttles.entries[entry.Key]; present {
+		ttles.dirty[oldEntry.bucket] = true
+		ttles.unlink(oldEntry)
+	}
+	if _, ok := ttles.accessed[entry.Key]; ok {
+		delete(ttles.accessed, entry.Key)
+		ttles.accessesDirty = true
+	}
+	entry.bucket = bucketOf(entry.Expiry)
+	ttles.link(entry)
+	ttles.dirty[entry.bucket] = true
+	ttles.checkSize()
+}
+
+// touch records an access to entry at t, postponing its expiry by its TTL.
+// Its shard is only written again if its expiry moves to another bucket, or
+// its access time by accessGranularity.
+func (ttles *TTLExpirationScheduler) touch(entry *schedulerEntry, t time.Time) {
+	entry.LastAccess = t
+	if entry.TTL > 0 {
+		entry.Expiry = t.Add(entry.TTL)
+		if bucket := bucketOf(entry.Expiry); bucket != entry.bucket {
+			ttles.dirty[entry.bucket] = true
+			ttles.unlink(entry)
+			entry.bucket = bucket
+			ttles.link(entry)
+			ttles.dirty[bucket] = true
+			return
+		}
+		if entry.bucket <= ttles.horizon {
+			ttles.schedule(entry)
+		}
+	}
+	if t.Sub(entry.saved) >= accessGranularity {
+		ttles.dirty[entry.bucket] = true
 	}
-	ttles.entries[entry.Key] = entry
-	entry.timer = ttles.startTimer(entry, ttl)
-	ttles.indexDirty = true
 }
 
-func (ttles *TTLExpirationScheduler) startTimer(entry *schedulerEntry, ttl time.Duration) *time.Timer {
-	return time.AfterFunc(ttl, func() {
-		ttles.Lock()
-		defer ttles.Unlock()
+// link adds entry to the entries held in memory, in the bucket of its
+// shard, and to the timer wheel if the bucket is within the horizon.
+func (ttles *TTLExpirationScheduler) link(entry *schedulerEntry) {
+	bk := ttles.buckets[entry.bucket]
+	if bk == nil {
+		// A bucket without summary has no shard yet.
+		bk = &bucket{summary: summary{Bucket: entry.bucket}, loaded: true, entries: make(map[string]*schedulerEntry)}
+		ttles.buckets[entry.bucket] = bk
+	}
+	bk.entries[entry.Key] = entry
+	delete(bk.removed, entry.Key)
+	ttles.entries[entry.Key] = entry
 
-		var f expiryFunc
+	bk.summary.add(entry)
+	ttles.count(entry, 1)
+	if entry.bucket <= ttles.horizon {
+		ttles.schedule(entry)
+	}
+}
 
-		switch entry.EntryType {
-		case entryTypeBlob:
-			f = ttles.onBlobExpire
-		case entryTypeManifest:
-			f = ttles.onManifestExpire
-		default:
-			f = func(reference.Reference) error {
-				return fmt.Errorf("scheduler entry type")
-			}
+// unlink removes entry from the entries held in memory. Its removal from a
+// shard which is not held is recorded to be merged once it is read.
+func (ttles *TTLExpirationScheduler) unlink(entry *schedulerEntry) {
+	bk := ttles.buckets[entry.bucket]
+	delete(bk.entries, entry.Key)
+	if !bk.loaded {
+		if bk.removed == nil {
+			bk.removed = make(map[string]bool)
 		}
+		bk.removed[entry.Key] = true
+	}
+	delete(ttles.entries, entry.Key)
 
-		ref, err := reference.Parse(entry.Key)
-		if err == nil {
-			if err := f(ref); err != nil {
-				context.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", entry.Key, err)
-			}
-		} else {
-			context.GetLogger(ttles.ctx).Errorf("Error unpacking reference: %s", err)
-		}
+	bk.summary.remove(entry)
+	ttles.count(entry, -1)
+	ttles.wheel.remove(entry)
+}
 
-		delete(ttles.entries, entry.Key)
-		ttles.indexDirty = true
-	})
+// schedule adds entry to the timer wheel, in the slot of its expiry.
+func (ttles *TTLExpirationScheduler) schedule(entry *schedulerEntry) {
+	ttles.wheel.remove(entry)
+	ttles.wheel.add(entry)
 }
 
-// Stop stops the scheduler.
-func (ttles *TTLExpirationScheduler) Stop() {
-	ttles.Lock()
-	defer ttles.Unlock()
+// count adds n times entry to the totals of the entries.
+func (ttles *TTLExpirationScheduler) count(entry *schedulerEntry, n int) {
+	ttles.counts[entry.EntryType] += n
+	ttles.bytes[entry.EntryType] += int64(n) * entry.Size
+	ttles.size += int64(n) * entry.Size
+	ttles.indexDirty = true
+}
 
-	if err := ttles.writeState(); err != nil {
-		context.GetLogger(ttles.ctx).Errorf("Error writing scheduler state: %s", err)
+// account adds n times the entries of a shard to the totals of the entries.
+func (ttles *TTLExpirationScheduler) account(s summary, n int) {
+	for t := range s.Counts {
+		ttles.counts[t] += n * s.Counts[t]
+		ttles.bytes[t] += int64(n) * s.Bytes[t]
+		ttles.size += int64(n) * s.Bytes[t]
 	}
+	ttles.indexDirty = true
+}
 
-	for _, entry := range ttles.entries {
-		entry.timer.Stop()
+// expiry is the call of the expiry function of a removed entry.
+type expiry struct {
+	key string
+	f   expiryFunc
+}
+
+// remove removes entry and returns the call of its expiry function, which
+// is made by expire once the lock is released.
+func (ttles *TTLExpirationScheduler) remove(entry *schedulerEntry) expiry {
+	var f expiryFunc
+
+	switch entry.EntryType {
+	case entryTypeBlob:
+		f = ttles.onBlobExpire
+	case entryTypeManifest:
+		f = ttles.onManifestExpire
+	default:
+		f = func(reference.Reference) error {
+			return fmt.Errorf("scheduler entry type")
+		}
 	}
 
-	close(ttles.doneChan)
-	ttles.saveTimer.Stop()
-	ttles.stopped = true
+	ttles.dirty[entry.bucket] = true
+	ttles.unlink(entry)
+	return expiry{key: entry.Key, f: f}
 }
 
-func (ttles *TTLExpirationScheduler) writeState() error {
-	jsonBytes, err := json.Marshal(ttles.entries)
-	if err != nil {
-		return err
+// expire calls the expiry functions of removed entries. They delete content
+// from storage, so the lock must not be held.
+func (ttles *TTLExpirationScheduler) expire(expired []expiry) {
+	for _, e := range expired {
+		ref, err := reference.Parse(e.key)
+		if err != nil {
+			context.GetLogger(ttles.ctx).Errorf("Error unpacking reference: %s", err)
+			continue
+		}
+		if err := e.f(ref); err != nil {
+			context.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", e.key, err)
+		}
 	}
+}
 
-	err = ttles.driver.PutContent(ttles.ctx, ttles.pathToStateFile, jsonBytes)
-	if err != nil {
-		return err
+// checkSize starts evicting entries if their total size exceeds the
+// maximum. Entries are evicted in the background, as the expiry functions
+// delete content from storage.
+func (ttles *TTLExpirationScheduler) checkSize() {
+	if ttles.maxSize <= 0 || ttles.size <= ttles.maxSize || ttles.evicting {
+		return
 	}
+	ttles.evicting = true
+	go ttles.evict()
+}
 
-	return nil
+// evict removes the least recently accessed entries until their total size
+// no longer exceeds the maximum. The shard holding the least recently
+// accessed entries is found from the summaries, and read if it is not held
+// in memory. The victims are chosen under the lock, and their content
+// deleted once it is released.
+func (ttles *TTLExpirationScheduler) evict() {
+	var evicted []expiry
+	ttles.Lock()
+	for !ttles.stopped && ttles.size > ttles.maxSize {
+		bk, next, others := ttles.leastRecent()
+		if bk == nil {
+			break
+		}
+		if !bk.loaded {
+			ttles.Unlock()
+			ttles.storage.Lock()
+			err := ttles.read(bk.summary.Bucket)
+			ttles.storage.Unlock()
+			ttles.Lock()
+			if err != nil {
+				context.GetLogger(ttles.ctx).Errorf("Error reading scheduler state: %s", err)
+				break
+			}
+			continue
+		}
+
+		entries := make(byLastAccess, 0, len(bk.entries))
+		for _, entry := range bk.entries {
+			entries = append(entries, entry)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		sort.Sort(entries)
+		if entries[0].LastAccess.After(bk.summary.Oldest) {
+			// Another shard may hold entries accessed earlier.
+			bk.summary.Oldest = entries[0].LastAccess
+			continue
+		}
+		for _, entry := range entries {
+			if ttles.size <= ttles.maxSize || (others && entry.LastAccess.After(next)) {
+				break
+			}
+			context.GetLogger(ttles.ctx).Infof("Evicting scheduler entry for %s, last accessed at %s", entry.Key, entry.LastAccess)
+			evicted = append(evicted, ttles.remove(entry))
+			ttles.evicted++
+		}
+	}
+	ttles.Unlock()
+
+	ttles.expire(evicted)
+
+	// Entries added meanwhile may exceed the maximum again.
+	ttles.Lock()
+	ttles.evicting = false
+	if !ttles.stopped {
+		ttles.checkSize()
+	}
+	ttles.Unlock()
 }
 
-func (ttles *TTLExpirationScheduler) readState() error {
-	if _, err := ttles.driver.Stat(ttles.ctx, ttles.pathToStateFile); err != nil {
-		switch err := err.(type) {
-		case driver.PathNotFoundError:
-			return nil
-		default:
-			return err
+// leastRecent returns the bucket whose shard may hold the least recently
+// accessed entry, and the earliest access of the entries of the others, if
+// there are.
+func (ttles *TTLExpirationScheduler) leastRecent() (*bucket, time.Time, bool) {
+	var (
+		least  *bucket
+		next   time.Time
+		others bool
+	)
+	for _, bk := range ttles.buckets {
+		if bk.summary.empty() {
+			continue
+		}
+		switch {
+		case least == nil:
+			least = bk
+		case bk.summary.Oldest.Before(least.summary.Oldest):
+			next, others = least.summary.Oldest, true
+			least = bk
+		case !others || bk.summary.Oldest.Before(next):
+			next, others = bk.summary.Oldest, true
 		}
 	}
+	return least, next, others
+}
 
-	bytes, err := ttles.driver.GetContent(ttles.ctx, ttles.pathToStateFile)
-	if err != nil {
-		return err
+// byLastAccess sorts entries from the least recently accessed.
+type byLastAccess []*schedulerEntry
+
+func (e byLastAccess) Len() int           { return len(e) }
+func (e byLastAccess) Less(i, j int) bool { return e[i].LastAccess.Before(e[j].LastAccess) }
+func (e byLastAccess) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// Stop stops the scheduler.
+func (ttles *TTLExpirationScheduler) Stop() {
+	ttles.Lock()
+	close(ttles.doneChan)
+	ttles.saveTimer.Stop()
+	if ttles.tickTimer != nil {
+		ttles.tickTimer.Stop()
 	}
+	ttles.stopped = true
+	ttles.Unlock()
 
-	err = json.Unmarshal(bytes, &ttles.entries)
-	if err != nil {
-		return err
+	if err := ttles.saveState(); err != nil {
+		context.GetLogger(ttles.ctx).Errorf("Error writing scheduler state: %s", err)
 	}
-	return nil
 }
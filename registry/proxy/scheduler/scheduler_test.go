@@ -2,6 +2,8 @@ package scheduler
 
 import (
 	"encoding/json"
+	"path"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -41,6 +43,7 @@ func TestSchedule(t *testing.T) {
 
 	var mu sync.Mutex
 	s := New(context.Background(), inmemory.New(), "/ttl")
+	s.tick = timeUnit
 	deleteFunc := func(repoName reference.Reference) error {
 		if len(remainingRepos) == 0 {
 			t.Fatalf("Incorrect expiry count")
@@ -62,12 +65,12 @@ func TestSchedule(t *testing.T) {
 		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
 	}
 
-	s.add(ref1, 3*timeUnit, entryTypeBlob)
-	s.add(ref2, 1*timeUnit, entryTypeBlob)
+	s.add(ref1, 3*timeUnit, 0, entryTypeBlob)
+	s.add(ref2, 1*timeUnit, 0, entryTypeBlob)
 
 	func() {
 		s.Lock()
-		s.add(ref3, 1*timeUnit, entryTypeBlob)
+		s.add(ref3, 1*timeUnit, 0, entryTypeBlob)
 		s.Unlock()
 
 	}()
@@ -125,13 +128,14 @@ func TestRestoreOld(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	pathToStatFile := "/ttl"
+	pathToStatFile := "/ttl.json"
 	fs := inmemory.New()
 	err = fs.PutContent(ctx, pathToStatFile, serialized)
 	if err != nil {
 		t.Fatal("Unable to write serialized data to fs")
 	}
 	s := New(context.Background(), fs, "/ttl")
+	s.tick = timeUnit
 	s.OnBlobExpire(deleteFunc)
 	err = s.Start()
 	if err != nil {
@@ -167,14 +171,15 @@ func TestStopRestore(t *testing.T) {
 	fs := inmemory.New()
 	pathToStateFile := "/ttl"
 	s := New(context.Background(), fs, pathToStateFile)
+	s.tick = timeUnit
 	s.onBlobExpire = deleteFunc
 
 	err := s.Start()
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	s.add(ref1, 300*timeUnit, entryTypeBlob)
-	s.add(ref2, 100*timeUnit, entryTypeBlob)
+	s.add(ref1, 300*timeUnit, 0, entryTypeBlob)
+	s.add(ref2, 100*timeUnit, 0, entryTypeBlob)
 
 	// Start and stop before all operations complete
 	// state will be written to fs
@@ -183,6 +188,7 @@ func TestStopRestore(t *testing.T) {
 
 	// v2 will restore state from fs
 	s2 := New(context.Background(), fs, pathToStateFile)
+	s2.tick = timeUnit
 	s2.onBlobExpire = deleteFunc
 	err = s2.Start()
 	if err != nil {
@@ -209,3 +215,466 @@ func TestDoubleStart(t *testing.T) {
 		t.Fatalf("Scheduler started twice without error")
 	}
 }
+
+func TestEvictLeastRecentlyAccessed(t *testing.T) {
+	ref1, ref2, ref3 := testRefs(t)
+
+	var mu sync.Mutex
+	var evicted []string
+	done := make(chan struct{})
+	deleteFunc := func(r reference.Reference) error {
+		mu.Lock()
+		defer mu.Unlock()
+		evicted = append(evicted, r.String())
+		close(done)
+		return nil
+	}
+
+	s := New(context.Background(), inmemory.New(), "/ttl")
+	s.OnBlobExpire(deleteFunc)
+	s.SetMaxSize(25)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	s.AddBlob(ref1.(reference.Canonical), time.Hour, 10)
+	time.Sleep(time.Millisecond)
+	s.AddBlob(ref2.(reference.Canonical), time.Hour, 10)
+	time.Sleep(time.Millisecond)
+	s.Access(ref1.(reference.Canonical))
+	s.AddBlob(ref3.(reference.Canonical), time.Hour, 10)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("no entry evicted")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(evicted) != 1 || evicted[0] != ref2.String() {
+		t.Fatalf("expected %s to be evicted, got %v", ref2, evicted)
+	}
+	stats := s.Stats()
+	if stats.Blobs != 2 || stats.BlobBytes != 20 || stats.Evicted != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// TestEvictionDoesNotBlockAccess checks that entries are accessed while the
+// content of evicted entries is deleted.
+func TestEvictionDoesNotBlockAccess(t *testing.T) {
+	ref1, ref2, ref3 := testRefs(t)
+
+	deleting := make(chan struct{})
+	release := make(chan struct{})
+	s := New(context.Background(), inmemory.New(), "/ttl")
+	s.OnBlobExpire(func(reference.Reference) error {
+		close(deleting)
+		<-release
+		return nil
+	})
+	s.SetMaxSize(15)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+	defer close(release)
+
+	s.AddBlob(ref1.(reference.Canonical), time.Hour, 10)
+	s.AddBlob(ref2.(reference.Canonical), time.Hour, 10)
+	<-deleting
+
+	accessed := make(chan struct{})
+	go func() {
+		s.Access(ref2.(reference.Canonical))
+		s.AddBlob(ref3.(reference.Canonical), time.Hour, 1)
+		close(accessed)
+	}()
+	select {
+	case <-accessed:
+	case <-time.After(time.Second):
+		t.Fatal("access blocked by the eviction")
+	}
+}
+
+func TestAccessPostponesExpiry(t *testing.T) {
+	ref1, _, _ := testRefs(t)
+
+	expired := make(chan struct{}, 1)
+	s := New(context.Background(), inmemory.New(), "/ttl")
+	s.tick = time.Millisecond
+	s.OnBlobExpire(func(reference.Reference) error {
+		expired <- struct{}{}
+		return nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	start := time.Now()
+	s.AddBlob(ref1.(reference.Canonical), 100*time.Millisecond, 1)
+	time.Sleep(60 * time.Millisecond)
+	s.Access(ref1.(reference.Canonical))
+
+	select {
+	case <-expired:
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Fatalf("entry expired %s after it was added, despite its access", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("entry did not expire")
+	}
+}
+
+// storedEntry returns the record of key in the shards of s.
+func storedEntry(t *testing.T, s *TTLExpirationScheduler, key string) *schedulerEntry {
+	s.Lock()
+	buckets := make([]int64, 0, len(s.buckets))
+	for b := range s.buckets {
+		buckets = append(buckets, b)
+	}
+	s.Unlock()
+
+	for _, b := range buckets {
+		records, _, err := s.readShard(b)
+		if err != nil {
+			t.Fatalf("Error reading shard: %s", err)
+		}
+		for _, record := range records {
+			if record.Key == key {
+				return record
+			}
+		}
+	}
+	return nil
+}
+
+// TestAccessIsStored checks that the access of an entry whose shard is not
+// held in memory is recorded, and written to the shard once it is read.
+func TestAccessIsStored(t *testing.T) {
+	ref1, _, _ := testRefs(t)
+	ctx := context.Background()
+	fs := inmemory.New()
+
+	s := New(ctx, fs, "/ttl")
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	s.AddBlob(ref1.(reference.Canonical), 24*time.Hour, 1)
+	if err := s.saveState(); err != nil {
+		t.Fatalf("Error writing scheduler state: %s", err)
+	}
+	s.Lock()
+	_, held := s.entries[ref1.String()]
+	s.Unlock()
+	if held {
+		t.Fatalf("expected the entry dropped from memory once written")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	s.Access(ref1.(reference.Canonical))
+	s.Lock()
+	accessed := s.accessed[ref1.String()]
+	s.Unlock()
+	if accessed.IsZero() {
+		t.Fatalf("expected the access to be recorded")
+	}
+
+	// The shard of the entry is read in turn to apply the access.
+	s.Stop()
+	if entry := storedEntry(t, s, ref1.String()); entry == nil || !entry.LastAccess.Equal(accessed) || !entry.Expiry.Equal(accessed.Add(24*time.Hour)) {
+		t.Fatalf("expected the access at %s to be written, got %+v", accessed, entry)
+	}
+	s.Lock()
+	pending := len(s.accessed)
+	s.Unlock()
+	if pending != 0 {
+		t.Fatalf("expected the applied access to be dropped, got %d", pending)
+	}
+}
+
+// TestAccessesRestored checks that the accesses not yet applied to their
+// shard are restored on start.
+func TestAccessesRestored(t *testing.T) {
+	ref1, ref2, _ := testRefs(t)
+	ctx := context.Background()
+	fs := inmemory.New()
+
+	s := New(ctx, fs, "/ttl")
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+	s.AddBlob(ref1.(reference.Canonical), 24*time.Hour, 1)
+	s.AddBlob(ref2.(reference.Canonical), 48*time.Hour, 1)
+	if err := s.saveState(); err != nil {
+		t.Fatalf("Error writing scheduler state: %s", err)
+	}
+
+	// Only the shard of ref1 is read by the next write.
+	s.Access(ref1.(reference.Canonical))
+	s.Access(ref2.(reference.Canonical))
+	if err := s.saveState(); err != nil {
+		t.Fatalf("Error writing scheduler state: %s", err)
+	}
+	s.Lock()
+	accessed := s.accessed[ref2.String()]
+	s.Unlock()
+
+	restored := New(ctx, fs, "/ttl")
+	if err := restored.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer restored.Stop()
+	restored.Lock()
+	defer restored.Unlock()
+	if len(restored.accessed) != 1 || !restored.accessed[ref2.String()].Equal(accessed) {
+		t.Fatalf("expected the access of %s at %s to be restored, got %v", ref2, accessed, restored.accessed)
+	}
+}
+
+// TestAccessGranularity checks that accesses are only written once the
+// access time moved by accessGranularity, unless the expiry moves to another
+// shard.
+func TestAccessGranularity(t *testing.T) {
+	ref1, ref2, _ := testRefs(t)
+	s := New(context.Background(), inmemory.New(), "/ttl")
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	// The entries of earlier versions have no TTL, so that their expiry
+	// does not move.
+	s.Lock()
+	s.add(ref1, time.Hour, 1, entryTypeBlob)
+	entry := s.entries[ref1.String()]
+	entry.TTL = 0
+	s.Unlock()
+	s.AddBlob(ref2.(reference.Canonical), 24*time.Hour, 1)
+	if err := s.saveState(); err != nil {
+		t.Fatalf("Error writing scheduler state: %s", err)
+	}
+
+	s.Access(ref1.(reference.Canonical))
+	s.Access(ref2.(reference.Canonical))
+	s.Lock()
+	dirty, journaled := len(s.dirty), s.accessesDirty
+	s.accessesDirty = false
+	s.Unlock()
+	if dirty != 0 {
+		t.Fatalf("expected an access within the granularity not to be written, got %d dirty shards", dirty)
+	}
+	if !journaled {
+		t.Fatalf("expected the access of an entry not held in memory to be recorded")
+	}
+
+	s.Access(ref2.(reference.Canonical))
+	s.Lock()
+	journaled = s.accessesDirty
+	entry.saved = entry.saved.Add(-accessGranularity)
+	s.Unlock()
+	if journaled {
+		t.Fatalf("expected a repeated access within the granularity not to be recorded")
+	}
+	s.Access(ref1.(reference.Canonical))
+	s.Lock()
+	dirty = len(s.dirty)
+	s.Unlock()
+	if dirty != 1 {
+		t.Fatalf("expected an access past the granularity to be written, got %d dirty shards", dirty)
+	}
+}
+
+// TestLazyShards checks that only the shards up to the horizon are held in
+// memory, while the others are accounted for by their summaries until the
+// horizon reaches them.
+func TestLazyShards(t *testing.T) {
+	ref1, ref2, _ := testRefs(t)
+	ctx := context.Background()
+	fs := inmemory.New()
+
+	s := New(ctx, fs, "/ttl")
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	s.AddBlob(ref1.(reference.Canonical), time.Hour, 1)
+	s.AddManifest(ref2.(reference.Canonical), 48*time.Hour, 2)
+	s.Stop()
+
+	s = New(ctx, fs, "/ttl")
+	s.tick = time.Hour
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+	s.Lock()
+	_, near := s.entries[ref1.String()]
+	_, far := s.entries[ref2.String()]
+	s.Unlock()
+	if !near || far {
+		t.Fatalf("expected only the entry expiring within the horizon in memory, got %v and %v", near, far)
+	}
+	if stats := s.Stats(); stats.Blobs != 1 || stats.Manifests != 1 || stats.ManifestBytes != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if err := s.extendHorizon(horizonAt(time.Now().Add(48 * time.Hour))); err != nil {
+		t.Fatalf("Error reading scheduler state: %s", err)
+	}
+	s.Lock()
+	entry := s.entries[ref2.String()]
+	s.Unlock()
+	if entry == nil || entry.slot < 0 {
+		t.Fatalf("expected the entry read and scheduled once the horizon reached it, got %+v", entry)
+	}
+}
+
+// TestEvictUnreadShard checks that the least recently accessed entry is
+// evicted from a shard which is not held in memory.
+func TestEvictUnreadShard(t *testing.T) {
+	ref1, ref2, ref3 := testRefs(t)
+	ctx := context.Background()
+	fs := inmemory.New()
+
+	s := New(ctx, fs, "/ttl")
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	s.AddBlob(ref1.(reference.Canonical), 48*time.Hour, 10)
+	time.Sleep(time.Millisecond)
+	s.AddBlob(ref2.(reference.Canonical), 72*time.Hour, 10)
+	time.Sleep(time.Millisecond)
+	s.AddBlob(ref3.(reference.Canonical), 96*time.Hour, 10)
+	s.Stop()
+
+	evicted := make(chan string, 3)
+	s = New(ctx, fs, "/ttl")
+	s.OnBlobExpire(func(r reference.Reference) error {
+		evicted <- r.String()
+		return nil
+	})
+	s.SetMaxSize(25)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	select {
+	case key := <-evicted:
+		if key != ref1.String() {
+			t.Fatalf("expected %s to be evicted, got %s", ref1, key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no entry evicted")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if stats := s.Stats(); stats.Blobs != 2 || stats.BlobBytes != 20 || stats.Evicted != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestShardedState(t *testing.T) {
+	ref1, ref2, _ := testRefs(t)
+	ctx := context.Background()
+	fs := inmemory.New()
+
+	s := New(ctx, fs, "/ttl")
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	s.AddBlob(ref1.(reference.Canonical), time.Hour, 1)
+	s.AddManifest(ref2.(reference.Canonical), 48*time.Hour, 2)
+	s.Stop()
+
+	shards, err := fs.List(ctx, "/ttl")
+	if err != nil {
+		t.Fatalf("Error listing shards: %s", err)
+	}
+	var count int
+	for _, shard := range shards {
+		if _, err := strconv.ParseInt(path.Base(shard), 10, 64); err == nil {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Fatalf("expected entries expiring on different days in 2 shards, got %v", shards)
+	}
+
+	// Only the shard of the new entry is written.
+	s = New(ctx, fs, "/ttl")
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+	if stats := s.Stats(); stats.Blobs != 1 || stats.Manifests != 1 || stats.BlobBytes != 1 || stats.ManifestBytes != 2 {
+		t.Fatalf("unexpected stats after restore: %+v", stats)
+	}
+	s.Lock()
+	s.add(ref1, 96*time.Hour, 1, entryTypeBlob)
+	dirty := len(s.dirty)
+	s.Unlock()
+	if dirty != 2 {
+		t.Fatalf("expected the old and new shards of the entry to be dirty, got %d", dirty)
+	}
+}
+
+func TestPartialWriteRecovery(t *testing.T) {
+	ref1, ref2, ref3 := testRefs(t)
+	ctx := context.Background()
+	fs := inmemory.New()
+
+	now := time.Now()
+	record := func(ref reference.Reference, expiry, lastAccess time.Time) string {
+		p, err := json.Marshal(&schedulerEntry{Key: ref.String(), Expiry: expiry, LastAccess: lastAccess, Size: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(p) + "\n"
+	}
+	// Both shards are within the horizon, so that they are read on start.
+	early, late := now.Add(-time.Minute), now.Add(time.Hour)
+
+	// ref2 was being moved to the later shard, whose write completed, and
+	// the write of the earlier shard was cut in the middle of a record.
+	earlyShard := record(ref1, early, now) + record(ref2, early, now.Add(-time.Hour)) + `{"Key": "testrepo@sha256:dd`
+	lateShard := record(ref2, late, now) + record(ref3, late, now)
+	for path, content := range map[string]string{
+		"/ttl/" + strconv.FormatInt(bucketOf(early), 10):      earlyShard,
+		"/ttl/" + strconv.FormatInt(bucketOf(late), 10):       lateShard,
+		"/ttl/_tmp/" + strconv.FormatInt(bucketOf(early), 10): earlyShard[:10],
+	} {
+		if err := fs.PutContent(ctx, path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New(ctx, fs, "/ttl")
+	// The expired entry is not removed before it is checked.
+	s.tick = time.Hour
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	s.Lock()
+	defer s.Unlock()
+	if len(s.entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(s.entries))
+	}
+	if entry := s.entries[ref2.String()]; !entry.Expiry.Equal(late) {
+		t.Fatalf("expected the most recent record of a moved entry, got expiry %s", entry.Expiry)
+	}
+	if !s.dirty[bucketOf(early)] {
+		t.Fatalf("expected the shard with an unreadable record to be rewritten")
+	}
+	if s.size != 3 {
+		t.Fatalf("expected size 3, got %d", s.size)
+	}
+	if _, err := fs.List(ctx, "/ttl/_tmp"); err == nil {
+		t.Fatalf("expected temporary files to be removed")
+	}
+}
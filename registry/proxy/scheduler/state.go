@@ -0,0 +1,688 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/storage/driver"
+)
+
+// The entries are stored in shards bucketed by expiry time, each holding
+// the entries expiring within bucketWidth, so that only the shards of the
+// entries which changed are written. A shard is a file of JSON records, one
+// per line, named after the Unix time of the start of its bucket. The index
+// file holds a summary of each shard, so that shards are only read as the
+// timer wheel reaches them, or to evict their entries, and the accesses file
+// the access times of the entries whose shard was not read since. Files are
+// written to a temporary file first and then moved in place, and the records
+// which cannot be read, as left by a partial write, are skipped. The index
+// is written after the shards, so its summaries may be off after a crash
+// until the shards are read.
+const (
+	bucketWidth  = time.Hour
+	tmpDir       = "_tmp"
+	indexFile    = "index"
+	accessesFile = "accesses"
+)
+
+// bucketOf returns the bucket of the entries expiring at t.
+func bucketOf(t time.Time) int64 {
+	return t.Unix() - t.Unix()%int64(bucketWidth/time.Second)
+}
+
+// horizonAt returns the last bucket held in memory at t, so that the shard
+// of the next bucket is read an hour before its entries expire.
+func horizonAt(t time.Time) int64 {
+	return bucketOf(t) + int64(bucketWidth/time.Second)
+}
+
+func (ttles *TTLExpirationScheduler) shardPath(bucket int64) string {
+	return path.Join(ttles.root, strconv.FormatInt(bucket, 10))
+}
+
+// legacyStatePath is the path of the single state file of earlier versions,
+// which is migrated to shards on start.
+func (ttles *TTLExpirationScheduler) legacyStatePath() string {
+	return ttles.root + ".json"
+}
+
+// shard is the content of a shard to write, or nil if it must be deleted.
+type shard struct {
+	bucket  int64
+	content []byte
+}
+
+// accessRecord is the record of an access in the accesses file.
+type accessRecord struct {
+	Key        string    `json:"Key"`
+	LastAccess time.Time `json:"LastAccess"`
+}
+
+// saveState writes the shards of the buckets which changed, with the index
+// and the accesses if they changed. The shards of the entries changed while
+// they were not held in memory are read first to merge them, and one more in
+// turn to apply the accesses of the entries not held in memory. The files
+// are encoded under the lock and written once it is released, so that
+// accesses are not blocked by storage. The shards written beyond the horizon
+// are then dropped from memory.
+func (ttles *TTLExpirationScheduler) saveState() error {
+	ttles.storage.Lock()
+	defer ttles.storage.Unlock()
+
+	ttles.Lock()
+	swept, sweep := ttles.nextSweep()
+	ttles.Unlock()
+	if sweep {
+		if err := ttles.read(swept); err != nil {
+			return err
+		}
+	}
+	for {
+		ttles.Lock()
+		unread, ok := ttles.unreadDirty()
+		ttles.Unlock()
+		if !ok {
+			break
+		}
+		if err := ttles.read(unread); err != nil {
+			return err
+		}
+	}
+
+	ttles.Lock()
+	shards, err := ttles.dirtyShards()
+	if err != nil {
+		ttles.Unlock()
+		return err
+	}
+	var index, accesses []byte
+	indexDirty, accessesDirty := ttles.indexDirty, ttles.accessesDirty
+	if indexDirty {
+		index, err = ttles.encodeIndex()
+	}
+	if err == nil && accessesDirty {
+		accesses, err = ttles.encodeAccesses()
+	}
+	ttles.indexDirty, ttles.accessesDirty = false, false
+	ttles.Unlock()
+
+	written := 0
+	if err == nil {
+		written, err = ttles.writeShards(shards)
+	}
+	if err == nil && accessesDirty {
+		err = ttles.writeFile(accessesFile, accesses)
+	}
+	if err == nil && indexDirty {
+		err = ttles.writeFile(indexFile, index)
+	}
+
+	ttles.Lock()
+	defer ttles.Unlock()
+	if err != nil {
+		// What is left is written again on the next save.
+		for _, s := range shards[written:] {
+			ttles.dirty[s.bucket] = true
+		}
+		ttles.indexDirty = ttles.indexDirty || indexDirty
+		ttles.accessesDirty = ttles.accessesDirty || accessesDirty
+		return err
+	}
+	ttles.unload()
+	return nil
+}
+
+// nextSweep returns the next shard to read to apply the accesses of the
+// entries not held in memory, if there are. Once all the shards were read,
+// the accesses made before are dropped, as their entries are not scheduled.
+func (ttles *TTLExpirationScheduler) nextSweep() (int64, bool) {
+	if len(ttles.accessed) == 0 {
+		return 0, false
+	}
+
+	next, found := int64(0), false
+	for b, bk := range ttles.buckets {
+		if !bk.loaded && b > ttles.swept && (!found || b < next) {
+			next, found = b, true
+		}
+	}
+	if found {
+		ttles.swept = next
+		return next, true
+	}
+
+	for key, at := range ttles.accessed {
+		if at.Before(ttles.sweepStart) {
+			delete(ttles.accessed, key)
+			ttles.accessesDirty = true
+		}
+	}
+	ttles.swept, ttles.sweepStart = math.MinInt64, time.Now()
+	return 0, false
+}
+
+// unreadDirty returns a bucket whose shard must be written but is not held
+// in memory.
+func (ttles *TTLExpirationScheduler) unreadDirty() (int64, bool) {
+	for b := range ttles.dirty {
+		if bk := ttles.buckets[b]; bk != nil && !bk.loaded {
+			return b, true
+		}
+	}
+	return 0, false
+}
+
+// dirtyShards encodes the shards of the buckets which changed, and marks
+// them clean. Entries only move to later buckets as they are accessed, so
+// later buckets come first: an interrupted write may leave an entry in two
+// shards, from which it expires early when the earlier one is read, but not
+// in none.
+func (ttles *TTLExpirationScheduler) dirtyShards() ([]shard, error) {
+	buckets := make([]int64, 0, len(ttles.dirty))
+	for bucket := range ttles.dirty {
+		// Shards changed while the others were written are read on the
+		// next save.
+		if bk := ttles.buckets[bucket]; bk == nil || bk.loaded {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Sort(sort.Reverse(int64s(buckets)))
+
+	shards := make([]shard, 0, len(buckets))
+	for _, bucket := range buckets {
+		content, err := ttles.encodeShard(bucket)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, shard{bucket: bucket, content: content})
+	}
+	for _, bucket := range buckets {
+		delete(ttles.dirty, bucket)
+	}
+	return shards, nil
+}
+
+func (ttles *TTLExpirationScheduler) encodeShard(bucket int64) ([]byte, error) {
+	bk := ttles.buckets[bucket]
+	if bk == nil || len(bk.entries) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(bk.entries))
+	for key := range bk.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		entry := bk.entries[key]
+		record, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(record)
+		buf.WriteByte('\n')
+		entry.saved = entry.LastAccess
+	}
+	return buf.Bytes(), nil
+}
+
+func (ttles *TTLExpirationScheduler) encodeIndex() ([]byte, error) {
+	buckets := make([]int64, 0, len(ttles.buckets))
+	for bucket, bk := range ttles.buckets {
+		if !bk.summary.empty() {
+			buckets = append(buckets, bucket)
+		}
+	}
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+	sort.Sort(int64s(buckets))
+
+	var buf bytes.Buffer
+	for _, bucket := range buckets {
+		record, err := json.Marshal(ttles.buckets[bucket].summary)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(record)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func (ttles *TTLExpirationScheduler) encodeAccesses() ([]byte, error) {
+	if len(ttles.accessed) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(ttles.accessed))
+	for key := range ttles.accessed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		record, err := json.Marshal(accessRecord{Key: key, LastAccess: ttles.accessed[key]})
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(record)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// unload drops the entries of the shards written beyond the horizon from
+// memory, and the buckets of the shards deleted.
+func (ttles *TTLExpirationScheduler) unload() {
+	for b, bk := range ttles.buckets {
+		if ttles.dirty[b] {
+			continue
+		}
+		if bk.summary.empty() {
+			delete(ttles.buckets, b)
+			continue
+		}
+		if b <= ttles.horizon || !bk.loaded {
+			continue
+		}
+		for key, entry := range bk.entries {
+			if ttles.entries[key] == entry {
+				delete(ttles.entries, key)
+			}
+		}
+		bk.loaded, bk.entries, bk.removed = false, make(map[string]*schedulerEntry), nil
+	}
+}
+
+// writeShards writes shards in order, returning the number written.
+func (ttles *TTLExpirationScheduler) writeShards(shards []shard) (int, error) {
+	for i, s := range shards {
+		if err := ttles.writeFile(strconv.FormatInt(s.bucket, 10), s.content); err != nil {
+			return i, err
+		}
+	}
+	return len(shards), nil
+}
+
+// writeFile writes the file name below the root, or deletes it if content
+// is nil.
+func (ttles *TTLExpirationScheduler) writeFile(name string, content []byte) error {
+	if content == nil {
+		err := ttles.driver.Delete(ttles.ctx, path.Join(ttles.root, name))
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	tmpPath := path.Join(ttles.root, tmpDir, name)
+	if err := ttles.driver.PutContent(ttles.ctx, tmpPath, content); err != nil {
+		return err
+	}
+	return ttles.driver.Move(ttles.ctx, tmpPath, path.Join(ttles.root, name))
+}
+
+// extendHorizon reads the shards of the buckets up to horizon, and adds
+// their entries to the timer wheel.
+func (ttles *TTLExpirationScheduler) extendHorizon(horizon int64) error {
+	ttles.Lock()
+	reached := ttles.horizon >= horizon
+	ttles.Unlock()
+	if reached {
+		return nil
+	}
+
+	ttles.storage.Lock()
+	defer ttles.storage.Unlock()
+
+	ttles.Lock()
+	from := ttles.horizon
+	var unread []int64
+	for b, bk := range ttles.buckets {
+		if b > from && b <= horizon && !bk.loaded {
+			unread = append(unread, b)
+		}
+	}
+	ttles.Unlock()
+	for _, b := range unread {
+		if err := ttles.read(b); err != nil {
+			return err
+		}
+	}
+
+	ttles.Lock()
+	defer ttles.Unlock()
+	for b, bk := range ttles.buckets {
+		if b > from && b <= horizon {
+			for _, entry := range bk.entries {
+				ttles.schedule(entry)
+			}
+		}
+	}
+	ttles.horizon = horizon
+	return nil
+}
+
+// read reads the shard of bucket b into memory, unless it is held. The
+// storage lock must be held, and the lock not.
+func (ttles *TTLExpirationScheduler) read(b int64) error {
+	ttles.Lock()
+	bk := ttles.buckets[b]
+	unread := bk != nil && !bk.loaded
+	ttles.Unlock()
+	if !unread {
+		return nil
+	}
+
+	records, rewrite, err := ttles.readShard(b)
+	if err != nil {
+		return err
+	}
+	ttles.Lock()
+	ttles.install(b, records, rewrite)
+	ttles.Unlock()
+	return nil
+}
+
+// install holds the entries of the shard of bucket b in memory, merging the
+// records read from it with the entries changed since it was written and
+// the accesses to them. Its summary is recomputed from them. The shard is
+// rewritten if rewrite is set, as some of its records could not be read.
+func (ttles *TTLExpirationScheduler) install(b int64, records []*schedulerEntry, rewrite bool) {
+	bk := ttles.buckets[b]
+	ttles.account(bk.summary, -1)
+	changed, removed := bk.entries, bk.removed
+	bk.summary = summary{Bucket: b}
+	bk.loaded, bk.entries, bk.removed = true, make(map[string]*schedulerEntry), nil
+	for _, entry := range changed {
+		ttles.link(entry)
+	}
+	if rewrite {
+		ttles.dirty[b] = true
+	}
+
+	for _, record := range records {
+		if removed[record.Key] {
+			continue
+		}
+		if current, ok := ttles.entries[record.Key]; ok {
+			// An entry found in two shards was being moved, or was
+			// added again; the most recent record is kept.
+			if !record.LastAccess.After(current.LastAccess) && !record.Expiry.After(current.Expiry) {
+				ttles.dirty[b] = true
+				continue
+			}
+			ttles.dirty[current.bucket] = true
+			ttles.unlink(current)
+		}
+
+		record.bucket = bucketOf(record.Expiry)
+		record.saved = record.LastAccess
+		if record.bucket != b {
+			ttles.dirty[b] = true
+			ttles.dirty[record.bucket] = true
+		}
+		ttles.link(record)
+		if at, ok := ttles.accessed[record.Key]; ok {
+			delete(ttles.accessed, record.Key)
+			ttles.accessesDirty = true
+			if at.After(record.LastAccess) {
+				// The access is written with the shard, as it is
+				// dropped from the accesses file.
+				ttles.touch(record, at)
+				ttles.dirty[record.bucket] = true
+			}
+		}
+	}
+}
+
+// readState reads the summaries of the shards, the accesses of the entries
+// not held in memory, and the shards of the buckets up to the horizon. The
+// state file of earlier versions, if it exists, is replaced by shards. As
+// the scheduler is not started, storage is accessed under the lock.
+func (ttles *TTLExpirationScheduler) readState() error {
+	migrated, err := ttles.readLegacyState()
+	if err != nil {
+		return err
+	}
+	summaries, err := ttles.readIndex()
+	if err != nil {
+		return err
+	}
+
+	children, err := ttles.driver.List(ttles.ctx, ttles.root)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		children, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	indexed := 0
+	for _, child := range children {
+		name := path.Base(child)
+		if name == tmpDir {
+			// Left over by interrupted writes, whose files are intact.
+			if err := ttles.driver.Delete(ttles.ctx, child); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || ttles.buckets[b] != nil {
+			// The index and accesses files, or the shards of a
+			// migration which was interrupted, which are written
+			// again.
+			continue
+		}
+
+		s, ok := summaries[b]
+		if ok {
+			indexed++
+		} else {
+			// The shard was written after the index, or the index
+			// could not be read.
+			if s, err = ttles.summarizeShard(b); err != nil {
+				return err
+			}
+			ttles.indexDirty = true
+		}
+		bk := &bucket{summary: s, entries: make(map[string]*schedulerEntry)}
+		if s.empty() {
+			bk.loaded = true
+			ttles.dirty[b] = true
+		}
+		ttles.buckets[b] = bk
+		ttles.account(s, 1)
+	}
+	if indexed != len(summaries) {
+		ttles.indexDirty = true
+	}
+
+	if err := ttles.readAccesses(); err != nil {
+		return err
+	}
+
+	var unread []int64
+	for b, bk := range ttles.buckets {
+		if b <= ttles.horizon && !bk.loaded {
+			unread = append(unread, b)
+		}
+	}
+	for _, b := range unread {
+		records, rewrite, err := ttles.readShard(b)
+		if err != nil {
+			return err
+		}
+		ttles.install(b, records, rewrite)
+	}
+
+	if migrated {
+		shards, err := ttles.dirtyShards()
+		if err != nil {
+			return err
+		}
+		if _, err := ttles.writeShards(shards); err != nil {
+			return err
+		}
+		index, err := ttles.encodeIndex()
+		if err != nil {
+			return err
+		}
+		if err := ttles.writeFile(indexFile, index); err != nil {
+			return err
+		}
+		ttles.indexDirty = false
+		ttles.unload()
+		return ttles.driver.Delete(ttles.ctx, ttles.legacyStatePath())
+	}
+	return nil
+}
+
+// readShard reads the records of the shard of bucket b, returning whether
+// some of them could not be read.
+func (ttles *TTLExpirationScheduler) readShard(b int64) ([]*schedulerEntry, bool, error) {
+	shardPath := ttles.shardPath(b)
+	content, err := ttles.driver.GetContent(ttles.ctx, shardPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	var (
+		records []*schedulerEntry
+		rewrite bool
+	)
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		entry := &schedulerEntry{slot: -1}
+		if err := json.Unmarshal(line, entry); err != nil || !entry.valid() {
+			context.GetLogger(ttles.ctx).Warnf("Skipping unreadable scheduler record %s:%d: %v", shardPath, i+1, err)
+			rewrite = true
+			continue
+		}
+		records = append(records, entry)
+	}
+	return records, rewrite, nil
+}
+
+// summarizeShard reads the shard of bucket b to compute its summary.
+func (ttles *TTLExpirationScheduler) summarizeShard(b int64) (summary, error) {
+	s := summary{Bucket: b}
+	records, _, err := ttles.readShard(b)
+	if err != nil {
+		return s, err
+	}
+	for _, record := range records {
+		s.add(record)
+	}
+	return s, nil
+}
+
+// valid returns whether entry was read from a complete record.
+func (entry *schedulerEntry) valid() bool {
+	return entry.Key != "" && (entry.EntryType == entryTypeBlob || entry.EntryType == entryTypeManifest)
+}
+
+// readIndex reads the summaries of the shards. The shards missing from the
+// index, or whose summary cannot be read, are read instead.
+func (ttles *TTLExpirationScheduler) readIndex() (map[int64]summary, error) {
+	summaries := make(map[int64]summary)
+	indexPath := path.Join(ttles.root, indexFile)
+	content, err := ttles.driver.GetContent(ttles.ctx, indexPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return summaries, nil
+		}
+		return nil, err
+	}
+
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var s summary
+		if err := json.Unmarshal(line, &s); err != nil || s.Bucket == 0 {
+			context.GetLogger(ttles.ctx).Warnf("Skipping unreadable scheduler summary %s:%d: %v", indexPath, i+1, err)
+			continue
+		}
+		summaries[s.Bucket] = s
+	}
+	return summaries, nil
+}
+
+// readAccesses reads the accesses of the entries whose shard was not read
+// since.
+func (ttles *TTLExpirationScheduler) readAccesses() error {
+	accessesPath := path.Join(ttles.root, accessesFile)
+	content, err := ttles.driver.GetContent(ttles.ctx, accessesPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record accessRecord
+		if err := json.Unmarshal(line, &record); err != nil || record.Key == "" {
+			context.GetLogger(ttles.ctx).Warnf("Skipping unreadable scheduler access %s:%d: %v", accessesPath, i+1, err)
+			ttles.accessesDirty = true
+			continue
+		}
+		ttles.accessed[record.Key] = record.LastAccess
+	}
+	return nil
+}
+
+// readLegacyState holds the entries of the state file of earlier versions
+// in memory, to be written to shards, and returns whether it exists.
+func (ttles *TTLExpirationScheduler) readLegacyState() (bool, error) {
+	content, err := ttles.driver.GetContent(ttles.ctx, ttles.legacyStatePath())
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// The state file was rewritten in place, and may have been left
+	// incomplete by a crash.
+	var entries map[string]*schedulerEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		context.GetLogger(ttles.ctx).Errorf("Ignoring unreadable scheduler state %s: %v", ttles.legacyStatePath(), err)
+		return false, nil
+	}
+	for key, entry := range entries {
+		entry.Key, entry.slot = key, -1
+		if !entry.valid() {
+			continue
+		}
+		entry.bucket = bucketOf(entry.Expiry)
+		ttles.link(entry)
+		ttles.dirty[entry.bucket] = true
+	}
+	return true, nil
+}
+
+// int64s sorts int64 values in increasing order.
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
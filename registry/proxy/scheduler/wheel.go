@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"time"
+)
+
+// timerWheel is a hashed timing wheel. Entries are kept in the slot of the
+// tick they expire at, modulo the number of slots, and the slots are visited
+// in turn as ticks pass, so that a single ticker drives the expiry of all
+// entries. Entries expiring more than a revolution ahead are visited, and
+// skipped, once per revolution until they expire.
+type timerWheel struct {
+	tick  time.Duration
+	slots []map[*schedulerEntry]struct{}
+
+	// last is the last tick visited.
+	last int64
+}
+
+func newTimerWheel(tick time.Duration, slots int, now time.Time) *timerWheel {
+	w := &timerWheel{
+		tick:  tick,
+		slots: make([]map[*schedulerEntry]struct{}, slots),
+	}
+	w.last = w.tickAt(now)
+	return w
+}
+
+// tickAt returns the last tick passed at t.
+func (w *timerWheel) tickAt(t time.Time) int64 {
+	return t.UnixNano() / int64(w.tick)
+}
+
+// add schedules entry at the first tick following its expiry, or at the
+// next tick if it already expired.
+func (w *timerWheel) add(entry *schedulerEntry) {
+	t := (entry.Expiry.UnixNano() + int64(w.tick) - 1) / int64(w.tick)
+	if t <= w.last {
+		t = w.last + 1
+	}
+
+	entry.slot = int(t % int64(len(w.slots)))
+	if w.slots[entry.slot] == nil {
+		w.slots[entry.slot] = make(map[*schedulerEntry]struct{})
+	}
+	w.slots[entry.slot][entry] = struct{}{}
+}
+
+// remove unschedules entry.
+func (w *timerWheel) remove(entry *schedulerEntry) {
+	if entry.slot < 0 {
+		return
+	}
+	delete(w.slots[entry.slot], entry)
+	entry.slot = -1
+}
+
+// advance visits the slots of the ticks passed since the last call and
+// returns the entries which expired by now. They remain scheduled until
+// removed.
+func (w *timerWheel) advance(now time.Time) []*schedulerEntry {
+	current := w.tickAt(now)
+	from := w.last + 1
+	if current-from >= int64(len(w.slots)) {
+		// A full revolution passed, all the slots are visited once.
+		from = current - int64(len(w.slots)) + 1
+	}
+
+	var expired []*schedulerEntry
+	for t := from; t <= current; t++ {
+		for entry := range w.slots[t%int64(len(w.slots))] {
+			if !entry.Expiry.After(now) {
+				expired = append(expired, entry)
+			}
+		}
+	}
+	if current > w.last {
+		w.last = current
+	}
+	return expired
+}
@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"github.com/docker/distribution/context"
+)
+
+// staleWarning is the Warning header of the responses served from the cache
+// while the upstream is unavailable, as described by RFC 7234.
+const staleWarning = `110 - "Response is Stale"`
+
+// markStale records that cached tags are served because the upstream is
+// unavailable, marking the response of ctx, if any, as stale.
+func markStale(ctx context.Context, err error) {
+	context.GetLogger(ctx).Warnf("Upstream unavailable, serving cached tags: %v", err)
+	proxyMetrics.ManifestStale()
+
+	if w, err := context.GetResponseWriter(ctx); err == nil {
+		w.Header().Set("Warning", staleWarning)
+	}
+}
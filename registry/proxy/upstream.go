@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/transport"
+)
+
+// upstream is a remote registry mirrored by the cache, serving the
+// repositories matching its prefix or regular expression.
+type upstream struct {
+	name    string
+	prefix  string
+	strip   bool
+	regexp  *regexp.Regexp
+	rewrite string
+
+	// mirrors are equivalent remote registries, tried in order.
+	mirrors []*mirror
+}
+
+// mirror is one of the remote registries of an upstream.
+type mirror struct {
+	remoteURL      url.URL
+	transport      http.RoundTripper
+	authChallenger authChallenger
+}
+
+// newUpstreams returns the upstreams of config. A remote URL configured
+// without upstreams is a single upstream serving all repositories.
+// Upstreams configured without credentials use those of the credentials
+// file for each of their mirrors, if any.
+func newUpstreams(config configuration.Proxy) ([]*upstream, error) {
+	upstreams := config.Upstreams
+	if config.RemoteURL != "" {
+		if len(upstreams) > 0 {
+			return nil, fmt.Errorf("proxy: remoteurl and upstreams are mutually exclusive")
+		}
+		upstreams = []configuration.ProxyUpstream{{
+			Name:         config.RemoteURL,
+			RemoteURLs:   []string{config.RemoteURL},
+			Username:     config.Username,
+			Password:     config.Password,
+			RefreshToken: config.RefreshToken,
+			TLS:          config.TLS,
+		}}
+	}
+
+	var credentialsFile dockerConfig
+	if config.CredentialsFile != "" {
+		var err error
+		if credentialsFile, err = loadDockerConfig(config.CredentialsFile); err != nil {
+			return nil, fmt.Errorf("proxy: unable to load credentials file: %v", err)
+		}
+	}
+
+	var ups []*upstream
+	for i, uc := range upstreams {
+		name := uc.Name
+		if name == "" {
+			name = fmt.Sprintf("upstreams[%d]", i)
+		}
+
+		u := &upstream{
+			name:   name,
+			prefix: uc.Prefix,
+			strip:  uc.StripPrefix,
+		}
+		switch {
+		case uc.Prefix != "" && uc.Regexp != "":
+			return nil, fmt.Errorf("proxy: %s: prefix and regexp are mutually exclusive", name)
+		case uc.StripPrefix && uc.Prefix == "":
+			return nil, fmt.Errorf("proxy: %s: stripprefix requires a prefix", name)
+		case uc.Rewrite != "" && uc.Regexp == "":
+			return nil, fmt.Errorf("proxy: %s: rewrite requires a regexp", name)
+		case uc.Regexp != "":
+			re, err := regexp.Compile("^(?:" + uc.Regexp + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("proxy: %s: invalid regexp: %v", name, err)
+			}
+			u.regexp, u.rewrite = re, uc.Rewrite
+		}
+
+		if len(uc.RemoteURLs) == 0 {
+			return nil, fmt.Errorf("proxy: %s: remoteurls must list at least one URL", name)
+		}
+		if uc.RefreshToken != "" && (uc.Username != "" || uc.Password != "") {
+			return nil, fmt.Errorf("proxy: %s: refreshtoken and username are mutually exclusive", name)
+		}
+		tr, err := newTransport(uc.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %s: %v", name, err)
+		}
+		for _, rawURL := range uc.RemoteURLs {
+			remoteURL, err := url.Parse(rawURL)
+			if err != nil {
+				return nil, fmt.Errorf("proxy: %s: invalid remote URL %q: %v", name, rawURL, err)
+			}
+
+			up := userpass{
+				username:     uc.Username,
+				password:     uc.Password,
+				refreshToken: uc.RefreshToken,
+			}
+			if up == (userpass{}) {
+				up = credentialsFile.credentials(*remoteURL)
+			}
+			cs := configureAuth(*remoteURL, up)
+
+			u.mirrors = append(u.mirrors, &mirror{
+				remoteURL: *remoteURL,
+				transport: tr,
+				authChallenger: &remoteAuthChallenger{
+					remoteURL: *remoteURL,
+					transport: tr,
+					cm:        learningChallengeManager{auth.NewSimpleChallengeManager(), cs},
+					cs:        cs,
+				},
+			})
+		}
+
+		ups = append(ups, u)
+	}
+	return ups, nil
+}
+
+// remoteName returns the name of the repository in the upstream, if the
+// upstream serves it.
+func (u *upstream) remoteName(name string) (string, bool) {
+	switch {
+	case u.regexp != nil:
+		match := u.regexp.FindStringSubmatchIndex(name)
+		if match == nil {
+			return "", false
+		}
+		if u.rewrite == "" {
+			return name, true
+		}
+		return string(u.regexp.ExpandString(nil, u.rewrite, name, match)), true
+	case u.prefix != "":
+		if !strings.HasPrefix(name, u.prefix) {
+			return "", false
+		}
+		if u.strip {
+			return strings.TrimPrefix(name, u.prefix), true
+		}
+		return name, true
+	default:
+		return name, true
+	}
+}
+
+// remoteServices returns the services of the repository in the upstream,
+// reading from the first available mirror.
+func (u *upstream) remoteServices(ctx context.Context, name reference.Named) (distribution.ManifestService, distribution.BlobService, distribution.TagService, error) {
+	var (
+		manifests = failoverManifests{mirrors: u.mirrors}
+		blobs     = failoverBlobs{mirrors: u.mirrors}
+		tags      = failoverTags{mirrors: u.mirrors}
+	)
+	for _, m := range u.mirrors {
+		c := m.authChallenger
+		tokenHandler := auth.NewTokenHandler(m.transport, c.credentialStore(), name.Name(), "pull")
+		tr := transport.NewTransport(m.transport,
+			auth.NewAuthorizer(c.challengeManager(), tokenHandler, auth.NewBasicHandler(c.credentialStore())))
+
+		remoteRepo, err := client.NewRepository(ctx, name, m.remoteURL.String(), tr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		remoteManifests, err := remoteRepo.Manifests(ctx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		manifests.manifests = append(manifests.manifests, remoteManifests)
+		blobs.blobs = append(blobs.blobs, remoteRepo.Blobs(ctx))
+		tags.tags = append(tags.tags, remoteRepo.Tags(ctx))
+	}
+
+	// A single mirror is used directly.
+	if len(u.mirrors) == 1 {
+		return manifests.manifests[0], blobs.blobs[0], tags.tags[0], nil
+	}
+	return manifests, blobs, tags, nil
+}
+
+// challenger returns the authChallenger of the upstream, which succeeds if
+// challenges are established with any of its mirrors.
+func (u *upstream) challenger() authChallenger {
+	if len(u.mirrors) == 1 {
+		return u.mirrors[0].authChallenger
+	}
+	return mirrorChallengers(u.mirrors)
+}
+
+// mirrorChallengers establishes challenges with the first available mirror.
+// Transports are built with the challenge manager and credentials of each
+// mirror; those returned here are the ones of the first mirror.
+type mirrorChallengers []*mirror
+
+func (mc mirrorChallengers) tryEstablishChallenges(ctx context.Context) error {
+	var err error
+	for _, m := range mc {
+		if err = m.authChallenger.tryEstablishChallenges(ctx); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (mc mirrorChallengers) challengeManager() auth.ChallengeManager {
+	return mc[0].authChallenger.challengeManager()
+}
+
+func (mc mirrorChallengers) credentialStore() auth.CredentialStore {
+	return mc[0].authChallenger.credentialStore()
+}
+
+// tryMirrors calls fn with each mirror in order, until it succeeds or fails
+// for another reason than the mirror being unavailable.
+func tryMirrors(ctx context.Context, mirrors []*mirror, fn func(i int) error) error {
+	var err error
+	for i, m := range mirrors {
+		err = m.authChallenger.tryEstablishChallenges(ctx)
+		if err == nil {
+			err = fn(i)
+		}
+		if err == nil || !isUnavailable(err) {
+			return err
+		}
+		if i < len(mirrors)-1 {
+			context.GetLogger(ctx).Warnf("upstream mirror %s unavailable, trying the next one: %v", m.remoteURL.String(), err)
+		}
+	}
+	return err
+}
+
+// isUnavailable returns whether err reports an upstream which cannot serve
+// requests, because it is unreachable, failing or rate limiting, rather than
+// an error about the request itself.
+func isUnavailable(err error) bool {
+	switch err := err.(type) {
+	case net.Error, *url.Error:
+		return true
+	case *client.UnexpectedHTTPStatusError:
+		return true
+	case *client.UnexpectedHTTPResponseError:
+		return unavailableStatus(err.StatusCode)
+	case errcode.ErrorCode:
+		return unavailableStatus(err.Descriptor().HTTPStatusCode)
+	case errcode.Error:
+		return unavailableStatus(err.Code.Descriptor().HTTPStatusCode)
+	case errcode.Errors:
+		for _, e := range err {
+			if isUnavailable(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unavailableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
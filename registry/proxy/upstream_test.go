@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client"
+)
+
+func TestUpstreamRouting(t *testing.T) {
+	upstreams, err := newUpstreams(configuration.Proxy{
+		Upstreams: []configuration.ProxyUpstream{
+			{Name: "hub", Prefix: "hub/", StripPrefix: true, RemoteURLs: []string{"https://registry-1.docker.io"}},
+			{Name: "quay", Regexp: `quay/(.+)`, Rewrite: "mirrored/$1", RemoteURLs: []string{"https://quay.io"}},
+			{Name: "internal", Prefix: "internal/", RemoteURLs: []string{"https://a.example.com", "https://b.example.com"}},
+			{Name: "default", RemoteURLs: []string{"https://registry.example.com"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error configuring upstreams: %v", err)
+	}
+
+	route := func(name string) (string, string) {
+		for _, u := range upstreams {
+			if remoteName, ok := u.remoteName(name); ok {
+				return u.name, remoteName
+			}
+		}
+		return "", ""
+	}
+	for _, tc := range []struct {
+		name, upstream, remoteName string
+	}{
+		{"hub/library/ubuntu", "hub", "library/ubuntu"},
+		{"quay/coreos/etcd", "quay", "mirrored/coreos/etcd"},
+		{"quayside/app", "default", "quayside/app"},
+		{"internal/app", "internal", "internal/app"},
+		{"other/app", "default", "other/app"},
+	} {
+		upstream, remoteName := route(tc.name)
+		if upstream != tc.upstream || remoteName != tc.remoteName {
+			t.Errorf("%s: expected %s from %s, got %s from %s", tc.name, tc.remoteName, tc.upstream, remoteName, upstream)
+		}
+	}
+	if len(upstreams[2].mirrors) != 2 {
+		t.Fatalf("expected 2 mirrors, got %d", len(upstreams[2].mirrors))
+	}
+
+	for _, config := range []configuration.Proxy{
+		{RemoteURL: "https://registry-1.docker.io", Upstreams: []configuration.ProxyUpstream{{RemoteURLs: []string{"https://quay.io"}}}},
+		{Upstreams: []configuration.ProxyUpstream{{Prefix: "a/", Regexp: "a/.*", RemoteURLs: []string{"https://quay.io"}}}},
+		{Upstreams: []configuration.ProxyUpstream{{StripPrefix: true, RemoteURLs: []string{"https://quay.io"}}}},
+		{Upstreams: []configuration.ProxyUpstream{{Regexp: "(", RemoteURLs: []string{"https://quay.io"}}}},
+		{Upstreams: []configuration.ProxyUpstream{{Prefix: "a/"}}},
+	} {
+		if _, err := newUpstreams(config); err == nil {
+			t.Errorf("expected an error configuring %+v", config)
+		}
+	}
+}
+
+// unavailableTagStore fails as an unavailable upstream.
+type unavailableTagStore struct {
+	mockTagStore
+}
+
+func (*unavailableTagStore) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	return distribution.Descriptor{}, &client.UnexpectedHTTPStatusError{Status: "503 Service Unavailable"}
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+	mirrors := []*mirror{
+		{remoteURL: url.URL{Host: "a"}, authChallenger: &mockChallenger{}},
+		{remoteURL: url.URL{Host: "b"}, authChallenger: &mockChallenger{}},
+	}
+	desc := distribution.Descriptor{Size: 42}
+	tags := failoverTags{
+		mirrors: mirrors,
+		tags: []distribution.TagService{
+			&unavailableTagStore{},
+			&mockTagStore{mapping: map[string]distribution.Descriptor{"latest": desc}},
+		},
+	}
+
+	got, err := tags.Get(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error getting tag: %v", err)
+	}
+	if got.Size != desc.Size {
+		t.Fatalf("unexpected descriptor: %+v", got)
+	}
+
+	// Errors about the request itself are returned without failing over.
+	tags.tags[0] = &mockTagStore{mapping: map[string]distribution.Descriptor{}}
+	if _, err := tags.Get(ctx, "latest"); err == nil {
+		t.Fatal("expected an unknown tag error from the first mirror")
+	}
+	if count := mirrors[1].authChallenger.(*mockChallenger).count; count != 1 {
+		t.Fatalf("expected the second mirror to be used once, got %d", count)
+	}
+}
+
+func TestIsUnavailable(t *testing.T) {
+	for _, tc := range []struct {
+		err         error
+		unavailable bool
+	}{
+		{&url.Error{Op: "Get", URL: "https://a", Err: errors.New("connection refused")}, true},
+		{&client.UnexpectedHTTPStatusError{Status: "502 Bad Gateway"}, true},
+		{&client.UnexpectedHTTPResponseError{StatusCode: 429}, true},
+		{&client.UnexpectedHTTPResponseError{StatusCode: 404}, false},
+		{errcode.ErrorCodeTooManyRequests.WithMessage("slow down"), true},
+		{errcode.Errors{errcode.ErrorCodeUnavailable}, true},
+		{errcode.ErrorCodeUnauthorized, false},
+		{distribution.ErrBlobUnknown, false},
+	} {
+		if isUnavailable(tc.err) != tc.unavailable {
+			t.Errorf("%v: expected unavailable to be %v", tc.err, tc.unavailable)
+		}
+	}
+}
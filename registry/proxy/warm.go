@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+)
+
+// defaultWarmConcurrency is the number of blobs pulled concurrently when
+// warming the cache, unless configured otherwise.
+const defaultWarmConcurrency = 4
+
+// WarmOptions configures the warming of the cache.
+type WarmOptions struct {
+	// Platforms selects the manifests of manifest lists to pull, as
+	// "os/architecture" or "os/architecture/variant". All the manifests of
+	// a list are pulled if empty.
+	Platforms []string
+
+	// Concurrency is the number of blobs pulled concurrently.
+	Concurrency int
+
+	// Progress, if set, is called with the result of each image once it is
+	// warmed, from the goroutines warming the images. Calls are serialized,
+	// and all of them return before Warm does.
+	Progress func(WarmResult)
+}
+
+// WarmResult reports the warming of an image.
+type WarmResult struct {
+	Image  string        `json:"image"`
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Manifests and Blobs count the manifests and blobs of the image, of
+	// which Cached were already in the cache.
+	Manifests int `json:"manifests"`
+	Blobs     int `json:"blobs"`
+	Cached    int `json:"cached"`
+
+	// Bytes is the number of bytes pulled from the upstream.
+	Bytes int64 `json:"bytes"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Warm pulls images into the cache registry, as returned by
+// NewRegistryPullThroughCache, so that later pulls are served from the
+// cache. Images are references to repositories of the cache, by tag or
+// digest, pulling the "latest" tag by default. Their manifests are pulled
+// in turn, while their blobs are pulled concurrently. The results are
+// returned in the order of images; errors warming an image are reported in
+// its result.
+func Warm(ctx context.Context, registry distribution.Namespace, images []string, options WarmOptions) ([]WarmResult, error) {
+	pr, ok := registry.(*proxyingRegistry)
+	if !ok {
+		return nil, fmt.Errorf("registry is not a pull through cache")
+	}
+	platforms := make([]manifestlist.PlatformSpec, 0, len(options.Platforms))
+	for _, p := range options.Platforms {
+		platform, err := parsePlatform(p)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, platform)
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultWarmConcurrency
+	}
+
+	jobs := make(chan func())
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				job()
+			}
+		}()
+	}
+
+	var (
+		mu      sync.Mutex
+		pending sync.WaitGroup
+		results = make([]WarmResult, len(images))
+	)
+	report := func(result *WarmResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		if options.Progress != nil {
+			options.Progress(*result)
+		}
+	}
+
+	for i, image := range images {
+		result := &results[i]
+		result.Image = image
+
+		blobs, err := pr.warmManifests(ctx, image, platforms, result)
+		if err != nil {
+			result.Error = err.Error()
+			report(result)
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, b := range blobs {
+			b := b
+			wg.Add(1)
+			jobs <- func() {
+				defer wg.Done()
+				if err := ctx.Err(); err != nil {
+					mu.Lock()
+					result.Error = err.Error()
+					mu.Unlock()
+					return
+				}
+
+				n, err := b.store.fetch(ctx, b.digest)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err != nil:
+					if result.Error == "" {
+						result.Error = fmt.Sprintf("blob %s: %v", b.digest, err)
+					}
+				case n == 0:
+					result.Cached++
+				default:
+					result.Bytes += n
+				}
+			}
+		}
+
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			wg.Wait()
+			report(result)
+		}()
+	}
+
+	close(jobs)
+	workers.Wait()
+	pending.Wait()
+	return results, nil
+}
+
+// warmBlob is a blob of an image to pull into store.
+type warmBlob struct {
+	store  *proxyBlobStore
+	digest digest.Digest
+}
+
+// warmManifests pulls the manifests of image and returns its blobs.
+func (pr *proxyingRegistry) warmManifests(ctx context.Context, image string, platforms []manifestlist.PlatformSpec, result *WarmResult) ([]warmBlob, error) {
+	ref, err := reference.ParseNamed(image)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := pr.Repository(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	manifestService, err := repo.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifests, ok1 := manifestService.(*proxyManifestStore)
+	blobStore, ok2 := repo.Blobs(ctx).(*proxyBlobStore)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("repository %s is not a pull through cache", ref.Name())
+	}
+
+	var dgst digest.Digest
+	switch r := ref.(type) {
+	case reference.Canonical:
+		dgst = r.Digest()
+	case reference.Tagged:
+		desc, err := repo.Tags(ctx).Get(ctx, r.Tag())
+		if err != nil {
+			return nil, err
+		}
+		dgst = desc.Digest
+	default:
+		desc, err := repo.Tags(ctx).Get(ctx, "latest")
+		if err != nil {
+			return nil, err
+		}
+		dgst = desc.Digest
+	}
+	result.Digest = dgst
+
+	manifest, n, err := manifests.fetch(ctx, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", dgst, err)
+	}
+	result.countManifest(n)
+
+	var images []distribution.Manifest
+	if list, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		for _, m := range list.Manifests {
+			if !matchesPlatform(m.Platform, platforms) {
+				continue
+			}
+			manifest, n, err := manifests.fetch(ctx, m.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("manifest %s: %v", m.Digest, err)
+			}
+			result.countManifest(n)
+			images = append(images, manifest)
+		}
+	} else {
+		images = append(images, manifest)
+	}
+
+	var blobs []warmBlob
+	seen := make(map[digest.Digest]bool)
+	for _, m := range images {
+		references := m.References()
+		if m, ok := m.(*schema2.DeserializedManifest); ok {
+			references = append(references, m.Config)
+		}
+		for _, desc := range references {
+			// Foreign layers are not served by the registry.
+			if desc.MediaType == schema2.MediaTypeForeignLayer || seen[desc.Digest] {
+				continue
+			}
+			seen[desc.Digest] = true
+			blobs = append(blobs, warmBlob{store: blobStore, digest: desc.Digest})
+		}
+	}
+	result.Blobs = len(blobs)
+	return blobs, nil
+}
+
+func (r *WarmResult) countManifest(pulled int64) {
+	r.Manifests++
+	if pulled == 0 {
+		r.Cached++
+	}
+	r.Bytes += pulled
+}
+
+// parsePlatform parses a platform given as "os/architecture" or
+// "os/architecture/variant".
+func parsePlatform(platform string) (manifestlist.PlatformSpec, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return manifestlist.PlatformSpec{}, fmt.Errorf("invalid platform %q, expected os/architecture[/variant]", platform)
+	}
+	spec := manifestlist.PlatformSpec{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		spec.Variant = parts[2]
+	}
+	return spec, nil
+}
+
+// matchesPlatform returns whether platform is one of platforms, or
+// platforms is empty. A platform without variant matches all variants.
+func matchesPlatform(platform manifestlist.PlatformSpec, platforms []manifestlist.PlatformSpec) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	for _, p := range platforms {
+		if p.OS == platform.OS && p.Architecture == platform.Architecture && (p.Variant == "" || p.Variant == platform.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadImageList reads a list of images, one per line, ignoring blank lines
+// and comments starting with "#".
+func ReadImageList(r io.Reader) ([]string, error) {
+	var images []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			images = append(images, line)
+		}
+	}
+	return images, scanner.Err()
+}
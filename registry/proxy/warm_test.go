@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+// testUpstream serves manifests and blobs by digest, and manifests by tag.
+// Blobs are served once gate is closed, if set.
+type testUpstream struct {
+	gate      chan struct{}
+	content   map[string]distribution.Descriptor
+	payloads  map[digest.Digest][]byte
+	mu        sync.Mutex
+	manifests int
+	blobs     int
+}
+
+func newTestUpstream() *testUpstream {
+	return &testUpstream{
+		content:  make(map[string]distribution.Descriptor),
+		payloads: make(map[digest.Digest][]byte),
+	}
+}
+
+func (u *testUpstream) add(mediaType string, payload []byte) distribution.Descriptor {
+	desc := distribution.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+	}
+	u.payloads[desc.Digest] = payload
+	u.content[desc.Digest.String()] = desc
+	return desc
+}
+
+func (u *testUpstream) addManifest(t *testing.T, m distribution.Manifest) distribution.Descriptor {
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.add(mediaType, payload)
+}
+
+func (u *testUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/"), "/")
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	desc, ok := u.content[parts[len(parts)-1]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == "GET" {
+		u.mu.Lock()
+		if parts[len(parts)-2] == "manifests" {
+			u.manifests++
+		} else {
+			u.blobs++
+		}
+		u.mu.Unlock()
+		if u.gate != nil && parts[len(parts)-2] == "blobs" {
+			<-u.gate
+		}
+	}
+	w.Header().Set("Content-Type", desc.MediaType)
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(u.payloads[desc.Digest]))
+}
+
+func TestWarm(t *testing.T) {
+	upstream := newTestUpstream()
+	image := func(platform string) distribution.Descriptor {
+		m, err := schema2.FromStruct(schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			Config:    upstream.add(schema2.MediaTypeConfig, []byte(`{"os":"`+platform+`"}`)),
+			Layers: []distribution.Descriptor{
+				upstream.add(schema2.MediaTypeLayer, []byte("shared layer")),
+				upstream.add(schema2.MediaTypeLayer, []byte("layer of "+platform)),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return upstream.addManifest(t, m)
+	}
+	amd64 := image("amd64")
+	arm64 := image("arm64")
+	list, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{
+		{Descriptor: amd64, Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64"}},
+		{Descriptor: arm64, Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listDesc := upstream.addManifest(t, list)
+	upstream.content["latest"] = listDesc
+
+	single, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    upstream.add(schema2.MediaTypeConfig, []byte(`{}`)),
+		Layers: []distribution.Descriptor{
+			upstream.add(schema2.MediaTypeLayer, []byte("shared layer")),
+			{MediaType: schema2.MediaTypeForeignLayer, Digest: digest.FromBytes([]byte("foreign")), Size: 7},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleDesc := upstream.addManifest(t, single)
+
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	ctx := context.Background()
+	driver := inmemory.New()
+	local, err := storage.NewRegistry(ctx, driver, storage.EnableDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewRegistryPullThroughCache(ctx, local, driver, configuration.Proxy{RemoteURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.(*proxyingRegistry).Close()
+
+	images := []string{"library/app", "library/single@" + singleDesc.Digest.String(), "library/app:missing"}
+	// Progress calls are serialized, as documented, so reported is appended
+	// to without locking.
+	var (
+		reported []WarmResult
+		calls    int32
+	)
+	results, err := Warm(ctx, cache, images, WarmOptions{
+		Platforms:   []string{"linux/amd64"},
+		Concurrency: 2,
+		Progress: func(r WarmResult) {
+			if atomic.AddInt32(&calls, 1) != 1 {
+				t.Error("concurrent progress calls")
+			}
+			reported = append(reported, r)
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&calls, -1)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error warming the cache: %v", err)
+	}
+	if len(reported) != len(images) {
+		t.Fatalf("expected progress for %d images, got %d", len(images), len(reported))
+	}
+
+	app := results[0]
+	if app.Error != "" || app.Digest != listDesc.Digest {
+		t.Fatalf("unexpected result warming %s: %+v", app.Image, app)
+	}
+	if app.Manifests != 2 || app.Blobs != 3 || app.Cached != 0 {
+		t.Errorf("expected the list, the amd64 manifest and its 3 blobs pulled, got %+v", app)
+	}
+	if want := listDesc.Size + amd64.Size + sizeOf(upstream, amd64.Digest); app.Bytes != want {
+		t.Errorf("expected %d bytes pulled, got %d", want, app.Bytes)
+	}
+	if results[1].Error != "" || results[1].Manifests != 1 || results[1].Blobs != 2 {
+		t.Errorf("expected the foreign layer skipped, got %+v", results[1])
+	}
+	if results[2].Error == "" {
+		t.Errorf("expected an error warming an unknown tag")
+	}
+
+	// Nothing is pulled again once cached.
+	manifests, blobs := upstream.manifests, upstream.blobs
+	results, err = Warm(ctx, cache, images[:1], WarmOptions{Platforms: []string{"linux/amd64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Error != "" || r.Bytes != 0 || r.Cached != r.Manifests+r.Blobs {
+		t.Errorf("expected all content cached, got %+v", r)
+	}
+	if upstream.manifests != manifests || upstream.blobs != blobs {
+		t.Errorf("expected no content pulled from the upstream")
+	}
+
+	if _, err := Warm(ctx, cache, images, WarmOptions{Platforms: []string{"linux"}}); err == nil {
+		t.Errorf("expected an error with an invalid platform")
+	}
+	if _, err := Warm(ctx, local, images, WarmOptions{}); err == nil {
+		t.Errorf("expected an error warming a registry which is not a cache")
+	}
+}
+
+// sizeOf returns the size of the blobs of the image manifest dgst.
+// TestWarmInflightBlob checks that a blob pulled by a concurrent request is
+// only reported as cached once it is stored, and is pulled again if the
+// concurrent pull fails.
+func TestWarmInflightBlob(t *testing.T) {
+	_, desc, server, local := newCoordinationEnv(t)
+	defer server.Close()
+	instance := newTestInstance(t, server.URL, local, newMemoryLeases(), time.Minute)
+	defer instance.close()
+
+	done := make(chan struct{})
+	mu.Lock()
+	inflight[desc.Digest] = done
+	mu.Unlock()
+
+	type fetched struct {
+		n   int64
+		err error
+	}
+	result := make(chan fetched, 1)
+	go func() {
+		n, err := instance.blobs.fetch(context.Background(), desc.Digest)
+		result <- fetched{n, err}
+	}()
+
+	select {
+	case r := <-result:
+		t.Fatalf("expected the fetch to wait for the concurrent pull, got %d, %v", r.n, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The concurrent pull fails without storing the blob.
+	mu.Lock()
+	close(done)
+	delete(inflight, desc.Digest)
+	mu.Unlock()
+
+	r := <-result
+	if r.err != nil || r.n != desc.Size {
+		t.Fatalf("expected the blob pulled once the concurrent pull failed, got %d, %v", r.n, r.err)
+	}
+	if _, err := instance.blobs.localStore.Stat(context.Background(), desc.Digest); err != nil {
+		t.Fatalf("expected the blob stored: %v", err)
+	}
+}
+
+func sizeOf(u *testUpstream, dgst digest.Digest) int64 {
+	var m schema2.DeserializedManifest
+	if err := m.UnmarshalJSON(u.payloads[dgst]); err != nil {
+		return -1
+	}
+	size := m.Config.Size
+	for _, desc := range m.References() {
+		size += desc.Size
+	}
+	return size
+}
+
+func TestMatchesPlatform(t *testing.T) {
+	arm, err := parsePlatform("linux/arm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	armv7, err := parsePlatform("linux/arm/v7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		platform  manifestlist.PlatformSpec
+		platforms []manifestlist.PlatformSpec
+		matches   bool
+	}{
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v6"}, nil, true},
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v6"}, []manifestlist.PlatformSpec{arm}, true},
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v6"}, []manifestlist.PlatformSpec{armv7}, false},
+		{manifestlist.PlatformSpec{OS: "windows", Architecture: "arm"}, []manifestlist.PlatformSpec{arm}, false},
+	} {
+		if matchesPlatform(tc.platform, tc.platforms) != tc.matches {
+			t.Errorf("matchesPlatform(%+v, %+v) != %v", tc.platform, tc.platforms, tc.matches)
+		}
+	}
+}
+
+func TestReadImageList(t *testing.T) {
+	images, err := ReadImageList(strings.NewReader("# images\nlibrary/app\n\n  library/db:9 # pinned\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0] != "library/app" || images[1] != "library/db:9" {
+		t.Errorf("unexpected images %q", images)
+	}
+}
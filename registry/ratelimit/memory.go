@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often full buckets are discarded from memory.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // time at which the bucket is full again
+}
+
+type inMemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewInMemoryLimiter returns a limiter keeping buckets in memory. Buckets
+// which have refilled are discarded periodically, since they are equivalent
+// to new ones.
+func NewInMemoryLimiter() Limiter {
+	return newInMemoryLimiter(time.Now)
+}
+
+func newInMemoryLimiter(now func() time.Time) *inMemoryLimiter {
+	return &inMemoryLimiter{
+		buckets:   make(map[string]*bucket),
+		lastSweep: now(),
+		now:       now,
+	}
+}
+
+func (l *inMemoryLimiter) Allow(buckets ...Bucket) (int, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+
+	refilled := make([]*bucket, len(buckets))
+	for i, bk := range buckets {
+		if !bk.Limit.Enabled() {
+			continue
+		}
+
+		b, ok := l.buckets[bk.Key]
+		if !ok {
+			b = &bucket{tokens: bk.Limit.burst(), last: now}
+			l.buckets[bk.Key] = b
+		}
+		b.tokens = refill(b.tokens, b.last, now, bk.Limit)
+		b.last = now
+		refilled[i] = b
+	}
+
+	for i, b := range refilled {
+		if b != nil && b.tokens < 1 {
+			return i, wait(b.tokens, buckets[i].Limit), nil
+		}
+	}
+
+	for i, b := range refilled {
+		if b == nil {
+			continue
+		}
+		limit := buckets[i].Limit
+		b.tokens--
+		b.full = now.Add(time.Duration((limit.burst() - b.tokens) / limit.Rate * float64(time.Second)))
+	}
+	return -1, 0, nil
+}
+
+func (l *inMemoryLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,59 @@
+// Package ratelimit provides token bucket rate limiters, kept either in
+// memory or in redis so that limits can be shared by several registry
+// instances.
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limit describes a token bucket. Rate tokens are added to the bucket per
+// second, up to Burst tokens. A zero Rate disables the limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Enabled reports whether the limit restricts anything.
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+// burst returns the capacity of the bucket, which is at least one token.
+func (l Limit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// Bucket identifies a token bucket by its key, along with its limit.
+type Bucket struct {
+	Key   string
+	Limit Limit
+}
+
+// Limiter takes tokens from buckets identified by a key.
+type Limiter interface {
+	// Allow takes a token from each of the buckets if all of them hold one.
+	// Otherwise no token is taken from any of them, and the index of the
+	// first empty bucket is returned along with the time until it holds a
+	// token. The index is -1 if the tokens were taken. Buckets without
+	// limit are ignored.
+	Allow(buckets ...Bucket) (int, time.Duration, error)
+}
+
+// refill returns the tokens of a bucket holding tokens at last, refilled up
+// to now.
+func refill(tokens float64, last, now time.Time, limit Limit) float64 {
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(limit.burst(), tokens+elapsed*limit.Rate)
+	}
+	return tokens
+}
+
+// wait returns the time until a bucket holding tokens holds a whole token.
+func wait(tokens float64, limit Limit) time.Duration {
+	return time.Duration(math.Ceil((1 - tokens) / limit.Rate * float64(time.Second)))
+}
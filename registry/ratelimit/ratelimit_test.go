@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestInMemoryLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newInMemoryLimiter(func() time.Time { return now })
+	checkLimiter(t, l, func(d time.Duration) { now = now.Add(d) })
+
+	// Refilled buckets are swept.
+	now = now.Add(2 * sweepInterval)
+	l.Allow(Bucket{Key: "other", Limit: Limit{Rate: 1, Burst: 1}})
+	if len(l.buckets) != 1 {
+		t.Fatalf("unexpected number of buckets after sweep: %d", len(l.buckets))
+	}
+}
+
+// TestRedisLimiter exercises a live redis instance. It is skipped unless
+// TEST_REGISTRY_RATELIMIT_REDIS_ADDR is set.
+func TestRedisLimiter(t *testing.T) {
+	addr := os.Getenv("TEST_REGISTRY_RATELIMIT_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("please set TEST_REGISTRY_RATELIMIT_REDIS_ADDR to test the rate limiter against redis")
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+		MaxIdle: 1,
+	}
+	conn := pool.Get()
+	if _, err := conn.Do("FLUSHDB"); err != nil {
+		t.Fatalf("unexpected error flushing redis db: %v", err)
+	}
+	conn.Close()
+
+	checkLimiter(t, NewRedisLimiter(pool), time.Sleep)
+}
+
+func checkLimiter(t *testing.T, l Limiter, advance func(time.Duration)) {
+	limit := Limit{Rate: 10, Burst: 2}
+	key := Bucket{Key: "key", Limit: limit}
+	other := Bucket{Key: "other", Limit: limit}
+
+	for i := 0; i < 2; i++ {
+		empty, _, err := l.Allow(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if empty >= 0 {
+			t.Fatalf("request %d denied within burst", i)
+		}
+	}
+
+	empty, wait, err := l.Allow(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if empty != 0 {
+		t.Fatalf("request allowed beyond burst")
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("unexpected wait: %v", wait)
+	}
+
+	if empty, _, _ := l.Allow(Bucket{Key: "key"}); empty >= 0 {
+		t.Fatalf("request denied without limit")
+	}
+
+	// No token is taken from the other buckets of a denied request.
+	for i := 0; i < 3; i++ {
+		if empty, _, _ := l.Allow(other, key); empty != 1 {
+			t.Fatalf("expected the empty bucket to be reported, got %d", empty)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if empty, _, _ := l.Allow(other); empty >= 0 {
+			t.Fatalf("request %d denied for another key after denials", i)
+		}
+	}
+
+	advance(wait)
+	if empty, _, _ := l.Allow(key); empty >= 0 {
+		t.Fatalf("request denied after waiting")
+	}
+}
@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// takeScript takes a token from each of the buckets given as keys, if all of
+// them hold one, atomically. Each bucket is a hash holding its tokens and the
+// time they were counted, which expires once the bucket would be full again.
+// The arguments are the current time followed by the rate and burst of each
+// bucket. Times are passed by the caller, in seconds, as scripts may not
+// read the clock of the server before writing. The script returns the 0-based
+// index of the first empty bucket, or -1, and the time to wait for its token.
+var takeScript = redis.NewScript(-1, `
+local now = tonumber(ARGV[1])
+
+local tokens = {}
+local empty = -1
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i])
+	local burst = tonumber(ARGV[2 * i + 1])
+
+	local state = redis.call("HMGET", key, "tokens", "last")
+	local t = tonumber(state[1])
+	local last = tonumber(state[2])
+	if t == nil or last == nil then
+		t = burst
+		last = now
+	end
+	if now > last then
+		t = math.min(burst, t + (now - last) * rate)
+	end
+	tokens[i] = t
+
+	if t < 1 and empty < 0 then
+		empty = i - 1
+		wait = (1 - t) / rate
+	end
+end
+
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i])
+	local burst = tonumber(ARGV[2 * i + 1])
+	local t = tokens[i]
+	if empty < 0 then
+		t = t - 1
+	end
+
+	redis.call("HMSET", key, "tokens", tostring(t), "last", tostring(now))
+	redis.call("PEXPIRE", key, math.ceil((burst - t) / rate * 1000) + 1000)
+end
+return {empty, tostring(wait)}
+`)
+
+type redisLimiter struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewRedisLimiter returns a limiter keeping buckets in redis, under keys
+// starting with "ratelimit::". Limits are shared by all the limiters using
+// the same redis instance.
+func NewRedisLimiter(pool *redis.Pool) Limiter {
+	return &redisLimiter{
+		pool:   pool,
+		prefix: "ratelimit::",
+	}
+}
+
+func (l *redisLimiter) Allow(buckets ...Bucket) (int, time.Duration, error) {
+	var indexes []int
+	for i, b := range buckets {
+		if b.Limit.Enabled() {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		return -1, 0, nil
+	}
+
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	args := []interface{}{len(indexes)}
+	for _, i := range indexes {
+		args = append(args, l.prefix+buckets[i].Key)
+	}
+	args = append(args, strconv.FormatFloat(now, 'f', 6, 64))
+	for _, i := range indexes {
+		args = append(args,
+			strconv.FormatFloat(buckets[i].Limit.Rate, 'f', -1, 64),
+			strconv.FormatFloat(buckets[i].Limit.burst(), 'f', -1, 64))
+	}
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(takeScript.Do(conn, args...))
+	if err != nil {
+		return -1, 0, err
+	}
+
+	var (
+		empty int
+		wait  string
+	)
+	if _, err := redis.Scan(reply, &empty, &wait); err != nil {
+		return -1, 0, err
+	}
+	if empty < 0 {
+		return -1, 0, nil
+	}
+	seconds, err := strconv.ParseFloat(wait, 64)
+	if err != nil {
+		return -1, 0, err
+	}
+	return indexes[empty], time.Duration(seconds * float64(time.Second)), nil
+}
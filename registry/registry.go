@@ -4,9 +4,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"rsc.io/letsencrypt"
@@ -17,11 +20,12 @@ import (
 	"github.com/docker/distribution/configuration"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/health"
+	"github.com/docker/distribution/metrics"
+	"github.com/docker/distribution/registry/accesslog"
 	"github.com/docker/distribution/registry/handlers"
 	"github.com/docker/distribution/registry/listener"
 	"github.com/docker/distribution/uuid"
 	"github.com/docker/distribution/version"
-	gorhandlers "github.com/gorilla/handlers"
 	"github.com/spf13/cobra"
 	"github.com/yvasiyarov/gorelic"
 )
@@ -52,11 +56,27 @@ var ServeCmd = &cobra.Command{
 			}(config.HTTP.Debug.Addr)
 		}
 
+		if config.HTTP.Metrics.Enabled && config.HTTP.Metrics.Addr != "" {
+			go func(addr string) {
+				log.Infof("metrics server listening %v", addr)
+				mux := http.NewServeMux()
+				mux.Handle(metricsPath(config), metrics.Handler())
+				if err := http.ListenAndServe(addr, mux); err != nil {
+					log.Fatalf("error listening on metrics interface: %v", err)
+				}
+			}(config.HTTP.Metrics.Addr)
+		}
+
 		registry, err := NewRegistry(ctx, config)
 		if err != nil {
 			log.Fatalln(err)
 		}
 
+		go registry.reloadOnSignal(func() (*configuration.Configuration, error) {
+			return resolveConfiguration(args)
+		})
+		go registry.closeOnSignal()
+
 		if err = registry.ListenAndServe(); err != nil {
 			log.Fatalln(err)
 		}
@@ -89,10 +109,16 @@ func NewRegistry(ctx context.Context, config *configuration.Configuration) (*Reg
 	app.RegisterHealthChecks()
 	handler := configureReporting(app)
 	handler = alive("/", handler)
+	if config.HTTP.Metrics.Enabled && config.HTTP.Metrics.Addr == "" {
+		handler = serveMetrics(metricsPath(config), handler)
+	}
 	handler = health.Handler(handler)
 	handler = panicHandler(handler)
 	if !config.Log.AccessLog.Disabled {
-		handler = gorhandlers.CombinedLoggingHandler(os.Stdout, handler)
+		handler, err = configureAccessLog(config, handler)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring access log: %v", err)
+		}
 	}
 
 	server := &http.Server{
@@ -277,6 +303,77 @@ func configureLogging(ctx context.Context, config *configuration.Configuration)
 	return ctx, nil
 }
 
+// configureAccessLog wraps the handler with the configured access log.
+func configureAccessLog(config *configuration.Configuration, handler http.Handler) (http.Handler, error) {
+	var out io.Writer = os.Stdout
+	if config.Log.AccessLog.Path != "" {
+		fp, err := os.OpenFile(config.Log.AccessLog.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out = fp
+	}
+
+	return accesslog.Handler(out, config.Log.AccessLog.Format, config.Log.AccessLog.Fields, handler)
+}
+
+// Reload applies the reloadable parts of config to the running registry. See
+// handlers.App.Reload for the fields which can be reloaded.
+func (registry *Registry) Reload(config *configuration.Configuration) error {
+	if err := registry.app.Reload(config); err != nil {
+		return err
+	}
+
+	if config.Log.Level == "" && config.Log.Formatter == "" {
+		// If no config for logging is set, fallback to deprecated "Loglevel".
+		log.SetLevel(logLevel(config.Loglevel))
+	} else {
+		log.SetLevel(logLevel(config.Log.Level))
+	}
+	return nil
+}
+
+// reloadOnSignal reloads the configuration returned by resolve each time
+// the process receives SIGHUP.
+func (registry *Registry) reloadOnSignal(resolve func() (*configuration.Configuration, error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		context.GetLogger(registry.app).Info("reloading configuration")
+
+		config, err := resolve()
+		if err != nil {
+			context.GetLogger(registry.app).Errorf("configuration reload failed: %v", err)
+			continue
+		}
+		if err := registry.Reload(config); err != nil {
+			context.GetLogger(registry.app).Errorf("configuration reload rejected: %v", err)
+		}
+	}
+}
+
+// closeOnSignal closes the registry and exits once the process receives
+// SIGINT or SIGTERM, so that buffered audit records are not lost.
+func (registry *Registry) closeOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	context.GetLogger(registry.app).Infof("stopping on %v", sig)
+	if err := registry.Close(); err != nil {
+		context.GetLogger(registry.app).Errorf("error closing registry: %v", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Close releases the resources of the registry. It must not serve requests
+// afterwards.
+func (registry *Registry) Close() error {
+	return registry.app.Close()
+}
+
 func logLevel(level configuration.Loglevel) log.Level {
 	l, err := log.ParseLevel(string(level))
 	if err != nil {
@@ -318,7 +415,36 @@ func alive(path string, handler http.Handler) http.Handler {
 	})
 }
 
+// serveMetrics wraps the handler with a route that serves the Prometheus
+// metrics when the path is matched. Other requests are passed to the provided
+// handler.
+func serveMetrics(path string, handler http.Handler) http.Handler {
+	metricsHandler := metrics.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			metricsHandler.ServeHTTP(w, r)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// metricsPath returns the configured path of the metrics endpoint.
+func metricsPath(config *configuration.Configuration) string {
+	if config.HTTP.Metrics.Path != "" {
+		return config.HTTP.Metrics.Path
+	}
+	return "/metrics"
+}
+
 func resolveConfiguration(args []string) (*configuration.Configuration, error) {
+	return readConfiguration(args, configuration.Parse)
+}
+
+// readConfiguration parses the configuration file named by args or by the
+// environment with parse.
+func readConfiguration(args []string, parse func(io.Reader) (*configuration.Configuration, error)) (*configuration.Configuration, error) {
 	var configurationPath string
 
 	if len(args) > 0 {
@@ -338,7 +464,7 @@ func resolveConfiguration(args []string) (*configuration.Configuration, error) {
 
 	defer fp.Close()
 
-	config, err := configuration.Parse(fp)
+	config, err := parse(fp)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing %s: %v", configurationPath, err)
 	}
@@ -1,10 +1,14 @@
 package registry
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/metrics"
 )
 
 // Tests to ensure nextProtos returns the correct protocols when:
@@ -28,3 +32,75 @@ func TestNextProtos(t *testing.T) {
 		t.Fatalf("expected protos to equal [http/1.1], got %s", protos)
 	}
 }
+
+// Tests to ensure the metrics endpoint is served on the configured path and
+// other requests reach the registry.
+func TestServeMetrics(t *testing.T) {
+	config := &configuration.Configuration{}
+	if path := metricsPath(config); path != "/metrics" {
+		t.Fatalf("expected default metrics path /metrics, got %s", path)
+	}
+	config.HTTP.Metrics.Path = "/debug/prometheus"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := serveMetrics(metricsPath(config), next)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, newRequest(t, "/debug/prometheus"))
+	if ct := rec.Header().Get("Content-Type"); ct != metrics.ContentType {
+		t.Fatalf("expected metrics content type, got %q", ct)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, newRequest(t, "/v2/"))
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("expected request to be passed through, got %d", rec.Code)
+	}
+}
+
+func newRequest(t *testing.T, path string) *http.Request {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	return req
+}
+
+// Tests to ensure credentials are redacted from the printed configuration
+// while the other values are kept.
+func TestRedactedConfiguration(t *testing.T) {
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{"s3": configuration.Parameters{
+			"bucket":    "images",
+			"accesskey": "AKIA",
+			"secretkey": "s3cr3t",
+		}},
+		Auth: configuration.Auth{"token": configuration.Parameters{
+			"realm": "https://auth.example.com/token",
+		}},
+	}
+	config.HTTP.Secret = "hunter2"
+	config.Notifications.Endpoints = []configuration.Endpoint{{
+		Name:    "listener",
+		Headers: http.Header{"Authorization": []string{"Bearer abc"}},
+	}}
+
+	p, err := redactedConfiguration(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := string(p)
+
+	for _, secret := range []string{"AKIA", "s3cr3t", "hunter2", "Bearer abc"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("expected %q to be redacted:\n%s", secret, out)
+		}
+	}
+	for _, value := range []string{"bucket: images", "realm: https://auth.example.com/token"} {
+		if !strings.Contains(out, value) {
+			t.Errorf("expected %q in output:\n%s", value, out)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package registry
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/audit"
 	"github.com/docker/distribution/registry/storage"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/factory"
 	"github.com/docker/distribution/version"
 	"github.com/docker/libtrust"
@@ -19,6 +23,11 @@ func init() {
 	RootCmd.AddCommand(GCCmd)
 	GCCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "do everything except remove the blobs")
 	RootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show the version and exit")
+	RootCmd.AddCommand(AuditCmd)
+	AuditCmd.Flags().StringVarP(&auditUser, "user", "u", "", "only show records of this user")
+	AuditCmd.Flags().StringVarP(&auditRepository, "repository", "r", "", "only show records of this repository")
+	AuditCmd.Flags().StringVar(&auditSince, "since", "", "only show records at or after this time (RFC3339 or a duration such as 24h)")
+	AuditCmd.Flags().StringVar(&auditUntil, "until", "", "only show records before this time (RFC3339 or a duration such as 1h)")
 }
 
 // RootCmd is the main command for the 'registry' binary.
@@ -82,3 +91,87 @@ var GCCmd = &cobra.Command{
 		}
 	},
 }
+
+var (
+	auditUser       string
+	auditRepository string
+	auditSince      string
+	auditUntil      string
+)
+
+// AuditCmd is the cobra command that corresponds to the audit subcommand
+var AuditCmd = &cobra.Command{
+	Use:   "audit <config>",
+	Short: "`audit` verifies and queries the audit log",
+	Long:  "`audit` verifies the hash chain of the audit log and prints the records matching the filters as JSON lines",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if !config.Audit.Enabled() {
+			fmt.Fprintln(os.Stderr, "audit log is not configured")
+			os.Exit(1)
+		}
+
+		filter := audit.Filter{
+			User:       auditUser,
+			Repository: auditRepository,
+		}
+		now := time.Now()
+		if filter.Since, err = parseAuditTime(auditSince, now); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --since: %v\n", err)
+			os.Exit(1)
+		}
+		if filter.Until, err = parseAuditTime(auditUntil, now); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --until: %v\n", err)
+			os.Exit(1)
+		}
+
+		var driver storagedriver.StorageDriver
+		if config.Audit.Storage.Enabled {
+			driver, err = factory.Create(config.Storage.Type(), config.Storage.Parameters())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+				os.Exit(1)
+			}
+		}
+
+		backend, err := audit.NewBackend(config.Audit, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open audit log: %v\n", err)
+			os.Exit(1)
+		}
+		defer backend.Close()
+
+		enc := json.NewEncoder(os.Stdout)
+		if err := audit.QueryBackend(backend, filter, func(chain string, record audit.Record) error {
+			return enc.Encode(auditOutput{Chain: chain, Record: record})
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to query audit log: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// auditOutput is a record printed by the audit command, with the chain it
+// belongs to when the log has several.
+type auditOutput struct {
+	Chain string `json:"chain,omitempty"`
+	audit.Record
+}
+
+// parseAuditTime parses an absolute RFC3339 time, or a duration which is
+// subtracted from now. An empty value returns the zero time.
+func parseAuditTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
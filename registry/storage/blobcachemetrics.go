@@ -4,6 +4,7 @@ import (
 	"expvar"
 	"sync/atomic"
 
+	"github.com/docker/distribution/metrics"
 	"github.com/docker/distribution/registry/storage/cache"
 )
 
@@ -57,4 +58,28 @@ func init() {
 		// numbers will always *eventually* be reported correctly.
 		return blobStatterCacheMetrics
 	}))
+
+	metrics.MustRegister(
+		metrics.NewCounterFunc("registry_storage_cache_requests_total",
+			"The number of blob descriptor cache lookups, by result.",
+			[]string{"cache", "result"}, func() []metrics.LabeledValue {
+				m := blobStatterCacheMetrics.Metrics()
+				return []metrics.LabeledValue{
+					{LabelValues: []string{"blobdescriptor", "hit"}, Value: float64(m.Hits)},
+					{LabelValues: []string{"blobdescriptor", "miss"}, Value: float64(m.Misses)},
+				}
+			}),
+		metrics.NewGaugeFunc("registry_storage_cache_hit_ratio",
+			"The ratio of blob descriptor cache lookups which were hits.",
+			[]string{"cache"}, func() []metrics.LabeledValue {
+				m := blobStatterCacheMetrics.Metrics()
+				var ratio float64
+				if m.Requests > 0 {
+					ratio = float64(m.Hits) / float64(m.Requests)
+				}
+				return []metrics.LabeledValue{
+					{LabelValues: []string{"blobdescriptor"}, Value: ratio},
+				}
+			}),
+	)
 }
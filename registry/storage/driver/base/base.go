@@ -86,7 +86,9 @@ func (base *Base) GetContent(ctx context.Context, path string) ([]byte, error) {
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, finish := base.instrument(ctx, "GetContent", path)
 	b, e := base.StorageDriver.GetContent(ctx, path)
+	finish(e)
 	return b, base.setDriverName(e)
 }
 
@@ -99,7 +101,10 @@ func (base *Base) PutContent(ctx context.Context, path string, content []byte) e
 		return storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
-	return base.setDriverName(base.StorageDriver.PutContent(ctx, path, content))
+	ctx, finish := base.instrument(ctx, "PutContent", path)
+	err := base.StorageDriver.PutContent(ctx, path, content)
+	finish(err)
+	return base.setDriverName(err)
 }
 
 // Reader wraps Reader of underlying storage driver.
@@ -115,7 +120,9 @@ func (base *Base) Reader(ctx context.Context, path string, offset int64) (io.Rea
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, finish := base.instrument(ctx, "Reader", path)
 	rc, e := base.StorageDriver.Reader(ctx, path, offset)
+	finish(e)
 	return rc, base.setDriverName(e)
 }
 
@@ -128,7 +135,9 @@ func (base *Base) Writer(ctx context.Context, path string, append bool) (storage
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, finish := base.instrument(ctx, "Writer", path)
 	writer, e := base.StorageDriver.Writer(ctx, path, append)
+	finish(e)
 	return writer, base.setDriverName(e)
 }
 
@@ -141,7 +150,9 @@ func (base *Base) Stat(ctx context.Context, path string) (storagedriver.FileInfo
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, finish := base.instrument(ctx, "Stat", path)
 	fi, e := base.StorageDriver.Stat(ctx, path)
+	finish(e)
 	return fi, base.setDriverName(e)
 }
 
@@ -154,7 +165,9 @@ func (base *Base) List(ctx context.Context, path string) ([]string, error) {
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, finish := base.instrument(ctx, "List", path)
 	str, e := base.StorageDriver.List(ctx, path)
+	finish(e)
 	return str, base.setDriverName(e)
 }
 
@@ -169,7 +182,10 @@ func (base *Base) Move(ctx context.Context, sourcePath string, destPath string)
 		return storagedriver.InvalidPathError{Path: destPath, DriverName: base.StorageDriver.Name()}
 	}
 
-	return base.setDriverName(base.StorageDriver.Move(ctx, sourcePath, destPath))
+	ctx, finish := base.instrument(ctx, "Move", sourcePath)
+	err := base.StorageDriver.Move(ctx, sourcePath, destPath)
+	finish(err)
+	return base.setDriverName(err)
 }
 
 // Delete wraps Delete of underlying storage driver.
@@ -181,7 +197,10 @@ func (base *Base) Delete(ctx context.Context, path string) error {
 		return storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
-	return base.setDriverName(base.StorageDriver.Delete(ctx, path))
+	ctx, finish := base.instrument(ctx, "Delete", path)
+	err := base.StorageDriver.Delete(ctx, path)
+	finish(err)
+	return base.setDriverName(err)
 }
 
 // URLFor wraps URLFor of underlying storage driver.
@@ -193,6 +212,8 @@ func (base *Base) URLFor(ctx context.Context, path string, options map[string]in
 		return "", storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, finish := base.instrument(ctx, "URLFor", path)
 	str, e := base.StorageDriver.URLFor(ctx, path, options)
+	finish(e)
 	return str, base.setDriverName(e)
 }
@@ -0,0 +1,55 @@
+package base
+
+import (
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/metrics"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/tracing"
+)
+
+var (
+	// storageActionSeconds tracks the latency of storage driver calls.
+	storageActionSeconds = metrics.NewHistogram("registry_storage_action_seconds",
+		"The latency of storage driver actions.", nil, "driver", "action")
+
+	// storageActionErrors counts storage driver calls which failed. Missing
+	// paths are not counted, since they are part of normal operation.
+	storageActionErrors = metrics.NewCounter("registry_storage_action_errors_total",
+		"The number of failed storage driver actions.", "driver", "action")
+)
+
+func init() {
+	metrics.MustRegister(storageActionSeconds, storageActionErrors)
+}
+
+// instrument starts a span for a call to the underlying driver. The returned
+// function ends the span and records the latency and outcome of the call.
+func (base *Base) instrument(ctx context.Context, action, path string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.StartSpan(ctx, "storage."+action, tracing.WithAttributes(map[string]interface{}{
+		"storage.driver": base.StorageDriver.Name(),
+		"storage.path":   path,
+	}))
+
+	return ctx, func(err error) {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			span.SetError(err)
+		}
+		span.End()
+		base.observe(action, start, err)
+	}
+}
+
+// observe records the latency and outcome of a call to the underlying driver.
+func (base *Base) observe(action string, start time.Time, err error) {
+	name := base.StorageDriver.Name()
+	storageActionSeconds.ObserveSince(start, name, action)
+
+	switch err.(type) {
+	case nil, storagedriver.PathNotFoundError:
+	default:
+		storageActionErrors.Inc(name, action)
+	}
+}
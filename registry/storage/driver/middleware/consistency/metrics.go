@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// Metrics counts how often the consistency middleware had to intervene.
+type Metrics struct {
+	// Retries is the number of times a read was repeated because the
+	// backend had not converged.
+	Retries uint64
+	// Converged is the number of reads which succeeded after retrying.
+	Converged uint64
+	// Timeouts is the number of reads which gave up waiting.
+	Timeouts uint64
+	// ShortCircuits is the number of reads answered from the record of
+	// recent deletes rather than from the backend.
+	ShortCircuits uint64
+}
+
+type consistencyMetricsCollector struct {
+	metrics Metrics
+}
+
+func (cmc *consistencyMetricsCollector) retry() {
+	atomic.AddUint64(&cmc.metrics.Retries, 1)
+}
+
+func (cmc *consistencyMetricsCollector) converge() {
+	atomic.AddUint64(&cmc.metrics.Converged, 1)
+}
+
+func (cmc *consistencyMetricsCollector) timeout() {
+	atomic.AddUint64(&cmc.metrics.Timeouts, 1)
+}
+
+func (cmc *consistencyMetricsCollector) shortCircuit() {
+	atomic.AddUint64(&cmc.metrics.ShortCircuits, 1)
+}
+
+// Metrics returns a snapshot of the counters.
+func (cmc *consistencyMetricsCollector) Metrics() Metrics {
+	return Metrics{
+		Retries:       atomic.LoadUint64(&cmc.metrics.Retries),
+		Converged:     atomic.LoadUint64(&cmc.metrics.Converged),
+		Timeouts:      atomic.LoadUint64(&cmc.metrics.Timeouts),
+		ShortCircuits: atomic.LoadUint64(&cmc.metrics.ShortCircuits),
+	}
+}
+
+// consistencyMetrics is kept globally and made available via expvar.
+var consistencyMetrics = &consistencyMetricsCollector{}
+
+func init() {
+	registry := expvar.Get("registry")
+	if registry == nil {
+		registry = expvar.NewMap("registry")
+	}
+
+	storage := registry.(*expvar.Map).Get("storage")
+	if storage == nil {
+		storage = &expvar.Map{}
+		storage.(*expvar.Map).Init()
+		registry.(*expvar.Map).Set("storage", storage)
+	}
+
+	storage.(*expvar.Map).Set("consistency", expvar.Func(func() interface{} {
+		return consistencyMetrics.Metrics()
+	}))
+}
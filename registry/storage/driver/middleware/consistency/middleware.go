@@ -0,0 +1,366 @@
+// Package middleware - consistency wrapper for eventually consistent
+// storage backends.
+//
+// The middleware remembers which paths were recently written or deleted
+// through it. When the backend has not yet converged, Stat, GetContent and
+// List are retried with a backoff until the backend agrees with what was
+// recorded, or are short-circuited when the recorded state is
+// authoritative (such as a recent delete). The record of recent operations
+// is kept in process memory by default and may be shared between registry
+// instances through redis.
+package middleware
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+const (
+	// defaultWindow is how long an operation is remembered after it has
+	// been performed.
+	defaultWindow = 30 * time.Second
+
+	// defaultMaxWait is the longest a single call will wait for the backend
+	// to converge before giving up.
+	defaultMaxWait = 5 * time.Second
+
+	// defaultRetryInterval is the initial delay between retries. It doubles
+	// after each attempt, up to maxRetryInterval.
+	defaultRetryInterval = 50 * time.Millisecond
+	maxRetryInterval     = time.Second
+)
+
+// consistencyStorageMiddleware tracks paths modified through it and hides
+// the lag of an eventually consistent backend from the registry.
+type consistencyStorageMiddleware struct {
+	storagedriver.StorageDriver
+	tracker       tracker
+	maxWait       time.Duration
+	retryInterval time.Duration
+}
+
+var _ storagedriver.StorageDriver = &consistencyStorageMiddleware{}
+
+// newConsistencyStorageMiddleware constructs a storage middleware which
+// provides read-after-write consistency for paths written through it.
+// Optional options: window, maxwait, retryinterval, redis
+func newConsistencyStorageMiddleware(storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	window, err := durationOption(options, "window", defaultWindow)
+	if err != nil {
+		return nil, err
+	}
+	maxWait, err := durationOption(options, "maxwait", defaultMaxWait)
+	if err != nil {
+		return nil, err
+	}
+	retryInterval, err := durationOption(options, "retryinterval", defaultRetryInterval)
+	if err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
+	}
+	if retryInterval <= 0 {
+		return nil, fmt.Errorf("retryinterval must be positive")
+	}
+
+	var t tracker
+	if r, ok := options["redis"]; ok && r != nil {
+		t, err = newRedisTracker(r, window)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		t = newMemoryTracker(window)
+	}
+
+	return &consistencyStorageMiddleware{
+		StorageDriver: storageDriver,
+		tracker:       t,
+		maxWait:       maxWait,
+		retryInterval: retryInterval,
+	}, nil
+}
+
+// durationOption reads a duration from the options, accepting either a
+// time.Duration or a string parsable by time.ParseDuration. Integers are
+// rejected rather than read as nanoseconds.
+func durationOption(options map[string]interface{}, key string, defaultValue time.Duration) (time.Duration, error) {
+	v, ok := options[key]
+	if !ok {
+		return defaultValue, nil
+	}
+
+	switch v := v.(type) {
+	case time.Duration:
+		return v, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %s", key, err)
+		}
+		return d, nil
+	}
+
+	return 0, fmt.Errorf("%s must be a duration", key)
+}
+
+// GetContent retries reads of recently written paths which the backend does
+// not report yet, and reports recently deleted paths as missing.
+func (cm *consistencyStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := cm.read(ctx, path, func() error {
+		var err error
+		content, err = cm.StorageDriver.GetContent(ctx, path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// PutContent records the write of path once the backend accepted it.
+func (cm *consistencyStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := cm.StorageDriver.PutContent(ctx, path, content); err != nil {
+		return err
+	}
+	cm.record(ctx, path, opWrite)
+	return nil
+}
+
+// Writer returns a FileWriter which records the write of path on Commit.
+func (cm *consistencyStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := cm.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{FileWriter: fw, ctx: ctx, path: path, cm: cm}, nil
+}
+
+// Stat retries stats of recently written paths which the backend does not
+// report yet, and reports recently deleted paths as missing.
+func (cm *consistencyStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	var fi storagedriver.FileInfo
+	err := cm.read(ctx, path, func() error {
+		var err error
+		fi, err = cm.StorageDriver.Stat(ctx, path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+// List retries until recently written children of path are reported by the
+// backend and removes recently deleted children from the result. If the
+// backend does not converge within the maximum wait, the recently written
+// children are added to the result.
+func (cm *consistencyStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	st, err := cm.tracker.state(ctx, path)
+	if err != nil {
+		context.GetLogger(ctx).Warnf("consistency: unable to look up %s: %v", path, err)
+		return cm.StorageDriver.List(ctx, path)
+	}
+	if st.deleted() {
+		consistencyMetrics.shortCircuit()
+		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: cm.Name()}
+	}
+
+	children, err := cm.tracker.children(ctx, path)
+	if err != nil {
+		context.GetLogger(ctx).Warnf("consistency: unable to look up children of %s: %v", path, err)
+		return cm.StorageDriver.List(ctx, path)
+	}
+
+	var (
+		listing  []string
+		missing  []string
+		deadline = time.Now().Add(cm.maxWait)
+		delay    = cm.retryInterval
+		retried  bool
+	)
+
+	for {
+		listing, err = cm.StorageDriver.List(ctx, path)
+		if err != nil && !isPathNotFound(err) {
+			return nil, err
+		}
+
+		listing, missing = reconcileListing(path, listing, children)
+		if len(missing) == 0 && (err == nil || !st.written()) {
+			break
+		}
+
+		if !cm.wait(ctx, deadline, &delay) {
+			consistencyMetrics.timeout()
+			context.GetLogger(ctx).Warnf("consistency: listing of %s did not converge within %s", path, cm.maxWait)
+			listing = append(listing, missing...)
+			sort.Strings(listing)
+			return listing, nil
+		}
+		retried = true
+		consistencyMetrics.retry()
+	}
+
+	if retried {
+		consistencyMetrics.converge()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
+
+// Move records the removal of the source path and the write of the
+// destination path.
+func (cm *consistencyStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := cm.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+	cm.record(ctx, sourcePath, opDelete)
+	cm.record(ctx, destPath, opWrite)
+	return nil
+}
+
+// Delete records the removal of path and all of its descendants.
+func (cm *consistencyStorageMiddleware) Delete(ctx context.Context, path string) error {
+	if err := cm.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	cm.record(ctx, path, opDelete)
+	return nil
+}
+
+// read performs a single-path read operation, reconciling its outcome with
+// the recorded state of the path.
+func (cm *consistencyStorageMiddleware) read(ctx context.Context, path string, op func() error) error {
+	err := op()
+
+	st, terr := cm.tracker.state(ctx, path)
+	if terr != nil {
+		context.GetLogger(ctx).Warnf("consistency: unable to look up %s: %v", path, terr)
+		return err
+	}
+
+	switch {
+	case st.deleted() && err == nil:
+		consistencyMetrics.shortCircuit()
+		return storagedriver.PathNotFoundError{Path: path, DriverName: cm.Name()}
+	case st.written() && isPathNotFound(err):
+		deadline := time.Now().Add(cm.maxWait)
+		delay := cm.retryInterval
+		for isPathNotFound(err) {
+			if !cm.wait(ctx, deadline, &delay) {
+				consistencyMetrics.timeout()
+				context.GetLogger(ctx).Warnf("consistency: %s did not become visible within %s", path, cm.maxWait)
+				return err
+			}
+			consistencyMetrics.retry()
+			err = op()
+		}
+		consistencyMetrics.converge()
+	}
+
+	return err
+}
+
+// wait sleeps for the current delay, doubling it for the next call. It
+// returns false if the deadline would be exceeded or the context is done.
+func (cm *consistencyStorageMiddleware) wait(ctx context.Context, deadline time.Time, delay *time.Duration) bool {
+	d := *delay
+	if remaining := deadline.Sub(time.Now()); remaining <= 0 {
+		return false
+	} else if d > remaining {
+		d = remaining
+	}
+
+	*delay *= 2
+	if *delay > maxRetryInterval {
+		*delay = maxRetryInterval
+	}
+
+	if ctx == nil {
+		time.Sleep(d)
+		return true
+	}
+
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// record stores an operation on path in the tracker. Failures are logged,
+// since the operation itself has already succeeded on the backend.
+func (cm *consistencyStorageMiddleware) record(ctx context.Context, path string, op operation) {
+	if err := cm.tracker.record(ctx, path, op, time.Now()); err != nil {
+		context.GetLogger(ctx).Warnf("consistency: unable to record %s of %s: %v", op, path, err)
+	}
+}
+
+// reconcileListing removes recently deleted children from listing and
+// returns the recently written children that are absent from it.
+func reconcileListing(dir string, listing []string, children map[string]pathState) ([]string, []string) {
+	present := make(map[string]bool, len(listing))
+	filtered := listing[:0:0]
+	for _, p := range listing {
+		if st, ok := children[path.Base(p)]; ok && st.deleted() {
+			continue
+		}
+		present[path.Base(p)] = true
+		filtered = append(filtered, p)
+	}
+
+	var missing []string
+	for name, st := range children {
+		if st.written() && !present[name] {
+			missing = append(missing, joinPath(dir, name))
+		}
+	}
+	sort.Strings(missing)
+
+	return filtered, missing
+}
+
+// fileWriter records the write of its path when committed.
+type fileWriter struct {
+	storagedriver.FileWriter
+	ctx  context.Context
+	path string
+	cm   *consistencyStorageMiddleware
+}
+
+func (fw *fileWriter) Commit() error {
+	if err := fw.FileWriter.Commit(); err != nil {
+		return err
+	}
+	fw.cm.record(fw.ctx, fw.path, opWrite)
+	return nil
+}
+
+func isPathNotFound(err error) bool {
+	_, ok := err.(storagedriver.PathNotFoundError)
+	return ok
+}
+
+// joinPath joins a directory and a child name, taking care of the root.
+func joinPath(dir, name string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+// init registers the consistency middleware backend.
+func init() {
+	storagemiddleware.Register("consistency", storagemiddleware.InitFunc(newConsistencyStorageMiddleware))
+}
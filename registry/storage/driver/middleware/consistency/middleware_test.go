@@ -0,0 +1,326 @@
+package middleware
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type MiddlewareSuite struct {
+	lagging *laggingDriver
+	driver  storagedriver.StorageDriver
+	ctx     context.Context
+}
+
+var _ = check.Suite(&MiddlewareSuite{})
+
+func (s *MiddlewareSuite) SetUpTest(c *check.C) {
+	s.ctx = context.Background()
+	s.lagging = newLaggingDriver()
+
+	options := map[string]interface{}{
+		"retryinterval": "1ms",
+		"maxwait":       "100ms",
+	}
+	d, err := newConsistencyStorageMiddleware(s.lagging, options)
+	c.Assert(err, check.IsNil)
+	s.driver = d
+}
+
+func (s *MiddlewareSuite) TestInvalidOptions(c *check.C) {
+	_, err := newConsistencyStorageMiddleware(nil, map[string]interface{}{"window": "forever"})
+	c.Assert(err, check.ErrorMatches, "invalid window: .*")
+
+	_, err = newConsistencyStorageMiddleware(nil, map[string]interface{}{"maxwait": true})
+	c.Assert(err, check.ErrorMatches, "maxwait must be a duration")
+
+	_, err = newConsistencyStorageMiddleware(nil, map[string]interface{}{"window": 30})
+	c.Assert(err, check.ErrorMatches, "window must be a duration")
+
+	_, err = newConsistencyStorageMiddleware(nil, map[string]interface{}{"redis": map[interface{}]interface{}{}})
+	c.Assert(err, check.ErrorMatches, "no redis addr provided")
+}
+
+func (s *MiddlewareSuite) TestReadAfterWrite(c *check.C) {
+	before := consistencyMetrics.Metrics()
+
+	s.lagging.lagWrites = 3
+	c.Assert(s.driver.PutContent(s.ctx, "/a/b", []byte("content")), check.IsNil)
+
+	content, err := s.driver.GetContent(s.ctx, "/a/b")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "content")
+
+	after := consistencyMetrics.Metrics()
+	c.Assert(after.Retries-before.Retries, check.Equals, uint64(3))
+	c.Assert(after.Converged-before.Converged, check.Equals, uint64(1))
+}
+
+func (s *MiddlewareSuite) TestStatAfterMove(c *check.C) {
+	c.Assert(s.driver.PutContent(s.ctx, "/uploads/data", []byte("content")), check.IsNil)
+
+	s.lagging.lagWrites = 2
+	c.Assert(s.driver.Move(s.ctx, "/uploads/data", "/blobs/data"), check.IsNil)
+
+	fi, err := s.driver.Stat(s.ctx, "/blobs/data")
+	c.Assert(err, check.IsNil)
+	c.Assert(fi.Size(), check.Equals, int64(len("content")))
+
+	_, err = s.driver.Stat(s.ctx, "/uploads/data")
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *MiddlewareSuite) TestWriterCommit(c *check.C) {
+	s.lagging.lagWrites = 2
+	fw, err := s.driver.Writer(s.ctx, "/a/written", false)
+	c.Assert(err, check.IsNil)
+	_, err = fw.Write([]byte("content"))
+	c.Assert(err, check.IsNil)
+	c.Assert(fw.Commit(), check.IsNil)
+	c.Assert(fw.Close(), check.IsNil)
+
+	_, err = s.driver.Stat(s.ctx, "/a/written")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *MiddlewareSuite) TestTimeout(c *check.C) {
+	before := consistencyMetrics.Metrics()
+
+	s.lagging.lagWrites = 1 << 20
+	c.Assert(s.driver.PutContent(s.ctx, "/a/b", []byte("content")), check.IsNil)
+
+	_, err := s.driver.Stat(s.ctx, "/a/b")
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+
+	after := consistencyMetrics.Metrics()
+	c.Assert(after.Timeouts-before.Timeouts, check.Equals, uint64(1))
+}
+
+func (s *MiddlewareSuite) TestDeleteShortCircuit(c *check.C) {
+	c.Assert(s.driver.PutContent(s.ctx, "/a/b/c", []byte("content")), check.IsNil)
+
+	s.lagging.lagDeletes = true
+	c.Assert(s.driver.Delete(s.ctx, "/a/b"), check.IsNil)
+
+	// The backend still reports the content.
+	_, err := s.lagging.GetContent(s.ctx, "/a/b/c")
+	c.Assert(err, check.IsNil)
+
+	_, err = s.driver.GetContent(s.ctx, "/a/b/c")
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+
+	_, err = s.driver.List(s.ctx, "/a/b")
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+
+	// The backend still lists the deleted directory.
+	list, err := s.lagging.List(s.ctx, "/a")
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.DeepEquals, []string{"/a/b"})
+
+	list, err = s.driver.List(s.ctx, "/a")
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 0)
+
+	// Writing again makes the path visible.
+	c.Assert(s.driver.PutContent(s.ctx, "/a/b/c", []byte("again")), check.IsNil)
+	content, err := s.driver.GetContent(s.ctx, "/a/b/c")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "again")
+}
+
+func (s *MiddlewareSuite) TestListRetries(c *check.C) {
+	c.Assert(s.driver.PutContent(s.ctx, "/repo/one", []byte("1")), check.IsNil)
+	s.lagging.lagWrites = 2
+	c.Assert(s.driver.PutContent(s.ctx, "/repo/two/data", []byte("2")), check.IsNil)
+
+	list, err := s.driver.List(s.ctx, "/repo")
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.DeepEquals, []string{"/repo/one", "/repo/two"})
+}
+
+func (s *MiddlewareSuite) TestListTimeoutIncludesWrites(c *check.C) {
+	s.lagging.lagWrites = 1 << 20
+	c.Assert(s.driver.PutContent(s.ctx, "/repo/one", []byte("1")), check.IsNil)
+
+	list, err := s.driver.List(s.ctx, "/repo")
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.DeepEquals, []string{"/repo/one"})
+}
+
+func (s *MiddlewareSuite) TestMemoryTrackerWindow(c *check.C) {
+	mt := newMemoryTracker(time.Minute)
+	now := time.Now()
+
+	c.Assert(mt.record(s.ctx, "/a/b/c", opWrite, now.Add(-2*time.Minute)), check.IsNil)
+	st, err := mt.state(s.ctx, "/a/b/c")
+	c.Assert(err, check.IsNil)
+	c.Assert(st.written(), check.Equals, false)
+
+	c.Assert(mt.record(s.ctx, "/a/b/c", opWrite, now), check.IsNil)
+	st, err = mt.state(s.ctx, "/a/b")
+	c.Assert(err, check.IsNil)
+	c.Assert(st.written(), check.Equals, true)
+
+	children, err := mt.children(s.ctx, "/a")
+	c.Assert(err, check.IsNil)
+	c.Assert(children, check.HasLen, 1)
+	c.Assert(children["b"].written(), check.Equals, true)
+}
+
+// laggingDriver simulates an eventually consistent backend. Paths written
+// while lagWrites is set stay invisible for that many reads. Paths deleted
+// while lagDeletes is set remain visible.
+type laggingDriver struct {
+	storagedriver.StorageDriver
+
+	mu         sync.Mutex
+	lagWrites  int
+	lagDeletes bool
+	hidden     map[string]int
+	ghosts     map[string][]byte
+}
+
+func newLaggingDriver() *laggingDriver {
+	return &laggingDriver{
+		StorageDriver: inmemory.New(),
+		hidden:        make(map[string]int),
+		ghosts:        make(map[string][]byte),
+	}
+}
+
+func (d *laggingDriver) hide(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, a := range ancestors(path) {
+		delete(d.ghosts, a)
+		if d.lagWrites > 0 {
+			d.hidden[a] = d.lagWrites
+		}
+	}
+}
+
+func (d *laggingDriver) isHidden(path string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hidden[path] > 0 {
+		d.hidden[path]--
+		return true
+	}
+	return false
+}
+
+func (d *laggingDriver) ghost(path string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	content, ok := d.ghosts[path]
+	return content, ok
+}
+
+func (d *laggingDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := d.StorageDriver.PutContent(ctx, path, content); err != nil {
+		return err
+	}
+	d.hide(path)
+	return nil
+}
+
+func (d *laggingDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	d.hide(path)
+	return d.StorageDriver.Writer(ctx, path, append)
+}
+
+func (d *laggingDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := d.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+	d.hide(destPath)
+	return nil
+}
+
+func (d *laggingDriver) Delete(ctx context.Context, path string) error {
+	if d.lagDeletes {
+		var ghosts []string
+		storagedriverWalk(ctx, d.StorageDriver, path, &ghosts)
+		d.mu.Lock()
+		d.ghosts[path] = nil
+		for _, p := range ghosts {
+			content, _ := d.StorageDriver.GetContent(ctx, p)
+			d.ghosts[p] = content
+		}
+		d.mu.Unlock()
+	}
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+func (d *laggingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if content, ok := d.ghost(path); ok {
+		return content, nil
+	}
+	if d.isHidden(path) {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *laggingDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if content, ok := d.ghost(path); ok {
+		return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+			Path: path,
+			Size: int64(len(content)),
+		}}, nil
+	}
+	if d.isHidden(path) {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func (d *laggingDriver) List(ctx context.Context, path string) ([]string, error) {
+	list, err := d.StorageDriver.List(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); err != nil && !ok {
+		return nil, err
+	}
+
+	var visible []string
+	for _, p := range list {
+		if !d.isHidden(p) {
+			visible = append(visible, p)
+		}
+	}
+
+	d.mu.Lock()
+	for p := range d.ghosts {
+		if parent(p) == path {
+			visible = append(visible, p)
+		}
+	}
+	d.mu.Unlock()
+
+	if visible == nil && err != nil {
+		return nil, err
+	}
+	return visible, nil
+}
+
+// storagedriverWalk collects the files beneath path.
+func storagedriverWalk(ctx context.Context, d storagedriver.StorageDriver, path string, files *[]string) {
+	fi, err := d.Stat(ctx, path)
+	if err != nil {
+		return
+	}
+	if !fi.IsDir() {
+		*files = append(*files, path)
+		return
+	}
+	children, _ := d.List(ctx, path)
+	for _, child := range children {
+		storagedriverWalk(ctx, d, child, files)
+	}
+}
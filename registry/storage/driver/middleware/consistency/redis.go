@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/docker/distribution/context"
+	"github.com/garyburd/redigo/redis"
+)
+
+const defaultRedisKeyPrefix = "consistency::"
+
+// redisTracker shares recent operations between registry instances through
+// redis. Each path has a hash holding the time of the latest write at or
+// beneath it and of its latest delete. Each directory has a sorted set of the
+// children which saw activity, scored by time, so that listings can be
+// reconciled without scanning the keyspace. All keys expire with the
+// tracking window.
+type redisTracker struct {
+	pool   *redis.Pool
+	prefix string
+	window time.Duration
+}
+
+// newRedisTracker creates a tracker from the redis options of the
+// middleware. Recognized options are addr, password, db and prefix.
+func newRedisTracker(options interface{}, window time.Duration) (*redisTracker, error) {
+	params := make(map[string]interface{})
+	switch options := options.(type) {
+	case map[string]interface{}:
+		params = options
+	case map[interface{}]interface{}:
+		for k, v := range options {
+			if s, ok := k.(string); ok {
+				params[s] = v
+			}
+		}
+	default:
+		return nil, fmt.Errorf("redis must be a map of options")
+	}
+
+	addr, ok := params["addr"].(string)
+	if !ok || addr == "" {
+		return nil, fmt.Errorf("no redis addr provided")
+	}
+
+	password, _ := params["password"].(string)
+
+	var db int
+	if v, ok := params["db"]; ok {
+		if db, ok = v.(int); !ok {
+			return nil, fmt.Errorf("redis db must be an integer")
+		}
+	}
+
+	prefix := defaultRedisKeyPrefix
+	if v, ok := params["prefix"]; ok {
+		if prefix, ok = v.(string); !ok {
+			return nil, fmt.Errorf("redis prefix must be a string")
+		}
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			conn, err := redis.Dial("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+
+			if password != "" {
+				if _, err := conn.Do("AUTH", password); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+
+			if db != 0 {
+				if _, err := conn.Do("SELECT", db); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+
+			return conn, nil
+		},
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+
+	return &redisTracker{
+		pool:   pool,
+		prefix: prefix,
+		window: window,
+	}, nil
+}
+
+func (rt *redisTracker) pathKey(p string) string {
+	return rt.prefix + "path:" + p
+}
+
+func (rt *redisTracker) childrenKey(dir string) string {
+	return rt.prefix + "children:" + dir
+}
+
+func (rt *redisTracker) record(ctx context.Context, p string, op operation, at time.Time) error {
+	conn := rt.pool.Get()
+	defer conn.Close()
+
+	ttl := int64(rt.window / time.Millisecond)
+	ts := at.UnixNano()
+
+	var touched []string
+	switch op {
+	case opWrite:
+		touched = ancestors(p)
+		for _, a := range touched {
+			conn.Send("HSET", rt.pathKey(a), "written", ts)
+		}
+	case opDelete:
+		touched = []string{p}
+		conn.Send("HSET", rt.pathKey(p), "deleted", ts)
+	}
+
+	for _, a := range touched {
+		conn.Send("PEXPIRE", rt.pathKey(a), ttl)
+		conn.Send("ZADD", rt.childrenKey(parent(a)), ts, path.Base(a))
+		conn.Send("ZREMRANGEBYSCORE", rt.childrenKey(parent(a)), "-inf", at.Add(-rt.window).UnixNano())
+		conn.Send("PEXPIRE", rt.childrenKey(parent(a)), ttl)
+	}
+
+	_, err := conn.Do("")
+	return err
+}
+
+func (rt *redisTracker) state(ctx context.Context, p string) (pathState, error) {
+	conn := rt.pool.Get()
+	defer conn.Close()
+
+	return rt.stateConn(conn, p)
+}
+
+func (rt *redisTracker) children(ctx context.Context, dir string) (map[string]pathState, error) {
+	conn := rt.pool.Get()
+	defer conn.Close()
+
+	cutoff := time.Now().Add(-rt.window)
+	names, err := redis.Strings(conn.Do("ZRANGEBYSCORE", rt.childrenKey(dir), cutoff.UnixNano(), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[string]pathState, len(names))
+	if len(names) == 0 {
+		return children, nil
+	}
+
+	// Deletes of dir or its ancestors apply to every child.
+	dirState, err := rt.stateConn(conn, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		conn.Send("HMGET", rt.pathKey(joinPath(dir, name)), "written", "deleted")
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, name := range names {
+		times, err := timestamps(replies[i])
+		if err != nil {
+			return nil, err
+		}
+
+		st := pathState{Deleted: dirState.Deleted}
+		if t := time.Unix(0, times[0]); times[0] != 0 && t.After(cutoff) {
+			st.Written = t
+		}
+		if t := time.Unix(0, times[1]); times[1] != 0 && t.After(cutoff) && t.After(st.Deleted) {
+			st.Deleted = t
+		}
+		children[name] = st
+	}
+
+	return children, nil
+}
+
+// stateConn looks up the state of p over the provided connection.
+func (rt *redisTracker) stateConn(conn redis.Conn, p string) (pathState, error) {
+	var st pathState
+
+	paths := ancestors(p)
+	if len(paths) == 0 {
+		return st, nil
+	}
+
+	conn.Send("HMGET", rt.pathKey(paths[0]), "written", "deleted")
+	for _, a := range paths[1:] {
+		conn.Send("HGET", rt.pathKey(a), "deleted")
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return st, err
+	}
+
+	cutoff := time.Now().Add(-rt.window)
+
+	times, err := timestamps(replies[0])
+	if err != nil {
+		return st, err
+	}
+	if t := time.Unix(0, times[0]); times[0] != 0 && t.After(cutoff) {
+		st.Written = t
+	}
+	deletes := []int64{times[1]}
+
+	for _, reply := range replies[1:] {
+		if reply == nil {
+			continue
+		}
+		ts, err := redis.Int64(reply, nil)
+		if err != nil {
+			return st, err
+		}
+		deletes = append(deletes, ts)
+	}
+
+	for _, ts := range deletes {
+		if t := time.Unix(0, ts); ts != 0 && t.After(cutoff) && t.After(st.Deleted) {
+			st.Deleted = t
+		}
+	}
+
+	return st, nil
+}
+
+// timestamps converts an HMGET reply into nanosecond timestamps, using zero
+// for missing fields.
+func timestamps(reply interface{}) ([]int64, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := make([]int64, len(values))
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		if ts[i], err = redis.Int64(v, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+)
+
+// operation identifies the kind of change made to a path.
+type operation int
+
+const (
+	opWrite operation = iota
+	opDelete
+)
+
+func (op operation) String() string {
+	switch op {
+	case opWrite:
+		return "write"
+	case opDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// pathState is the most recent activity recorded for a path. Written is the
+// time of the latest write at or beneath the path. Deleted is the time of the
+// latest delete of the path or any of its ancestors. Zero times mean no
+// activity within the tracking window.
+type pathState struct {
+	Written time.Time
+	Deleted time.Time
+}
+
+// written returns true if the path was last known to exist.
+func (ps pathState) written() bool {
+	return !ps.Written.IsZero() && ps.Written.After(ps.Deleted)
+}
+
+// deleted returns true if the path was last known to be removed.
+func (ps pathState) deleted() bool {
+	return !ps.Deleted.IsZero() && !ps.Deleted.Before(ps.Written)
+}
+
+// tracker remembers recent operations on storage paths.
+type tracker interface {
+	// record notes that op was performed on p at the given time.
+	record(ctx context.Context, p string, op operation, at time.Time) error
+
+	// state returns the recent activity for p.
+	state(ctx context.Context, p string) (pathState, error)
+
+	// children returns the recent activity for the direct children of dir
+	// that saw any, keyed by child name.
+	children(ctx context.Context, dir string) (map[string]pathState, error)
+}
+
+// ancestors returns p followed by each of its parent directories, excluding
+// the root.
+func ancestors(p string) []string {
+	var paths []string
+	for p != "/" && p != "." && p != "" {
+		paths = append(paths, p)
+		p = path.Dir(p)
+	}
+	return paths
+}
+
+// parent returns the directory containing p.
+func parent(p string) string {
+	return path.Dir(p)
+}
+
+// memoryEntry is the in-memory record of activity at a single path. The
+// write time covers writes at or beneath the path, while the delete time
+// only covers deletes of the path itself.
+type memoryEntry struct {
+	written time.Time
+	deleted time.Time
+}
+
+func (me memoryEntry) latest() time.Time {
+	if me.written.After(me.deleted) {
+		return me.written
+	}
+	return me.deleted
+}
+
+// memoryTracker keeps recent operations in process memory. It is only
+// useful when a single registry instance writes to the storage backend.
+type memoryTracker struct {
+	mu        sync.Mutex
+	window    time.Duration
+	entries   map[string]*memoryEntry
+	lastSweep time.Time
+}
+
+func newMemoryTracker(window time.Duration) *memoryTracker {
+	return &memoryTracker{
+		window:    window,
+		entries:   make(map[string]*memoryEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (mt *memoryTracker) record(ctx context.Context, p string, op operation, at time.Time) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.sweep(at)
+
+	switch op {
+	case opWrite:
+		for _, a := range ancestors(p) {
+			e := mt.entry(a)
+			if at.After(e.written) {
+				e.written = at
+			}
+		}
+	case opDelete:
+		e := mt.entry(p)
+		if at.After(e.deleted) {
+			e.deleted = at
+		}
+	}
+
+	return nil
+}
+
+func (mt *memoryTracker) state(ctx context.Context, p string) (pathState, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	return mt.stateLocked(p, time.Now().Add(-mt.window)), nil
+}
+
+func (mt *memoryTracker) children(ctx context.Context, dir string) (map[string]pathState, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	cutoff := time.Now().Add(-mt.window)
+	children := make(map[string]pathState)
+	for p, e := range mt.entries {
+		if parent(p) != dir || e.latest().Before(cutoff) {
+			continue
+		}
+		children[path.Base(p)] = mt.stateLocked(p, cutoff)
+	}
+
+	return children, nil
+}
+
+// stateLocked computes the state of p, ignoring activity before cutoff. The
+// caller must hold the lock.
+func (mt *memoryTracker) stateLocked(p string, cutoff time.Time) pathState {
+	var st pathState
+	for i, a := range ancestors(p) {
+		e, ok := mt.entries[a]
+		if !ok {
+			continue
+		}
+		if i == 0 && e.written.After(cutoff) {
+			st.Written = e.written
+		}
+		if e.deleted.After(cutoff) && e.deleted.After(st.Deleted) {
+			st.Deleted = e.deleted
+		}
+	}
+	return st
+}
+
+// entry returns the entry for p, allocating it if necessary. The caller must
+// hold the lock.
+func (mt *memoryTracker) entry(p string) *memoryEntry {
+	e, ok := mt.entries[p]
+	if !ok {
+		e = &memoryEntry{}
+		mt.entries[p] = e
+	}
+	return e
+}
+
+// sweep drops entries that fell out of the tracking window. It runs at most
+// once per window. The caller must hold the lock.
+func (mt *memoryTracker) sweep(now time.Time) {
+	if now.Sub(mt.lastSweep) < mt.window {
+		return
+	}
+	mt.lastSweep = now
+
+	cutoff := now.Add(-mt.window)
+	for p, e := range mt.entries {
+		if e.latest().Before(cutoff) {
+			delete(mt.entries, p)
+		}
+	}
+}
@@ -29,6 +29,18 @@ type registry struct {
 type manifestURLs struct {
 	allow *regexp.Regexp
 	deny  *regexp.Regexp
+
+	// fn, if set, provides the regular expressions in place of allow and
+	// deny.
+	fn func() (allow, deny *regexp.Regexp)
+}
+
+// regexps returns the regular expressions currently in effect.
+func (mu manifestURLs) regexps() (allow, deny *regexp.Regexp) {
+	if mu.fn != nil {
+		return mu.fn()
+	}
+	return mu.allow, mu.deny
 }
 
 // RegistryOption is the type used for functional options for NewRegistry.
@@ -71,6 +83,18 @@ func ManifestURLsDenyRegexp(r *regexp.Regexp) RegistryOption {
 	}
 }
 
+// ManifestURLsFunc is a functional option for NewRegistry. The regular
+// expressions controlling manifest URL whitelisting are obtained from fn each
+// time a manifest is validated, so that they can be changed while the
+// registry is running. It takes precedence over ManifestURLsAllowRegexp and
+// ManifestURLsDenyRegexp.
+func ManifestURLsFunc(fn func() (allow, deny *regexp.Regexp)) RegistryOption {
+	return func(registry *registry) error {
+		registry.manifestURLs.fn = fn
+		return nil
+	}
+}
+
 // Schema1SigningKey returns a functional option for NewRegistry. It sets the
 // key for signing  all schema1 manifests.
 func Schema1SigningKey(key libtrust.PrivateKey) RegistryOption {
@@ -97,8 +97,7 @@ func (ms *schema2ManifestHandler) verifyManifest(ctx context.Context, mnfst sche
 				if len(fsLayer.URLs) == 0 {
 					err = errMissingURL
 				}
-				allow := ms.manifestURLs.allow
-				deny := ms.manifestURLs.deny
+				allow, deny := ms.manifestURLs.regexps()
 				for _, u := range fsLayer.URLs {
 					var pu *url.URL
 					pu, err = url.Parse(u)
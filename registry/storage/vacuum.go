@@ -10,7 +10,8 @@ import (
 
 // vacuum contains functions for cleaning up repositories and blobs
 // These functions will only reliably work on strongly consistent
-// storage systems.
+// storage systems. Eventually consistent backends should be wrapped with the
+// "consistency" storage middleware.
 // https://en.wikipedia.org/wiki/Consistency_model
 
 // NewVacuum creates a new Vacuum
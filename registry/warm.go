@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/proxy"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/docker/libtrust"
+	"github.com/spf13/cobra"
+)
+
+var (
+	warmFile        string
+	warmPlatforms   stringList
+	warmConcurrency int
+)
+
+func init() {
+	RootCmd.AddCommand(WarmCmd)
+	WarmCmd.Flags().StringVarP(&warmFile, "file", "f", "", "read the images from this file, one per line, or from stdin if -")
+	WarmCmd.Flags().Var(&warmPlatforms, "platform", "only pull the manifests of lists for this os/architecture[/variant], may be repeated")
+	WarmCmd.Flags().IntVarP(&warmConcurrency, "concurrency", "c", 4, "number of blobs pulled concurrently")
+}
+
+// WarmCmd is the cobra command that corresponds to the warm subcommand
+var WarmCmd = &cobra.Command{
+	Use:   "warm <config> [image...]",
+	Short: "`warm` pulls images into the pull through cache",
+	Long:  "`warm` pulls the manifests and blobs of images into the storage of the pull through cache and prints the result of each image as JSON lines. The registry should not be serving the same storage; use the admin endpoint instead.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if !config.Proxy.Enabled() {
+			fmt.Fprintln(os.Stderr, "the registry is not configured as a pull through cache")
+			os.Exit(1)
+		}
+
+		var images []string
+		if len(args) > 1 {
+			images = append(images, args[1:]...)
+		}
+		if warmFile != "" {
+			list, err := readWarmFile(warmFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", warmFile, err)
+				os.Exit(1)
+			}
+			images = append(images, list...)
+		}
+		if len(images) == 0 {
+			fmt.Fprintln(os.Stderr, "no images to warm")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := context.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		k, err := libtrust.GenerateECP256PrivateKey()
+		if err != nil {
+			fmt.Fprint(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver, storage.Schema1SigningKey(k))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+		cache, err := proxy.NewRegistryPullThroughCache(ctx, registry, driver, config.Proxy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct pull through cache: %v", err)
+			os.Exit(1)
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		results, err := proxy.Warm(ctx, cache, images, proxy.WarmOptions{
+			Platforms:   warmPlatforms,
+			Concurrency: warmConcurrency,
+			Progress: func(result proxy.WarmResult) {
+				encoder.Encode(result)
+			},
+		})
+		// Persist the expiry of the content pulled.
+		if closer, ok := cache.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to save the cache state: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to warm the cache: %v\n", err)
+			os.Exit(1)
+		}
+		failed := 0
+		for _, result := range results {
+			if result.Error != "" {
+				failed++
+			}
+		}
+		if failed > 0 {
+			fmt.Fprintf(os.Stderr, "failed to warm %d of %d images\n", failed, len(images))
+			os.Exit(1)
+		}
+	},
+}
+
+// readWarmFile reads the images listed in path, or in stdin if path is "-".
+func readWarmFile(path string) ([]string, error) {
+	if path == "-" {
+		return proxy.ReadImageList(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return proxy.ReadImageList(f)
+}
+
+// stringList is a flag which may be repeated.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+func (l *stringList) Type() string   { return "string" }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
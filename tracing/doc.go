@@ -0,0 +1,16 @@
+// Package tracing records spans which follow a request through the registry
+// and exports them to a collector.
+//
+// A span is started from a context and ended when the traced operation
+// completes:
+//
+//	ctx, span := tracing.StartSpan(ctx, "storage.GetContent")
+//	defer span.End()
+//
+// Spans started from a context which already carries a span become its
+// children. Trace context is carried across processes using the W3C
+// traceparent header; see Extract, Inject and NewTransport.
+//
+// Spans are only recorded once a Tracer has been installed with SetTracer.
+// Until then, StartSpan returns a nil span, on which all methods are no-ops.
+package tracing
@@ -0,0 +1,334 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fileSpan is the JSON representation of a span written by the file
+// exporter.
+type fileSpan struct {
+	Service    string                 `json:"service,omitempty"`
+	TraceID    string                 `json:"traceId"`
+	SpanID     string                 `json:"spanId"`
+	ParentID   string                 `json:"parentSpanId,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Duration   time.Duration          `json:"durationNanos"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// fileExporter writes spans to a file as JSON, one span per line.
+type fileExporter struct {
+	service string
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewFileExporter returns an exporter appending spans to the file at path as
+// JSON lines. The file is created if it does not exist.
+func NewFileExporter(path, service string) (Exporter, error) {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileExporter{service: service, w: fp}, nil
+}
+
+func (fe *fileExporter) ExportSpans(spans []SpanData) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, span := range spans {
+		fs := fileSpan{
+			Service:    fe.service,
+			TraceID:    span.TraceID.String(),
+			SpanID:     span.SpanID.String(),
+			Name:       span.Name,
+			Kind:       span.Kind.String(),
+			Start:      span.Start,
+			End:        span.End,
+			Duration:   span.End.Sub(span.Start),
+			Attributes: span.Attributes,
+			Error:      span.Error,
+		}
+		if span.Parent.IsValid() {
+			fs.ParentID = span.Parent.String()
+		}
+		if err := enc.Encode(fs); err != nil {
+			return err
+		}
+	}
+
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	_, err := fe.w.Write(buf.Bytes())
+	return err
+}
+
+func (fe *fileExporter) Close() error {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	return fe.w.Close()
+}
+
+// OTLPOptions configures the OTLP exporter.
+type OTLPOptions struct {
+	// Endpoint is the url spans are posted to, typically ending in
+	// /v1/traces.
+	Endpoint string
+
+	// Headers are added to each export request, for example to
+	// authenticate with the collector.
+	Headers http.Header
+
+	// Timeout bounds each export request. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+
+	// Transport is used to send requests. Defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+// otlpExporter posts spans to a collector using the JSON encoding of the
+// OTLP/HTTP protocol.
+type otlpExporter struct {
+	options OTLPOptions
+	client  *http.Client
+}
+
+// NewOTLPExporter returns an exporter sending spans to an OTLP/HTTP
+// collector.
+func NewOTLPExporter(options OTLPOptions) (Exporter, error) {
+	if options.Endpoint == "" {
+		return nil, fmt.Errorf("no otlp endpoint provided")
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 10 * time.Second
+	}
+	if options.Transport == nil {
+		options.Transport = http.DefaultTransport
+	}
+
+	return &otlpExporter{
+		options: options,
+		client: &http.Client{
+			Transport: options.Transport,
+			Timeout:   options.Timeout,
+		},
+	}, nil
+}
+
+func (oe *otlpExporter) ExportSpans(spans []SpanData) error {
+	p, err := json.Marshal(oe.request(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", oe.options.Endpoint, bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	for k, s := range oe.options.Headers {
+		req.Header[k] = append(req.Header[k], s...)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := oe.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("otlp collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (oe *otlpExporter) Close() error {
+	return nil
+}
+
+// The following types mirror the JSON mapping of the OTLP trace protobuf
+// messages, limited to the fields set by the exporter.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const otlpStatusError = 2
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func (oe *otlpExporter) request(spans []SpanData) otlpRequest {
+	scope := otlpScopeSpans{
+		Scope: otlpScope{Name: "github.com/docker/distribution"},
+		Spans: make([]otlpSpan, 0, len(spans)),
+	}
+
+	for _, span := range spans {
+		out := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.Parent.IsValid() {
+			out.ParentSpanID = span.Parent.String()
+		}
+		if span.Error != "" {
+			out.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		scope.Spans = append(scope.Spans, out)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: otlpAttributes(map[string]interface{}{
+						"service.name": oe.options.ServiceName,
+					}),
+				},
+				ScopeSpans: []otlpScopeSpans{scope},
+			},
+		},
+	}
+}
+
+// otlpAttributes converts attributes to OTLP key values, sorted by key.
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		var value otlpAnyValue
+		switch v := attributes[k].(type) {
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := strconv.FormatInt(int64(v), 10)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case string:
+			value.StringValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: value})
+	}
+	return kvs
+}
+
+// multiExporter sends spans to several exporters.
+type multiExporter []Exporter
+
+// NewMultiExporter returns an exporter sending spans to each of exporters.
+func NewMultiExporter(exporters ...Exporter) Exporter {
+	return multiExporter(exporters)
+}
+
+func (me multiExporter) ExportSpans(spans []SpanData) error {
+	var errs []error
+	for _, e := range me {
+		if err := e.ExportSpans(spans); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+func (me multiExporter) Close() error {
+	var errs []error
+	for _, e := range me {
+		if err := e.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+func combineErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("%d errors: %v", len(errs), errs)
+	}
+}
@@ -0,0 +1,187 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/context"
+)
+
+// TraceparentHeader is the W3C trace context header.
+const TraceparentHeader = "Traceparent"
+
+const (
+	traceparentVersion = "00"
+	flagSampled        = 0x01
+)
+
+// ParseTraceparent parses the value of a traceparent header.
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, fmt.Errorf("invalid traceparent: %q", value)
+	}
+
+	version := parts[0]
+	if len(version) != 2 || version == "ff" {
+		return sc, fmt.Errorf("invalid traceparent version: %q", version)
+	}
+	if version == traceparentVersion && len(parts) != 4 {
+		return sc, fmt.Errorf("invalid traceparent: %q", value)
+	}
+
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return sc, fmt.Errorf("invalid traceparent trace id: %v", err)
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return sc, fmt.Errorf("invalid traceparent parent id: %v", err)
+	}
+
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return sc, fmt.Errorf("invalid traceparent flags: %v", err)
+	}
+	sc.Sampled = flags[0]&flagSampled != 0
+
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent: zero id in %q", value)
+	}
+
+	return sc, nil
+}
+
+// FormatTraceparent returns the traceparent header value for sc.
+func FormatTraceparent(sc SpanContext) string {
+	var flags byte
+	if sc.Sampled {
+		flags |= flagSampled
+	}
+	return fmt.Sprintf("%s-%s-%s-%02x", traceparentVersion, sc.TraceID, sc.SpanID, flags)
+}
+
+// Extract returns the span context carried by the traceparent header, if
+// present and valid.
+func Extract(header http.Header) (SpanContext, bool) {
+	value := header.Get(TraceparentHeader)
+	if value == "" {
+		return SpanContext{}, false
+	}
+
+	sc, err := ParseTraceparent(value)
+	if err != nil {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+// Inject sets the traceparent header from the span in ctx. The header is
+// left untouched if ctx carries no span.
+func Inject(ctx context.Context, header http.Header) {
+	sc, ok := parentSpanContext(ctx)
+	if !ok {
+		return
+	}
+	header.Set(TraceparentHeader, FormatTraceparent(sc))
+}
+
+// NewTransport returns a transport which records a client span, as a child
+// of the span in ctx, around each request sent through base and propagates
+// it with the traceparent header. If tracing is disabled, base is returned
+// unchanged.
+func NewTransport(ctx context.Context, base http.RoundTripper) http.RoundTripper {
+	if !Enabled() {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tracingTransport{
+		ctx:    ctx,
+		base:   base,
+		modReq: make(map[*http.Request]*http.Request),
+	}
+}
+
+type tracingTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+
+	mu     sync.Mutex                      // guards modReq
+	modReq map[*http.Request]*http.Request // original -> modified
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := StartSpan(t.ctx, "HTTP "+req.Method, WithKind(SpanKindClient), WithAttributes(map[string]interface{}{
+		"http.method": req.Method,
+		"http.url":    redactURL(req),
+	}))
+	defer span.End()
+
+	// The request must not be modified, so headers are set on a copy.
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.Header = make(http.Header, len(req.Header)+1)
+	for k, s := range req.Header {
+		req2.Header[k] = s
+	}
+	Inject(ctx, req2.Header)
+
+	t.mu.Lock()
+	t.modReq[req] = req2
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.modReq, req)
+		t.mu.Unlock()
+	}()
+
+	resp, err := t.base.RoundTrip(req2)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetError(fmt.Errorf("%s", resp.Status))
+	}
+	return resp, nil
+}
+
+// CancelRequest cancels an in-flight request on the base transport, if
+// supported.
+func (t *tracingTransport) CancelRequest(req *http.Request) {
+	type canceler interface {
+		CancelRequest(*http.Request)
+	}
+	if cr, ok := t.base.(canceler); ok {
+		t.mu.Lock()
+		modReq := t.modReq[req]
+		t.mu.Unlock()
+		if modReq != nil {
+			cr.CancelRequest(modReq)
+		}
+	}
+}
+
+// redactURL returns the request url without credentials or query string,
+// which may carry signed tokens.
+func redactURL(req *http.Request) string {
+	u := *req.URL
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return fmt.Errorf("expected %d lowercase hex digits: %q", hex.EncodedLen(len(dst)), s)
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
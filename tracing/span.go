@@ -0,0 +1,261 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/context"
+)
+
+// TraceID identifies a trace, shared by all of its spans.
+type TraceID [16]byte
+
+// String returns the lowercase hex encoding of the id.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid returns true if the id is not all zeros.
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the lowercase hex encoding of the id.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid returns true if the id is not all zeros.
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext is the part of a span which is propagated to children and
+// across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true if both the trace and span ids are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanKind describes the relationship of a span to its remote peers.
+type SpanKind int
+
+// The kinds of spans, matching their OTLP values.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// String returns a readable name for the kind.
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	default:
+		return "internal"
+	}
+}
+
+// SpanData is a snapshot of an ended span, as handed to exporters.
+type SpanData struct {
+	SpanContext
+	Parent     SpanID
+	Name       string
+	Kind       SpanKind
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+}
+
+// Span is a timed operation within a trace. All methods may be called on a
+// nil span, in which case they do nothing.
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SpanContext returns the context to propagate to children of the span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetAttribute records a key value pair on the span. Values should be
+// strings, integers or booleans.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetError marks the span as failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Error = err.Error()
+}
+
+// End completes the span and queues it for export, if sampled. Calls after
+// the first have no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+// SpanOption configures a span when it is started.
+type SpanOption func(*SpanData)
+
+// WithKind sets the kind of the span. Spans are internal by default.
+func WithKind(kind SpanKind) SpanOption {
+	return func(d *SpanData) {
+		d.Kind = kind
+	}
+}
+
+// WithAttributes sets initial attributes on the span.
+func WithAttributes(attributes map[string]interface{}) SpanOption {
+	return func(d *SpanData) {
+		if d.Attributes == nil {
+			d.Attributes = make(map[string]interface{}, len(attributes))
+		}
+		for k, v := range attributes {
+			d.Attributes[k] = v
+		}
+	}
+}
+
+type spanKey struct{}
+type remoteParentKey struct{}
+
+// StartSpan starts a span named name, as a child of the span in ctx or the
+// remote parent set with WithRemoteParent. The returned context carries the
+// new span. If no tracer is installed, ctx is returned with a nil span.
+func StartSpan(ctx context.Context, name string, options ...SpanOption) (context.Context, *Span) {
+	t := getTracer()
+	if t == nil {
+		return ctx, nil
+	}
+
+	data := SpanData{
+		Name:  name,
+		Kind:  SpanKindInternal,
+		Start: time.Now(),
+	}
+
+	if parent, ok := parentSpanContext(ctx); ok {
+		data.TraceID = parent.TraceID
+		data.Parent = parent.SpanID
+		data.Sampled = parent.Sampled
+	} else {
+		data.TraceID = newTraceID()
+		data.Sampled = true
+	}
+	data.SpanID = newSpanID()
+
+	for _, option := range options {
+		option(&data)
+	}
+
+	span := &Span{tracer: t, data: data}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// WithRemoteParent returns a context in which spans started without a local
+// parent become children of sc. This is used to continue traces started by
+// clients.
+func WithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteParentKey{}, sc)
+}
+
+func parentSpanContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	if span := FromContext(ctx); span != nil {
+		return span.SpanContext(), true
+	}
+	if sc, ok := ctx.Value(remoteParentKey{}).(SpanContext); ok {
+		return sc, true
+	}
+	return SpanContext{}, false
+}
+
+func newTraceID() (id TraceID) {
+	randomID(id[:])
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	randomID(id[:])
+	return id
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("tracing: error reading random id: %v", err))
+	}
+}
@@ -0,0 +1,155 @@
+package tracing
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultQueueSize     = 2048
+	defaultBatchSize     = 512
+	defaultFlushInterval = 5 * time.Second
+)
+
+// Exporter sends ended spans to a collector.
+type Exporter interface {
+	// ExportSpans exports a batch of spans. It is never called concurrently.
+	ExportSpans(spans []SpanData) error
+
+	// Close releases any resources held by the exporter.
+	Close() error
+}
+
+// Tracer queues ended spans and exports them in batches from a background
+// goroutine. Spans ended while the queue is full are dropped.
+type Tracer struct {
+	exporter      Exporter
+	queue         chan SpanData
+	flush         chan chan struct{}
+	batchSize     int
+	flushInterval time.Duration
+	dropped       uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewTracer returns a tracer exporting to exporter and starts its export
+// loop.
+func NewTracer(exporter Exporter) *Tracer {
+	t := &Tracer{
+		exporter:      exporter,
+		queue:         make(chan SpanData, defaultQueueSize),
+		flush:         make(chan chan struct{}),
+		batchSize:     defaultBatchSize,
+		flushInterval: defaultFlushInterval,
+		done:          make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Dropped returns the number of spans dropped because the queue was full.
+func (t *Tracer) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Flush exports all queued spans before returning.
+func (t *Tracer) Flush() {
+	ch := make(chan struct{})
+	select {
+	case t.flush <- ch:
+		<-ch
+	case <-t.done:
+	}
+}
+
+// Close exports the queued spans, stops the export loop and closes the
+// exporter.
+func (t *Tracer) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.Flush()
+		close(t.done)
+		err = t.exporter.Close()
+	})
+	return err
+}
+
+func (t *Tracer) enqueue(data SpanData) {
+	select {
+	case t.queue <- data:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, t.batchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.ExportSpans(batch); err != nil {
+			logrus.Errorf("tracing: error exporting %d spans: %v", len(batch), err)
+		}
+		batch = make([]SpanData, 0, t.batchSize)
+	}
+
+	for {
+		select {
+		case data := <-t.queue:
+			batch = append(batch, data)
+			if len(batch) >= t.batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case ch := <-t.flush:
+			// Drain whatever was queued before the flush request.
+			for n := len(t.queue); n > 0; n-- {
+				batch = append(batch, <-t.queue)
+				if len(batch) >= t.batchSize {
+					export()
+				}
+			}
+			export()
+			close(ch)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+var (
+	globalMu     sync.RWMutex
+	globalTracer *Tracer
+)
+
+// SetTracer installs t as the tracer used by StartSpan. Passing nil disables
+// tracing. The previously installed tracer is returned so it can be closed.
+func SetTracer(t *Tracer) *Tracer {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	previous := globalTracer
+	globalTracer = t
+	return previous
+}
+
+// Enabled returns true if a tracer is installed.
+func Enabled() bool {
+	return getTracer() != nil
+}
+
+func getTracer() *Tracer {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return globalTracer
+}
@@ -0,0 +1,304 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/context"
+)
+
+// recordingExporter keeps exported spans in memory.
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (re *recordingExporter) ExportSpans(spans []SpanData) error {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	re.spans = append(re.spans, spans...)
+	return nil
+}
+
+func (re *recordingExporter) Close() error {
+	return nil
+}
+
+func (re *recordingExporter) byName(t *testing.T, name string) SpanData {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	for _, span := range re.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("span %q not exported", name)
+	return SpanData{}
+}
+
+func withTracer(exporter Exporter) *Tracer {
+	tracer := NewTracer(exporter)
+	SetTracer(tracer)
+	return tracer
+}
+
+func TestDisabled(t *testing.T) {
+	SetTracer(nil)
+
+	ctx, span := StartSpan(context.Background(), "noop")
+	if span != nil {
+		t.Fatalf("expected nil span without a tracer")
+	}
+	// Methods on the nil span must not panic.
+	span.SetAttribute("key", "value")
+	span.SetError(os.ErrNotExist)
+	span.End()
+
+	if FromContext(ctx) != nil {
+		t.Fatalf("unexpected span in context")
+	}
+}
+
+func TestParentChild(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := withTracer(exporter)
+	defer SetTracer(nil)
+
+	ctx, parent := StartSpan(context.Background(), "parent", WithKind(SpanKindServer))
+	_, child := StartSpan(ctx, "child")
+	child.SetAttribute("path", "/a")
+	child.SetError(os.ErrNotExist)
+	child.End()
+	parent.End()
+	tracer.Flush()
+
+	p := exporter.byName(t, "parent")
+	c := exporter.byName(t, "child")
+
+	if c.TraceID != p.TraceID {
+		t.Fatalf("child trace id %s does not match parent %s", c.TraceID, p.TraceID)
+	}
+	if c.Parent != p.SpanID {
+		t.Fatalf("child parent id %s does not match parent span id %s", c.Parent, p.SpanID)
+	}
+	if p.Parent.IsValid() {
+		t.Fatalf("root span should not have a parent")
+	}
+	if p.Kind != SpanKindServer || c.Kind != SpanKindInternal {
+		t.Fatalf("unexpected kinds: %v, %v", p.Kind, c.Kind)
+	}
+	if c.Attributes["path"] != "/a" || c.Error == "" {
+		t.Fatalf("unexpected child span: %#v", c)
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	const value = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, err := ParseTraceparent(value)
+	if err != nil {
+		t.Fatalf("unexpected error parsing traceparent: %v", err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Fatalf("unexpected span context: %#v", sc)
+	}
+	if FormatTraceparent(sc) != value {
+		t.Fatalf("unexpected formatted traceparent: %s", FormatTraceparent(sc))
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, err := ParseTraceparent(invalid); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestRemoteParentAndTransport(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := withTracer(exporter)
+	defer SetTracer(nil)
+
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(TraceparentHeader)
+	}))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	remote, ok := Extract(header)
+	if !ok {
+		t.Fatalf("expected traceparent to be extracted")
+	}
+
+	ctx := WithRemoteParent(context.Background(), remote)
+	ctx, span := StartSpan(ctx, "server")
+
+	client := &http.Client{Transport: NewTransport(ctx, nil)}
+	resp, err := client.Get(server.URL + "/v2/?token=secret")
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+	span.End()
+	tracer.Flush()
+
+	server1 := exporter.byName(t, "server")
+	outbound := exporter.byName(t, "HTTP GET")
+
+	if server1.TraceID != remote.TraceID || server1.Parent != remote.SpanID {
+		t.Fatalf("server span does not continue the remote trace: %#v", server1)
+	}
+	if outbound.Parent != server1.SpanID || outbound.Kind != SpanKindClient {
+		t.Fatalf("unexpected outbound span: %#v", outbound)
+	}
+	if outbound.Attributes["http.status_code"] != http.StatusOK {
+		t.Fatalf("unexpected status attribute: %v", outbound.Attributes["http.status_code"])
+	}
+	if strings.Contains(outbound.Attributes["http.url"].(string), "secret") {
+		t.Fatalf("query string should not be recorded: %v", outbound.Attributes["http.url"])
+	}
+
+	sc, err := ParseTraceparent(received)
+	if err != nil {
+		t.Fatalf("invalid traceparent sent upstream %q: %v", received, err)
+	}
+	if sc.TraceID != remote.TraceID || sc.SpanID != outbound.SpanID {
+		t.Fatalf("traceparent sent upstream does not identify the outbound span: %s", received)
+	}
+}
+
+func TestUnsampledParent(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := withTracer(exporter)
+	defer SetTracer(nil)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx, span := StartSpan(WithRemoteParent(context.Background(), remote), "unsampled")
+	if span.SpanContext().Sampled {
+		t.Fatalf("span should inherit the sampling decision of its parent")
+	}
+
+	header := http.Header{}
+	Inject(ctx, header)
+	if !strings.HasSuffix(header.Get(TraceparentHeader), "-00") {
+		t.Fatalf("unexpected propagated traceparent: %s", header.Get(TraceparentHeader))
+	}
+
+	span.End()
+	tracer.Flush()
+	if len(exporter.spans) != 0 {
+		t.Fatalf("unsampled spans should not be exported: %v", exporter.spans)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var (
+		body   otlpRequest
+		header http.Header
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding export request: %v", err)
+		}
+	}))
+	defer collector.Close()
+
+	exporter, err := NewOTLPExporter(OTLPOptions{
+		Endpoint:    collector.URL + "/v1/traces",
+		Headers:     http.Header{"Authorization": []string{"Bearer collector"}},
+		ServiceName: "registry",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating exporter: %v", err)
+	}
+	tracer := withTracer(exporter)
+	defer SetTracer(nil)
+
+	_, span := StartSpan(context.Background(), "registry.manifest", WithKind(SpanKindServer))
+	span.SetAttribute("http.status_code", 404)
+	span.SetError(os.ErrNotExist)
+	span.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("unexpected error closing tracer: %v", err)
+	}
+
+	if header.Get("Authorization") != "Bearer collector" || header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected export headers: %v", header)
+	}
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected export request: %#v", body)
+	}
+	if v := body.ResourceSpans[0].Resource.Attributes[0]; v.Key != "service.name" || *v.Value.StringValue != "registry" {
+		t.Fatalf("unexpected resource attributes: %#v", body.ResourceSpans[0].Resource)
+	}
+
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	s := spans[0]
+	if s.Name != "registry.manifest" || s.Kind != SpanKindServer || s.TraceID != span.SpanContext().TraceID.String() {
+		t.Fatalf("unexpected span: %#v", s)
+	}
+	if s.Status.Code != otlpStatusError || *s.Attributes[0].Value.IntValue != "404" {
+		t.Fatalf("unexpected span status or attributes: %#v", s)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "spans.json")
+	exporter, err := NewFileExporter(path, "registry")
+	if err != nil {
+		t.Fatalf("unexpected error creating exporter: %v", err)
+	}
+	tracer := withTracer(exporter)
+	defer SetTracer(nil)
+
+	ctx, parent := StartSpan(context.Background(), "parent")
+	_, child := StartSpan(ctx, "child")
+	child.End()
+	parent.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("unexpected error closing tracer: %v", err)
+	}
+
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading spans: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(p)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 spans, got %d: %s", len(lines), p)
+	}
+
+	var fs fileSpan
+	if err := json.Unmarshal([]byte(lines[0]), &fs); err != nil {
+		t.Fatalf("unexpected error decoding span: %v", err)
+	}
+	if fs.Name != "child" || fs.ParentID != parent.SpanContext().SpanID.String() || fs.Service != "registry" {
+		t.Fatalf("unexpected span: %#v", fs)
+	}
+}